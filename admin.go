@@ -0,0 +1,29 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// adminToken guards the site-wide admin API, such as publishing waiver templates. It is set
+// from the ADMIN_TOKEN environment variable; while it is empty the admin API is disabled.
+var adminToken string
+
+// requireAdmin checks the request's adminToken query parameter and writes an error response
+// if it doesn't match. Returns false if the handler should stop.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if adminToken == "" {
+		http.Error(w, "The admin API is not enabled", http.StatusForbidden)
+		return false
+	}
+	token := r.URL.Query().Get("adminToken")
+	if token == "" {
+		http.Error(w, "adminToken is required", http.StatusUnauthorized)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Trails close often, after landslides or when permits change. An admin posts an advisory on
+// a trailhead with a status, a message, where the news came from and when it expires. The
+// advisories in effect are shown when leaders pick a trailhead and on the hike, and a hike
+// can't be created at a closed trailhead if CLOSED_TRAILHEAD_POLICY is block.
+
+const (
+	advisoryOpen    = "open" // e.g. reopened after repairs
+	advisoryCaution = "caution"
+	advisoryClosed  = "closed"
+)
+
+// Most severe first
+var advisoryStatuses = []string{advisoryClosed, advisoryCaution, advisoryOpen}
+
+// blockClosedTrailheads refuses new hikes at closed trailheads instead of only warning. It is
+// set from the CLOSED_TRAILHEAD_POLICY environment variable.
+var blockClosedTrailheads bool
+
+type TrailheadAdvisory struct {
+	Id            int64      `json:"id"`
+	TrailheadName string     `json:"trailheadName"`
+	Status        string     `json:"status"` // open, caution or closed
+	Message       string     `json:"message"`
+	Source        string     `json:"source,omitempty"`    // Who reported it, e.g. DLNR Na Ala Hele
+	ExpiresAt     *time.Time `json:"expiresAt,omitempty"` // nil if it lasts until it's removed
+	CreatedAt     time.Time  `json:"createdAt"`
+}
+
+func advisorySeverity(status string) int {
+	for i, s := range advisoryStatuses {
+		if s == status {
+			return len(advisoryStatuses) - i
+		}
+	}
+	return 0
+}
+
+// trailheadAdvisories returns the advisories on a trailhead, given its name or an alias, that
+// are still in effect at a time, newest first. The newest is the trailhead's current status,
+// so posting an open advisory reopens a closed trailhead.
+func trailheadAdvisories(q sqlQueryer, trailheadName string, at time.Time) ([]TrailheadAdvisory, error) {
+	rows, err := q.Query(`
+		SELECT id, trailhead_name, status, message, source, expires_at, created_at
+		FROM trailhead_advisories
+		WHERE trailhead_name = ? OR trailhead_name = (SELECT trailhead_name FROM trailhead_aliases WHERE alias = ?)
+	`, trailheadName, trailheadName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var advisories []TrailheadAdvisory
+	for rows.Next() {
+		var a TrailheadAdvisory
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&a.Id, &a.TrailheadName, &a.Status, &a.Message, &a.Source, &expiresAt, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			if !expiresAt.Time.After(at) {
+				continue
+			}
+			a.ExpiresAt = &expiresAt.Time
+		}
+		advisories = append(advisories, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(advisories, func(i, j int) bool {
+		if !advisories[i].CreatedAt.Equal(advisories[j].CreatedAt) {
+			return advisories[i].CreatedAt.After(advisories[j].CreatedAt)
+		}
+		return advisories[i].Id > advisories[j].Id
+	})
+	return advisories, nil
+}
+
+// closingAdvisory returns the advisory closing the trailhead if the newest of its advisories,
+// as returned by trailheadAdvisories, closes it
+func closingAdvisory(advisories []TrailheadAdvisory) *TrailheadAdvisory {
+	if len(advisories) > 0 && advisories[0].Status == advisoryClosed {
+		return &advisories[0]
+	}
+	return nil
+}
+
+// trailheadClosedError is returned for a hike at a closed trailhead when closed trailheads
+// are blocked
+type trailheadClosedError struct {
+	advisory TrailheadAdvisory
+}
+
+func (e *trailheadClosedError) Error() string {
+	return fmt.Sprintf("%s is closed: %s", e.advisory.TrailheadName, e.advisory.Message)
+}
+
+// checkTrailheadOpen returns the advisories that will still be in effect at a trailhead when a
+// hike there starts, to warn the leader with. If one closes the trailhead and closed trailheads
+// are blocked, it returns a *trailheadClosedError instead.
+func checkTrailheadOpen(q sqlQueryer, trailheadName string, startTime time.Time) ([]TrailheadAdvisory, error) {
+	at := startTime
+	if now := time.Now(); at.Before(now) {
+		at = now
+	}
+	advisories, err := trailheadAdvisories(q, trailheadName, at)
+	if err != nil {
+		return nil, err
+	}
+	if closed := closingAdvisory(advisories); closed != nil && blockClosedTrailheads {
+		return advisories, &trailheadClosedError{*closed}
+	}
+	return advisories, nil
+}
+
+// attachTrailheadAdvisories sets the advisories in effect now on each trailhead
+func attachTrailheadAdvisories(trailheads []Trailhead) error {
+	now := time.Now()
+	for i := range trailheads {
+		advisories, err := trailheadAdvisories(db, trailheads[i].Name, now)
+		if err != nil {
+			return err
+		}
+		trailheads[i].Advisories = advisories
+	}
+	return nil
+}
+
+func validateAdvisory(a TrailheadAdvisory) error {
+	if advisorySeverity(a.Status) == 0 {
+		return fmt.Errorf("status must be one of %s", strings.Join(advisoryStatuses, ", "))
+	}
+	if strings.TrimSpace(a.Message) == "" {
+		return fmt.Errorf("message is required")
+	}
+	if a.ExpiresAt != nil && !a.ExpiresAt.After(time.Now()) {
+		return fmt.Errorf("expiresAt must be in the future")
+	}
+	return nil
+}
+
+// Post an advisory on a trailhead. Requires the adminToken.
+func createTrailheadAdvisoryHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var advisory TrailheadAdvisory
+	if err := json.NewDecoder(r.Body).Decode(&advisory); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateAdvisory(advisory); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	trailheadName, err := resolveTrailheadName(db, r.PathValue("name"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Trailhead not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	advisory.TrailheadName = trailheadName
+	advisory.Message = strings.TrimSpace(advisory.Message)
+	advisory.CreatedAt = time.Now()
+	var expiresAt interface{}
+	if advisory.ExpiresAt != nil {
+		expiresAt = advisory.ExpiresAt.Format("2006-01-02T15:04:05-07:00")
+	}
+	result, err := db.Exec(`
+		INSERT INTO trailhead_advisories (trailhead_name, status, message, source, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, advisory.TrailheadName, advisory.Status, advisory.Message, advisory.Source, expiresAt, advisory.CreatedAt.Format("2006-01-02T15:04:05-07:00"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if advisory.Id, err = result.LastInsertId(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(advisory)
+	logAction(fmt.Sprintf("Trailhead advisory %d posted on %s: %s, %s", advisory.Id, advisory.TrailheadName, advisory.Status, advisory.Message))
+}
+
+// List the advisories in effect on a trailhead
+func getTrailheadAdvisoriesHandler(w http.ResponseWriter, r *http.Request) {
+	trailheadName, err := resolveTrailheadName(db, r.PathValue("name"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Trailhead not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	advisories, err := trailheadAdvisories(db, trailheadName, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if advisories == nil {
+		advisories = []TrailheadAdvisory{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(advisories)
+}
+
+// Remove an advisory, e.g. once a closed trail reopens. Requires the adminToken.
+func deleteTrailheadAdvisoryHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	advisoryId, err := parseInt64(r.PathValue("advisoryId"))
+	if err != nil {
+		http.Error(w, "Invalid advisory id", http.StatusBadRequest)
+		return
+	}
+	trailheadName, err := resolveTrailheadName(db, r.PathValue("name"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Trailhead not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM trailhead_advisories WHERE id = ? AND trailhead_name = ?", advisoryId, trailheadName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Advisory not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	logAction(fmt.Sprintf("Trailhead advisory %d removed from %s", advisoryId, trailheadName))
+}
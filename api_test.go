@@ -1,11 +1,18 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -337,7 +344,7 @@ func TestRSVPToHike_DuplicateRSVP(t *testing.T) {
 	}
 
 	// First RSVP
-	joinTestHikeWithOptions(t, hike, originalUser) // This helper now calls /rsvp
+	first := joinTestHikeWithOptions(t, hike, originalUser) // This helper now calls /rsvp
 
 	// Attempt RSVP again with updated info
 	updatedUser := User{
@@ -348,14 +355,29 @@ func TestRSVPToHike_DuplicateRSVP(t *testing.T) {
 		EmergencyContact: "3213214321", // Different emergency contact
 	}
 	body, _ := json.Marshal(updatedUser)
-	req, _ := http.NewRequest("POST", fmt.Sprintf("/api/hike/%s/participant", hike.JoinCode), bytes.NewBuffer(body))
+	mux := setupTestMux()
+
+	// Only the participant, with the token from their first RSVP, can RSVP them again
+	for _, query := range []string{"", "?participantToken=guessed"} {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/api/hike/%s/participant%s", hike.JoinCode, query), bytes.NewBuffer(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusForbidden, rr.Code, query)
+	}
+	var unchangedName string
+	db.QueryRow("SELECT name FROM users WHERE uuid = ?", originalUser.UUID).Scan(&unchangedName)
+	assert.Equal(t, originalUser.Name, unchangedName)
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/api/hike/%s/participant?participantToken=%s", hike.JoinCode, first.Hike.ParticipantToken), bytes.NewBuffer(body))
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
-	mux := setupTestMux()
 	mux.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusOK, rr.Code, "Duplicate RSVP request failed: %s", rr.Body.String())
+	var again Hike
+	json.Unmarshal(rr.Body.Bytes(), &again)
+	assert.Equal(t, first.Hike.ParticipantToken, again.ParticipantToken, "The participant keeps their token")
 
 	// Verify user details ARE updated in users table
 	var dbName, dbPhone, dbLicensePlate, dbEmergencyContact string
@@ -377,16 +399,143 @@ func TestRSVPToHike_DuplicateRSVP(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, 1, entryCount, "There should still be only one entry in hike_users for this participant")
 
-	// Waiver count should still be 1 (assuming duplicate RSVP doesn't add new waiver if user already signed one for this hike)
-	// The current rsvpToHikeHandler logic for waiver is INSERT, not INSERT OR REPLACE.
-	// It logs an error but continues if waiver insert fails. This means a duplicate waiver *might* be inserted if the unique constraint is per (user, hike, time) or something.
-	// For now, let's assume the test setup means it's a second signature.
-	// The current DB schema for waiver_signatures has an auto-incrementing ID, but no unique constraint on (user_uuid, hike_join_code).
-	// So a second RSVP will indeed create a second waiver.
+	// The waiver log is append-only, so the second RSVP adds a signature and keeps the first
 	var waiverCount int
 	err = db.QueryRow("SELECT COUNT(*) FROM waiver_signatures WHERE hike_join_code = ? AND user_uuid = ?", hike.JoinCode, updatedUser.UUID).Scan(&waiverCount)
 	require.NoError(t, err)
-	assert.Equal(t, 1, waiverCount, "Waiver signature should be recorded for each RSVP attempt if not constrained uniquely")
+	assert.Equal(t, 2, waiverCount, "Waiver signature should be recorded for each RSVP attempt")
+}
+
+func TestRSVPToHike_Waitlist(t *testing.T) {
+	mux := setupTestMux()
+	leader := User{UUID: "leader-waitlist", Name: "Waitlist Leader", Phone: "1231231234"}
+	cappedHike := Hike{
+		Name:            "Ka'au Crater Permit Hike",
+		Leader:          leader,
+		TrailheadName:   "Ka'au Crater",
+		StartTime:       time.Now().Add(24 * time.Hour),
+		MaxParticipants: 2,
+	}
+	body, _ := json.Marshal(cappedHike)
+	req, _ := http.NewRequest("POST", "/api/hike", bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var hike Hike
+	json.Unmarshal(rr.Body.Bytes(), &hike)
+	assert.Equal(t, 2, hike.MaxParticipants)
+
+	first := joinTestHikeWithOptions(t, hike, User{UUID: "user-waitlist-1", Name: "First"})
+	second := joinTestHikeWithOptions(t, hike, User{UUID: "user-waitlist-2", Name: "Second"})
+	third := joinTestHikeWithOptions(t, hike, User{UUID: "user-waitlist-3", Name: "Third"})
+	fourth := joinTestHikeWithOptions(t, hike, User{UUID: "user-waitlist-4", Name: "Fourth"})
+	assert.Equal(t, "rsvp", first.Hike.ParticipantStatus)
+	assert.Equal(t, "rsvp", second.Hike.ParticipantStatus)
+	assert.Equal(t, "waitlist", third.Hike.ParticipantStatus, "RSVPs past the cap go to the waitlist")
+	assert.Equal(t, "waitlist", fourth.Hike.ParticipantStatus)
+
+	// Re-RSVPing while still full keeps a waitlisted participant's place in line
+	body, _ = json.Marshal(User{UUID: "user-waitlist-3", Name: "Third Again"})
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/api/hike/%s/participant?participantToken=%s", hike.JoinCode, third.Hike.ParticipantToken), bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	getParticipants := func() map[string]Participant {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/api/hike/%s/participant?leaderCode=%s", hike.JoinCode, hike.LeaderCode), nil)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+		var participants []Participant
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &participants))
+		byName := make(map[string]Participant)
+		for _, p := range participants {
+			byName[p.User.Name] = p
+		}
+		return byName
+	}
+	participants := getParticipants()
+	require.Len(t, participants, 4)
+	assert.Equal(t, 0, participants["First"].WaitlistPosition)
+	assert.Equal(t, 1, participants["Third Again"].WaitlistPosition)
+	assert.Equal(t, 2, participants["Fourth"].WaitlistPosition)
+
+	// A waitlisted participant sees the hike on their list with their status
+	req, _ = http.NewRequest("GET", "/api/hike?userUUID=user-waitlist-4", nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	var fourthsHikes []Hike
+	json.Unmarshal(rr.Body.Bytes(), &fourthsHikes)
+	require.Len(t, fourthsHikes, 1)
+	assert.Equal(t, "waitlist", fourthsHikes[0].ParticipantStatus)
+
+	// unRSVP frees a spot which goes to the first person on the waitlist
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("/api/hike/%s/participant/%d?participantToken=%s", hike.JoinCode, first.Hike.ParticipantId, first.Hike.ParticipantToken), nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	participants = getParticipants()
+	assert.Equal(t, "rsvp", participants["Third Again"].Status, "First waitlisted participant should be promoted")
+	assert.Equal(t, 0, participants["Third Again"].WaitlistPosition)
+	assert.Equal(t, "waitlist", participants["Fourth"].Status)
+	assert.Equal(t, 1, participants["Fourth"].WaitlistPosition)
+
+	// Leaving the waitlist is allowed too
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("/api/hike/%s/participant/%d?participantToken=%s", hike.JoinCode, fourth.Hike.ParticipantId, fourth.Hike.ParticipantToken), nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	// Raising the cap promotes the waitlist
+	fifth := joinTestHikeWithOptions(t, hike, User{UUID: "user-waitlist-5", Name: "Fifth"})
+	assert.Equal(t, "waitlist", getParticipants()["Fifth"].Status)
+	update := Hike{Name: hike.Name, Leader: leader, TrailheadName: hike.TrailheadName, StartTime: hike.StartTime, MaxParticipants: 3}
+	body, _ = json.Marshal(update)
+	req, _ = http.NewRequest("PUT", fmt.Sprintf("/api/hike/%s", hike.LeaderCode), bytes.NewBuffer(body))
+	req.Header.Set("If-Match", "*")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "rsvp", getParticipants()["Fifth"].Status)
+
+	// A no-show gives up their spot
+	joinTestHikeWithOptions(t, hike, User{UUID: "user-waitlist-6", Name: "Sixth"})
+	assert.Equal(t, "waitlist", getParticipants()["Sixth"].Status)
+	body, _ = json.Marshal(Participant{Status: "no_show"})
+	req, _ = http.NewRequest("PUT", fmt.Sprintf("/api/hike/%s/participant/%d?leaderCode=%s", hike.JoinCode, second.Hike.ParticipantId, hike.LeaderCode), bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	participants = getParticipants()
+	assert.Equal(t, "no_show", participants["Second"].Status)
+	assert.Equal(t, "rsvp", participants["Sixth"].Status)
+
+	// and can't be put back in it once the waitlist has taken it
+	body, _ = json.Marshal(Participant{Status: "rsvp"})
+	req, _ = http.NewRequest("PUT", fmt.Sprintf("/api/hike/%s/participant/%d?leaderCode=%s", hike.JoinCode, second.Hike.ParticipantId, hike.LeaderCode), bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, "no_show", getParticipants()["Second"].Status)
+
+	// Lowering the cap doesn't take spots away, not even from someone who RSVPs again
+	update.MaxParticipants = 1
+	body, _ = json.Marshal(update)
+	req, _ = http.NewRequest("PUT", fmt.Sprintf("/api/hike/%s", hike.LeaderCode), bytes.NewBuffer(body))
+	req.Header.Set("If-Match", "*")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	body, _ = json.Marshal(User{UUID: "user-waitlist-5", Name: "Fifth"})
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/api/hike/%s/participant?participantToken=%s", hike.JoinCode, fifth.Hike.ParticipantToken), bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var again Hike
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &again))
+	assert.Equal(t, "rsvp", again.ParticipantStatus)
+	assert.Equal(t, "rsvp", getParticipants()["Fifth"].Status)
 }
 
 // Tests for startHikingHandler
@@ -397,7 +546,7 @@ func TestStartHiking_Success(t *testing.T) {
 	body, _ := json.Marshal(Participant{Status: "active"})
 
 	req, _ := http.NewRequest("PUT",
-		fmt.Sprintf("/api/hike/%s/participant/%d", hike.JoinCode, request.Hike.ParticipantId),
+		fmt.Sprintf("/api/hike/%s/participant/%d?participantToken=%s", hike.JoinCode, request.Hike.ParticipantId, request.Hike.ParticipantToken),
 		bytes.NewReader(body))
 	rr := httptest.NewRecorder()
 	mux := setupTestMux()
@@ -422,7 +571,7 @@ func TestStartHiking_HikeNotOpen(t *testing.T) {
 	require.NoError(t, err)
 
 	req, _ := http.NewRequest("PUT",
-		fmt.Sprintf("/api/hike/%s/participant/%d", hike.JoinCode, request.Hike.ParticipantId),
+		fmt.Sprintf("/api/hike/%s/participant/%d?participantToken=%s", hike.JoinCode, request.Hike.ParticipantId, request.Hike.ParticipantToken),
 		bytes.NewReader(body))
 	rr := httptest.NewRecorder()
 	mux := setupTestMux()
@@ -451,7 +600,7 @@ func TestUnRSVP_Success(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 1, count, "Waiver should exist before unRSVP")
 
-	req, _ := http.NewRequest("DELETE", fmt.Sprintf("/api/hike/%s/participant/%d", hike.JoinCode, rsvpResponse.Hike.ParticipantId), nil)
+	req, _ := http.NewRequest("DELETE", fmt.Sprintf("/api/hike/%s/participant/%d?participantToken=%s", hike.JoinCode, rsvpResponse.Hike.ParticipantId, rsvpResponse.Hike.ParticipantToken), nil)
 	rr := httptest.NewRecorder()
 	mux := setupTestMux()
 	mux.ServeHTTP(rr, req)
@@ -463,10 +612,10 @@ func TestUnRSVP_Success(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, 0, count, "Participant should be removed from hike_users after unRSVP")
 
-	// Verify waiver removed from waiver_signatures (still uses userUUID for this check)
+	// The signed waiver stays in the append-only waiver log
 	err = db.QueryRow("SELECT COUNT(*) FROM waiver_signatures WHERE hike_join_code = ? AND user_uuid = ?", hike.JoinCode, user.UUID).Scan(&count)
 	require.NoError(t, err)
-	assert.Equal(t, 0, count, "Waiver signature should be removed after unRSVP")
+	assert.Equal(t, 1, count, "Waiver signature should be kept after unRSVP")
 }
 
 func TestUnRSVP_NotRSVPed(t *testing.T) {
@@ -475,7 +624,7 @@ func TestUnRSVP_NotRSVPed(t *testing.T) {
 
 	// Attempt 1: User not in hike_users at all (using a non-existent participantId)
 	nonExistentParticipantId := int64(999999)
-	req, _ := http.NewRequest("DELETE", fmt.Sprintf("/api/hike/%s/participant/%d", hike.JoinCode, nonExistentParticipantId), nil)
+	req, _ := http.NewRequest("DELETE", fmt.Sprintf("/api/hike/%s/participant/%d?leaderCode=%s", hike.JoinCode, nonExistentParticipantId, hike.LeaderCode), nil)
 	rr := httptest.NewRecorder()
 	mux := setupTestMux()
 	mux.ServeHTTP(rr, req)
@@ -487,7 +636,7 @@ func TestUnRSVP_NotRSVPed(t *testing.T) {
 	_, err := db.Exec("UPDATE hike_users SET status = 'active' WHERE id = ?", rsvpResponse.Hike.ParticipantId) // Manually set to active using participantId
 	require.NoError(t, err)
 
-	reqActive, _ := http.NewRequest("DELETE", fmt.Sprintf("/api/hike/%s/participant/%d", hike.JoinCode, rsvpResponse.Hike.ParticipantId), nil)
+	reqActive, _ := http.NewRequest("DELETE", fmt.Sprintf("/api/hike/%s/participant/%d?participantToken=%s", hike.JoinCode, rsvpResponse.Hike.ParticipantId, rsvpResponse.Hike.ParticipantToken), nil)
 	rrActive := httptest.NewRecorder()
 	mux.ServeHTTP(rrActive, reqActive)
 	assert.Equal(t, http.StatusBadRequest, rrActive.Code, "Expected 400 when user is active. Body: %s", rrActive.Body.String())
@@ -507,14 +656,14 @@ func TestUnRSVP_HikeClosed(t *testing.T) {
 	// unRSVPHandler does not explicitly check if the hike is closed. It only checks the participant's status.
 	// So, unRSVPing from a closed hike (where user is 'rsvp') should still succeed.
 
-	req, _ := http.NewRequest("DELETE", fmt.Sprintf("/api/hike/%s/participant/%d", hike.JoinCode, rsvpResponse.Hike.ParticipantId), nil)
+	req, _ := http.NewRequest("DELETE", fmt.Sprintf("/api/hike/%s/participant/%d?participantToken=%s", hike.JoinCode, rsvpResponse.Hike.ParticipantId, rsvpResponse.Hike.ParticipantToken), nil)
 	rr := httptest.NewRecorder()
 	mux := setupTestMux()
 	mux.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusOK, rr.Code, "UnRSVP from a closed hike should succeed if status is 'rsvp'. Body: %s", rr.Body.String())
 
-	// Verify participant and waiver removed
+	// Verify participant removed; the waiver stays in the log
 	var count int
 	err = db.QueryRow("SELECT COUNT(*) FROM hike_users WHERE id = ?", rsvpResponse.Hike.ParticipantId).Scan(&count)
 	require.NoError(t, err)
@@ -522,7 +671,7 @@ func TestUnRSVP_HikeClosed(t *testing.T) {
 
 	err = db.QueryRow("SELECT COUNT(*) FROM waiver_signatures WHERE hike_join_code = ? AND user_uuid = ?", hike.JoinCode, user.UUID).Scan(&count)
 	require.NoError(t, err)
-	assert.Equal(t, 0, count, "Waiver should be removed")
+	assert.Equal(t, 1, count, "Waiver should be kept")
 }
 
 // Tests for /api/hike (formerly getUserHikesByStatusHandler functionality is merged here)
@@ -569,6 +718,7 @@ func TestUpdateHike_ToEndHikeAndFinalizeParticipants(t *testing.T) {
 	body, _ := json.Marshal(updatePayload)
 
 	req, _ := http.NewRequest("PUT", fmt.Sprintf("/api/hike/%s", hikeToClose.LeaderCode), bytes.NewBuffer(body))
+	req.Header.Set("If-Match", "*")
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
@@ -608,44 +758,33 @@ func TestUpdateParticipantStatus_PreventRSVPChange(t *testing.T) {
 
 	// Note: The endpoint for updateParticipantStatusHandler is PUT /api/hike/{hikeId}/participant/{participantId}
 	// {hikeId} is joinCode, {participantId} is userUUID
-	req, _ := http.NewRequest("PUT", fmt.Sprintf("/api/hike/%s/participant/%d", hike.JoinCode, result.Hike.ParticipantId), bytes.NewBuffer(bodyBytes))
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("/api/hike/%s/participant/%d?participantToken=%s", hike.JoinCode, result.Hike.ParticipantId, result.Hike.ParticipantToken), bytes.NewBuffer(bodyBytes))
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
 	mux := setupTestMux()
 	mux.ServeHTTP(rr, req)
 
-	// The current updateParticipantStatusHandler does NOT have logic to prevent changing 'rsvp'.
-	// It blindly updates the status. This test will currently fail if it expects a 400/403.
-	// For this test to pass as "preventing" a change from rsvp, the handler would need modification.
-	// If the requirement is that this endpoint *should not* change 'rsvp', then this test points out a missing validation.
-	// Based on current code, it WILL change it, and this test would reflect that by expecting 200 and status 'active'.
-	// However, the subtask implies it *should* prevent this.
-	// For now, let's test the *current* behavior, which is that it *will* change it.
-	// If a future task is to "harden updateParticipantStatusHandler", this test would change its assertion.
-
-	// Assuming the subtask *intended* for this to be a check that it *doesn't* prevent it, or that we're testing current state:
-	// assert.Equal(t, http.StatusOK, rr.Code, "Update status request failed: %s", rr.Body.String())
-
-	// var finalStatus string
-	// err := db.QueryRow("SELECT status FROM hike_users WHERE hike_join_code = ? AND user_uuid = ?", hike.JoinCode, userRSVP.UUID).Scan(&finalStatus)
-	// require.NoError(t, err)
-	// assert.Equal(t, "active", finalStatus, "Status should have been changed to active by the endpoint")
-
-	// IF THE INTENT IS TO PREVENT IT (which is more logical for a "startHiking" flow):
-	// The current code *will* allow this change. So, to make this test reflect the subtask title "PreventRSVPChange",
-	// we would expect a failure from the endpoint or no change in status.
-	// Since the handler doesn't prevent it, this test will currently reflect that the status *is* changed.
-	// Let's write the test to expect the current behavior (status changes) and add a comment.
-	assert.Equal(t, http.StatusOK, rr.Code)
+	// rsvp -> active is how a participant starts hiking, so it's allowed
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
 	var status string
 	db.QueryRow("SELECT status FROM hike_users WHERE user_uuid = ?", userRSVP.UUID).Scan(&status)
 	assert.Equal(t, "active", status, "Participant status should have been changed to 'active' by updateParticipantStatusHandler")
-	// If this endpoint should NOT change 'rsvp', then `main.go` needs an update, and this assertion would change.
-	// The current `updateParticipantStatusHandler` has no specific logic to prevent changing from 'rsvp'.
-	// The specific route to change from 'rsvp' to 'active' is the startHikingHandler.
-	// So, arguably, updateParticipantStatusHandler should NOT allow changing from 'rsvp'.
-	// For now, this test confirms current behavior. A future task might be to restrict updateParticipantStatusHandler.
+
+	// but once hiking they can't go back to rsvp
+	req, _ = http.NewRequest("PUT", fmt.Sprintf("/api/hike/%s/participant/%d?participantToken=%s", hike.JoinCode, result.Hike.ParticipantId, result.Hike.ParticipantToken), bytes.NewBufferString(`{"status":"rsvp"}`))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "A participant can't change a participant's status from 'active' to 'rsvp'")
+
+	// and an RSVP can't skip straight to finished
+	other := joinTestHikeWithOptions(t, hike, User{UUID: "user-rsvp-for-update-prevent-2", Name: "RSVP User Update Prevent 2"})
+	req, _ = http.NewRequest("PUT", fmt.Sprintf("/api/hike/%s/participant/%d?participantToken=%s", hike.JoinCode, other.Hike.ParticipantId, other.Hike.ParticipantToken), bytes.NewBufferString(`{"status":"finished"}`))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "from 'rsvp' to 'finished'")
 }
 
 // TestGetHikes_Location was removed.
@@ -923,6 +1062,7 @@ func TestUpdateHike(t *testing.T) {
 
 	updateBody, _ := json.Marshal(updatedHikeData)
 	req, _ := http.NewRequest("PUT", fmt.Sprintf("/api/hike/%s", createdHike.LeaderCode), bytes.NewBuffer(updateBody))
+	req.Header.Set("If-Match", "*")
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
@@ -955,6 +1095,7 @@ func TestUpdateHike(t *testing.T) {
 
 	updateWithNewLeaderBody, _ := json.Marshal(hikeDataWithNewLeader)
 	reqNewLeader, _ := http.NewRequest("PUT", fmt.Sprintf("/api/hike/%s", createdHike.LeaderCode), bytes.NewBuffer(updateWithNewLeaderBody))
+	reqNewLeader.Header.Set("If-Match", "*")
 	reqNewLeader.Header.Set("Content-Type", "application/json")
 
 	rrNewLeader := httptest.NewRecorder()
@@ -997,12 +1138,109 @@ func TestUpdateHike(t *testing.T) {
 	assert.Equal(t, http.StatusBadRequest, rrInvalidBody.Code)
 }
 
+func TestUpdateHikeIfMatch(t *testing.T) {
+	mux := setupTestMux()
+	leader := User{UUID: "leader-etag", Name: "ETag Leader", Phone: "8085550024"}
+	hike := createTestHikeWithOptions(t, leader)
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/api/hike/%s?leaderCode=%s", hike.JoinCode, hike.LeaderCode), nil)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	etag := rr.Header().Get("ETag")
+	assert.Equal(t, `"1"`, etag)
+
+	update := func(ifMatch, description string) *httptest.ResponseRecorder {
+		edit := Hike{Name: hike.Name, Leader: leader, TrailheadName: hike.TrailheadName, StartTime: hike.StartTime, DescriptionMarkdown: description}
+		body, _ := json.Marshal(edit)
+		req, _ := http.NewRequest("PUT", "/api/hike/"+hike.LeaderCode, bytes.NewBuffer(body))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr = update("", "Bring water")
+	assert.Equal(t, http.StatusPreconditionRequired, rr.Code)
+
+	// The first co-leader to save wins
+	rr = update(etag, "Bring water")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, `"2"`, rr.Header().Get("ETag"))
+
+	// The second gets the hike as it is now, to merge their edit into
+	rr = update(etag, "Bring sunscreen")
+	require.Equal(t, http.StatusPreconditionFailed, rr.Code)
+	assert.Equal(t, `"2"`, rr.Header().Get("ETag"))
+	var current Hike
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &current))
+	assert.Equal(t, "Bring water", current.DescriptionMarkdown)
+	assert.Equal(t, int64(2), current.Version)
+	var description string
+	db.QueryRow("SELECT description FROM hikes WHERE join_code = ?", hike.JoinCode).Scan(&description)
+	assert.Equal(t, "Bring water", description)
+
+	rr = update(`W/"3", "2"`, "Bring water and sunscreen")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `"3"`, rr.Header().Get("ETag"))
+}
+
+func TestCreatedHikeVersion(t *testing.T) {
+	mux := setupTestMux()
+	leader := User{UUID: "leader-created-version", Name: "Version Leader", Phone: "8085550025"}
+	hike := Hike{Name: "Fresh Hike", Leader: leader, TrailheadName: "Olomana", StartTime: time.Now().Add(24 * time.Hour)}
+	body, _ := json.Marshal(hike)
+	req, _ := http.NewRequest("POST", "/api/hike", bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var created Hike
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &created))
+	assert.Equal(t, int64(1), created.Version)
+	assert.Equal(t, hikeETag(created.Version), rr.Header().Get("ETag"))
+
+	// The leader's first edit can use the version the hike was created with
+	edit := Hike{Name: "Fresh Hike, Edited", Leader: leader, TrailheadName: "Olomana", StartTime: created.StartTime}
+	body, _ = json.Marshal(edit)
+	req, _ = http.NewRequest("PUT", "/api/hike/"+created.LeaderCode, bytes.NewBuffer(body))
+	req.Header.Set("If-Match", hikeETag(created.Version))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var edited Hike
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &edited))
+	assert.Equal(t, int64(2), edited.Version)
+
+	// So can the first edit of a series occurrence
+	body, _ = json.Marshal(HikeSeries{Recurrence: "FREQ=WEEKLY", Template: hike})
+	req, _ = http.NewRequest("POST", "/api/series", bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var series HikeSeries
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &series))
+	require.NotEmpty(t, series.Occurrences)
+	occurrence := series.Occurrences[0]
+	assert.Equal(t, int64(1), occurrence.Version)
+	edit.StartTime = occurrence.StartTime
+	body, _ = json.Marshal(edit)
+	req, _ = http.NewRequest("PUT", "/api/hike/"+occurrence.LeaderCode, bytes.NewBuffer(body))
+	req.Header.Set("If-Match", hikeETag(occurrence.Version))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+}
+
 func TestLeaveHike(t *testing.T) {
 	hike := createTestHike(t)
 	participant := joinTestHike(t, hike)
+	_, err := db.Exec("UPDATE hike_users SET status = 'active' WHERE id = ?", participant.Hike.ParticipantId) // Only someone hiking can leave
+	require.NoError(t, err)
 
 	req, _ := http.NewRequest("PUT",
-		fmt.Sprintf("/api/hike/%s/participant/%d", hike.JoinCode, participant.Hike.ParticipantId),
+		fmt.Sprintf("/api/hike/%s/participant/%d?participantToken=%s", hike.JoinCode, participant.Hike.ParticipantId, participant.Hike.ParticipantToken),
 		bytes.NewBufferString(`{"status":"finished"}`))
 	req.Header.Set("Content-Type", "application/json")
 
@@ -1013,150 +1251,2488 @@ func TestLeaveHike(t *testing.T) {
 	assert.Equal(t, http.StatusOK, rr.Code)
 }
 
-func TestTrailheadSuggestions(t *testing.T) {
-	req, _ := http.NewRequest("GET", "/api/trailhead?q=Ka", nil)
-	rr := httptest.NewRecorder()
+func TestParticipantChangeAuthorization(t *testing.T) {
 	mux := setupTestMux()
+	leader := User{UUID: "leader-participant-auth", Name: "Auth Leader", Phone: "8085550002"}
+	hike := createTestHikeWithOptions(t, leader)
+	otherHike := createTestHikeWithOptions(t, User{UUID: "leader-participant-auth-other", Name: "Other Leader", Phone: "8085550003"})
+	alice := joinTestHikeWithOptions(t, hike, User{UUID: "user-auth-alice", Name: "Alice"})
+	bob := joinTestHikeWithOptions(t, hike, User{UUID: "user-auth-bob", Name: "Bob"})
+	require.NotEmpty(t, alice.Hike.ParticipantToken)
+	require.NotEqual(t, alice.Hike.ParticipantToken, bob.Hike.ParticipantToken)
+
+	send := func(method string, participantId int64, query string, status string) *httptest.ResponseRecorder {
+		url := fmt.Sprintf("/api/hike/%s/participant/%d", hike.JoinCode, participantId)
+		if query != "" {
+			url += "?" + query
+		}
+		var body *bytes.Buffer
+		if status != "" {
+			body = bytes.NewBufferString(fmt.Sprintf(`{"status":%q}`, status))
+		} else {
+			body = &bytes.Buffer{}
+		}
+		req, _ := http.NewRequest(method, url, body)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	bobStatus := func() string {
+		var status string
+		err := db.QueryRow("SELECT status FROM hike_users WHERE id = ?", bob.Hike.ParticipantId).Scan(&status)
+		require.NoError(t, err)
+		return status
+	}
+
+	// No credentials, or ones we don't recognize
+	assert.Equal(t, http.StatusUnauthorized, send("PUT", bob.Hike.ParticipantId, "", "active").Code)
+	assert.Equal(t, http.StatusUnauthorized, send("DELETE", bob.Hike.ParticipantId, "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, send("PUT", bob.Hike.ParticipantId, "participantToken=guessed", "active").Code)
+	assert.Equal(t, http.StatusUnauthorized, send("PUT", bob.Hike.ParticipantId, "leaderCode=guessed", "active").Code)
+
+	// Alice can't change Bob by using her own token with his participant id
+	aliceToken := "participantToken=" + alice.Hike.ParticipantToken
+	rr := send("PUT", bob.Hike.ParticipantId, aliceToken, "finished")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	rr = send("DELETE", bob.Hike.ParticipantId, aliceToken, "")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, "rsvp", bobStatus(), "Bob's RSVP should be untouched")
+
+	// Another hike's leader code doesn't cover this hike's participants
+	assert.Equal(t, http.StatusForbidden, send("PUT", bob.Hike.ParticipantId, "leaderCode="+otherHike.LeaderCode, "active").Code)
+
+	// Bob's own token, the leader code and a sweep's code all work
+	rr = send("PUT", bob.Hike.ParticipantId, "participantToken="+bob.Hike.ParticipantToken, "active")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "active", bobStatus())
+	rr = send("PUT", bob.Hike.ParticipantId, "leaderCode="+hike.LeaderCode, "finished")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "finished", bobStatus())
+
+	body, _ := json.Marshal(HikeRole{Role: "sweep", Name: "Sweep"})
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/api/hike/%s/role?leaderCode=%s", hike.JoinCode, hike.LeaderCode), bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var sweep HikeRole
+	json.Unmarshal(rr.Body.Bytes(), &sweep)
+	rr = send("PUT", bob.Hike.ParticipantId, "leaderCode="+sweep.AccessCode, "active")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "active", bobStatus())
+
+	// The token is on the participant's list of hikes so another device with their UUID can use it
+	req, _ = http.NewRequest("GET", "/api/hike?userUUID=user-auth-alice", nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	var aliceHikes []Hike
+	json.Unmarshal(rr.Body.Bytes(), &aliceHikes)
+	require.Len(t, aliceHikes, 1)
+	assert.Equal(t, alice.Hike.ParticipantToken, aliceHikes[0].ParticipantToken)
+
+	// Someone else can't RSVP as Alice to get a new token; Alice keeps hers when she RSVPs again
+	body, _ = json.Marshal(User{UUID: "user-auth-alice", Name: "Not Alice"})
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/api/hike/%s/participant", hike.JoinCode), bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	body, _ = json.Marshal(User{UUID: "user-auth-alice", Name: "Alice"})
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/api/hike/%s/participant?%s", hike.JoinCode, aliceToken), bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
 	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var again Hike
+	json.Unmarshal(rr.Body.Bytes(), &again)
+	assert.Equal(t, alice.Hike.ParticipantToken, again.ParticipantToken)
+	rr = send("DELETE", again.ParticipantId, aliceToken, "")
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+}
 
-	assert.Equal(t, http.StatusOK, rr.Code)
+func TestParticipantStatusHistory(t *testing.T) {
+	mux := setupTestMux()
+	leader := User{UUID: "leader-status-history", Name: "History Leader", Phone: "8085550004"}
+	cappedHike := Hike{Name: "Status History Hike", Leader: leader, TrailheadName: "Olomana", StartTime: time.Now(), MaxParticipants: 2}
+	body, _ := json.Marshal(cappedHike)
+	req, _ := http.NewRequest("POST", "/api/hike", bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var hike Hike
+	json.Unmarshal(rr.Body.Bytes(), &hike)
 
-	var suggestions []Trailhead
-	json.Unmarshal(rr.Body.Bytes(), &suggestions)
-	assert.GreaterOrEqual(t, len(suggestions), 1, "Should get at least one suggestion for 'Ka'")
-	for _, s := range suggestions {
-		assert.NotEmpty(t, s.Name, "Suggestion name should not be empty")
-		assert.NotEmpty(t, s.MapLink, "Suggestion MapLink should not be empty")
-		assert.Contains(t, s.MapLink, "https://", "MapLink is not a link")
+	hiker := joinTestHikeWithOptions(t, hike, User{UUID: "user-history-hiker", Name: "Hiker"})
+	leaving := joinTestHikeWithOptions(t, hike, User{UUID: "user-history-leaving", Name: "Leaving"})
+	waiting := joinTestHikeWithOptions(t, hike, User{UUID: "user-history-waiting", Name: "Waiting"})
+	require.Equal(t, "waitlist", waiting.Hike.ParticipantStatus)
+
+	body, _ = json.Marshal(HikeRole{Role: "sweep", Name: "Sweep"})
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/api/hike/%s/role?leaderCode=%s", hike.JoinCode, hike.LeaderCode), bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var sweep HikeRole
+	json.Unmarshal(rr.Body.Bytes(), &sweep)
+
+	setStatus := func(participantId int64, credentials string, status string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PUT", fmt.Sprintf("/api/hike/%s/participant/%d?%s", hike.JoinCode, participantId, credentials), bytes.NewBufferString(fmt.Sprintf(`{"status":%q}`, status)))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	history := func(participantId int64) []StatusChange {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/api/hike/%s/participant/%d/history?leaderCode=%s", hike.JoinCode, participantId, hike.LeaderCode), nil)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var changes []StatusChange
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &changes))
+		return changes
+	}
+	type step struct{ from, to, actor string }
+	steps := func(changes []StatusChange) []step {
+		var result []step
+		for _, c := range changes {
+			result = append(result, step{c.FromStatus, c.ToStatus, c.Actor})
+		}
+		return result
 	}
 
-	// Test with userUUID
-	// 1. Create a user and a hike for them
-	testUserUUID := "test-user-trailhead-suggestions"
-	_, err := db.Exec("INSERT OR IGNORE INTO users (uuid, name, phone) VALUES (?, ?, ?)", testUserUUID, "Test User TH", "1112223333")
-	require.NoError(t, err)
+	leaderCode := "leaderCode=" + hike.LeaderCode
+	// The waitlist belongs to the system; a leader can't jump someone ahead of it
+	rr = setStatus(waiting.Hike.ParticipantId, leaderCode, "rsvp")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "A leader can't change a participant's status from 'waitlist'")
 
-	// Hike 1 by user - recent
-	_, err = db.Exec(`INSERT INTO hikes (name, trailhead_name, trailhead_map_link, leader_uuid, created_at, start_time, join_code, leader_code)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		"User Hike Recent", "Ka'au Crater User", "http://maps.google.com/user_kaau", testUserUUID, time.Now().Add(-1*time.Hour).Format("2006-01-02T15:04:05-07:00"), time.Now().Add(2*time.Hour), "joinRecentUserLedHike", "leadRecentUserLedHike")
-	require.NoError(t, err)
-	// No need to insert into hike_users if we are testing trailheads from hikes LED by the user.
+	require.Equal(t, http.StatusOK, setStatus(hiker.Hike.ParticipantId, "participantToken="+hiker.Hike.ParticipantToken, "active").Code)
+	require.Equal(t, http.StatusOK, setStatus(hiker.Hike.ParticipantId, leaderCode, "finished").Code)
+	require.Equal(t, http.StatusOK, setStatus(hiker.Hike.ParticipantId, leaderCode, "active").Code, "leaders can correct a mistaken finish")
+	require.Equal(t, http.StatusOK, setStatus(hiker.Hike.ParticipantId, "leaderCode="+sweep.AccessCode, "dropped_out").Code)
 
-	// Hike 2 by user - older, also led by testUserUUID
-	_, err = db.Exec(`INSERT INTO hikes (name, trailhead_name, trailhead_map_link, leader_uuid, created_at, start_time, join_code, leader_code)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		"User Hike Older", "Kamilo'iki User", "http://maps.google.com/user_kamiloiki", testUserUUID, time.Now().Add(-2*time.Hour).Format("2006-01-02T15:04:05-07:00"), time.Now().Add(1*time.Hour), "joinOlderUserLedHike", "leadOlderUserLedHike")
-	require.NoError(t, err)
-	// No need to insert into hike_users for this test's purpose.
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("/api/hike/%s/participant/%d?participantToken=%s", hike.JoinCode, leaving.Hike.ParticipantId, leaving.Hike.ParticipantToken), nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
 
-	// Predefined "Ka'au Crater" also exists. The user one should take precedence.
-	// Predefined "Kamilo'iki" also exists.
+	// RSVPing again doesn't reset someone who has already been out on the trail
+	body, _ = json.Marshal(User{UUID: "user-history-hiker", Name: "Hiker"})
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/api/hike/%s/participant?participantToken=%s", hike.JoinCode, hiker.Hike.ParticipantToken), bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "from 'dropped_out'")
+
+	assert.Equal(t, []step{
+		{"", "rsvp", "participant"},
+		{"rsvp", "active", "participant"},
+		{"active", "finished", "leader"},
+		{"finished", "active", "leader"},
+		{"active", "dropped_out", "sweep"},
+	}, steps(history(hiker.Hike.ParticipantId)))
+	// Dropping out freed a spot for the waitlist
+	assert.Equal(t, []step{
+		{"", "waitlist", "participant"},
+		{"waitlist", "rsvp", "system"},
+	}, steps(history(waiting.Hike.ParticipantId)))
+
+	// Closing the hike finishes everyone still on it
+	update := Hike{Name: hike.Name, Leader: leader, TrailheadName: hike.TrailheadName, StartTime: hike.StartTime, MaxParticipants: 2, Status: "closed"}
+	body, _ = json.Marshal(update)
+	req, _ = http.NewRequest("PUT", "/api/hike/"+hike.LeaderCode, bytes.NewBuffer(body))
+	req.Header.Set("If-Match", "*")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	waitingHistory := history(waiting.Hike.ParticipantId)
+	require.Len(t, waitingHistory, 3)
+	assert.Equal(t, step{"rsvp", "finished", "system"}, steps(waitingHistory)[2])
+	assert.Len(t, history(hiker.Hike.ParticipantId), 5, "dropped_out participants aren't finished when the hike closes")
 
-	// Scenario 1: Query matches user history and predefined, user history should be prioritized
-	reqUser, _ := http.NewRequest("GET", fmt.Sprintf("/api/trailhead?q=Ka&userUUID=%s", testUserUUID), nil)
-	rrUser := httptest.NewRecorder()
-	mux.ServeHTTP(rrUser, reqUser)
-	assert.Equal(t, http.StatusOK, rrUser.Code)
-	var userSuggestions []Trailhead
-	json.Unmarshal(rrUser.Body.Bytes(), &userSuggestions)
+	// Status changes aren't allowed once the hike is closed
+	assert.Equal(t, http.StatusBadRequest, setStatus(hiker.Hike.ParticipantId, leaderCode, "active").Code)
 
-	assert.GreaterOrEqual(t, len(userSuggestions), 1, "Should get at least one suggestion for 'Ka' with userUUID")
+	// Only codes for the hike can see the history
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/api/hike/%s/participant/%d/history", hike.JoinCode, hiker.Hike.ParticipantId), nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
 
-	foundUserKaauUser := false
-	foundStdKaauCrater := false
-	foundUserKamiloikiUser := false
+func TestExportHikeParticipants(t *testing.T) {
+	mux := setupTestMux()
+	leader := User{UUID: "leader-export", Name: "Export Leader", Phone: "8085550005"}
+	hike := createTestHikeWithOptions(t, leader)
+	joinTestHikeWithOptions(t, hike, User{UUID: "user-export-zed", Name: "Zed Hiker", Phone: "8085551234", LicensePlate: "ABC 123", EmergencyContact: "8085554321"})
+	joinTestHikeWithOptions(t, hike, User{UUID: "user-export-ana", Name: "ʻAna, \"Trail\" Hiker", Phone: "8085555678"})
+
+	export := func(query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/api/hike/%s/participant/export?%s", hike.JoinCode, query), nil)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
 
-	// Check that user's specific trailheads ("Ka'au Crater User", "Kamilo'iki User") appear.
-	// Also check if the standard "Ka'au Crater" appears if not overridden.
-	for _, s := range userSuggestions {
-		if s.Name == "Ka'au Crater User" {
-			foundUserKaauUser = true
-			assert.Equal(t, "http://maps.google.com/user_kaau", s.MapLink, "User's 'Ka'au Crater User' map link is incorrect")
-		} else if s.Name == "Ka'au Crater" { // This is the predefined one
-			foundStdKaauCrater = true
-			// We expect its original map link if no user override with this exact name exists OR if the user override was not fetched due to query/limit
-			// This part of the test is before adding an exact name override by the user.
-			var predefinedKaauMapLink string
-			for _, pth := range predefinedTrailheads {
-				if pth.Name == "Ka'au Crater" {
-					predefinedKaauMapLink = pth.MapLink
-					break
-				}
-			}
-			assert.Equal(t, predefinedKaauMapLink, s.MapLink, "Standard 'Ka'au Crater' map link is incorrect or overridden prematurely.")
-		}
-		if s.Name == "Kamilo'iki User" {
-			foundUserKamiloikiUser = true
-			assert.Equal(t, "http://maps.google.com/user_kamiloiki", s.MapLink, "User's 'Kamilo'iki User' map link is incorrect")
+	rr := export("format=csv&leaderCode=" + hike.LeaderCode)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "text/csv; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Contains(t, rr.Header().Get("Content-Disposition"), ".csv")
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.Equal(t, rosterExportHeader, records[0])
+	assert.Equal(t, "ʻAna, \"Trail\" Hiker", records[1][0], "Rows are sorted by name and quoted")
+	assert.Equal(t, []string{"Zed Hiker", "(808) 555-1234", "ABC 123", "(808) 555-4321", "rsvp"}, records[2][:5])
+	assert.NotEqual(t, "Not signed", records[2][5])
+
+	// csv is the default
+	rr = export("leaderCode=" + hike.LeaderCode)
+	assert.Equal(t, "text/csv; charset=utf-8", rr.Header().Get("Content-Type"))
+
+	rr = export("format=xlsx&leaderCode=" + hike.LeaderCode)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	require.NoError(t, err)
+	var sheet string
+	for _, f := range zr.File {
+		if f.Name == "xl/worksheets/sheet1.xml" {
+			rc, err := f.Open()
+			require.NoError(t, err)
+			content, _ := io.ReadAll(rc)
+			rc.Close()
+			sheet = string(content)
 		}
 	}
-	assert.True(t, foundUserKaauUser, "User's 'Ka'au Crater User' trailhead should be in suggestions")
-	assert.True(t, foundUserKamiloikiUser, "User's 'Kamilo'iki User' trailhead should be in suggestions")
-	// Standard Ka'au Crater should also be found at this stage as there's no user hike named exactly "Ka'au Crater" yet.
-	assert.True(t, foundStdKaauCrater, "Standard 'Ka'au Crater' should be suggested when no user override exists for that exact name and query matches.")
-
+	assert.Contains(t, sheet, "Zed Hiker")
+	assert.Contains(t, sheet, "&#34;Trail&#34;")
+	assert.Contains(t, sheet, `r="F3"`)
+
+	rr = export("format=pdf&leaderCode=" + hike.LeaderCode)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "application/pdf", rr.Header().Get("Content-Type"))
+	pdf := rr.Body.String()
+	assert.True(t, strings.HasPrefix(pdf, "%PDF-1.4"))
+	assert.True(t, strings.HasSuffix(pdf, "%%EOF\n"))
+	assert.Contains(t, pdf, "(Sign-In Sheet: "+hike.Name+")")
+	assert.Contains(t, pdf, "(Zed Hiker)")
+	assert.Contains(t, pdf, "('Ana, \"Trail\" Hiker)")
+	assert.Contains(t, pdf, "/Count 1")
+
+	assert.Equal(t, http.StatusBadRequest, export("format=doc&leaderCode="+hike.LeaderCode).Code)
+	assert.Equal(t, http.StatusNotFound, export("format=csv").Code)
+}
 
-	// If a user trailhead has the same name as a predefined one, the user's (most recent) should be used.
-	// Let's add a user hike (led by testUserUUID) with the exact name "Ka'au Crater" but a different map link.
-	_, err = db.Exec(`INSERT INTO hikes (name, trailhead_name, trailhead_map_link, leader_uuid, created_at, start_time, join_code, leader_code)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		"User Hike Exact Name", "Ka'au Crater", "http://maps.google.com/user_exact_kaau_override", testUserUUID, time.Now().Format("2006-01-02T15:04:05-07:00"), time.Now().Add(3*time.Hour), "joinExactUserLedHikeOverride", "leadExactUserLedHikeOverride")
-	require.NoError(t, err)
-	// No hike_users insertion needed for this specific test logic.
+func TestSignedWaiverPDF(t *testing.T) {
+	mux := setupTestMux()
+	leader := User{UUID: "leader-waiver-pdf", Name: "Waiver Leader", Phone: "8085550009"}
+	hike := createTestHikeWithOptions(t, leader)
 
-	reqOverride, _ := http.NewRequest("GET", fmt.Sprintf("/api/trailhead?q=Ka'au Crater&userUUID=%s", testUserUUID), nil)
-	rrOverride := httptest.NewRecorder()
-	mux.ServeHTTP(rrOverride, reqOverride)
-	assert.Equal(t, http.StatusOK, rrOverride.Code)
-	var overrideSuggestions []Trailhead
-	json.Unmarshal(rrOverride.Body.Bytes(), &overrideSuggestions)
+	body, _ := json.Marshal(User{UUID: "user-waiver-pdf", Name: "Keola Hiker", Phone: "8085550010"})
+	req, _ := http.NewRequest("POST", fmt.Sprintf("/api/hike/%s/participant", hike.JoinCode), bytes.NewBuffer(body))
+	req.Header.Set("User-Agent", "WaiverTest/1.0")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var rsvp Hike
+	json.Unmarshal(rr.Body.Bytes(), &rsvp)
+	joinTestHikeWithOptions(t, hike, User{UUID: "user-waiver-pdf-2", Name: "ʻIolani Hiker", Phone: "8085550011"})
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
 
-	require.GreaterOrEqual(t, len(overrideSuggestions), 1, "Should get at least one suggestion for exact match 'Ka'au Crater'")
-	assert.Equal(t, "Ka'au Crater", overrideSuggestions[0].Name)
-	assert.Equal(t, "http://maps.google.com/user_exact_kaau_override", overrideSuggestions[0].MapLink, "User's specific map link for 'Ka'au Crater' should override predefined.")
+	waivers, err := signedWaivers(hike.JoinCode, rsvp.ParticipantId)
+	require.NoError(t, err)
+	require.Len(t, waivers, 1)
+	hash := waivers[0].ContentHash()
+	assert.Len(t, hash, 64)
+
+	rr = get(fmt.Sprintf("/api/hike/%s/participant/%d/waiver?leaderCode=%s", hike.JoinCode, rsvp.ParticipantId, hike.LeaderCode))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "application/pdf", rr.Header().Get("Content-Type"))
+	assert.Contains(t, rr.Header().Get("Content-Disposition"), "Keola_Hiker.pdf")
+	pdf := rr.Body.String()
+	assert.True(t, strings.HasPrefix(pdf, "%PDF-1.4"))
+	assert.Contains(t, pdf, "(Keola Hiker)")
+	assert.Contains(t, pdf, "(203.0.113.7)")
+	assert.Contains(t, pdf, "(WaiverTest/1.0)")
+	assert.Contains(t, pdf, "("+hash+")")
+	assert.Contains(t, pdf, "(Hiking is an inherently dangerous activity")
+
+	// Changing the stored waiver changes its hash
+	tampered := waivers[0]
+	tampered.IPAddress = "198.51.100.1"
+	assert.NotEqual(t, hash, tampered.ContentHash())
+
+	rr = get(fmt.Sprintf("/api/hike/%s/waiver?leaderCode=%s", hike.JoinCode, hike.LeaderCode))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "application/zip", rr.Header().Get("Content-Type"))
+	zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	require.NoError(t, err)
+	require.Len(t, zr.File, 2)
+	assert.Equal(t, fmt.Sprintf("waiver_%s_%d_Keola_Hiker.pdf", hike.JoinCode, rsvp.ParticipantId), zr.File[0].Name)
+	assert.True(t, strings.HasSuffix(zr.File[1].Name, "_Iolani_Hiker.pdf"))
 
-	// Ensure limit is respected
-	assert.LessOrEqual(t, len(overrideSuggestions), 5, "Should not return more than 5 suggestions")
+	assert.Equal(t, http.StatusNotFound, get(fmt.Sprintf("/api/hike/%s/participant/%d/waiver", hike.JoinCode, rsvp.ParticipantId)).Code)
+	assert.Equal(t, http.StatusNotFound, get(fmt.Sprintf("/api/hike/%s/waiver", hike.JoinCode)).Code)
+	assert.Equal(t, http.StatusNotFound, get(fmt.Sprintf("/api/hike/%s/participant/999999/waiver?leaderCode=%s", hike.JoinCode, hike.LeaderCode)).Code)
+}
 
-	// Scenario 2: Query matches only predefined trailheads
-	reqNoUserHistoryMatch, _ := http.NewRequest("GET", fmt.Sprintf("/api/trailhead?q=Makiki Valley Loop&userUUID=%s", testUserUUID), nil)
-	rrNoUserHistoryMatch := httptest.NewRecorder()
-	mux.ServeHTTP(rrNoUserHistoryMatch, reqNoUserHistoryMatch)
-	assert.Equal(t, http.StatusOK, rrNoUserHistoryMatch.Code)
-	var noUserMatchSuggestions []Trailhead
-	json.Unmarshal(rrNoUserHistoryMatch.Body.Bytes(), &noUserMatchSuggestions)
-	assert.GreaterOrEqual(t, len(noUserMatchSuggestions), 1, "Should get suggestions from predefined if no user history matches")
-	assert.Equal(t, "Makiki Valley Loop (Nature Center)", noUserMatchSuggestions[0].Name)
+func TestWaiverTemplates(t *testing.T) {
+	mux := setupTestMux()
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "test-admin-token"
+
+	publish := func(query string, request map[string]interface{}) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(request)
+		req, _ := http.NewRequest("POST", "/api/waiver-template?"+query, bytes.NewBuffer(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
 
-	// Scenario 3: No userUUID provided, should be same as original test
-	reqNoUUID, _ := http.NewRequest("GET", "/api/trailhead?q=Ka", nil)
-	rrNoUUID := httptest.NewRecorder()
-	mux.ServeHTTP(rrNoUUID, reqNoUUID)
-	assert.Equal(t, http.StatusOK, rrNoUUID.Code)
-	var noUUIDSuggestions []Trailhead
-	json.Unmarshal(rrNoUUID.Body.Bytes(), &noUUIDSuggestions)
-	assert.Equal(t, len(suggestions), len(noUUIDSuggestions), "Suggestions without userUUID should match original test count")
+	assert.Equal(t, http.StatusUnauthorized, publish("", map[string]interface{}{"organization": "Ridge Club", "body": "x"}).Code)
+	assert.Equal(t, http.StatusUnauthorized, publish("adminToken=wrong", map[string]interface{}{"organization": "Ridge Club", "body": "x"}).Code)
+	rr := publish("adminToken=test-admin-token", map[string]interface{}{"organization": "Ridge Club", "body": "{{.Missing}}"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Invalid waiver template")
+
+	rr = publish("adminToken=test-admin-token", map[string]interface{}{"organization": "Ridge Club", "body": "Ridge Club waiver v1 for {{.LeaderName}}"})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var v1 WaiverTemplate
+	json.Unmarshal(rr.Body.Bytes(), &v1)
+	assert.Equal(t, 1, v1.Version)
+	// Scheduled for next month, so v1 stays in effect for now
+	rr = publish("adminToken=test-admin-token", map[string]interface{}{"organization": "Ridge Club", "body": "Ridge Club waiver v2",
+		"effectiveAt": time.Now().AddDate(0, 1, 0)})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var v2 WaiverTemplate
+	json.Unmarshal(rr.Body.Bytes(), &v2)
+	assert.Equal(t, 2, v2.Version)
+
+	leader := User{UUID: "leader-waiver-template", Name: "Template Leader", Phone: "8085550012"}
+	body, _ := json.Marshal(Hike{Name: "Ridge Hike", Organization: "Ridge Club", Leader: leader, TrailheadName: "Olomana", StartTime: time.Now().Add(24 * time.Hour)})
+	req, _ := http.NewRequest("POST", "/api/hike", bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var hike Hike
+	json.Unmarshal(rr.Body.Bytes(), &hike)
+	assert.Equal(t, "Ridge Club waiver v1 for Template Leader", hike.WaiverText)
+
+	participant := joinTestHikeWithOptions(t, hike, User{UUID: "user-waiver-template", Name: "Template Hiker", Phone: "8085550013"})
+	var templateId int64
+	var waiverText string
+	err := db.QueryRow("SELECT template_id, waiver_text FROM waiver_signatures WHERE user_uuid = ? AND hike_join_code = ?", "user-waiver-template", hike.JoinCode).Scan(&templateId, &waiverText)
+	require.NoError(t, err)
+	assert.Equal(t, v1.Id, templateId)
+	assert.Equal(t, "Ridge Club waiver v1 for Template Leader", waiverText)
+	waivers, err := signedWaivers(hike.JoinCode, participant.Hike.ParticipantId)
+	require.NoError(t, err)
+	require.Len(t, waivers, 1)
+	assert.Equal(t, "Ridge Club waiver, version 1", waivers[0].templateLabel())
 
-	// Cleanup test data (optional if using in-memory DB that's reset, but good practice for file-based)
-	// This is complex due to potential cascading or foreign key constraints.
-	// For :memory: db, it's usually fine. If using a file db for tests, more robust cleanup might be needed.
-	// Example cleanup, might need adjustment based on actual FKs and dependencies:
-	db.Exec("DELETE FROM hike_users WHERE user_uuid = ?", testUserUUID)
-	db.Exec("DELETE FROM hikes WHERE leader_uuid = ?", testUserUUID)
-	db.Exec("DELETE FROM users WHERE uuid = ?", testUserUUID)
+	// Organizations without a template of their own get the default
+	defaultTemplate, err := effectiveWaiverTemplate("No Such Club", time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, "", defaultTemplate.Organization)
+	assert.Equal(t, defaultWaiverTemplate, defaultTemplate.Body)
+	ridgeTemplate, err := effectiveWaiverTemplate("ridge club", time.Now().AddDate(0, 2, 0))
+	require.NoError(t, err)
+	assert.Equal(t, v2.Id, ridgeTemplate.Id, "Organization names match regardless of case")
 
+	req, _ = http.NewRequest("GET", "/api/waiver-template?organization=Ridge+Club&adminToken=test-admin-token", nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var templates []WaiverTemplate
+	json.Unmarshal(rr.Body.Bytes(), &templates)
+	require.Len(t, templates, 2)
+	assert.Equal(t, 2, templates[0].Version)
+
+	adminToken = ""
+	assert.Equal(t, http.StatusForbidden, publish("adminToken=test-admin-token", map[string]interface{}{"body": "x"}).Code)
 }
 
-func TestGetHikeByCode(t *testing.T) {
-	hike := createTestHike(t)
-
-	req, _ := http.NewRequest("GET", fmt.Sprintf("/api/hike/%s", hike.JoinCode), nil)
-	rr := httptest.NewRecorder()
+func TestRSVPWithDependents(t *testing.T) {
 	mux := setupTestMux()
-	mux.ServeHTTP(rr, req)
+	leader := User{UUID: "leader-dependents", Name: "Dependents Leader", Phone: "8085550014"}
+	hike := createTestHikeWithOptions(t, leader)
 
-	assert.Equal(t, http.StatusOK, rr.Code)
+	rsvp := func(user User) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(user)
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/api/hike/%s/participant", hike.JoinCode), bytes.NewBuffer(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	guardian := User{UUID: "user-guardian", Name: "Malia Parent", Phone: "8085550015", EmergencyContact: "8085550016",
+		Dependents: []Dependent{{Name: "Kai Keiki", Age: 10, GuardianAcknowledged: true}, {Name: "Noe Keiki", Age: 7}}}
+
+	// Every dependent needs the guardian's acknowledgment, and nobody is added without it
+	rr := rsvp(guardian)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Malia Parent must acknowledge the waiver on behalf of Noe Keiki")
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM hike_users WHERE hike_join_code = ?", hike.JoinCode).Scan(&count)
+	assert.Equal(t, 0, count)
+
+	guardian.Dependents[1].GuardianAcknowledged = true
+	rr = rsvp(guardian)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var response Hike
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	require.Len(t, response.Dependents, 2)
+	kai := response.Dependents[0]
+	assert.NotEmpty(t, kai.UUID, "A UUID is generated for a new dependent")
+	assert.Equal(t, "rsvp", kai.ParticipantStatus)
+
+	var guardianUUID, waiverText string
+	err := db.QueryRow("SELECT guardian_uuid, waiver_text FROM waiver_signatures WHERE user_uuid = ? AND hike_join_code = ?", kai.UUID, hike.JoinCode).Scan(&guardianUUID, &waiverText)
+	require.NoError(t, err)
+	assert.Equal(t, "user-guardian", guardianUUID)
+	assert.Contains(t, waiverText, "I, Malia Parent, am the parent or legal guardian of Kai Keiki (age 10).")
+
+	participants, err := hikeParticipants(hike.JoinCode)
+	require.NoError(t, err)
+	require.Len(t, participants, 3)
+	for _, p := range participants {
+		if p.Id == kai.ParticipantId {
+			assert.True(t, p.Minor)
+			assert.Equal(t, 10, p.Age)
+			assert.Equal(t, "Malia Parent", p.GuardianName)
+			assert.Equal(t, "8085550015", p.User.Phone, "The leader reaches a dependent through their guardian")
+		} else if p.Id == response.ParticipantId {
+			assert.False(t, p.Minor)
+		}
+	}
+	rows := rosterRows(participants)
+	assert.Equal(t, []string{"Minor", "Guardian"}, rows[0][6:])
+	var kaiRow []string
+	for _, row := range rows {
+		if row[0] == "Kai Keiki" {
+			kaiRow = row
+		}
+	}
+	assert.Equal(t, []string{"Yes (10)", "Malia Parent"}, kaiRow[6:])
+
+	// The guardian's token covers their dependents, but not the other way around
+	statusURL := fmt.Sprintf("/api/hike/%s/participant/%d?participantToken=%s", hike.JoinCode, kai.ParticipantId, response.ParticipantToken)
+	req, _ := http.NewRequest("PUT", statusURL, strings.NewReader(`{"status":"active"}`))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	req, _ = http.NewRequest("PUT", fmt.Sprintf("/api/hike/%s/participant/%d?participantToken=%s", hike.JoinCode, response.ParticipantId, kai.ParticipantToken), strings.NewReader(`{"status":"active"}`))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// Nobody else can RSVP someone as their dependent to take over their RSVP
+	for _, takenUUID := range []string{"user-guardian", kai.UUID} {
+		stranger := User{UUID: "user-stranger-guardian", Name: "Stranger", Phone: "8085550017",
+			Dependents: []Dependent{{UUID: takenUUID, Name: "Taken Over", Age: 9, GuardianAcknowledged: true}}}
+		rr = rsvp(stranger)
+		assert.Equal(t, http.StatusConflict, rr.Code, takenUUID)
+	}
+	var kaiName string
+	db.QueryRow("SELECT name FROM users WHERE uuid = ?", kai.UUID).Scan(&kaiName)
+	assert.Equal(t, "Kai Keiki", kaiName)
+
+	// Kai is out on the trail, so RSVPing him again is refused before anything else is saved
+	var waivers int
+	db.QueryRow("SELECT COUNT(*) FROM waiver_signatures WHERE hike_join_code = ?", hike.JoinCode).Scan(&waivers)
+	again := User{UUID: "user-guardian", Name: "Malia Renamed", Phone: "8085550015",
+		Dependents: []Dependent{{Name: "Lani Keiki", Age: 5, GuardianAcknowledged: true}, {UUID: kai.UUID, Name: "Kai Keiki", Age: 10, GuardianAcknowledged: true}}}
+	body, _ := json.Marshal(again)
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/api/hike/%s/participant?participantToken=%s", hike.JoinCode, response.ParticipantToken), bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code, rr.Body.String())
+	var waiversAfter int
+	db.QueryRow("SELECT COUNT(*) FROM waiver_signatures WHERE hike_join_code = ?", hike.JoinCode).Scan(&waiversAfter)
+	assert.Equal(t, waivers, waiversAfter)
+	participants, err = hikeParticipants(hike.JoinCode)
+	require.NoError(t, err)
+	assert.Len(t, participants, 3)
+	var guardianName string
+	db.QueryRow("SELECT name FROM users WHERE uuid = 'user-guardian'").Scan(&guardianName)
+	assert.Equal(t, "Malia Parent", guardianName)
+	_, err = addDependents(hike.JoinCode, again, again.Dependents, "test", "127.0.0.1")
+	assert.IsType(t, &statusTransitionError{}, err)
+	participants, err = hikeParticipants(hike.JoinCode)
+	require.NoError(t, err)
+	assert.Len(t, participants, 3, "Dependents are added all together or not at all")
+
+	// Dependents who haven't started hiking leave with their guardian
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("/api/hike/%s/participant/%d?participantToken=%s", hike.JoinCode, response.ParticipantId, response.ParticipantToken), nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var remaining []string
+	rowsLeft, err := db.Query("SELECT u.name FROM hike_users hu JOIN users u ON hu.user_uuid = u.uuid WHERE hu.hike_join_code = ?", hike.JoinCode)
+	require.NoError(t, err)
+	for rowsLeft.Next() {
+		var name string
+		rowsLeft.Scan(&name)
+		remaining = append(remaining, name)
+	}
+	rowsLeft.Close()
+	assert.Equal(t, []string{"Kai Keiki"}, remaining)
+}
+
+func TestWaiverLogChain(t *testing.T) {
+	// Tampering with the log needs a database of its own
+	legacyDB := openTestDB(t)
+	_, err := legacyDB.Exec(legacySchemaSnapshot)
+	require.NoError(t, err)
+	_, err = legacyDB.Exec(`
+		INSERT INTO users (uuid, name, phone) VALUES ('chain-leader', 'Chain Leader', '1234567890'), ('chain-hiker', 'Chain Hiker', '1234567891');
+		INSERT INTO hikes (name, leader_uuid, created_at, start_time, join_code, leader_code)
+		VALUES ('Chain Hike', 'chain-leader', '2024-01-01T08:00:00-10:00', '2024-01-02T08:00:00-10:00', 'chainJoin', 'chainLead');
+		INSERT INTO waiver_signatures (user_uuid, hike_join_code, signed_at, user_agent, ip_address, waiver_text)
+		VALUES ('chain-hiker', 'chainJoin', '2024-01-01T09:00:00-10:00', 'Legacy/1.0', '192.0.2.1', 'Old waiver');
+	`)
+	require.NoError(t, err)
+	require.NoError(t, migrateDB(legacyDB))
+
+	defer func(saved *sql.DB) { db = saved }(db)
+	db = legacyDB
+
+	// Signatures from before the log are chained by the migration
+	count, problems, err := verifyWaiverChain()
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Empty(t, problems)
+
+	for _, ip := range []string{"192.0.2.2", "192.0.2.3"} {
+		require.NoError(t, appendWaiverSignature(waiverRecord{UserUUID: "chain-hiker", JoinCode: "chainJoin", SignedAt: time.Now(),
+			UserAgent: "Chain/1.0", IPAddress: ip, WaiverText: "New waiver"}))
+	}
+	var out bytes.Buffer
+	assert.Equal(t, 0, runVerifyWaivers(&out))
+	assert.Equal(t, "Waiver log OK: 3 records verified\n", out.String())
+
+	var prevHash, firstHash string
+	require.NoError(t, db.QueryRow("SELECT hash FROM waiver_signatures WHERE id = 1").Scan(&firstHash))
+	require.NoError(t, db.QueryRow("SELECT prev_hash FROM waiver_signatures WHERE id = 2").Scan(&prevHash))
+	assert.Equal(t, firstHash, prevHash)
+
+	// The log can't be changed through SQL while the triggers are in place
+	_, err = db.Exec("UPDATE waiver_signatures SET ip_address = '198.51.100.1' WHERE id = 2")
+	assert.ErrorContains(t, err, "append-only")
+	_, err = db.Exec("DELETE FROM waiver_signatures WHERE id = 2")
+	assert.ErrorContains(t, err, "append-only")
+
+	// and anyone who gets around them is caught by the chain
+	_, err = db.Exec(`
+		DROP TRIGGER waiver_signatures_no_update;
+		DROP TRIGGER waiver_signatures_no_delete;
+		UPDATE waiver_signatures SET ip_address = '198.51.100.1' WHERE id = 2;
+		DELETE FROM waiver_signatures WHERE id = 3;
+	`)
+	require.NoError(t, err)
+	_, problems, err = verifyWaiverChain()
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"Record 2: contents don't match its hash; it may have been edited",
+		"Record 3 has been removed from the end of the log",
+	}, problems)
+	out.Reset()
+	assert.Equal(t, 1, runVerifyWaivers(&out))
+	assert.Contains(t, out.String(), "Waiver log is BROKEN: 2 problem(s) found in 2 records")
+}
+
+func TestPDFWrap(t *testing.T) {
+	lines := pdfWrap("one two three four\n\nfive", pdfTextWidth("one two three", 10, false), 10, false)
+	assert.Equal(t, []string{"one two three", "four", "", "five"}, lines)
+	lines = pdfWrap("abcdefghij", pdfTextWidth("abcd", 10, false), 10, false)
+	assert.Equal(t, []string{"abcd", "efgh", "ij"}, lines)
+}
+
+// recordingNotifier remembers the overdue alerts it was sent
+type recordingNotifier struct {
+	alerts []OverdueAlert
+}
+
+func (n *recordingNotifier) NotifyOverdue(alert OverdueAlert) error {
+	n.alerts = append(n.alerts, alert)
+	return nil
+}
+
+func TestHikeEvents(t *testing.T) {
+	server := httptest.NewServer(setupTestMux())
+	defer server.Close()
+	leader := User{UUID: "leader-events", Name: "Events Leader", Phone: "8085550020"}
+	hike := createTestHikeWithOptions(t, leader)
+
+	type sseEvent struct {
+		id, name string
+		data     HikeEvent
+	}
+	connect := func(lastEventId string) (*http.Response, func() sseEvent) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("%s/api/hike/%s/events?leaderCode=%s", server.URL, hike.JoinCode, hike.LeaderCode), nil)
+		if lastEventId != "" {
+			req.Header.Set("Last-Event-ID", lastEventId)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+		reader := bufio.NewReader(resp.Body)
+		next := func() sseEvent {
+			var event sseEvent
+			for {
+				line, err := reader.ReadString('\n')
+				require.NoError(t, err)
+				line = strings.TrimRight(line, "\n")
+				switch {
+				case line == "" && event.name != "":
+					return event
+				case strings.HasPrefix(line, "id: "):
+					event.id = strings.TrimPrefix(line, "id: ")
+				case strings.HasPrefix(line, "event: "):
+					event.name = strings.TrimPrefix(line, "event: ")
+				case strings.HasPrefix(line, "data: "):
+					require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.data))
+				}
+			}
+		}
+		return resp, next
+	}
+
+	// A new connection is told to load everything
+	resp, next := connect("")
+	event := next()
+	assert.Equal(t, eventSync, event.name)
+
+	user := User{UUID: "user-events", Name: "Late Arrival", Phone: "8085550021"}
+	body, _ := json.Marshal(user)
+	rsvpResp, err := http.Post(fmt.Sprintf("%s/api/hike/%s/participant", server.URL, hike.JoinCode), "application/json", bytes.NewBuffer(body))
+	require.NoError(t, err)
+	var joined Hike
+	json.NewDecoder(rsvpResp.Body).Decode(&joined)
+	rsvpResp.Body.Close()
+
+	event = next()
+	assert.Equal(t, eventRSVP, event.name)
+	assert.Equal(t, joined.ParticipantId, event.data.ParticipantId)
+	assert.Equal(t, "rsvp", event.data.Status)
+
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("%s/api/hike/%s/participant/%d?participantToken=%s", server.URL, hike.JoinCode, joined.ParticipantId, joined.ParticipantToken),
+		strings.NewReader(`{"status":"active"}`))
+	statusResp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	statusResp.Body.Close()
+	event = next()
+	assert.Equal(t, eventStatus, event.name)
+	assert.Equal(t, "active", event.data.Status)
+	resp.Body.Close()
+
+	// Events published while disconnected are sent on reconnect
+	hikeEvents.publish(hike.JoinCode, eventHike, 0, "open")
+	resp, next = connect(event.id)
+	event = next()
+	assert.Equal(t, eventHike, event.name, "No sync event when the client can be caught up")
+	assert.Equal(t, hike.JoinCode, event.data.JoinCode)
+	resp.Body.Close()
+
+	// Events for other hikes aren't sent, and a client too far behind is told to load everything
+	hub := newEventHub()
+	first, _, _, _ := hub.subscribe("other", 0)
+	hub.publish("other", eventRSVP, 1, "rsvp")
+	firstEvent := <-first
+	for i := 0; i <= hikeEventHistory; i++ {
+		hub.publish("other", eventStatus, 1, "active")
+	}
+	_, missed, complete, latestId := hub.subscribe("other", firstEvent.Id)
+	assert.False(t, complete)
+	assert.Empty(t, missed)
+	assert.Equal(t, firstEvent.Id+hikeEventHistory+1, latestId)
+	_, missed, complete, _ = hub.subscribe("other", firstEvent.Id+1)
+	assert.True(t, complete)
+	assert.Len(t, missed, hikeEventHistory)
+	_, _, complete, _ = hub.subscribe("unrelated", firstEvent.Id)
+	assert.True(t, complete)
+	received := 0
+	for range first {
+		received++
+	}
+	assert.Less(t, received, hikeEventHistory, "A subscriber that stops reading is disconnected")
+
+	// A hike's history is dropped when it closes, and when nobody has watched it for a while
+	hub = newEventHub()
+	hub.publish("closing", eventRSVP, 1, "rsvp")
+	beforeClose := hub.lastId
+	hub.publish("closing", eventHike, 0, "closed")
+	hub.publish("quiet", eventRSVP, 1, "rsvp")
+	beforeIdle := hub.lastId
+	watched, _, _, _ := hub.subscribe("watched", 0)
+	hub.publish("watched", eventRSVP, 1, "rsvp")
+	assert.NotContains(t, hub.history, "closing")
+	_, _, complete, _ = hub.subscribe("closing", beforeClose)
+	assert.False(t, complete, "A console that missed the close reloads")
+	hub.mu.Lock()
+	hub.pruneIdle(time.Now().Add(hikeEventIdle))
+	hub.mu.Unlock()
+	assert.NotContains(t, hub.history, "quiet")
+	assert.NotContains(t, hub.replayFrom, "quiet")
+	assert.Contains(t, hub.history, "watched")
+	_, _, complete, _ = hub.subscribe("quiet", beforeIdle)
+	assert.False(t, complete)
+	_, missed, complete, _ = hub.subscribe("watched", beforeIdle)
+	assert.True(t, complete)
+	assert.Len(t, missed, 1)
+	hub.unsubscribe("watched", watched)
+	hub.publish("quiet", eventStatus, 1, "active")
+	_, missed, complete, _ = hub.subscribe("quiet", hub.lastId-1)
+	assert.True(t, complete, "A forgotten hike is caught up from its new history")
+	assert.Len(t, missed, 1)
+
+	// Only leaders who can see the roster can watch it
+	badResp, err := http.Get(fmt.Sprintf("%s/api/hike/%s/events?leaderCode=wrong", server.URL, hike.JoinCode))
+	require.NoError(t, err)
+	badResp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, badResp.StatusCode)
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	mux := setupTestMux()
+	leader := User{UUID: "leader-idempotency", Name: "Idempotency Leader", Phone: "8085550022"}
+	hike := createTestHikeWithOptions(t, leader)
+
+	send := func(method, url, key string, body interface{}) *httptest.ResponseRecorder {
+		payload, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, url, bytes.NewBuffer(payload))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	rsvpURL := fmt.Sprintf("/api/hike/%s/participant", hike.JoinCode)
+	user := User{UUID: "user-idempotency", Name: "Queued Offline", Phone: "8085550023"}
+
+	first := send("POST", rsvpURL, "rsvp-key-1", user)
+	require.Equal(t, http.StatusOK, first.Code, first.Body.String())
+	assert.Empty(t, first.Header().Get("Idempotent-Replayed"))
+
+	// The retry gets the first response back and nothing is done twice
+	retry := send("POST", rsvpURL, "rsvp-key-1", user)
+	require.Equal(t, http.StatusOK, retry.Code)
+	assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, first.Body.String(), retry.Body.String(), "The participant token from the first RSVP is still the one handed back")
+	var waivers int
+	db.QueryRow("SELECT COUNT(*) FROM waiver_signatures WHERE user_uuid = ? AND hike_join_code = ?", user.UUID, hike.JoinCode).Scan(&waivers)
+	assert.Equal(t, 1, waivers)
+
+	// A key can't be reused for something else
+	other := user
+	other.Name = "Someone Else"
+	rr := send("POST", rsvpURL, "rsvp-key-1", other)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+
+	// Error responses are replayed too, other than server errors
+	var joined Hike
+	json.Unmarshal(first.Body.Bytes(), &joined)
+	statusURL := fmt.Sprintf("/api/hike/%s/participant/%d?participantToken=%s", hike.JoinCode, joined.ParticipantId, joined.ParticipantToken)
+	rr = send("PUT", statusURL, "status-key-1", map[string]string{"status": "finished"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = send("PUT", statusURL, "status-key-2", map[string]string{"status": "active"})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = send("PUT", statusURL, "status-key-1", map[string]string{"status": "finished"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Equal(t, "true", rr.Header().Get("Idempotent-Replayed"))
+
+	// Without a key every request is handled
+	rr = send("PUT", statusURL, "", map[string]string{"status": "finished"})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// Replays carry the ETag and Location headers of the first response
+	edit := func() *httptest.ResponseRecorder {
+		body, _ := json.Marshal(Hike{Name: "Edited Offline", Leader: leader, TrailheadName: hike.TrailheadName, StartTime: hike.StartTime})
+		req, _ := http.NewRequest("PUT", "/api/hike/"+hike.LeaderCode, bytes.NewBuffer(body))
+		req.Header.Set("Idempotency-Key", "edit-key-1")
+		req.Header.Set("If-Match", "*")
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	rr = edit()
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	etag := rr.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+	rr = edit()
+	assert.Equal(t, "true", rr.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, etag, rr.Header().Get("ETag"))
+
+	created := idempotent(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/api/hike/created")
+		w.WriteHeader(http.StatusCreated)
+	})
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", "/api/hike", strings.NewReader(""))
+		req.Header.Set("Idempotency-Key", "location-key-1")
+		rr = httptest.NewRecorder()
+		created(rr, req)
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		assert.Equal(t, "/api/hike/created", rr.Header().Get("Location"))
+	}
+	assert.Equal(t, "true", rr.Header().Get("Idempotent-Replayed"))
+
+	// A request still in progress isn't run a second time, unless it has been abandoned
+	now := time.Now()
+	_, err := db.Exec("INSERT INTO idempotency_keys (key, request_hash, created_at) VALUES ('in-progress', 'hash', ?), ('abandoned', 'hash', ?), ('expired', 'hash', ?)",
+		formatIdempotencyTime(now), formatIdempotencyTime(now.Add(-2*idempotencyLockTimeout)), formatIdempotencyTime(now.Add(-2*idempotencyKeyLifetime)))
+	require.NoError(t, err)
+	claimed, stored, err := claimIdempotencyKey("in-progress", "hash", now)
+	require.NoError(t, err)
+	assert.False(t, claimed)
+	assert.Equal(t, 0, stored.statusCode)
+	claimed, _, err = claimIdempotencyKey("abandoned", "hash", now)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM idempotency_keys WHERE key = 'expired'").Scan(&count)
+	assert.Equal(t, 0, count, "Expired keys are cleared out")
+}
+
+func TestCarpool(t *testing.T) {
+	mux := setupTestMux()
+	leader := User{UUID: "leader-carpool", Name: "Carpool Leader", Phone: "8085550030"}
+	hike := createTestHikeWithOptions(t, leader)
+
+	do := func(method, url string, body any) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != nil {
+			data, _ := json.Marshal(body)
+			reader = bytes.NewBuffer(data)
+		}
+		req, _ := http.NewRequest(method, url, reader)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	rsvp := func(user User) Hike {
+		rr := do("POST", fmt.Sprintf("/api/hike/%s/participant", hike.JoinCode), user)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var response Hike
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+		return response
+	}
+	decode := func(rr *httptest.ResponseRecorder) Carpool {
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var carpool Carpool
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &carpool))
+		return carpool
+	}
+
+	rr := do("POST", fmt.Sprintf("/api/hike/%s/participant", hike.JoinCode),
+		User{UUID: "user-carpool-bad", Name: "Bad Driver", Phone: "8085550031", Carpool: &CarpoolSignup{Role: carpoolDriver}})
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "A driver has to offer at least one seat")
+
+	departure := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	driver := rsvp(User{UUID: "user-carpool-driver", Name: "Keoni Driver", Phone: "8085550032", LicensePlate: "ABC123",
+		Carpool: &CarpoolSignup{Role: carpoolDriver, Seats: 2, MeetingPoint: "Kaimuki Safeway", DepartureTime: departure}})
+	rider := rsvp(User{UUID: "user-carpool-rider", Name: "Leilani Rider", Phone: "8085550033",
+		Carpool: &CarpoolSignup{Role: carpoolRider, Seats: 2}})
+	other := rsvp(User{UUID: "user-carpool-other", Name: "Mana Rider", Phone: "8085550034",
+		Carpool: &CarpoolSignup{Role: carpoolRider}})
+
+	// Any participant can see the carpool
+	carpoolURL := fmt.Sprintf("/api/hike/%s/carpool", hike.JoinCode)
+	carpool := decode(do("GET", carpoolURL+"?participantToken="+other.ParticipantToken, nil))
+	require.Len(t, carpool.Cars, 1)
+	assert.Equal(t, "Keoni Driver", carpool.Cars[0].DriverName)
+	assert.Equal(t, "ABC123", carpool.Cars[0].LicensePlate)
+	assert.True(t, departure.Equal(carpool.Cars[0].DepartureTime))
+	assert.Len(t, carpool.WaitingRiders, 2)
+	assert.Equal(t, 3, carpool.VehicleCount, "Nobody is sharing a car yet")
+	assert.Equal(t, http.StatusNotFound, do("GET", carpoolURL, nil).Code)
+
+	// Only the driver, or a leader, can accept riders
+	acceptURL := func(riderId int64, token string) string {
+		return fmt.Sprintf("/api/hike/%s/participant/%d/carpool/rider/%d?participantToken=%s", hike.JoinCode, driver.ParticipantId, riderId, token)
+	}
+	assert.Equal(t, http.StatusForbidden, do("PUT", acceptURL(rider.ParticipantId, rider.ParticipantToken), nil).Code)
+	carpool = decode(do("PUT", acceptURL(rider.ParticipantId, driver.ParticipantToken), nil))
+	require.Len(t, carpool.Cars[0].Riders, 1)
+	assert.Equal(t, 2, carpool.Cars[0].SeatsTaken)
+	assert.Len(t, carpool.WaitingRiders, 1)
+	assert.Equal(t, 2, carpool.VehicleCount)
+
+	rr = do("PUT", acceptURL(other.ParticipantId, driver.ParticipantToken), nil)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), errCarpoolFull.Error())
+	rr = do("PUT", fmt.Sprintf("/api/hike/%s/participant/%d/carpool/rider/%d?participantToken=%s", hike.JoinCode, other.ParticipantId, rider.ParticipantId, other.ParticipantToken), nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "Riders can't accept riders")
+
+	// Offering more seats makes room, and the accepted rider keeps their place
+	signupURL := fmt.Sprintf("/api/hike/%s/participant/%d/carpool?participantToken=%s", hike.JoinCode, driver.ParticipantId, driver.ParticipantToken)
+	carpool = decode(do("PUT", signupURL, CarpoolSignup{Role: carpoolDriver, Seats: 3, MeetingPoint: "Kaimuki Safeway"}))
+	assert.Len(t, carpool.Cars[0].Riders, 1)
+	carpool = decode(do("PUT", acceptURL(other.ParticipantId, driver.ParticipantToken), nil))
+	assert.Equal(t, 3, carpool.Cars[0].SeatsTaken)
+	assert.Equal(t, 1, carpool.VehicleCount)
+
+	// But not fewer seats than the riders already take
+	rr = do("PUT", signupURL, CarpoolSignup{Role: carpoolDriver, Seats: 2, MeetingPoint: "Kaimuki Safeway"})
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), errCarpoolOverfull.Error())
+	carpool, err := hikeCarpool(hike.JoinCode)
+	require.NoError(t, err)
+	assert.Equal(t, 3, carpool.Cars[0].Seats)
+	rr = do("POST", fmt.Sprintf("/api/hike/%s/participant?participantToken=%s", hike.JoinCode, driver.ParticipantToken),
+		User{UUID: "user-carpool-driver", Name: "Keoni Renamed", Phone: "8085550032", Carpool: &CarpoolSignup{Role: carpoolDriver, Seats: 1}})
+	assert.Equal(t, http.StatusConflict, rr.Code, "The same goes for RSVPing again")
+	carpool, err = hikeCarpool(hike.JoinCode)
+	require.NoError(t, err)
+	assert.Equal(t, 3, carpool.Cars[0].Seats)
+	assert.Equal(t, "Keoni Driver", carpool.Cars[0].DriverName, "Nothing from the refused RSVP is saved")
+
+	// When the driver drops out their riders go back to waiting
+	rr = do("DELETE", fmt.Sprintf("/api/hike/%s/participant/%d?participantToken=%s", hike.JoinCode, driver.ParticipantId, driver.ParticipantToken), nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	carpool, err = hikeCarpool(hike.JoinCode)
+	require.NoError(t, err)
+	assert.Empty(t, carpool.Cars)
+	assert.Len(t, carpool.WaitingRiders, 2)
+	assert.Equal(t, 2, carpool.VehicleCount)
+
+	carpool = decode(do("DELETE", fmt.Sprintf("/api/hike/%s/participant/%d/carpool?participantToken=%s", hike.JoinCode, other.ParticipantId, other.ParticipantToken), nil))
+	assert.Len(t, carpool.WaitingRiders, 1)
+}
+
+func TestHikeCalendar(t *testing.T) {
+	mux := setupTestMux()
+	leader := User{UUID: "leader-calendar", Name: "Calendar Leader", Phone: "8085550040"}
+	start := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	hike := createTestHikeWithOptionsAndStartTime(t, leader, "Calendar Hike, Part 1", "Koko Head", start)
+	joinTestHikeWithOptions(t, hike, User{UUID: "user-calendar", Name: "Calendar Hiker", Phone: "8085550041"})
+
+	get := func(url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	rr := get("/api/hike/" + hike.JoinCode + ".ics")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "text/calendar; charset=utf-8", rr.Header().Get("Content-Type"))
+	ics := rr.Body.String()
+	assert.True(t, strings.HasPrefix(ics, "BEGIN:VCALENDAR\r\n"))
+	assert.Contains(t, ics, "UID:"+hike.JoinCode+"@hiketracker\r\n")
+	assert.Contains(t, ics, "SUMMARY:Calendar Hike\\, Part 1\r\n")
+	assert.Contains(t, ics, "LOCATION:Koko Head\r\n")
+	assert.Contains(t, ics, "DTSTART:"+formatCalendarTime(start)+"\r\n")
+	assert.Contains(t, ics, "DTEND:"+formatCalendarTime(start.Add(defaultCalendarDuration))+"\r\n")
+	assert.Contains(t, ics, "SEQUENCE:0\r\n")
+	assert.Contains(t, ics, "STATUS:CONFIRMED\r\n")
+	assert.Equal(t, http.StatusNotFound, get("/api/hike/nosuchhike.ics").Code)
+
+	update := func(edit Hike) {
+		body, _ := json.Marshal(edit)
+		req, _ := http.NewRequest("PUT", "/api/hike/"+hike.LeaderCode, bytes.NewBuffer(body))
+		req.Header.Set("If-Match", "*")
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	// The feed follows the hike when its time changes
+	later := start.Add(time.Hour)
+	edit := Hike{Name: hike.Name, Leader: leader, TrailheadName: hike.TrailheadName, StartTime: later, DurationMinutes: 90,
+		DescriptionMarkdown: strings.Repeat("Bring plenty of water. ", 10)}
+	update(edit)
+	for _, uuid := range []string{"user-calendar", "leader-calendar"} {
+		rr = get("/api/user/" + uuid + "/calendar.ics")
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		ics = rr.Body.String()
+		assert.Contains(t, ics, "DTSTART:"+formatCalendarTime(later)+"\r\n", uuid)
+		assert.Contains(t, ics, "DTEND:"+formatCalendarTime(later.Add(90*time.Minute))+"\r\n", uuid)
+		assert.Contains(t, ics, "SEQUENCE:1\r\n", uuid)
+	}
+	for _, line := range strings.Split(ics, "\r\n") {
+		assert.LessOrEqual(t, len(line), 75, "Long lines are folded")
+	}
+	assert.Equal(t, http.StatusNotFound, get("/api/user/nobody/calendar.ics").Code)
+
+	// Closing a hike before it starts calls it off
+	edit.Status = "closed"
+	update(edit)
+	ics = get("/api/user/user-calendar/calendar.ics").Body.String()
+	assert.Contains(t, ics, "STATUS:CANCELLED\r\n")
+	assert.Contains(t, ics, "SEQUENCE:2\r\n")
+}
+
+func TestPublicHikeDirectory(t *testing.T) {
+	mux := setupTestMux()
+	leader := User{UUID: "leader-directory", Name: "Directory Leader", Phone: "8085550050"}
+	create := func(name, organization, trailhead, difficulty string, public bool, start time.Time) {
+		hike := Hike{Name: name, Organization: organization, Leader: leader, TrailheadName: trailhead, StartTime: start,
+			Public: public, Difficulty: difficulty, DescriptionMarkdown: "Bring **water**"}
+		body, _ := json.Marshal(hike)
+		req, _ := http.NewRequest("POST", "/api/hike", bytes.NewBuffer(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	}
+	get := func(url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	list := func(url string) []string {
+		rr := get(url)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var hikes []Hike
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &hikes))
+		names := []string{}
+		for _, h := range hikes {
+			names = append(names, h.Name)
+		}
+		return names
+	}
+
+	now := time.Now()
+	create("Directory Ridge", "Trail Club & Friends", "Koko Head", difficultyStrenuous, true, now.AddDate(0, 0, 3))
+	create("Directory Falls", "Trail Club & Friends", "Manoa Falls", difficultyEasy, true, now.AddDate(0, 0, 1))
+	create("Directory Private", "Trail Club & Friends", "Manoa Falls", difficultyEasy, false, now.AddDate(0, 0, 2))
+	create("Directory Past", "Trail Club & Friends", "Manoa Falls", difficultyEasy, true, now.AddDate(0, 0, -1))
+	create("Directory Elsewhere", "Another Club", "Manoa Falls", difficultyEasy, true, now.AddDate(0, 0, 2))
+
+	assert.Equal(t, "trail-club-friends", organizationSlug("Trail Club & Friends"))
+	assert.Equal(t, []string{"Directory Falls", "Directory Ridge"}, list("/api/org/trail-club-friends/hikes"))
+	assert.Equal(t, []string{"Directory Ridge"}, list("/api/org/trail-club-friends/hikes?difficulty=moderate,strenuous"))
+	assert.Equal(t, []string{"Directory Falls"}, list("/api/org/trail-club-friends/hikes?trailhead=manoa"))
+	assert.Equal(t, []string{"Directory Falls"}, list("/api/org/trail-club-friends/hikes?to="+now.AddDate(0, 0, 2).Format("2006-01-02")))
+	assert.Equal(t, []string{"Directory Ridge"}, list("/api/org/trail-club-friends/hikes?from="+now.AddDate(0, 0, 2).Format("2006-01-02")))
+	assert.Empty(t, list("/api/org/no-such-club/hikes"))
+	assert.Equal(t, http.StatusBadRequest, get("/api/org/trail-club-friends/hikes?difficulty=extreme").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/api/org/trail-club-friends/hikes?from=tomorrow").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/api/org/trail-club-friends/hikes?format=pdf").Code)
+
+	rr := get("/api/org/trail-club-friends/hikes?format=html")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "text/html; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Contains(t, rr.Body.String(), "Upcoming Trail Club &amp; Friends Hikes")
+	assert.Contains(t, rr.Body.String(), "<strong>water</strong>")
+	assert.NotContains(t, rr.Body.String(), "Directory Private")
+
+	rr = get("/api/org/trail-club-friends/hikes?format=rss")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var feed rssFeed
+	require.NoError(t, xml.Unmarshal(rr.Body.Bytes(), &feed))
+	assert.Equal(t, "Trail Club & Friends Hikes", feed.Channel.Title)
+	require.Len(t, feed.Channel.Items, 2)
+	assert.Contains(t, feed.Channel.Items[0].Title, "Directory Falls")
+	assert.True(t, strings.HasSuffix(feed.Channel.Items[0].Link, "/?code="+feed.Channel.Items[0].GUID.Value))
+
+	bad := Hike{Name: "Directory Bad", Leader: leader, TrailheadName: "Koko Head", StartTime: now, Difficulty: "extreme"}
+	body, _ := json.Marshal(bad)
+	req, _ := http.NewRequest("POST", "/api/hike", bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestOrganizations(t *testing.T) {
+	mux := setupTestMux()
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "test-admin-token"
+
+	call := func(method, url string, body interface{}) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != nil {
+			b, _ := json.Marshal(body)
+			reader = bytes.NewBuffer(b)
+		}
+		req, _ := http.NewRequest(method, url, reader)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// A hike created before the organization is registered, under a different spelling
+	leader := User{UUID: "leader-org", Name: "Org Leader", Phone: "8085550060"}
+	early := createTestHikeWithOptionsAndStartTime(t, leader, "Org Early Hike", "Koko Head", time.Now().Add(24*time.Hour))
+	_, err := db.Exec("UPDATE hikes SET organization = ? WHERE join_code = ?", "mauka  hikers", early.JoinCode)
+	require.NoError(t, err)
+
+	request := Organization{Name: "Mauka Hikers", DefaultPhotoRelease: true, LogoURL: "https://example.com/logo.png",
+		DefaultWaiver: "Mauka Hikers waiver for {{.LeaderName}}",
+		Admins:        []OrganizationAdmin{{User: User{UUID: "org-admin-1", Name: "First Admin"}}}}
+	assert.Equal(t, http.StatusUnauthorized, call("POST", "/api/org", request).Code)
+	rr := call("POST", "/api/org?adminToken=test-admin-token", request)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var org Organization
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &org))
+	assert.Equal(t, "mauka-hikers", org.Slug)
+	require.Len(t, org.Admins, 1)
+	adminCode := org.Admins[0].AdminCode
+	require.NotEmpty(t, adminCode)
+	assert.Equal(t, http.StatusConflict, call("POST", "/api/org?adminToken=test-admin-token", Organization{Name: "mauka hikers"}).Code)
+
+	rr = call("GET", "/api/org/mauka-hikers", nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var public Organization
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &public))
+	assert.Empty(t, public.Admins)
+	assert.True(t, public.DefaultPhotoRelease)
+	assert.Equal(t, "https://example.com/logo.png", public.LogoURL)
+	assert.Equal(t, "Mauka Hikers waiver for {{.LeaderName}}", public.DefaultWaiver)
+
+	// Hikes use the registered spelling, and its waiver
+	hike := Hike{Name: "Org Typo Hike", Organization: "MAUKA HIKERS", Leader: leader, TrailheadName: "Koko Head", StartTime: time.Now().Add(48 * time.Hour)}
+	rr = call("POST", "/api/hike", hike)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &hike))
+	assert.Equal(t, "Mauka Hikers", hike.Organization)
+	assert.Equal(t, "Mauka Hikers waiver for Org Leader", hike.WaiverText)
+
+	// Admins see every hike, including the one adopted from the old spelling
+	assert.Equal(t, http.StatusUnauthorized, call("GET", "/api/org/mauka-hikers/hike", nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, call("GET", "/api/org/mauka-hikers/hike?adminCode=wrong", nil).Code)
+	rr = call("GET", "/api/org/mauka-hikers/hike?adminCode="+adminCode, nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var hikes []Hike
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &hikes))
+	require.Len(t, hikes, 2)
+	assert.Equal(t, "Org Typo Hike", hikes[0].Name)
+	assert.Equal(t, "Org Early Hike", hikes[1].Name)
+	assert.Equal(t, "Mauka Hikers", hikes[1].Organization)
+
+	// An admin code only works for its own organization
+	rr = call("POST", "/api/org?adminToken=test-admin-token", Organization{Name: "Makai Walkers", Admins: []OrganizationAdmin{{User: User{UUID: "org-admin-2"}}}})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var other Organization
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &other))
+	assert.Equal(t, http.StatusForbidden, call("GET", "/api/org/mauka-hikers/hike?adminCode="+other.Admins[0].AdminCode, nil).Code)
+	assert.Equal(t, http.StatusNotFound, call("POST", "/api/org/makai-walkers/hike/"+hike.JoinCode+"/close?adminCode="+other.Admins[0].AdminCode, nil).Code)
+
+	// Reassigning a hike hands out a new leader code and retires the old one
+	newLeader := User{UUID: "leader-org-new", Name: "New Org Leader", Phone: "8085550061"}
+	rr = call("PUT", "/api/org/mauka-hikers/hike/"+early.JoinCode+"/leader?adminCode="+adminCode, newLeader)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var reassigned Hike
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &reassigned))
+	assert.Equal(t, newLeader.UUID, reassigned.Leader.UUID)
+	assert.NotEqual(t, early.LeaderCode, reassigned.LeaderCode)
+	_, err = resolveHikeAccess(early.LeaderCode)
+	assert.Equal(t, sql.ErrNoRows, err)
+	access, err := resolveHikeAccess(reassigned.LeaderCode)
+	require.NoError(t, err)
+	assert.Equal(t, early.JoinCode, access.joinCode)
+
+	// Closing an abandoned hike finishes its participants
+	participant := joinTestHikeWithOptions(t, early, User{UUID: "user-org", Name: "Org Hiker", Phone: "8085550062"})
+	rr = call("POST", "/api/org/mauka-hikers/hike/"+early.JoinCode+"/close?adminCode="+adminCode, nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var status string
+	require.NoError(t, db.QueryRow("SELECT status FROM hike_users WHERE id = ?", participant.Hike.ParticipantId).Scan(&status))
+	assert.Equal(t, "finished", status)
+	assert.Equal(t, http.StatusConflict, call("POST", "/api/org/mauka-hikers/hike/"+early.JoinCode+"/close?adminCode="+adminCode, nil).Code)
+
+	// Admins can add and revoke other admins
+	rr = call("POST", "/api/org/mauka-hikers/admin?adminCode="+adminCode, User{UUID: "org-admin-3", Name: "Third Admin"})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var added OrganizationAdmin
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &added))
+	rr = call("GET", "/api/org/mauka-hikers/admin?adminCode="+added.AdminCode, nil)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var admins []OrganizationAdmin
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &admins))
+	assert.Len(t, admins, 2)
+	assert.Equal(t, http.StatusOK, call("DELETE", fmt.Sprintf("/api/org/mauka-hikers/admin/%d?adminCode=%s", added.Id, adminCode), nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, call("GET", "/api/org/mauka-hikers/admin?adminCode="+added.AdminCode, nil).Code)
+
+	// Renaming the organization renames its hikes and keeps its waiver
+	update := Organization{Name: "Mauka Hiking Club", DefaultPhotoRelease: false}
+	rr = call("PUT", "/api/org/mauka-hikers?adminCode="+adminCode, update)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var renamed Organization
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &renamed))
+	assert.Equal(t, "mauka-hikers", renamed.Slug)
+	assert.Equal(t, "Mauka Hikers waiver for {{.LeaderName}}", renamed.DefaultWaiver)
+	var organization string
+	require.NoError(t, db.QueryRow("SELECT organization FROM hikes WHERE join_code = ?", hike.JoinCode).Scan(&organization))
+	assert.Equal(t, "Mauka Hiking Club", organization)
+	assert.Equal(t, http.StatusConflict, call("PUT", "/api/org/mauka-hikers?adminCode="+adminCode, Organization{Name: "Makai Walkers"}).Code)
+	assert.Equal(t, http.StatusBadRequest, call("PUT", "/api/org/mauka-hikers?adminCode="+adminCode, Organization{Name: "Mauka", LogoURL: "javascript:alert(1)"}).Code)
+}
+
+func TestTrailInfo(t *testing.T) {
+	mux := setupTestMux()
+	_, err := db.Exec(`
+		UPDATE trailheads SET distance_miles = 4.5, elevation_gain_feet = 1200, duration_minutes = 180, difficulty = 'strenuous', hazards = 'exposure,mud'
+		WHERE name = 'Olomana'
+	`)
+	require.NoError(t, err)
+
+	leader := User{UUID: "leader-trail-info", Name: "Trail Info Leader", Phone: "8085550070"}
+	create := func(hike Hike) *httptest.ResponseRecorder {
+		hike.Leader = leader
+		hike.Organization = "Trail Info Club"
+		hike.Public = true
+		hike.StartTime = time.Now().Add(24 * time.Hour)
+		body, _ := json.Marshal(hike)
+		req, _ := http.NewRequest("POST", "/api/hike", bytes.NewBuffer(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// A hike takes what it leaves out from the trailhead
+	rr := create(Hike{Name: "Trail Info Defaults", TrailheadName: "Olomana"})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var hike Hike
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &hike))
+	assert.Equal(t, 4.5, hike.DistanceMiles)
+	assert.Equal(t, 1200, hike.ElevationGainFeet)
+	assert.Equal(t, 180, hike.DurationMinutes)
+	assert.Equal(t, difficultyStrenuous, hike.Difficulty)
+	assert.Equal(t, Hazards{hazardExposure, hazardMud}, hike.Hazards)
+
+	rr = create(Hike{Name: "Trail Info Override", TrailheadName: "Olomana", DistanceMiles: 2, Difficulty: difficultyModerate, Hazards: Hazards{hazardStreamCrossing}})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &hike))
+	assert.Equal(t, 2.0, hike.DistanceMiles)
+	assert.Equal(t, 1200, hike.ElevationGainFeet)
+	assert.Equal(t, difficultyModerate, hike.Difficulty)
+	assert.Equal(t, Hazards{hazardStreamCrossing}, hike.Hazards)
+
+	req, _ := http.NewRequest("GET", "/api/hike/"+hike.JoinCode, nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var fetched Hike
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &fetched))
+	assert.Equal(t, hike.Hazards, fetched.Hazards)
+	assert.Equal(t, 2.0, fetched.DistanceMiles)
+
+	assert.Equal(t, http.StatusBadRequest, create(Hike{Name: "Trail Info Bad", TrailheadName: "Olomana", Hazards: Hazards{"sharks"}}).Code)
+	assert.Equal(t, http.StatusBadRequest, create(Hike{Name: "Trail Info Bad", TrailheadName: "Olomana", DistanceMiles: -1}).Code)
+
+	// Trailhead suggestions carry the defaults
+	req, _ = http.NewRequest("GET", "/api/trailhead?q=Olomana", nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	var suggestions []Trailhead
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &suggestions))
+	require.NotEmpty(t, suggestions)
+	assert.Equal(t, 4.5, suggestions[0].DistanceMiles)
+	assert.Equal(t, Hazards{hazardExposure, hazardMud}, suggestions[0].Hazards)
+
+	// Participants can filter the directory by what they can handle
+	list := func(query string) []string {
+		req, _ := http.NewRequest("GET", "/api/org/trail-info-club/hikes?"+query, nil)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var hikes []Hike
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &hikes))
+		names := []string{}
+		for _, h := range hikes {
+			names = append(names, h.Name)
+		}
+		return names
+	}
+	assert.Len(t, list(""), 2)
+	assert.Equal(t, []string{"Trail Info Override"}, list("maxDistance=3"))
+	assert.Equal(t, []string{"Trail Info Override"}, list("avoid=mud"))
+	assert.Equal(t, []string{"Trail Info Defaults"}, list("avoid=stream-crossing"))
+	assert.Empty(t, list("maxElevationGain=1000"))
+	assert.Len(t, list("maxDuration=180"), 2)
+
+	// A series moved to the trailhead takes its defaults too, and its occurrences show them
+	body, _ := json.Marshal(HikeSeries{Recurrence: "FREQ=WEEKLY", Template: Hike{Name: "Trail Info Series", Leader: leader, TrailheadName: "Trail Info Nowhere", StartTime: time.Now().Add(24 * time.Hour)}})
+	req, _ = http.NewRequest("POST", "/api/series", bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var series HikeSeries
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &series))
+	assert.Zero(t, series.Template.DistanceMiles)
+
+	body, _ = json.Marshal(HikeSeries{Template: Hike{Name: "Trail Info Series", Leader: leader, TrailheadName: "Olomana", ElevationGainFeet: 900}})
+	req, _ = http.NewRequest("PUT", "/api/series/"+series.LeaderCode, bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &series))
+	assert.Equal(t, 4.5, series.Template.DistanceMiles)
+	assert.Equal(t, 900, series.Template.ElevationGainFeet)
+	require.NotEmpty(t, series.Occurrences)
+	for _, o := range series.Occurrences {
+		assert.Equal(t, 4.5, o.DistanceMiles)
+		assert.Equal(t, 900, o.ElevationGainFeet)
+		assert.Equal(t, difficultyStrenuous, o.Difficulty)
+		assert.Equal(t, Hazards{hazardExposure, hazardMud}, o.Hazards)
+	}
+}
+
+func TestHikeRoute(t *testing.T) {
+	mux := setupTestMux()
+	hike := createTestHike(t)
+	put := func(leaderCode, format, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PUT", "/api/hike/"+hike.JoinCode+"/route?format="+format+"&leaderCode="+leaderCode, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/api/hike/"+hike.JoinCode+path, nil)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get("/route.gpx")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// Each 0.01 degree of latitude is about 0.69 miles. The 5 m dip is GPS noise, so the gain is 10 + 95 m.
+	gpx := `<?xml version="1.0"?>
+<gpx version="1.1" creator="test" xmlns="http://www.topografix.com/GPX/1/1">
+  <trk><name>Ridge Loop</name><trkseg>
+    <trkpt lat="21.00" lon="-157.80"><ele>100</ele></trkpt>
+    <trkpt lat="21.01" lon="-157.80"><ele>110</ele></trkpt>
+    <trkpt lat="21.02" lon="-157.80"><ele>105</ele></trkpt>
+    <trkpt lat="21.03" lon="-157.80"><ele>200</ele></trkpt>
+  </trkseg></trk>
+</gpx>`
+	assert.Equal(t, http.StatusNotFound, put("wrong-code", "", gpx).Code)
+	rr = put(hike.LeaderCode, "", gpx)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	// The hike takes the route's distance and elevation gain
+	rr = get("")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var fetched Hike
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &fetched))
+	assert.True(t, fetched.HasRoute)
+	assert.InDelta(t, 2.07, fetched.DistanceMiles, 0.01)
+	assert.Equal(t, 344, fetched.ElevationGainFeet)
+
+	rr = get("/route.geojson")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var feature struct {
+		Geometry struct {
+			Type        string      `json:"type"`
+			Coordinates [][]float64 `json:"coordinates"`
+		} `json:"geometry"`
+		Properties map[string]interface{} `json:"properties"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &feature))
+	assert.Equal(t, "LineString", feature.Geometry.Type)
+	require.Len(t, feature.Geometry.Coordinates, 4)
+	assert.Equal(t, []float64{-157.80, 21.03, 200}, feature.Geometry.Coordinates[3])
+	assert.Equal(t, "Ridge Loop", feature.Properties["name"])
+
+	rr = get("/route.gpx")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Contains(t, rr.Header().Get("Content-Disposition"), hike.JoinCode+".gpx")
+	route, err := parseGPX(rr.Body.Bytes())
+	require.NoError(t, err)
+	require.Len(t, route.Lines, 1)
+	assert.Len(t, route.Lines[0], 4)
+
+	// KML and GeoJSON routes replace the GPX one
+	kml := `<?xml version="1.0"?>
+<kml xmlns="http://www.opengis.net/kml/2.2"><Document><name>Valley Walk</name><Placemark>
+  <LineString><coordinates>-157.80,21.00,10 -157.80,21.01,20</coordinates></LineString>
+</Placemark></Document></kml>`
+	rr = put(hike.LeaderCode, "kml", kml)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &feature))
+	assert.Equal(t, "Valley Walk", feature.Properties["name"])
+	assert.InDelta(t, 0.69, feature.Properties["distanceMiles"], 0.01)
+	assert.EqualValues(t, 33, feature.Properties["elevationGainFeet"])
+
+	geojson := `{"type": "FeatureCollection", "features": [{"type": "Feature", "properties": {"name": "Two Parts"},
+		"geometry": {"type": "MultiLineString", "coordinates": [[[-157.80, 21.00], [-157.80, 21.01]], [[-157.79, 21.00], [-157.79, 21.01]]]}}]}`
+	rr = put(hike.LeaderCode, "", geojson)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var multi struct {
+		Geometry struct {
+			Type        string        `json:"type"`
+			Coordinates [][][]float64 `json:"coordinates"`
+		} `json:"geometry"`
+		Properties map[string]interface{} `json:"properties"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &multi))
+	assert.Equal(t, "MultiLineString", multi.Geometry.Type)
+	assert.Len(t, multi.Geometry.Coordinates, 2)
+	assert.InDelta(t, 1.38, multi.Properties["distanceMiles"], 0.01)
+
+	// A bare geometry is a route too
+	rr = put(hike.LeaderCode, "geojson", `{"type": "LineString", "coordinates": [[-157.80, 21.00], [-157.80, 21.01]]}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &feature))
+	assert.InDelta(t, 0.69, feature.Properties["distanceMiles"], 0.01)
+	rr = put(hike.LeaderCode, "geojson", `{"type": "MultiLineString", "coordinates": [[[-157.80, 21.00], [-157.80, 21.01]], [[-157.79, 21.00], [-157.79, 21.01]]]}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &multi))
+	assert.Len(t, multi.Geometry.Coordinates, 2)
+
+	assert.Equal(t, http.StatusBadRequest, put(hike.LeaderCode, "", "not a route").Code)
+	assert.Equal(t, http.StatusBadRequest, put(hike.LeaderCode, "gpx", `<gpx><trk><trkseg><trkpt lat="21" lon="-157"/></trkseg></trk></gpx>`).Code)
+	assert.Equal(t, http.StatusBadRequest, put(hike.LeaderCode, "geojson", `{"type": "LineString", "coordinates": [[0, 95], [0, 96]]}`).Code)
+
+	req, _ := http.NewRequest("DELETE", "/api/hike/"+hike.JoinCode+"/route?leaderCode="+hike.LeaderCode, nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, http.StatusNotFound, get("/route.geojson").Code)
+}
+
+func TestNearbyTrailheads(t *testing.T) {
+	mux := setupTestMux()
+	near := func(query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/api/trailhead/near?"+query, nil)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Bowman is about 150 m away and Kamana'iki about 1.8 km
+	rr := near("lat=21.3500&lng=-157.8754&radiusKm=3")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var nearby []NearbyTrailhead
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &nearby))
+	require.GreaterOrEqual(t, len(nearby), 2)
+	assert.Equal(t, "Bowman (Radar Hill)", nearby[0].Name)
+	assert.InDelta(t, 0.15, nearby[0].DistanceKm, 0.05)
+	assert.Equal(t, "Kamana'iki", nearby[1].Name)
+	for i, th := range nearby {
+		assert.LessOrEqual(t, th.DistanceKm, 3.0)
+		if i > 0 {
+			assert.GreaterOrEqual(t, th.DistanceKm, nearby[i-1].DistanceKm)
+		}
+	}
+
+	rr = near("lat=21.3500&lng=-157.8754&radiusKm=3&limit=1")
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &nearby))
+	assert.Len(t, nearby, 1)
+
+	// Nothing in the middle of the ocean
+	rr = near("lat=0&lng=0")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "[]\n", rr.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, near("lat=21.35").Code)
+	assert.Equal(t, http.StatusBadRequest, near("lat=95&lng=-157.8").Code)
+	assert.Equal(t, http.StatusBadRequest, near("lat=21.35&lng=-157.8&radiusKm=-1").Code)
+
+	// Trailheads behind short links have no coordinates
+	var lat sql.NullFloat64
+	require.NoError(t, db.QueryRow("SELECT latitude FROM trailheads WHERE name = 'Aiea Loop (upper)'").Scan(&lat))
+	assert.False(t, lat.Valid)
+
+	// Databases from before coordinates get them from their map links
+	conn := openTestDB(t)
+	_, err := conn.Exec(legacySchemaSnapshot)
+	require.NoError(t, err)
+	_, err = conn.Exec(`INSERT INTO trailheads (name, map_link) VALUES
+		('Tom Tom', 'https://www.google.com/maps/search/?api=1&query=21.32499,-157.69683'),
+		('Olomana', 'https://maps.app.goo.gl/F2PyeuVriufDqNkVA')`)
+	require.NoError(t, err)
+	require.NoError(t, migrateDB(conn))
+	var lng sql.NullFloat64
+	require.NoError(t, conn.QueryRow("SELECT latitude, longitude FROM trailheads WHERE name = 'Tom Tom'").Scan(&lat, &lng))
+	assert.Equal(t, 21.32499, lat.Float64)
+	assert.Equal(t, -157.69683, lng.Float64)
+	require.NoError(t, conn.QueryRow("SELECT latitude FROM trailheads WHERE name = 'Olomana'").Scan(&lat))
+	assert.False(t, lat.Valid)
+}
+
+func TestTrailheadCatalog(t *testing.T) {
+	mux := setupTestMux()
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "test-admin-token"
+	do := func(method, path, query string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path+"?adminToken=test-admin-token&"+query, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	get := func(name string) Trailhead {
+		rr := do("GET", "/api/trailhead/"+url.PathEscape(name), "", "")
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var th Trailhead
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &th))
+		return th
+	}
+	suggest := func(q string) []string {
+		rr := do("GET", "/api/trailhead", "q="+url.QueryEscape(q), "")
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var suggestions []Trailhead
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &suggestions))
+		names := []string{}
+		for _, th := range suggestions {
+			names = append(names, th.Name)
+		}
+		return names
+	}
+
+	req, _ := http.NewRequest("POST", "/api/trailhead?adminToken=wrong", strings.NewReader(`{"name": "Catalog Ridge"}`))
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// Coordinates come from the map link
+	rr = do("POST", "/api/trailhead", "", `{"name": " Catalog Ridge ", "mapLink": "https://www.google.com/maps/search/?api=1&query=21.41,-157.91"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	th := get("Catalog Ridge")
+	require.NotNil(t, th.Latitude)
+	assert.Equal(t, 21.41, *th.Latitude)
+	assert.Equal(t, http.StatusConflict, do("POST", "/api/trailhead", "", `{"name": "Catalog Ridge"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/api/trailhead", "", `{"name": "Catalog Bad", "hazards": ["sharks"]}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/api/trailhead", "", `{"name": "Catalog Bad", "latitude": 21.4}`).Code)
+
+	// Renaming keeps the old name as an alias
+	rr = do("PUT", "/api/trailhead/"+url.PathEscape("Catalog Ridge"), "", `{"name": "Catalog Ridge Trail", "mapLink": "https://www.google.com/maps/search/?api=1&query=21.41,-157.91", "distanceMiles": 3}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	th = get("Catalog Ridge")
+	assert.Equal(t, "Catalog Ridge Trail", th.Name)
+	assert.Equal(t, []string{"Catalog Ridge"}, th.Aliases)
+	assert.Equal(t, 3.0, th.DistanceMiles)
+	assert.Equal(t, []string{"Catalog Ridge Trail"}, suggest("Catalog Ridge"))
+	assert.Equal(t, http.StatusConflict, do("POST", "/api/trailhead", "", `{"name": "Catalog Ridge"}`).Code)
+
+	// Merging a duplicate fills in what the trailhead was missing and keeps the duplicate's name
+	rr = do("POST", "/api/trailhead", "", `{"name": "Catalog Ridge (old)", "difficulty": "strenuous", "distanceMiles": 9}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/api/trailhead/"+url.PathEscape("Catalog Ridge (old)")+"/merge", "into=Nowhere", "").Code)
+	rr = do("POST", "/api/trailhead/"+url.PathEscape("Catalog Ridge (old)")+"/merge", "into="+url.QueryEscape("Catalog Ridge"), "")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	th = get("Catalog Ridge (old)")
+	assert.Equal(t, "Catalog Ridge Trail", th.Name)
+	assert.Equal(t, difficultyStrenuous, th.Difficulty)
+	assert.Equal(t, 3.0, th.DistanceMiles)
+	assert.ElementsMatch(t, []string{"Catalog Ridge", "Catalog Ridge (old)"}, th.Aliases)
+
+	// A new hike under an old name takes the trailhead's defaults
+	hike := Hike{Name: "Catalog Hike", TrailheadName: "Catalog Ridge", Leader: User{UUID: "catalog-leader", Name: "Catalog Leader", Phone: "8085550071"}, StartTime: time.Now().Add(time.Hour)}
+	body, _ := json.Marshal(hike)
+	req, _ = http.NewRequest("POST", "/api/hike", bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &hike))
+	assert.Equal(t, 3.0, hike.DistanceMiles)
+
+	// Retired trailheads are no longer suggested
+	assert.Equal(t, http.StatusOK, do("DELETE", "/api/trailhead/"+url.PathEscape("Catalog Ridge Trail"), "", "").Code)
+	assert.True(t, get("Catalog Ridge Trail").Retired)
+	assert.Empty(t, suggest("Catalog Ridge"))
+	rr = do("GET", "/api/trailhead/near", "lat=21.41&lng=-157.91&radiusKm=1", "")
+	assert.NotContains(t, rr.Body.String(), "Catalog Ridge")
+
+	// Export, edit and import the catalog
+	rr = do("GET", "/api/trailhead/export", "format=csv", "")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, trailheadCSVHeader, records[0])
+	assert.Contains(t, records, []string{"Catalog Ridge Trail", "https://www.google.com/maps/search/?api=1&query=21.41,-157.91", "21.41", "-157.91", "3", "0", "0", "strenuous", "", "true"})
+
+	// Rows under an old name update the trailhead, keeping the columns left out
+	rr = do("POST", "/api/trailhead/import", "format=csv", "name,distanceMiles,hazards,retired\n\"Catalog Ridge (old)\",4.5,\"mud,exposure\",false\nCatalog Falls,1.2,,\n")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.JSONEq(t, `{"created": 1, "updated": 1}`, rr.Body.String())
+	th = get("Catalog Ridge Trail")
+	assert.Equal(t, 4.5, th.DistanceMiles)
+	assert.Equal(t, Hazards{hazardMud, hazardExposure}, th.Hazards)
+	assert.False(t, th.Retired)
+	assert.Equal(t, difficultyStrenuous, th.Difficulty)
+	require.NotNil(t, th.Latitude)
+	assert.Equal(t, 21.41, *th.Latitude)
+	assert.Equal(t, 1.2, get("Catalog Falls").DistanceMiles)
+
+	// Nothing is imported if any row is invalid
+	rr = do("POST", "/api/trailhead/import", "format=csv", "name,distanceMiles\nCatalog Lake,2\nCatalog Peak,far\n")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "line 3")
+	rr = do("POST", "/api/trailhead/import", "format=csv", "name,hazards\nCatalog Lake,mud\nCatalog Peak,sharks\n")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "line 3")
+	rr = do("POST", "/api/trailhead/import", "format=csv", "name,latitude,longitude\nCatalog Lake,21.3,-157.8\nCatalog Peak,21.4,\n")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "latitude and longitude must be given together")
+	assert.Equal(t, http.StatusNotFound, do("GET", "/api/trailhead/"+url.PathEscape("Catalog Lake"), "", "").Code)
+
+	rr = do("GET", "/api/trailhead/export", "format=geojson", "")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	geojson := rr.Body.String()
+	var collection struct {
+		Features []trailheadFeature `json:"features"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(geojson), &collection))
+	var found bool
+	for _, f := range collection.Features {
+		if f.Properties.Name == "Catalog Ridge Trail" {
+			found = true
+			require.NotNil(t, f.Geometry)
+			assert.Equal(t, []float64{-157.91, 21.41}, f.Geometry.Coordinates)
+		}
+	}
+	assert.True(t, found)
+	rr = do("POST", "/api/trailhead/import", "format=geojson", geojson)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.JSONEq(t, fmt.Sprintf(`{"created": 0, "updated": %d}`, len(collection.Features)), rr.Body.String())
+	assert.Equal(t, 4.5, get("Catalog Ridge Trail").DistanceMiles)
+}
+
+func TestTrailheadAdvisories(t *testing.T) {
+	mux := setupTestMux()
+	defer func(token string, block bool) { adminToken, blockClosedTrailheads = token, block }(adminToken, blockClosedTrailheads)
+	adminToken = "test-admin-token"
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path+"?adminToken=test-admin-token", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	advisories := func(name string) []TrailheadAdvisory {
+		rr := do("GET", "/api/trailhead/"+url.PathEscape(name)+"/advisory", "")
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var list []TrailheadAdvisory
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &list))
+		return list
+	}
+	createHike := func(startTime time.Time) *httptest.ResponseRecorder {
+		hike := Hike{Name: "Advisory Hike", TrailheadName: "Advisory Falls", StartTime: startTime,
+			Leader: User{UUID: "advisory-leader", Name: "Advisory Leader", Phone: "8085550072"}}
+		body, _ := json.Marshal(hike)
+		req, _ := http.NewRequest("POST", "/api/hike", bytes.NewBuffer(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	require.Equal(t, http.StatusOK, do("POST", "/api/trailhead", `{"name": "Advisory Falls"}`).Code)
+	assert.Empty(t, advisories("Advisory Falls"))
+
+	req, _ := http.NewRequest("POST", "/api/trailhead/Advisory%20Falls/advisory", strings.NewReader(`{"status": "closed", "message": "Landslide"}`))
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/api/trailhead/Advisory%20Falls/advisory", `{"status": "shut", "message": "Landslide"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/api/trailhead/Advisory%20Falls/advisory", `{"status": "closed"}`).Code)
+	assert.Equal(t, http.StatusNotFound, do("POST", "/api/trailhead/Nowhere/advisory", `{"status": "closed", "message": "Landslide"}`).Code)
+
+	// Closed for two days; mud until further notice
+	closesUntil := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	rr = do("POST", "/api/trailhead/Advisory%20Falls/advisory", `{"status": "caution", "message": "Very muddy"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	body, _ := json.Marshal(TrailheadAdvisory{Status: advisoryClosed, Message: "Landslide above the falls", Source: "DLNR", ExpiresAt: &closesUntil})
+	rr = do("POST", "/api/trailhead/Advisory%20Falls/advisory", string(body))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var closed TrailheadAdvisory
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &closed))
+	_, err := db.Exec(`INSERT INTO trailhead_advisories (trailhead_name, status, message, expires_at, created_at) VALUES ('Advisory Falls', 'closed', 'Old news', ?, ?)`,
+		time.Now().Add(-time.Hour).Format("2006-01-02T15:04:05-07:00"), time.Now().Add(-48*time.Hour).Format("2006-01-02T15:04:05-07:00"))
+	require.NoError(t, err)
+
+	list := advisories("Advisory Falls")
+	require.Len(t, list, 2)
+	assert.Equal(t, "Landslide above the falls", list[0].Message)
+	assert.Equal(t, "DLNR", list[0].Source)
+	require.NotNil(t, list[0].ExpiresAt)
+	assert.True(t, closesUntil.Equal(*list[0].ExpiresAt))
+	assert.Equal(t, advisoryCaution, list[1].Status)
+
+	// Leaders see them as they pick the trailhead
+	req, _ = http.NewRequest("GET", "/api/trailhead?q=Advisory+Falls", nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	var suggestions []Trailhead
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &suggestions))
+	require.Len(t, suggestions, 1)
+	assert.Len(t, suggestions[0].Advisories, 2)
+
+	// By default a hike at a closed trailhead is created with a warning
+	rr = createHike(time.Now().Add(time.Hour))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var hike Hike
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &hike))
+	require.Len(t, hike.Advisories, 2)
+	assert.Equal(t, advisoryClosed, hike.Advisories[0].Status)
+
+	req, _ = http.NewRequest("GET", "/api/hike/"+hike.JoinCode, nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	var fetched Hike
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &fetched))
+	assert.Len(t, fetched.Advisories, 2)
+
+	// It can be configured to refuse them, unless the closure ends before the hike starts
+	blockClosedTrailheads = true
+	rr = createHike(time.Now().Add(time.Hour))
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Landslide above the falls")
+	rr = createHike(time.Now().Add(72 * time.Hour))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &hike))
+	require.Len(t, hike.Advisories, 1)
+	assert.Equal(t, advisoryCaution, hike.Advisories[0].Status)
+
+	// Advisories follow the trailhead when it's renamed
+	require.Equal(t, http.StatusOK, do("PUT", "/api/trailhead/Advisory%20Falls", `{"name": "Advisory Falls Trail"}`).Code)
+	assert.Len(t, advisories("Advisory Falls Trail"), 2)
+
+	assert.Equal(t, http.StatusOK, do("DELETE", fmt.Sprintf("/api/trailhead/Advisory%%20Falls/advisory/%d", closed.Id), "").Code)
+	assert.Equal(t, http.StatusNotFound, do("DELETE", fmt.Sprintf("/api/trailhead/Advisory%%20Falls/advisory/%d", closed.Id), "").Code)
+	list = advisories("Advisory Falls")
+	require.Len(t, list, 1)
+	assert.Equal(t, advisoryCaution, list[0].Status)
+	require.Equal(t, http.StatusOK, createHike(time.Now().Add(time.Hour)).Code)
+
+	// The newest advisory is the trailhead's status, so an open one reopens it
+	rr = do("POST", "/api/trailhead/Advisory%20Falls%20Trail/advisory", `{"status": "closed", "message": "Rockslide"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, http.StatusConflict, createHike(time.Now().Add(time.Hour)).Code)
+	rr = do("POST", "/api/trailhead/Advisory%20Falls%20Trail/advisory", `{"status": "open", "message": "Reopened after repairs"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	rr = createHike(time.Now().Add(time.Hour))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &hike))
+	require.Len(t, hike.Advisories, 3)
+	assert.Equal(t, advisoryOpen, hike.Advisories[0].Status)
+}
+
+func TestClosedTrailheadChecks(t *testing.T) {
+	mux := setupTestMux()
+	defer func(token string, block bool) { adminToken, blockClosedTrailheads = token, block }(adminToken, blockClosedTrailheads)
+	adminToken, blockClosedTrailheads = "test-admin-token", true
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path+"?adminToken=test-admin-token", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	send := func(method, path string, v any) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(v)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(body))
+		req.Header.Set("If-Match", "*")
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	leader := User{UUID: "closure-leader", Name: "Closure Leader", Phone: "8085550073"}
+	start := time.Now().Add(24 * time.Hour).Truncate(time.Minute)
+
+	require.Equal(t, http.StatusOK, do("POST", "/api/trailhead", `{"name": "Closure Ridge"}`).Code)
+	require.Equal(t, http.StatusOK, do("POST", "/api/trailhead", `{"name": "Open Valley"}`).Code)
+	rr := do("POST", "/api/trailhead/Closure%20Ridge/advisory", `{"status": "closed", "message": "Rockfall"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	// Moving a hike to a closed trailhead is refused like creating one there
+	rr = send("POST", "/api/hike", Hike{Name: "Closure Hike", TrailheadName: "Open Valley", StartTime: start, Leader: leader})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var hike Hike
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &hike))
+	rr = send("PUT", "/api/hike/"+hike.LeaderCode, Hike{Name: hike.Name, TrailheadName: "Closure Ridge", StartTime: start, Leader: leader})
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Rockfall")
+	rr = send("PUT", "/api/hike/"+hike.LeaderCode, Hike{Name: "Renamed Closure Hike", TrailheadName: "Open Valley", StartTime: start, Leader: leader})
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	// So are series there, and moving a series there
+	rr = send("POST", "/api/series", HikeSeries{Recurrence: "FREQ=WEEKLY", Template: Hike{Name: "Closed Series", TrailheadName: "Closure Ridge", StartTime: start, Leader: leader}})
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Rockfall")
+	rr = send("POST", "/api/series", HikeSeries{Recurrence: "FREQ=WEEKLY", Template: Hike{Name: "Open Series", TrailheadName: "Open Valley", StartTime: start, Leader: leader}})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var series HikeSeries
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &series))
+	rr = send("PUT", "/api/series/"+series.LeaderCode, HikeSeries{Template: Hike{Name: "Open Series", TrailheadName: "Closure Ridge", StartTime: start, Leader: leader}})
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	// Moving a series checks each of its occurrences when it starts, not now
+	require.Equal(t, http.StatusOK, do("POST", "/api/trailhead", `{"name": "Brief Closure"}`).Code)
+	reopens := time.Now().Add(72 * time.Hour)
+	body, _ := json.Marshal(TrailheadAdvisory{Status: advisoryClosed, Message: "Tree down", ExpiresAt: &reopens})
+	require.Equal(t, http.StatusOK, do("POST", "/api/trailhead/Brief%20Closure/advisory", string(body)).Code)
+	rr = send("PUT", "/api/series/"+series.LeaderCode, HikeSeries{Template: Hike{Name: "Open Series", TrailheadName: "Brief Closure", StartTime: start, Leader: leader}})
+	assert.Equal(t, http.StatusConflict, rr.Code, "The first occurrence is tomorrow")
+	later := start.AddDate(0, 0, 7)
+	rr = send("POST", "/api/series", HikeSeries{Recurrence: "FREQ=WEEKLY", Template: Hike{Name: "Later Series", TrailheadName: "Open Valley", StartTime: later, Leader: leader}})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var laterSeries HikeSeries
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &laterSeries))
+	rr = send("PUT", "/api/series/"+laterSeries.LeaderCode, HikeSeries{Template: Hike{Name: "Later Series", TrailheadName: "Brief Closure", StartTime: later, Leader: leader}})
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	// Occurrences aren't created while their trailhead is closed, and are once it reopens
+	rr = do("POST", "/api/trailhead/Open%20Valley/advisory", `{"status": "closed", "message": "Flooding"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var flooding TrailheadAdvisory
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &flooding))
+	var seriesId int64
+	require.NoError(t, db.QueryRow("SELECT id FROM hike_series WHERE join_code = ?", series.JoinCode).Scan(&seriesId))
+	horizon := time.Now().Add(14 * 24 * time.Hour)
+	created, err := materializeSeries(seriesId, horizon)
+	require.NoError(t, err)
+	assert.Empty(t, created)
+	require.Equal(t, http.StatusOK, do("DELETE", fmt.Sprintf("/api/trailhead/Open%%20Valley/advisory/%d", flooding.Id), "").Code)
+	created, err = materializeSeries(seriesId, horizon)
+	require.NoError(t, err)
+	assert.Len(t, created, 2)
+}
+
+func TestFuzzyTrailheadSearch(t *testing.T) {
+	mux := setupTestMux()
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "test-admin-token"
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path+"?adminToken=test-admin-token", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	suggest := func(q string) []string {
+		req, _ := http.NewRequest("GET", "/api/trailhead?q="+url.QueryEscape(q), nil)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var suggestions []Trailhead
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &suggestions))
+		names := []string{}
+		for _, th := range suggestions {
+			names = append(names, th.Name)
+		}
+		return names
+	}
+
+	// With or without the ʻokina, and with a typo
+	for _, q := range []string{"Kuliouou", "Kuli'ou'ou", "Kuliʻouʻou", "kuli’ou’ou ridge", "Kuliuou"} {
+		names := suggest(q)
+		require.NotEmpty(t, names, q)
+		assert.Equal(t, "Kuli'ou'ou Ridge", names[0], q)
+	}
+	assert.Empty(t, suggest("Kxyzq"))
+
+	// With or without the kahakō
+	for _, q := range []string{"Pu'u Ma'eli'eli", "puu maelieli", "Puʻu Māʻeliʻeli"} {
+		names := suggest(q)
+		require.NotEmpty(t, names, q)
+		assert.Equal(t, "Pu'u Mā'eli'eli", names[0], q)
+	}
+
+	// Other names a trailhead goes by
+	assert.Equal(t, "Ka'iwa Ridge (Lanikai Side)", suggest("Lanikai Pillbox")[0])
+	require.Equal(t, http.StatusOK, do("POST", "/api/trailhead", `{"name": "Haiku Stairs"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/api/trailhead/Haiku%20Stairs/alias", `{"alias": " "}`).Code)
+	assert.Equal(t, http.StatusNotFound, do("POST", "/api/trailhead/Nowhere/alias", `{"alias": "Stairway to Heaven"}`).Code)
+	rr := do("POST", "/api/trailhead/Haiku%20Stairs/alias", `{"alias": "Stairway to Heaven"}`)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var th Trailhead
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &th))
+	assert.Equal(t, []string{"Stairway to Heaven"}, th.Aliases)
+	assert.Equal(t, http.StatusConflict, do("POST", "/api/trailhead/Haiku%20Stairs/alias", `{"alias": "Stairway to Heaven"}`).Code)
+	assert.Equal(t, http.StatusConflict, do("POST", "/api/trailhead/Haiku%20Stairs/alias", `{"alias": "Kuli'ou'ou Ridge"}`).Code)
+	assert.Equal(t, []string{"Haiku Stairs"}, suggest("Stairway"))
+	assert.Equal(t, []string{"Haiku Stairs"}, suggest("stairway to heven"))
+	assert.Equal(t, http.StatusOK, do("DELETE", "/api/trailhead/Haiku%20Stairs/alias/Stairway%20to%20Heaven", "").Code)
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/api/trailhead/Haiku%20Stairs/alias/Stairway%20to%20Heaven", "").Code)
+	assert.Empty(t, suggest("Stairway"))
+
+	// Equally good matches are ranked by how often they're hiked
+	require.Equal(t, http.StatusOK, do("POST", "/api/trailhead", `{"name": "Fuzzy Summit North"}`).Code)
+	require.Equal(t, http.StatusOK, do("POST", "/api/trailhead", `{"name": "Fuzzy Summit South"}`).Code)
+	assert.Equal(t, []string{"Fuzzy Summit North", "Fuzzy Summit South"}, suggest("Fuzzy Summit"))
+	hike := Hike{Name: "Fuzzy Hike", TrailheadName: "Fuzzy Summit South", StartTime: time.Now().Add(time.Hour),
+		Leader: User{UUID: "fuzzy-leader", Name: "Fuzzy Leader", Phone: "8085550073"}}
+	body, _ := json.Marshal(hike)
+	req, _ := http.NewRequest("POST", "/api/hike", bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, []string{"Fuzzy Summit South", "Fuzzy Summit North"}, suggest("Fuzzy Summit"))
+	// A closer match still comes first
+	assert.Equal(t, "Fuzzy Summit North", suggest("Fuzzy Summit North")[0])
+}
+
+func TestCheckOverdueParticipants(t *testing.T) {
+	mux := setupTestMux()
+	leader := User{UUID: "leader-overdue", Name: "Overdue Leader", Phone: "8088088080"}
+	startTime := time.Now().Add(-3 * time.Hour)
+	overdueHike := Hike{Name: "Overdue Hike", Leader: leader, TrailheadName: "Olomana", StartTime: startTime, DurationMinutes: 120}
+	body, _ := json.Marshal(overdueHike)
+	req, _ := http.NewRequest("POST", "/api/hike", bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var hike Hike
+	json.Unmarshal(rr.Body.Bytes(), &hike)
+	assert.Equal(t, 120, hike.DurationMinutes)
+
+	stillHiking := joinTestHikeWithOptions(t, hike, User{UUID: "user-overdue-active", Name: "Still Hiking", Phone: "1112223333", EmergencyContact: "4445556666"})
+	neverStarted := joinTestHikeWithOptions(t, hike, User{UUID: "user-overdue-rsvp", Name: "Never Started"})
+	_, err := db.Exec("UPDATE hike_users SET status = 'active' WHERE id = ?", stillHiking.Hike.ParticipantId)
+	require.NoError(t, err)
+
+	// A hike without a duration has no expected return and is never flagged
+	noDurationHike := createTestHikeWithOptionsAndStartTime(t, leader, "No Duration Hike", "Olomana", startTime)
+	noDuration := joinTestHikeWithOptions(t, noDurationHike, User{UUID: "user-overdue-no-duration", Name: "No Duration"})
+	_, err = db.Exec("UPDATE hike_users SET status = 'active' WHERE id = ?", noDuration.Hike.ParticipantId)
+	require.NoError(t, err)
+
+	// Within the grace period nothing is flagged
+	notifier := &recordingNotifier{}
+	flagged, err := checkOverdueParticipants(startTime.Add(120*time.Minute+overdueGracePeriod-time.Minute), notifier)
+	require.NoError(t, err)
+	assert.Empty(t, flagged)
+
+	flagged, err = checkOverdueParticipants(time.Now(), notifier)
+	require.NoError(t, err)
+	require.Len(t, notifier.alerts, 1)
+	assert.Equal(t, flagged, notifier.alerts)
+	alert := notifier.alerts[0]
+	assert.Equal(t, stillHiking.Hike.ParticipantId, alert.ParticipantId)
+	assert.Equal(t, "Still Hiking", alert.ParticipantName)
+	assert.Equal(t, "4445556666", alert.EmergencyContact)
+	assert.Equal(t, hike.JoinCode, alert.JoinCode)
+	assert.Equal(t, leader.Name, alert.LeaderName)
+	assert.WithinDuration(t, startTime.Add(120*time.Minute), alert.ExpectedEndTime, time.Second)
+
+	// The leader sees the overdue status in the participant list
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/api/hike/%s/participant?leaderCode=%s", hike.JoinCode, hike.LeaderCode), nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	var participants []Participant
+	json.Unmarshal(rr.Body.Bytes(), &participants)
+	statuses := make(map[int64]string)
+	for _, p := range participants {
+		statuses[p.Id] = p.Status
+	}
+	assert.Equal(t, "overdue", statuses[stillHiking.Hike.ParticipantId])
+	assert.Equal(t, "rsvp", statuses[neverStarted.Hike.ParticipantId])
+
+	var actor string
+	err = db.QueryRow("SELECT actor FROM participant_status_history WHERE hike_user_id = ? AND to_status = 'overdue'", stillHiking.Hike.ParticipantId).Scan(&actor)
+	require.NoError(t, err)
+	assert.Equal(t, "system", actor)
+
+	// Participants are only reported once
+	flagged, err = checkOverdueParticipants(time.Now(), notifier)
+	require.NoError(t, err)
+	assert.Empty(t, flagged)
+	assert.Len(t, notifier.alerts, 1)
+
+	// A participant whose history can't be recorded stays active, and the others are still flagged
+	unrecorded := joinTestHikeWithOptions(t, hike, User{UUID: "user-overdue-unrecorded", Name: "Unrecorded"})
+	recorded := joinTestHikeWithOptions(t, hike, User{UUID: "user-overdue-recorded", Name: "Recorded"})
+	_, err = db.Exec("UPDATE hike_users SET status = 'active' WHERE id IN (?, ?)", unrecorded.Hike.ParticipantId, recorded.Hike.ParticipantId)
+	require.NoError(t, err)
+	_, err = db.Exec(fmt.Sprintf(`CREATE TRIGGER refuse_overdue_history BEFORE INSERT ON participant_status_history
+		WHEN NEW.hike_user_id = %d BEGIN SELECT RAISE(ABORT, 'history unavailable'); END`, unrecorded.Hike.ParticipantId))
+	require.NoError(t, err)
+	defer db.Exec("DROP TRIGGER IF EXISTS refuse_overdue_history")
+	flagged, err = checkOverdueParticipants(time.Now(), notifier)
+	assert.Error(t, err)
+	require.Len(t, flagged, 1)
+	assert.Equal(t, recorded.Hike.ParticipantId, flagged[0].ParticipantId)
+	var status string
+	require.NoError(t, db.QueryRow("SELECT status FROM hike_users WHERE id = ?", unrecorded.Hike.ParticipantId).Scan(&status))
+	assert.Equal(t, "active", status)
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var received OverdueAlert
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	alert := OverdueAlert{HikeName: "Webhook Hike", JoinCode: "webhookJoin", ParticipantId: 42, ParticipantName: "Webhook Hiker", ExpectedEndTime: time.Now().Truncate(time.Second)}
+	require.NoError(t, newWebhookNotifier(server.URL).NotifyOverdue(alert))
+	assert.Equal(t, alert.ParticipantName, received.ParticipantName)
+	assert.Equal(t, alert.ParticipantId, received.ParticipantId)
+	assert.True(t, alert.ExpectedEndTime.Equal(received.ExpectedEndTime))
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	assert.Error(t, newWebhookNotifier(failing.URL).NotifyOverdue(alert))
+}
+
+func TestHikeRoles(t *testing.T) {
+	mux := setupTestMux()
+	leader := User{UUID: "leader-roles", Name: "Roles Leader", Phone: "8085550001"}
+	hike := createTestHikeWithOptions(t, leader)
+	joinTestHikeWithOptions(t, hike, User{UUID: "user-roles-participant", Name: "Roles Participant"})
+
+	addRole := func(code string, role HikeRole) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(role)
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/api/hike/%s/role?leaderCode=%s", hike.JoinCode, code), bytes.NewBuffer(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	updateHike := func(code string, update Hike) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(update)
+		req, _ := http.NewRequest("PUT", "/api/hike/"+code, bytes.NewBuffer(body))
+		req.Header.Set("If-Match", "*")
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	get := func(url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := addRole(hike.LeaderCode, HikeRole{Role: "driver"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = addRole(hike.LeaderCode, HikeRole{Role: "sweep", Name: "Sam Sweep"})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var sweep HikeRole
+	json.Unmarshal(rr.Body.Bytes(), &sweep)
+	assert.NotEmpty(t, sweep.AccessCode)
+	assert.NotEqual(t, hike.LeaderCode, sweep.AccessCode)
+	assert.Equal(t, []string{permViewRoster, permUpdateParticipants}, sweep.Permissions)
+
+	rr = addRole(hike.LeaderCode, HikeRole{Role: "co-leader", Name: "Casey Co"})
+	require.Equal(t, http.StatusOK, rr.Code)
+	var coLeader HikeRole
+	json.Unmarshal(rr.Body.Bytes(), &coLeader)
+
+	// Only codes that can manage roles can add them
+	rr = addRole(sweep.AccessCode, HikeRole{Role: "leader"})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	rr = addRole(coLeader.AccessCode, HikeRole{Role: "leader"})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// The sweep sees the hike and roster with their own code, never the leader's
+	rr = get(fmt.Sprintf("/api/hike/%s?leaderCode=%s&userUUID=%s", hike.JoinCode, sweep.AccessCode, "user-roles-sweep"))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var sweepView Hike
+	json.Unmarshal(rr.Body.Bytes(), &sweepView)
+	assert.Equal(t, sweep.AccessCode, sweepView.LeaderCode)
+	assert.Equal(t, "sweep", sweepView.Role)
+	rr = get(fmt.Sprintf("/api/hike/%s/participant?leaderCode=%s", hike.JoinCode, sweep.AccessCode))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var participants []Participant
+	json.Unmarshal(rr.Body.Bytes(), &participants)
+	assert.Len(t, participants, 1)
+
+	// Opening the code puts the hike in the sweep's Leading list
+	rr = get("/api/hike?userUUID=user-roles-sweep")
+	var sweepHikes []Hike
+	json.Unmarshal(rr.Body.Bytes(), &sweepHikes)
+	require.Len(t, sweepHikes, 1)
+	assert.Equal(t, "led_by_user", sweepHikes[0].SourceType)
+	assert.Equal(t, sweep.AccessCode, sweepHikes[0].LeaderCode)
+
+	// A sweep can't edit or close the hike
+	edit := hike
+	edit.Name = "Renamed by Sweep"
+	edit.Leader = User{UUID: "user-roles-sweep", Name: "Sam Sweep"}
+	rr = updateHike(sweep.AccessCode, edit)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	edit.Status = "closed"
+	rr = updateHike(sweep.AccessCode, edit)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// A co-leader can edit, but doesn't become the leader by doing so
+	edit = hike
+	edit.Name = "Renamed by Co-Leader"
+	edit.Leader = User{UUID: "user-roles-coleader", Name: "Casey Co"}
+	rr = updateHike(coLeader.AccessCode, edit)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var edited Hike
+	json.Unmarshal(rr.Body.Bytes(), &edited)
+	assert.Equal(t, "Renamed by Co-Leader", edited.Name)
+	assert.Equal(t, leader.UUID, edited.Leader.UUID)
+	assert.Equal(t, coLeader.AccessCode, edited.LeaderCode)
+
+	// A code for one hike doesn't open another
+	other := createTestHikeWithOptions(t, leader)
+	rr = get(fmt.Sprintf("/api/hike/%s/participant?leaderCode=%s", other.JoinCode, sweep.AccessCode))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = get(fmt.Sprintf("/api/hike/%s/role?leaderCode=%s", hike.JoinCode, hike.LeaderCode))
+	require.Equal(t, http.StatusOK, rr.Code)
+	var roles []HikeRole
+	json.Unmarshal(rr.Body.Bytes(), &roles)
+	require.Len(t, roles, 2)
+	assert.Equal(t, "user-roles-sweep", roles[0].UserUUID)
+
+	// Revoked codes stop working
+	req, _ := http.NewRequest("DELETE", fmt.Sprintf("/api/hike/%s/role/%d?leaderCode=%s", hike.JoinCode, sweep.Id, hike.LeaderCode), nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	rr = get(fmt.Sprintf("/api/hike/%s/participant?leaderCode=%s", hike.JoinCode, sweep.AccessCode))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = get(fmt.Sprintf("/api/hike/%s?leaderCode=%s", hike.JoinCode, sweep.AccessCode))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = get("/api/hike?userUUID=user-roles-sweep")
+	assert.Equal(t, "null\n", rr.Body.String())
+
+	// The co-leader can close the hike
+	edit.Status = "closed"
+	rr = updateHike(coLeader.AccessCode, edit)
+	require.Equal(t, http.StatusOK, rr.Code)
+	json.Unmarshal(rr.Body.Bytes(), &edited)
+	assert.Equal(t, "closed", edited.Status)
+}
+
+func TestRecurrenceOccurrences(t *testing.T) {
+	hst := time.FixedZone("HST", -10*60*60)
+	dtstart := time.Date(2025, 1, 4, 8, 0, 0, 0, hst) // a Saturday
+	day := func(month time.Month, d int) time.Time { return time.Date(2025, month, d, 8, 0, 0, 0, hst) }
+
+	tests := []struct {
+		rule    string
+		through time.Time
+		want    []time.Time
+	}{
+		{"FREQ=WEEKLY;BYDAY=SA", day(1, 25), []time.Time{day(1, 4), day(1, 11), day(1, 18), day(1, 25)}},
+		{"FREQ=WEEKLY", day(1, 12), []time.Time{day(1, 4), day(1, 11)}},
+		{"FREQ=WEEKLY;INTERVAL=2;BYDAY=SA,SU;COUNT=4", day(12, 31), []time.Time{day(1, 4), day(1, 5), day(1, 18), day(1, 19)}},
+		{"FREQ=MONTHLY;BYDAY=1SA", day(4, 1), []time.Time{day(1, 4), day(2, 1), day(3, 1)}},
+		{"FREQ=MONTHLY;BYDAY=-1SU", day(4, 1), []time.Time{day(1, 26), day(2, 23), day(3, 30)}},
+		{"FREQ=MONTHLY;BYMONTHDAY=15;UNTIL=20250301", day(12, 31), []time.Time{day(1, 15), day(2, 15)}},
+		{"FREQ=MONTHLY;BYMONTHDAY=31", day(5, 1), []time.Time{day(1, 31), day(3, 31)}},
+		{"FREQ=MONTHLY;BYDAY=FR;BYMONTHDAY=13", day(12, 31), []time.Time{day(6, 13)}},
+		{"FREQ=MONTHLY;BYDAY=SA;BYMONTHDAY=1,2,3,4,5,6,7", day(4, 1), []time.Time{day(1, 4), day(2, 1), day(3, 1)}},
+	}
+	for _, tt := range tests {
+		rule, err := parseRecurrence(tt.rule, dtstart)
+		require.NoError(t, err, tt.rule)
+		assert.Equal(t, tt.want, rule.occurrences(dtstart, tt.through), tt.rule)
+	}
+
+	for _, invalid := range []string{"", "FREQ=DAILY", "BYDAY=SA", "FREQ=WEEKLY;BYDAY=1SA", "FREQ=WEEKLY;BYDAY=XX", "FREQ=MONTHLY;BYMONTHDAY=32", "FREQ=WEEKLY;INTERVAL=0"} {
+		_, err := parseRecurrence(invalid, dtstart)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestHikeSeries(t *testing.T) {
+	mux := setupTestMux()
+	leader := User{UUID: "leader-series", Name: "Series Leader", Phone: "8081112222"}
+	// Mid-morning tomorrow, so moving the series an hour later stays on the same day
+	tomorrow := time.Now().AddDate(0, 0, 1)
+	dtstart := time.Date(tomorrow.Year(), tomorrow.Month(), tomorrow.Day(), 9, 0, 0, 0, time.Local)
+
+	// Invalid recurrence is rejected
+	body, _ := json.Marshal(HikeSeries{Recurrence: "FREQ=DAILY", Template: Hike{Name: "Bad Series", Leader: leader, StartTime: dtstart}})
+	req, _ := http.NewRequest("POST", "/api/series", bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Weekly series materializes every occurrence inside the horizon, each with its own codes
+	body, _ = json.Marshal(HikeSeries{
+		Recurrence: "FREQ=WEEKLY",
+		Template:   Hike{Name: "Saturday Series", Leader: leader, TrailheadName: "Olomana", StartTime: dtstart, MaxParticipants: 10, DurationMinutes: 180},
+	})
+	req, _ = http.NewRequest("POST", "/api/series", bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var series HikeSeries
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &series))
+	assert.NotEmpty(t, series.JoinCode)
+	assert.NotEmpty(t, series.LeaderCode)
+	require.Len(t, series.Occurrences, 9) // weekly for 60 days starting tomorrow
+	codes := make(map[string]bool)
+	for i, o := range series.Occurrences {
+		assert.True(t, dtstart.AddDate(0, 0, 7*i).Equal(o.StartTime), "occurrence %d start time", i)
+		assert.Equal(t, "Saturday Series", o.Name)
+		assert.Equal(t, 10, o.MaxParticipants)
+		assert.Equal(t, series.JoinCode, o.SeriesCode)
+		assert.False(t, codes[o.JoinCode] || codes[o.LeaderCode], "codes must be unique")
+		codes[o.JoinCode], codes[o.LeaderCode] = true, true
+	}
+	first, second := series.Occurrences[0], series.Occurrences[1]
+
+	// An occurrence is an ordinary hike that links back to its series
+	req, _ = http.NewRequest("GET", "/api/hike/"+first.JoinCode, nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	var fetched Hike
+	json.Unmarshal(rr.Body.Bytes(), &fetched)
+	assert.Equal(t, series.JoinCode, fetched.SeriesCode)
+
+	// Participants see the series without leader codes
+	req, _ = http.NewRequest("GET", "/api/series/"+series.JoinCode, nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	var publicSeries HikeSeries
+	json.Unmarshal(rr.Body.Bytes(), &publicSeries)
+	assert.Empty(t, publicSeries.LeaderCode)
+	require.Len(t, publicSeries.Occurrences, 9)
+	for _, o := range publicSeries.Occurrences {
+		assert.Empty(t, o.LeaderCode)
+	}
+
+	// RSVP to a single occurrence, then subscribe to the series
+	subscriber := User{UUID: "user-series-subscriber", Name: "Every Week", Phone: "8083334444"}
+	single := joinTestHikeWithOptions(t, first, subscriber)
+	body, _ = json.Marshal(subscriber)
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/api/series/%s/subscriber", series.JoinCode), bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var subscribed HikeSeries
+	json.Unmarshal(rr.Body.Bytes(), &subscribed)
+	assert.NotZero(t, subscribed.SubscriptionId)
+	require.Len(t, subscribed.Occurrences, 9)
+	assert.Equal(t, single.Hike.ParticipantId, subscribed.Occurrences[0].ParticipantId, "existing RSVP is kept")
+	for _, o := range subscribed.Occurrences {
+		assert.NotZero(t, o.ParticipantId)
+		assert.Equal(t, "rsvp", o.ParticipantStatus)
+	}
+	var waivers int
+	db.QueryRow("SELECT COUNT(*) FROM waiver_signatures ws JOIN hikes h ON ws.hike_join_code = h.join_code WHERE ws.user_uuid = ? AND h.series_id IS NOT NULL", subscriber.UUID).Scan(&waivers)
+	assert.Equal(t, 9, waivers)
+
+	// Edit one occurrence on its own
+	override := second
+	override.Name = "Special Edition"
+	override.Leader = leader
+	body, _ = json.Marshal(override)
+	req, _ = http.NewRequest("PUT", "/api/hike/"+second.LeaderCode, bytes.NewBuffer(body))
+	req.Header.Set("If-Match", "*")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	// Changing the recurrence isn't supported
+	update := HikeSeries{Recurrence: "FREQ=MONTHLY", Template: series.Template}
+	body, _ = json.Marshal(update)
+	req, _ = http.NewRequest("PUT", "/api/series/"+series.LeaderCode, bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Edit the whole series: the individually edited occurrence is left alone
+	update = HikeSeries{Template: series.Template}
+	update.Template.Name = "Renamed Series"
+	update.Template.StartTime = dtstart.Add(time.Hour)
+	body, _ = json.Marshal(update)
+	req, _ = http.NewRequest("PUT", "/api/series/"+series.LeaderCode, bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var updated HikeSeries
+	json.Unmarshal(rr.Body.Bytes(), &updated)
+	assert.Equal(t, "Renamed Series", updated.Template.Name)
+	require.Len(t, updated.Occurrences, 9)
+	for i, o := range updated.Occurrences {
+		if o.JoinCode == second.JoinCode {
+			assert.Equal(t, "Special Edition", o.Name)
+			assert.True(t, second.StartTime.Equal(o.StartTime))
+			continue
+		}
+		assert.Equal(t, "Renamed Series", o.Name)
+		assert.True(t, dtstart.AddDate(0, 0, 7*i).Add(time.Hour).Equal(o.StartTime), "occurrence %d start time", i)
+	}
+
+	// Occurrences coming into range later are created with the subscriber already RSVPd
+	var seriesId int64
+	require.NoError(t, db.QueryRow("SELECT id FROM hike_series WHERE join_code = ?", series.JoinCode).Scan(&seriesId))
+	created, err := materializeSeries(seriesId, time.Now().Add(14*24*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, created, 2)
+	var status string
+	require.NoError(t, db.QueryRow("SELECT status FROM hike_users WHERE hike_join_code = ? AND user_uuid = ?", created[0], subscriber.UUID).Scan(&status))
+	assert.Equal(t, "rsvp", status)
+
+	// Subscribing again, and unsubscribing, need the subscription's token
+	body, _ = json.Marshal(subscriber)
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/api/series/%s/subscriber", series.JoinCode), bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	other := User{UUID: "user-series-other", Name: "Other Subscriber", Phone: "8083334445"}
+	body, _ = json.Marshal(other)
+	req, _ = http.NewRequest("POST", fmt.Sprintf("/api/series/%s/subscriber", series.JoinCode), bytes.NewBuffer(body))
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var otherSubscribed HikeSeries
+	json.Unmarshal(rr.Body.Bytes(), &otherSubscribed)
+	unsubscribe := func(subscriptionId int64, query string) int {
+		req, _ := http.NewRequest("DELETE", fmt.Sprintf("/api/series/%s/subscriber/%d?%s", series.JoinCode, subscriptionId, query), nil)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, unsubscribe(subscribed.SubscriptionId, ""))
+	assert.Equal(t, http.StatusForbidden, unsubscribe(subscribed.SubscriptionId, "subscriptionToken="+otherSubscribed.SubscriptionToken))
+	assert.Equal(t, http.StatusForbidden, unsubscribe(subscribed.SubscriptionId, "leaderCode="+series.JoinCode))
+	assert.Equal(t, http.StatusOK, unsubscribe(otherSubscribed.SubscriptionId, "leaderCode="+series.LeaderCode))
+
+	// After unsubscribing, new occurrences are no longer RSVPd
+	require.NotEmpty(t, subscribed.SubscriptionToken)
+	require.Equal(t, http.StatusOK, unsubscribe(subscribed.SubscriptionId, "subscriptionToken="+subscribed.SubscriptionToken))
+	created, err = materializeSeries(seriesId, time.Now().Add(21*24*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, created, 1)
+	err = db.QueryRow("SELECT status FROM hike_users WHERE hike_join_code = ? AND user_uuid = ?", created[0], subscriber.UUID).Scan(&status)
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestTrailheadSuggestions(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/api/trailhead?q=Ka", nil)
+	rr := httptest.NewRecorder()
+	mux := setupTestMux()
+	mux.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var suggestions []Trailhead
+	json.Unmarshal(rr.Body.Bytes(), &suggestions)
+	assert.GreaterOrEqual(t, len(suggestions), 1, "Should get at least one suggestion for 'Ka'")
+	for _, s := range suggestions {
+		assert.NotEmpty(t, s.Name, "Suggestion name should not be empty")
+		assert.NotEmpty(t, s.MapLink, "Suggestion MapLink should not be empty")
+		assert.Contains(t, s.MapLink, "https://", "MapLink is not a link")
+	}
+
+	// Test with userUUID
+	// 1. Create a user and a hike for them
+	testUserUUID := "test-user-trailhead-suggestions"
+	_, err := db.Exec("INSERT OR IGNORE INTO users (uuid, name, phone) VALUES (?, ?, ?)", testUserUUID, "Test User TH", "1112223333")
+	require.NoError(t, err)
+
+	// Hike 1 by user - recent
+	_, err = db.Exec(`INSERT INTO hikes (name, trailhead_name, trailhead_map_link, leader_uuid, created_at, start_time, join_code, leader_code)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		"User Hike Recent", "Ka'au Crater User", "http://maps.google.com/user_kaau", testUserUUID, time.Now().Add(-1*time.Hour).Format("2006-01-02T15:04:05-07:00"), time.Now().Add(2*time.Hour), "joinRecentUserLedHike", "leadRecentUserLedHike")
+	require.NoError(t, err)
+	// No need to insert into hike_users if we are testing trailheads from hikes LED by the user.
+
+	// Hike 2 by user - older, also led by testUserUUID
+	_, err = db.Exec(`INSERT INTO hikes (name, trailhead_name, trailhead_map_link, leader_uuid, created_at, start_time, join_code, leader_code)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		"User Hike Older", "Kamilo'iki User", "http://maps.google.com/user_kamiloiki", testUserUUID, time.Now().Add(-2*time.Hour).Format("2006-01-02T15:04:05-07:00"), time.Now().Add(1*time.Hour), "joinOlderUserLedHike", "leadOlderUserLedHike")
+	require.NoError(t, err)
+	// No need to insert into hike_users for this test's purpose.
+
+	// Predefined "Ka'au Crater" also exists. The user one should take precedence.
+	// Predefined "Kamilo'iki" also exists.
+
+	// Scenario 1: Query matches user history and predefined, user history should be prioritized
+	reqUser, _ := http.NewRequest("GET", fmt.Sprintf("/api/trailhead?q=Ka&userUUID=%s", testUserUUID), nil)
+	rrUser := httptest.NewRecorder()
+	mux.ServeHTTP(rrUser, reqUser)
+	assert.Equal(t, http.StatusOK, rrUser.Code)
+	var userSuggestions []Trailhead
+	json.Unmarshal(rrUser.Body.Bytes(), &userSuggestions)
+
+	assert.GreaterOrEqual(t, len(userSuggestions), 1, "Should get at least one suggestion for 'Ka' with userUUID")
+
+	foundUserKaauUser := false
+	foundStdKaauCrater := false
+	foundUserKamiloikiUser := false
+
+	// Check that user's specific trailheads ("Ka'au Crater User", "Kamilo'iki User") appear.
+	// Also check if the standard "Ka'au Crater" appears if not overridden.
+	for _, s := range userSuggestions {
+		if s.Name == "Ka'au Crater User" {
+			foundUserKaauUser = true
+			assert.Equal(t, "http://maps.google.com/user_kaau", s.MapLink, "User's 'Ka'au Crater User' map link is incorrect")
+		} else if s.Name == "Ka'au Crater" { // This is the predefined one
+			foundStdKaauCrater = true
+			// We expect its original map link if no user override with this exact name exists OR if the user override was not fetched due to query/limit
+			// This part of the test is before adding an exact name override by the user.
+			var predefinedKaauMapLink string
+			for _, pth := range predefinedTrailheads {
+				if pth.Name == "Ka'au Crater" {
+					predefinedKaauMapLink = pth.MapLink
+					break
+				}
+			}
+			assert.Equal(t, predefinedKaauMapLink, s.MapLink, "Standard 'Ka'au Crater' map link is incorrect or overridden prematurely.")
+		}
+		if s.Name == "Kamilo'iki User" {
+			foundUserKamiloikiUser = true
+			assert.Equal(t, "http://maps.google.com/user_kamiloiki", s.MapLink, "User's 'Kamilo'iki User' map link is incorrect")
+		}
+	}
+	assert.True(t, foundUserKaauUser, "User's 'Ka'au Crater User' trailhead should be in suggestions")
+	assert.True(t, foundUserKamiloikiUser, "User's 'Kamilo'iki User' trailhead should be in suggestions")
+	// Standard Ka'au Crater should also be found at this stage as there's no user hike named exactly "Ka'au Crater" yet.
+	assert.True(t, foundStdKaauCrater, "Standard 'Ka'au Crater' should be suggested when no user override exists for that exact name and query matches.")
+
+
+	// If a user trailhead has the same name as a predefined one, the user's (most recent) should be used.
+	// Let's add a user hike (led by testUserUUID) with the exact name "Ka'au Crater" but a different map link.
+	_, err = db.Exec(`INSERT INTO hikes (name, trailhead_name, trailhead_map_link, leader_uuid, created_at, start_time, join_code, leader_code)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		"User Hike Exact Name", "Ka'au Crater", "http://maps.google.com/user_exact_kaau_override", testUserUUID, time.Now().Format("2006-01-02T15:04:05-07:00"), time.Now().Add(3*time.Hour), "joinExactUserLedHikeOverride", "leadExactUserLedHikeOverride")
+	require.NoError(t, err)
+	// No hike_users insertion needed for this specific test logic.
+
+	reqOverride, _ := http.NewRequest("GET", fmt.Sprintf("/api/trailhead?q=Ka'au Crater&userUUID=%s", testUserUUID), nil)
+	rrOverride := httptest.NewRecorder()
+	mux.ServeHTTP(rrOverride, reqOverride)
+	assert.Equal(t, http.StatusOK, rrOverride.Code)
+	var overrideSuggestions []Trailhead
+	json.Unmarshal(rrOverride.Body.Bytes(), &overrideSuggestions)
+
+	require.GreaterOrEqual(t, len(overrideSuggestions), 1, "Should get at least one suggestion for exact match 'Ka'au Crater'")
+	assert.Equal(t, "Ka'au Crater", overrideSuggestions[0].Name)
+	assert.Equal(t, "http://maps.google.com/user_exact_kaau_override", overrideSuggestions[0].MapLink, "User's specific map link for 'Ka'au Crater' should override predefined.")
+
+	// Ensure limit is respected
+	assert.LessOrEqual(t, len(overrideSuggestions), 5, "Should not return more than 5 suggestions")
+
+	// Scenario 2: Query matches only predefined trailheads
+	reqNoUserHistoryMatch, _ := http.NewRequest("GET", fmt.Sprintf("/api/trailhead?q=Makiki Valley Loop&userUUID=%s", testUserUUID), nil)
+	rrNoUserHistoryMatch := httptest.NewRecorder()
+	mux.ServeHTTP(rrNoUserHistoryMatch, reqNoUserHistoryMatch)
+	assert.Equal(t, http.StatusOK, rrNoUserHistoryMatch.Code)
+	var noUserMatchSuggestions []Trailhead
+	json.Unmarshal(rrNoUserHistoryMatch.Body.Bytes(), &noUserMatchSuggestions)
+	assert.GreaterOrEqual(t, len(noUserMatchSuggestions), 1, "Should get suggestions from predefined if no user history matches")
+	assert.Equal(t, "Makiki Valley Loop (Nature Center)", noUserMatchSuggestions[0].Name)
+
+	// Scenario 3: No userUUID provided, should be same as original test
+	reqNoUUID, _ := http.NewRequest("GET", "/api/trailhead?q=Ka", nil)
+	rrNoUUID := httptest.NewRecorder()
+	mux.ServeHTTP(rrNoUUID, reqNoUUID)
+	assert.Equal(t, http.StatusOK, rrNoUUID.Code)
+	var noUUIDSuggestions []Trailhead
+	json.Unmarshal(rrNoUUID.Body.Bytes(), &noUUIDSuggestions)
+	assert.Equal(t, len(suggestions), len(noUUIDSuggestions), "Suggestions without userUUID should match original test count")
+
+	// Cleanup test data (optional if using in-memory DB that's reset, but good practice for file-based)
+	// This is complex due to potential cascading or foreign key constraints.
+	// For :memory: db, it's usually fine. If using a file db for tests, more robust cleanup might be needed.
+	// Example cleanup, might need adjustment based on actual FKs and dependencies:
+	db.Exec("DELETE FROM hike_users WHERE user_uuid = ?", testUserUUID)
+	db.Exec("DELETE FROM hikes WHERE leader_uuid = ?", testUserUUID)
+	db.Exec("DELETE FROM users WHERE uuid = ?", testUserUUID)
+
+}
+
+func TestGetHikeByCode(t *testing.T) {
+	hike := createTestHike(t)
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/api/hike/%s", hike.JoinCode), nil)
+	rr := httptest.NewRecorder()
+	mux := setupTestMux()
+	mux.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
 
 	var response Hike
 	json.Unmarshal(rr.Body.Bytes(), &response)
@@ -1212,12 +3788,18 @@ func TestTableCreation(t *testing.T) {
 	defer rows.Close()
 
 	expectedColumns := map[string]string{
-		"user_uuid":      "TEXT",
-		"hike_join_code": "TEXT",
-		"signed_at":      "DATETIME",
-		"user_agent":     "TEXT",
-		"ip_address":     "TEXT",
-		"waiver_text":    "TEXT",
+		"user_uuid":                "TEXT",
+		"hike_join_code":           "TEXT",
+		"signed_at":                "DATETIME",
+		"user_agent":               "TEXT",
+		"ip_address":               "TEXT",
+		"waiver_text":              "TEXT",
+		"template_id":              "INTEGER",
+		"guardian_uuid":            "TEXT",
+		"guardian_acknowledged_at": "DATETIME",
+		"id":                       "INTEGER",
+		"prev_hash":                "TEXT",
+		"hash":                     "TEXT",
 	}
 
 	foundColumns := 0
@@ -1243,11 +3825,111 @@ func TestTableCreation(t *testing.T) {
 	}
 	require.NoError(t, rows.Err(), "Error iterating over table_info rows")
 	assert.Empty(t, expectedColumns, "Not all expected columns were found")
-	assert.Equal(t, 6, foundColumns, "Should find exactly 7 columns")
+	assert.Equal(t, 12, foundColumns, "Should find exactly 12 columns")
 
 	// Note: Checking foreign keys with PRAGMA foreign_key_list(waiver_signatures) is more complex
 	// and might be overkill for this test, as SQLite's enforcement is the main thing.
 	// We trust that if go-sqlite3 doesn't error on the CREATE TABLE, the FKs are syntactically correct.
+
+	// The shared test database was migrated from empty, so it should be at the latest version
+	var version int
+	err = db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version)
+	require.NoError(t, err)
+	assert.Equal(t, latestSchemaVersion(), version)
+
+	// Migrating an empty database and an old snapshot should both arrive at the same schema
+	emptyDB := openTestDB(t)
+	require.NoError(t, migrateDB(emptyDB))
+
+	legacyDB := openTestDB(t)
+	_, err = legacyDB.Exec(legacySchemaSnapshot)
+	require.NoError(t, err)
+	_, err = legacyDB.Exec(`INSERT INTO users (uuid, name, phone) VALUES ('legacy-leader', 'Legacy Leader', '1234567890')`)
+	require.NoError(t, err)
+	_, err = legacyDB.Exec(`INSERT INTO hikes (name, leader_uuid, created_at, start_time, join_code, leader_code)
+		VALUES ('Legacy Hike', 'legacy-leader', '2024-01-01T08:00:00-10:00', '2024-01-02T08:00:00-10:00', 'legacyJoin', 'legacyLead')`)
+	require.NoError(t, err)
+	require.NoError(t, migrateDB(legacyDB))
+
+	for _, table := range []string{"trailheads", "users", "hikes", "hike_users", "waiver_signatures", "schema_version"} {
+		assert.Equal(t, tableColumns(t, db, table), tableColumns(t, emptyDB, table), "Schema of %s after migrating from empty", table)
+		assert.Equal(t, tableColumns(t, db, table), tableColumns(t, legacyDB, table), "Schema of %s after migrating old snapshot", table)
+	}
+	assert.Equal(t, "TEXT", tableColumns(t, legacyDB, "hikes")["description"])
+	assert.Equal(t, "BOOLEAN", tableColumns(t, legacyDB, "hikes")["photo_release"])
+
+	// Existing rows survive and pick up the defaults of the new columns
+	var description string
+	var photoRelease bool
+	err = legacyDB.QueryRow("SELECT description, photo_release FROM hikes WHERE join_code = 'legacyJoin'").Scan(&description, &photoRelease)
+	require.NoError(t, err)
+	assert.Equal(t, "", description)
+	assert.False(t, photoRelease)
+
+	// Running the migrations again is a no-op
+	require.NoError(t, migrateDB(legacyDB))
+	var appliedCount int
+	err = legacyDB.QueryRow("SELECT COUNT(*) FROM schema_version").Scan(&appliedCount)
+	require.NoError(t, err)
+	assert.Equal(t, len(migrations), appliedCount)
+}
+
+func TestMigrateDB_RefusesNewerSchema(t *testing.T) {
+	newerDB := openTestDB(t)
+	require.NoError(t, migrateDB(newerDB))
+	_, err := newerDB.Exec("INSERT INTO schema_version (version, description) VALUES (?, 'From the future')", latestSchemaVersion()+1)
+	require.NoError(t, err)
+
+	err = migrateDB(newerDB)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "newer than this build supports")
+}
+
+// legacySchemaSnapshot is the schema as it existed before versioned migrations, minus the
+// columns that were later added to production databases by hand.
+const legacySchemaSnapshot = `
+	CREATE TABLE trailheads (name TEXT PRIMARY KEY, map_link TEXT DEFAULT '');
+	CREATE TABLE users (uuid TEXT PRIMARY KEY, name TEXT NOT NULL, phone TEXT NOT NULL,
+		license_plate TEXT DEFAULT '', emergency_contact TEXT DEFAULT '');
+	CREATE TABLE hikes (name TEXT NOT NULL, organization TEXT DEFAULT '', trailhead_name TEXT DEFAULT '',
+		trailhead_map_link TEXT DEFAULT '', leader_uuid TEXT NOT NULL, created_at DATETIME NOT NULL,
+		start_time DATETIME NOT NULL, status TEXT DEFAULT 'open', join_code TEXT PRIMARY KEY, leader_code TEXT UNIQUE,
+		FOREIGN KEY (leader_uuid) REFERENCES users(uuid));
+	CREATE TABLE hike_users (id INTEGER PRIMARY KEY AUTOINCREMENT, hike_join_code TEXT NOT NULL, user_uuid TEXT NOT NULL,
+		status TEXT DEFAULT 'active', joined_at DATETIME DEFAULT CURRENT_TIMESTAMP, UNIQUE (hike_join_code, user_uuid),
+		FOREIGN KEY (hike_join_code) REFERENCES hikes(join_code), FOREIGN KEY (user_uuid) REFERENCES users(uuid));
+	CREATE TABLE waiver_signatures (user_uuid TEXT NOT NULL, hike_join_code TEXT NOT NULL,
+		signed_at DATETIME DEFAULT CURRENT_TIMESTAMP, user_agent TEXT NOT NULL, ip_address TEXT NOT NULL,
+		waiver_text TEXT NOT NULL, PRIMARY KEY (user_uuid, hike_join_code),
+		FOREIGN KEY (user_uuid) REFERENCES users(uuid), FOREIGN KEY (hike_join_code) REFERENCES hikes(join_code));
+`
+
+// openTestDB opens a private in-memory database, separate from the shared test database.
+// A single connection is used because every new :memory: connection is a new, empty database.
+func openTestDB(t *testing.T) *sql.DB {
+	conn, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	conn.SetMaxOpenConns(1)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// tableColumns returns column name -> declared type for a table
+func tableColumns(t *testing.T, conn *sql.DB, table string) map[string]string {
+	rows, err := conn.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	require.NoError(t, err)
+	defer rows.Close()
+
+	columns := make(map[string]string)
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, dataType string
+		var dfltValue interface{}
+		require.NoError(t, rows.Scan(&cid, &name, &dataType, &notnull, &dfltValue, &pk))
+		columns[name] = dataType
+	}
+	require.NoError(t, rows.Err())
+	return columns
 }
 
 func TestJoinHikeRecordsWaiver(t *testing.T) {
@@ -1369,7 +4051,7 @@ func TestUpdateParticipantStatus(t *testing.T) {
 	participant := joinTestHike(t, hike)
 
 	req, _ := http.NewRequest("PUT",
-		fmt.Sprintf("/api/hike/%s/participant/%d", hike.JoinCode, participant.Hike.ParticipantId),
+		fmt.Sprintf("/api/hike/%s/participant/%d?participantToken=%s", hike.JoinCode, participant.Hike.ParticipantId, participant.Hike.ParticipantToken),
 		bytes.NewBufferString(`{"status":"completed"}`))
 	req.Header.Set("Content-Type", "application/json")
 
@@ -1377,7 +4059,9 @@ func TestUpdateParticipantStatus(t *testing.T) {
 	mux := setupTestMux()
 	mux.ServeHTTP(rr, req)
 
-	assert.Equal(t, http.StatusOK, rr.Code)
+	// "completed" isn't a participant status
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Unknown status 'completed'")
 }
 
 func createTestHike(t *testing.T) Hike {
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Hikes can be added to a calendar one at a time, or a user can subscribe to a feed of every
+// hike they've RSVPd to or lead. Calendar apps poll the feed, so a change to a hike's time or
+// it being closed shows up on its own; SEQUENCE is the hike's version so the newer copy wins.
+
+// How long a hike without an expected duration is shown as lasting
+const defaultCalendarDuration = 2 * time.Hour
+
+// Hikes that started longer ago than this are left out of a user's feed
+const calendarFeedHistory = 90 * 24 * time.Hour
+
+// How often calendar apps are asked to check the feed for changes
+const calendarRefreshInterval = "PT1H"
+
+// calendarHike is a hike as it appears on a calendar
+type calendarHike struct {
+	Hike
+	updatedAt sql.NullTime
+}
+
+const calendarHikeColumns = `
+	h.join_code, h.name, h.organization, h.trailhead_name, h.trailhead_map_link, h.start_time, h.status, h.description,
+	h.duration_minutes, h.version, h.created_at, h.updated_at, u.name`
+
+func scanCalendarHike(scanner interface{ Scan(...any) error }, extra ...any) (calendarHike, error) {
+	var h calendarHike
+	dest := []any{&h.JoinCode, &h.Name, &h.Organization, &h.TrailheadName, &h.TrailheadMapLink, &h.StartTime, &h.Status,
+		&h.DescriptionMarkdown, &h.DurationMinutes, &h.Version, &h.CreatedAt, &h.updatedAt, &h.Leader.Name}
+	err := scanner.Scan(append(dest, extra...)...)
+	return h, err
+}
+
+// Download a single hike as an iCalendar file
+func getHikeCalendarHandler(w http.ResponseWriter, r *http.Request, joinCode string) {
+	row := db.QueryRow("SELECT"+calendarHikeColumns+`
+		FROM hikes AS h JOIN users AS u ON h.leader_uuid = u.uuid
+		WHERE h.join_code = ?
+	`, joinCode)
+	hike, err := scanCalendarHike(row)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Hike not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.ics"`, joinCode))
+	w.Write([]byte(hikeCalendar(hike.Name, []calendarHike{hike}, time.Now())))
+}
+
+// A feed of every hike a user has RSVPd to, leads, or holds a role on, for calendar apps to
+// subscribe to
+func getUserCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	userUUID := r.PathValue("uuid")
+	var userName string
+	err := db.QueryRow("SELECT name FROM users WHERE uuid = ?", userUUID).Scan(&userName)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query("SELECT"+calendarHikeColumns+`, COALESCE(hu.status, '')
+		FROM hikes AS h JOIN users AS u ON h.leader_uuid = u.uuid
+		LEFT JOIN hike_users AS hu ON hu.hike_join_code = h.join_code AND hu.user_uuid = ?
+		WHERE hu.id IS NOT NULL OR h.leader_uuid = ?
+		   OR h.join_code IN (SELECT hike_join_code FROM hike_roles WHERE user_uuid = ? AND revoked_at IS NULL)
+		ORDER BY h.start_time
+	`, userUUID, userUUID, userUUID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var hikes []calendarHike
+	for rows.Next() {
+		var participantStatus string
+		hike, err := scanCalendarHike(rows, &participantStatus)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if hike.StartTime.Before(now.Add(-calendarFeedHistory)) {
+			continue
+		}
+		hike.ParticipantStatus = participantStatus
+		hikes = append(hikes, hike)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write([]byte(hikeCalendar(fmt.Sprintf("Hikes for %s", userName), hikes, now)))
+}
+
+// hikeCalendar formats hikes as an iCalendar (RFC 5545) document
+func hikeCalendar(name string, hikes []calendarHike, now time.Time) string {
+	var b strings.Builder
+	line := func(property, value string) {
+		writeCalendarLine(&b, property+":"+value)
+	}
+	line("BEGIN", "VCALENDAR")
+	line("VERSION", "2.0")
+	line("PRODID", "-//Hike Tracker//Hikes//EN")
+	line("CALSCALE", "GREGORIAN")
+	line("METHOD", "PUBLISH")
+	line("X-WR-CALNAME", escapeCalendarText(name))
+	line("REFRESH-INTERVAL;VALUE=DURATION", calendarRefreshInterval)
+	line("X-PUBLISHED-TTL", calendarRefreshInterval)
+	for _, hike := range hikes {
+		start := hike.StartTime
+		end := start.Add(defaultCalendarDuration)
+		if hike.DurationMinutes > 0 {
+			end = start.Add(time.Duration(hike.DurationMinutes) * time.Minute)
+		}
+		modified := hike.CreatedAt
+		if hike.updatedAt.Valid {
+			modified = hike.updatedAt.Time
+		}
+
+		// A hike closed before it started was called off; one closed on the trail ended then
+		status := "CONFIRMED"
+		if hike.Status == "closed" && hike.updatedAt.Valid {
+			if modified.Before(start) {
+				status = "CANCELLED"
+			} else {
+				end = modified
+			}
+		} else if hike.ParticipantStatus == "waitlist" {
+			status = "TENTATIVE"
+		}
+
+		description := hike.DescriptionMarkdown
+		details := []string{"Leader: " + hike.Leader.Name}
+		if hike.Organization != "" {
+			details[0] += " (" + hike.Organization + ")"
+		}
+		if hike.TrailheadMapLink != "" {
+			details = append(details, "Trailhead map: "+hike.TrailheadMapLink)
+		}
+		if hike.ParticipantStatus == "waitlist" {
+			details = append(details, "You are on the waitlist for this hike.")
+		}
+		if description != "" {
+			description += "\n\n"
+		}
+		description += strings.Join(details, "\n")
+
+		line("BEGIN", "VEVENT")
+		line("UID", hike.JoinCode+"@hiketracker")
+		line("DTSTAMP", formatCalendarTime(now))
+		line("LAST-MODIFIED", formatCalendarTime(modified))
+		line("SEQUENCE", fmt.Sprint(hike.Version-1))
+		line("DTSTART", formatCalendarTime(start))
+		line("DTEND", formatCalendarTime(end))
+		line("SUMMARY", escapeCalendarText(hike.Name))
+		if hike.TrailheadName != "" {
+			line("LOCATION", escapeCalendarText(hike.TrailheadName))
+		}
+		if hike.TrailheadMapLink != "" {
+			line("URL", hike.TrailheadMapLink)
+		}
+		line("DESCRIPTION", escapeCalendarText(description))
+		line("STATUS", status)
+		line("END", "VEVENT")
+	}
+	line("END", "VCALENDAR")
+	return b.String()
+}
+
+func formatCalendarTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// escapeCalendarText escapes a TEXT value
+func escapeCalendarText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`).Replace(s)
+}
+
+// writeCalendarLine writes a content line, folded so no line is longer than 75 octets
+func writeCalendarLine(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		// Don't split a multi-byte character
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		limit = 74 // The leading space of a continuation line counts
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
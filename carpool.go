@@ -0,0 +1,522 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Trailhead lots are small, so participants can offer a ride or ask for one. A rider waits
+// until a driver accepts them into their car. The leader console shows the cars and how many
+// vehicles to expect at the trailhead.
+
+const (
+	carpoolDriver = "driver"
+	carpoolRider  = "rider"
+)
+
+// Most seats a driver can offer
+const maxCarpoolSeats = 15
+
+var (
+	errCarpoolNoOffer   = fmt.Errorf("This participant isn't offering a ride")
+	errCarpoolNoRequest = fmt.Errorf("This participant hasn't asked for a ride")
+	errCarpoolTaken     = fmt.Errorf("This rider is already riding with another driver")
+	errCarpoolFull      = fmt.Errorf("Not enough seats left in this car")
+	errCarpoolOverfull  = fmt.Errorf("More seats than that are already taken; remove riders from the car first")
+)
+
+// CarpoolSignup is a participant offering a ride or asking for one, sent when RSVPing or later
+type CarpoolSignup struct {
+	Role          string    `json:"role"`          // driver or rider
+	Seats         int       `json:"seats"`         // Seats a driver offers, or a rider needs (default 1)
+	MeetingPoint  string    `json:"meetingPoint"`  // Where the driver leaves from, or where the rider would like to be picked up
+	DepartureTime time.Time `json:"departureTime"` // When the driver leaves; zero if not set
+}
+
+// CarpoolRider is someone riding, or waiting for a ride
+type CarpoolRider struct {
+	ParticipantId int64  `json:"participantId"`
+	Name          string `json:"name"`
+	Seats         int    `json:"seats"`
+	MeetingPoint  string `json:"meetingPoint,omitempty"`
+}
+
+// Car is a driver's offer and who is riding with them
+type Car struct {
+	DriverId      int64          `json:"driverId"` // The driver's participant id
+	DriverName    string         `json:"driverName"`
+	LicensePlate  string         `json:"licensePlate"`
+	Seats         int            `json:"seats"`
+	SeatsTaken    int            `json:"seatsTaken"`
+	MeetingPoint  string         `json:"meetingPoint"`
+	DepartureTime time.Time      `json:"departureTime"`
+	Riders        []CarpoolRider `json:"riders"`
+}
+
+// Carpool is everything about getting a hike's participants to the trailhead
+type Carpool struct {
+	Cars          []Car          `json:"cars"`
+	WaitingRiders []CarpoolRider `json:"waitingRiders"` // Asked for a ride and not in a car yet
+	VehicleCount  int            `json:"vehicleCount"`  // Cars expected at the trailhead, including people driving alone
+}
+
+// validateCarpoolSignup checks a signup and fills in the default seat count
+func validateCarpoolSignup(c *CarpoolSignup) error {
+	c.MeetingPoint = strings.TrimSpace(c.MeetingPoint)
+	switch c.Role {
+	case carpoolDriver:
+		if c.Seats < 1 || c.Seats > maxCarpoolSeats {
+			return fmt.Errorf("A driver must offer between 1 and %d seats", maxCarpoolSeats)
+		}
+	case carpoolRider:
+		if c.Seats == 0 {
+			c.Seats = 1
+		}
+		if c.Seats < 1 || c.Seats > maxCarpoolSeats {
+			return fmt.Errorf("A rider can ask for between 1 and %d seats", maxCarpoolSeats)
+		}
+	default:
+		return fmt.Errorf("Carpool role must be '%s' or '%s'", carpoolDriver, carpoolRider)
+	}
+	if len(c.MeetingPoint) > 200 {
+		return fmt.Errorf("Meeting point must be 200 characters or less")
+	}
+	return nil
+}
+
+// saveCarpoolSignup adds or replaces a participant's carpool signup. A rider who asks again
+// stays in the car they were accepted into; a driver who stops driving lets their riders go.
+// A driver can't offer fewer seats than their riders already take; that's errCarpoolOverfull.
+func saveCarpoolSignup(tx *sql.Tx, joinCode, userUUID string, c CarpoolSignup) error {
+	if c.Role != carpoolDriver {
+		if err := releaseCarpoolRiders(tx, joinCode, userUUID); err != nil {
+			return err
+		}
+	} else if err := checkCarpoolSeats(tx, joinCode, userUUID, c); err != nil {
+		return err
+	}
+
+	var departureTime sql.NullString
+	if !c.DepartureTime.IsZero() {
+		departureTime = sql.NullString{String: c.DepartureTime.Format("2006-01-02T15:04:05-07:00"), Valid: true}
+	}
+	_, err := tx.Exec(`
+		INSERT INTO carpool_signups (hike_join_code, user_uuid, role, seats, meeting_point, departure_time, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (hike_join_code, user_uuid) DO UPDATE SET
+			driver_uuid = CASE WHEN role = excluded.role THEN driver_uuid ELSE NULL END,
+			role = excluded.role, seats = excluded.seats, meeting_point = excluded.meeting_point,
+			departure_time = excluded.departure_time
+	`, joinCode, userUUID, c.Role, c.Seats, c.MeetingPoint, departureTime, time.Now().Format("2006-01-02T15:04:05-07:00"))
+	return err
+}
+
+// checkCarpoolSeats returns errCarpoolOverfull if a driver would offer fewer seats than the
+// riders they've accepted take
+func checkCarpoolSeats(q sqlQueryer, joinCode, userUUID string, c CarpoolSignup) error {
+	if c.Role != carpoolDriver {
+		return nil
+	}
+	var taken int
+	err := q.QueryRow("SELECT COALESCE(SUM(seats), 0) FROM carpool_signups WHERE hike_join_code = ? AND driver_uuid = ?", joinCode, userUUID).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken > c.Seats {
+		return errCarpoolOverfull
+	}
+	return nil
+}
+
+// joinCarpool saves the carpool signup sent with an RSVP
+func joinCarpool(joinCode, userUUID string, c CarpoolSignup) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Rollback if not committed
+	if err := saveCarpoolSignup(tx, joinCode, userUUID, c); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// releaseCarpoolRiders puts everyone riding with a driver back to waiting for a ride
+func releaseCarpoolRiders(exec sqlExecutor, joinCode, driverUUID string) error {
+	_, err := exec.Exec("UPDATE carpool_signups SET driver_uuid = NULL WHERE hike_join_code = ? AND driver_uuid = ?", joinCode, driverUUID)
+	return err
+}
+
+// leaveCarpool removes a participant from the carpool. Their riders go back to waiting.
+func leaveCarpool(exec sqlExecutor, joinCode, userUUID string) error {
+	if err := releaseCarpoolRiders(exec, joinCode, userUUID); err != nil {
+		return err
+	}
+	_, err := exec.Exec("DELETE FROM carpool_signups WHERE hike_join_code = ? AND user_uuid = ?", joinCode, userUUID)
+	return err
+}
+
+// pruneCarpool drops signups for people who are no longer on the hike, e.g. after an unRSVP
+func pruneCarpool(exec sqlExecutor, joinCode string) error {
+	_, err := exec.Exec(`
+		UPDATE carpool_signups SET driver_uuid = NULL
+		WHERE hike_join_code = ? AND driver_uuid NOT IN (SELECT user_uuid FROM hike_users WHERE hike_join_code = ?)
+	`, joinCode, joinCode)
+	if err != nil {
+		return err
+	}
+	_, err = exec.Exec(`
+		DELETE FROM carpool_signups
+		WHERE hike_join_code = ? AND user_uuid NOT IN (SELECT user_uuid FROM hike_users WHERE hike_join_code = ?)
+	`, joinCode, joinCode)
+	return err
+}
+
+// acceptCarpoolRider puts a rider in a driver's car if there is room
+func acceptCarpoolRider(tx *sql.Tx, joinCode, driverUUID string, riderId int64) error {
+	var seats int
+	err := tx.QueryRow("SELECT seats FROM carpool_signups WHERE hike_join_code = ? AND user_uuid = ? AND role = ?", joinCode, driverUUID, carpoolDriver).Scan(&seats)
+	if err == sql.ErrNoRows {
+		return errCarpoolNoOffer
+	}
+	if err != nil {
+		return err
+	}
+
+	var riderUUID string
+	var riderSeats int
+	var currentDriver sql.NullString
+	err = tx.QueryRow(`
+		SELECT c.user_uuid, c.seats, c.driver_uuid
+		FROM carpool_signups c JOIN hike_users hu ON hu.user_uuid = c.user_uuid AND hu.hike_join_code = c.hike_join_code
+		WHERE hu.id = ? AND c.hike_join_code = ? AND c.role = ?
+	`, riderId, joinCode, carpoolRider).Scan(&riderUUID, &riderSeats, &currentDriver)
+	if err == sql.ErrNoRows {
+		return errCarpoolNoRequest
+	}
+	if err != nil {
+		return err
+	}
+	if currentDriver.Valid {
+		if currentDriver.String == driverUUID {
+			return nil
+		}
+		return errCarpoolTaken
+	}
+
+	var taken int
+	err = tx.QueryRow("SELECT COALESCE(SUM(seats), 0) FROM carpool_signups WHERE hike_join_code = ? AND driver_uuid = ?", joinCode, driverUUID).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken+riderSeats > seats {
+		return errCarpoolFull
+	}
+	_, err = tx.Exec("UPDATE carpool_signups SET driver_uuid = ? WHERE hike_join_code = ? AND user_uuid = ?", driverUUID, joinCode, riderUUID)
+	return err
+}
+
+// hikeCarpool returns the cars for a hike, the riders still waiting, and how many vehicles to
+// expect at the trailhead
+func hikeCarpool(joinCode string) (Carpool, error) {
+	carpool := Carpool{Cars: []Car{}, WaitingRiders: []CarpoolRider{}}
+	rows, err := db.Query(`
+		SELECT hu.id, u.name, u.license_plate, c.user_uuid, c.role, c.seats, c.meeting_point, c.departure_time,
+		       COALESCE(c.driver_uuid, '')
+		FROM carpool_signups c
+		JOIN hike_users hu ON hu.user_uuid = c.user_uuid AND hu.hike_join_code = c.hike_join_code
+		JOIN users u ON u.uuid = c.user_uuid
+		WHERE c.hike_join_code = ?
+		ORDER BY c.created_at, c.id
+	`, joinCode)
+	if err != nil {
+		return carpool, err
+	}
+	defer rows.Close()
+
+	cars := map[string]*Car{}
+	var driverOrder []string
+	ridersByDriver := map[string][]CarpoolRider{}
+	for rows.Next() {
+		var participantId int64
+		var name, licensePlate, userUUID, role, meetingPoint, driverUUID string
+		var seats int
+		var departureTime sql.NullTime
+		err := rows.Scan(&participantId, &name, &licensePlate, &userUUID, &role, &seats, &meetingPoint, &departureTime, &driverUUID)
+		if err != nil {
+			return carpool, err
+		}
+		if role == carpoolDriver {
+			cars[userUUID] = &Car{DriverId: participantId, DriverName: name, LicensePlate: licensePlate, Seats: seats,
+				MeetingPoint: meetingPoint, DepartureTime: departureTime.Time, Riders: []CarpoolRider{}}
+			driverOrder = append(driverOrder, userUUID)
+			continue
+		}
+		rider := CarpoolRider{ParticipantId: participantId, Name: name, Seats: seats, MeetingPoint: meetingPoint}
+		if driverUUID == "" {
+			carpool.WaitingRiders = append(carpool.WaitingRiders, rider)
+		} else {
+			ridersByDriver[driverUUID] = append(ridersByDriver[driverUUID], rider)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return carpool, err
+	}
+	for _, driverUUID := range driverOrder {
+		car := cars[driverUUID]
+		car.Riders = append(car.Riders, ridersByDriver[driverUUID]...)
+		for _, rider := range car.Riders {
+			car.SeatsTaken += rider.Seats
+		}
+		carpool.Cars = append(carpool.Cars, *car)
+	}
+	// Earliest departures first; cars without a time keep the order they were offered in
+	sort.SliceStable(carpool.Cars, func(i, j int) bool {
+		a, b := carpool.Cars[i].DepartureTime, carpool.Cars[j].DepartureTime
+		return !a.IsZero() && (b.IsZero() || a.Before(b))
+	})
+
+	// Everyone on the roster brings a vehicle unless they ride with a driver; dependents come
+	// with their guardian, and the waitlist, no-shows and those who dropped out aren't coming
+	err = db.QueryRow(`
+		SELECT COUNT(*) FROM hike_users hu
+		WHERE hu.hike_join_code = ? AND hu.status IN ('rsvp', 'active', 'finished', 'overdue') AND hu.guardian_uuid IS NULL
+		  AND NOT EXISTS (SELECT 1 FROM carpool_signups c
+		                  WHERE c.hike_join_code = hu.hike_join_code AND c.user_uuid = hu.user_uuid AND c.driver_uuid IS NOT NULL)
+	`, joinCode).Scan(&carpool.VehicleCount)
+	return carpool, err
+}
+
+// Get a hike's carpool. Open to any participant on the hike with their participantToken, and
+// to leader codes that can view the roster.
+func getHikeCarpoolHandler(w http.ResponseWriter, r *http.Request) {
+	joinCode := r.PathValue("hikeId")
+	if token := r.URL.Query().Get("participantToken"); token != "" {
+		var tokenJoinCode string
+		err := db.QueryRow("SELECT hike_join_code FROM hike_users WHERE participant_token = ?", token).Scan(&tokenJoinCode)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid participant token", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if tokenJoinCode != joinCode {
+			http.Error(w, "The participant token is for a different hike", http.StatusForbidden)
+			return
+		}
+	} else if _, ok := requireHikeAccess(w, r, permViewRoster); !ok {
+		return
+	}
+
+	writeHikeCarpool(w, joinCode)
+}
+
+func writeHikeCarpool(w http.ResponseWriter, joinCode string) {
+	carpool, err := hikeCarpool(joinCode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(carpool)
+}
+
+// carpoolParticipant authorizes a change to a participant's carpool and looks up who they are.
+// It writes the error response and returns false if the handler should stop.
+func carpoolParticipant(w http.ResponseWriter, r *http.Request, joinCode string, participantId int64) (string, bool) {
+	if _, ok := authorizeParticipantChange(w, r, joinCode, participantId); !ok {
+		return "", false
+	}
+	var userUUID, hikeStatus string
+	err := db.QueryRow(`
+		SELECT hu.user_uuid, h.status FROM hike_users hu JOIN hikes h ON h.join_code = hu.hike_join_code
+		WHERE hu.id = ? AND hu.hike_join_code = ?
+	`, participantId, joinCode).Scan(&userUUID, &hikeStatus)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Participant not found for this hike with the given ID.", http.StatusNotFound)
+		return "", false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return "", false
+	}
+	if hikeStatus != "open" {
+		http.Error(w, "Hike has already ended", http.StatusBadRequest)
+		return "", false
+	}
+	return userUUID, true
+}
+
+// Offer a ride or ask for one. Requires the participant's token or a leaderCode that can
+// update participants. Returns the hike's carpool.
+func updateCarpoolSignupHandler(w http.ResponseWriter, r *http.Request) {
+	joinCode := r.PathValue("hikeId")
+	participantId, err := parseInt64(r.PathValue("participantId"))
+	if err != nil {
+		http.Error(w, "Invalid participant ID format", http.StatusBadRequest)
+		return
+	}
+	userUUID, ok := carpoolParticipant(w, r, joinCode, participantId)
+	if !ok {
+		return
+	}
+
+	var signup CarpoolSignup
+	if err := json.NewDecoder(r.Body).Decode(&signup); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateCarpoolSignup(&signup); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to start transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback() // Rollback if not committed
+	err = saveCarpoolSignup(tx, joinCode, userUUID, signup)
+	if err == errCarpoolOverfull {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hikeEvents.publish(joinCode, eventCarpool, participantId, signup.Role)
+	logAction(fmt.Sprintf("Participant %d signed up for the carpool on hike %s as a %s (%d seats)", participantId, joinCode, signup.Role, signup.Seats))
+	writeHikeCarpool(w, joinCode)
+}
+
+// Leave the carpool. A driver's riders go back to waiting for a ride.
+func deleteCarpoolSignupHandler(w http.ResponseWriter, r *http.Request) {
+	joinCode := r.PathValue("hikeId")
+	participantId, err := parseInt64(r.PathValue("participantId"))
+	if err != nil {
+		http.Error(w, "Invalid participant ID format", http.StatusBadRequest)
+		return
+	}
+	userUUID, ok := carpoolParticipant(w, r, joinCode, participantId)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to start transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback() // Rollback if not committed
+	if err := leaveCarpool(tx, joinCode, userUUID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hikeEvents.publish(joinCode, eventCarpool, participantId, "")
+	logAction(fmt.Sprintf("Participant %d left the carpool on hike %s", participantId, joinCode))
+	writeHikeCarpool(w, joinCode)
+}
+
+// A driver accepts a rider into their car. Requires the driver's token or a leaderCode that
+// can update participants.
+func acceptCarpoolRiderHandler(w http.ResponseWriter, r *http.Request) {
+	joinCode := r.PathValue("hikeId")
+	driverId, err := parseInt64(r.PathValue("participantId"))
+	if err != nil {
+		http.Error(w, "Invalid participant ID format", http.StatusBadRequest)
+		return
+	}
+	riderId, err := parseInt64(r.PathValue("riderId"))
+	if err != nil {
+		http.Error(w, "Invalid rider ID format", http.StatusBadRequest)
+		return
+	}
+	driverUUID, ok := carpoolParticipant(w, r, joinCode, driverId)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to start transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback() // Rollback if not committed
+	err = acceptCarpoolRider(tx, joinCode, driverUUID, riderId)
+	switch err {
+	case nil:
+	case errCarpoolNoOffer, errCarpoolNoRequest:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errCarpoolTaken, errCarpoolFull:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hikeEvents.publish(joinCode, eventCarpool, riderId, "")
+	logAction(fmt.Sprintf("Participant %d accepted rider %d into their car for hike %s", driverId, riderId, joinCode))
+	writeHikeCarpool(w, joinCode)
+}
+
+// A driver takes a rider out of their car; the rider goes back to waiting for a ride
+func removeCarpoolRiderHandler(w http.ResponseWriter, r *http.Request) {
+	joinCode := r.PathValue("hikeId")
+	driverId, err := parseInt64(r.PathValue("participantId"))
+	if err != nil {
+		http.Error(w, "Invalid participant ID format", http.StatusBadRequest)
+		return
+	}
+	riderId, err := parseInt64(r.PathValue("riderId"))
+	if err != nil {
+		http.Error(w, "Invalid rider ID format", http.StatusBadRequest)
+		return
+	}
+	driverUUID, ok := carpoolParticipant(w, r, joinCode, driverId)
+	if !ok {
+		return
+	}
+
+	result, err := db.Exec(`
+		UPDATE carpool_signups SET driver_uuid = NULL
+		WHERE hike_join_code = ? AND driver_uuid = ?
+		  AND user_uuid = (SELECT user_uuid FROM hike_users WHERE id = ? AND hike_join_code = ?)
+	`, joinCode, driverUUID, riderId, joinCode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "This rider isn't in this driver's car", http.StatusNotFound)
+		return
+	}
+
+	hikeEvents.publish(joinCode, eventCarpool, riderId, "")
+	logAction(fmt.Sprintf("Participant %d removed rider %d from their car for hike %s", driverId, riderId, joinCode))
+	writeHikeCarpool(w, joinCode)
+}
@@ -0,0 +1,825 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The trailhead catalog is maintained through the admin API; predefinedTrailheads only seeds
+// an empty database. Renaming or merging a trailhead keeps the old name as an alias so
+// searches, and new hikes at the old name, still find it; aliases can also be added for other
+// names a trailhead goes by. Retired trailheads stay in the
+// catalog, and on past hikes, but are no longer suggested.
+
+// trailheadCSVHeader are the columns of the catalog as CSV, named like the JSON fields
+var trailheadCSVHeader = []string{"name", "mapLink", "latitude", "longitude", "distanceMiles", "elevationGainFeet", "durationMinutes", "difficulty", "hazards", "retired"}
+
+// resolveTrailheadName returns the current name of a trailhead given its name or an alias.
+// Returns sql.ErrNoRows if there's no such trailhead.
+func resolveTrailheadName(q sqlQueryer, name string) (string, error) {
+	var current string
+	err := q.QueryRow("SELECT name FROM trailheads WHERE name = ?", name).Scan(&current)
+	if err == sql.ErrNoRows {
+		err = q.QueryRow("SELECT trailhead_name FROM trailhead_aliases WHERE alias = ?", name).Scan(&current)
+	}
+	return current, err
+}
+
+// loadTrailhead returns a trailhead and its aliases, given its name or an alias
+func loadTrailhead(q sqlQueryer, name string) (Trailhead, error) {
+	var th Trailhead
+	current, err := resolveTrailheadName(q, name)
+	if err != nil {
+		return th, err
+	}
+	err = q.QueryRow(`
+		SELECT name, map_link, latitude, longitude, distance_miles, elevation_gain_feet, duration_minutes, difficulty, hazards, retired_at IS NOT NULL
+		FROM trailheads WHERE name = ?
+	`, current).Scan(&th.Name, &th.MapLink, &th.Latitude, &th.Longitude, &th.DistanceMiles, &th.ElevationGainFeet, &th.DurationMinutes, &th.Difficulty, &th.Hazards, &th.Retired)
+	if err != nil {
+		return th, err
+	}
+	rows, err := q.Query("SELECT alias FROM trailhead_aliases WHERE trailhead_name = ? ORDER BY created_at, alias", current)
+	if err != nil {
+		return th, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var alias string
+		if err := rows.Scan(&alias); err != nil {
+			return th, err
+		}
+		th.Aliases = append(th.Aliases, alias)
+	}
+	return th, rows.Err()
+}
+
+// validateTrailhead checks a trailhead from the admin API or an import, filling in its
+// coordinates from its map link if they weren't given
+func validateTrailhead(th *Trailhead) error {
+	th.Name = strings.TrimSpace(th.Name)
+	if th.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if err := validateTrailInfo(th.Difficulty, th.DistanceMiles, th.ElevationGainFeet, th.Hazards); err != nil {
+		return err
+	}
+	if th.DurationMinutes < 0 {
+		return fmt.Errorf("durationMinutes cannot be negative")
+	}
+	if (th.Latitude == nil) != (th.Longitude == nil) {
+		return fmt.Errorf("latitude and longitude must be given together")
+	}
+	if th.Latitude == nil {
+		if lat, lng, ok := mapLinkCoordinates(th.MapLink); ok {
+			th.Latitude, th.Longitude = &lat, &lng
+		}
+	} else if !validCoordinates(*th.Latitude, *th.Longitude) {
+		return fmt.Errorf("latitude and longitude are out of range")
+	}
+	return nil
+}
+
+// saveTrailhead inserts a trailhead, or if existingName is set, updates that trailhead under
+// th.Name. A trailhead that's already retired keeps its retirement time.
+func saveTrailhead(tx *sql.Tx, th Trailhead, existingName string) error {
+	now := time.Now().Format("2006-01-02T15:04:05-07:00")
+	var err error
+	if existingName == "" {
+		var retiredAt interface{}
+		if th.Retired {
+			retiredAt = now
+		}
+		_, err = tx.Exec(`
+			INSERT INTO trailheads (name, map_link, latitude, longitude, distance_miles, elevation_gain_feet, duration_minutes, difficulty, hazards, retired_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, th.Name, th.MapLink, th.Latitude, th.Longitude, th.DistanceMiles, th.ElevationGainFeet, th.DurationMinutes, th.Difficulty, th.Hazards, retiredAt)
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE trailheads SET name = ?, map_link = ?, latitude = ?, longitude = ?, distance_miles = ?, elevation_gain_feet = ?,
+		    duration_minutes = ?, difficulty = ?, hazards = ?, retired_at = CASE WHEN ? THEN COALESCE(retired_at, ?) ELSE NULL END
+		WHERE name = ?
+	`, th.Name, th.MapLink, th.Latitude, th.Longitude, th.DistanceMiles, th.ElevationGainFeet, th.DurationMinutes, th.Difficulty, th.Hazards, th.Retired, now, existingName)
+	return err
+}
+
+// renameTrailhead moves a trailhead's aliases and advisories to its new name, and makes the old
+// name an alias. Call it before the trailhead row itself is renamed or removed.
+func renameTrailhead(tx *sql.Tx, oldName, newName string) error {
+	if _, err := tx.Exec("UPDATE trailhead_aliases SET trailhead_name = ? WHERE trailhead_name = ?", newName, oldName); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE trailhead_advisories SET trailhead_name = ? WHERE trailhead_name = ?", newName, oldName); err != nil {
+		return err
+	}
+	// Going back to an earlier name turns that alias back into the name
+	if _, err := tx.Exec("DELETE FROM trailhead_aliases WHERE alias = ?", newName); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		INSERT INTO trailhead_aliases (alias, trailhead_name, created_at) VALUES (?, ?, ?)
+		ON CONFLICT(alias) DO UPDATE SET trailhead_name = excluded.trailhead_name
+	`, oldName, newName, time.Now().Format("2006-01-02T15:04:05-07:00"))
+	return err
+}
+
+// trailheadNameTaken reports whether a name is used by a trailhead, or an alias of one, other
+// than the trailhead named except
+func trailheadNameTaken(q sqlQueryer, name, except string) (bool, error) {
+	current, err := resolveTrailheadName(q, name)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return current != except, nil
+}
+
+// Add a trailhead to the catalog. Requires the adminToken.
+func createTrailheadHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var th Trailhead
+	if err := json.NewDecoder(r.Body).Decode(&th); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateTrailhead(&th); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	taken, err := trailheadNameTaken(tx, th.Name, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "A trailhead with that name or alias already exists", http.StatusConflict)
+		return
+	}
+	if err := saveTrailhead(tx, th, ""); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(th)
+	logAction(fmt.Sprintf("Trailhead created: %s", th.Name))
+}
+
+// Get a trailhead by its name or one of its aliases
+func getTrailheadHandler(w http.ResponseWriter, r *http.Request) {
+	th, err := loadTrailhead(db, r.PathValue("name"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Trailhead not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if th.Advisories, err = trailheadAdvisories(db, th.Name, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(th)
+}
+
+// Replace a trailhead's details. A different name renames it and keeps the old name as an
+// alias; retired false brings back a retired trailhead. Requires the adminToken.
+func updateTrailheadHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var th Trailhead
+	if err := json.NewDecoder(r.Body).Decode(&th); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateTrailhead(&th); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	current, err := resolveTrailheadName(tx, r.PathValue("name"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Trailhead not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if th.Name != current {
+		taken, err := trailheadNameTaken(tx, th.Name, current)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if taken {
+			http.Error(w, "A trailhead with that name or alias already exists", http.StatusConflict)
+			return
+		}
+		if err := renameTrailhead(tx, current, th.Name); err != nil {
+			http.Error(w, "Error renaming trailhead: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := saveTrailhead(tx, th, current); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	updated, err := loadTrailhead(tx, th.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+	if th.Name != current {
+		logAction(fmt.Sprintf("Trailhead renamed: %s to %s", current, th.Name))
+	} else {
+		logAction(fmt.Sprintf("Trailhead updated: %s", th.Name))
+	}
+}
+
+// Retire a trailhead so it's no longer suggested. Past hikes there are unaffected. Requires
+// the adminToken.
+func retireTrailheadHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	current, err := resolveTrailheadName(db, r.PathValue("name"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Trailhead not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = db.Exec("UPDATE trailheads SET retired_at = COALESCE(retired_at, ?) WHERE name = ?", time.Now().Format("2006-01-02T15:04:05-07:00"), current)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	logAction(fmt.Sprintf("Trailhead retired: %s", current))
+}
+
+// Merge a duplicate trailhead into the one named by into. The duplicate's name and aliases
+// become aliases of into, which takes any details it's missing from the duplicate. Requires
+// the adminToken.
+func mergeTrailheadHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	duplicate, err := loadTrailhead(tx, r.PathValue("name"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Trailhead not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	target, err := loadTrailhead(tx, r.URL.Query().Get("into"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "into must name the trailhead to merge into", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if duplicate.Name == target.Name {
+		http.Error(w, "A trailhead cannot be merged into itself", http.StatusBadRequest)
+		return
+	}
+
+	if target.MapLink == "" {
+		target.MapLink = duplicate.MapLink
+	}
+	if target.Latitude == nil {
+		target.Latitude, target.Longitude = duplicate.Latitude, duplicate.Longitude
+	}
+	if target.DistanceMiles == 0 {
+		target.DistanceMiles = duplicate.DistanceMiles
+	}
+	if target.ElevationGainFeet == 0 {
+		target.ElevationGainFeet = duplicate.ElevationGainFeet
+	}
+	if target.DurationMinutes == 0 {
+		target.DurationMinutes = duplicate.DurationMinutes
+	}
+	if target.Difficulty == "" {
+		target.Difficulty = duplicate.Difficulty
+	}
+	if len(target.Hazards) == 0 {
+		target.Hazards = duplicate.Hazards
+	}
+	if err := saveTrailhead(tx, target, target.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := renameTrailhead(tx, duplicate.Name, target.Name); err != nil {
+		http.Error(w, "Error moving aliases: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM trailheads WHERE name = ?", duplicate.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	merged, err := loadTrailhead(tx, target.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(merged)
+	logAction(fmt.Sprintf("Trailhead merged: %s into %s", duplicate.Name, target.Name))
+}
+
+// Add another name a trailhead goes by, e.g. "Stairway to Heaven" for Haiku Stairs, so
+// searches for it find the trailhead. Requires the adminToken.
+func addTrailheadAliasHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var body struct {
+		Alias string `json:"alias"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	alias := strings.TrimSpace(body.Alias)
+	if alias == "" {
+		http.Error(w, "alias is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	current, err := resolveTrailheadName(tx, r.PathValue("name"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Trailhead not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	taken, err := trailheadNameTaken(tx, alias, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "A trailhead with that name or alias already exists", http.StatusConflict)
+		return
+	}
+	_, err = tx.Exec("INSERT INTO trailhead_aliases (alias, trailhead_name, created_at) VALUES (?, ?, ?)", alias, current, time.Now().Format("2006-01-02T15:04:05-07:00"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	th, err := loadTrailhead(tx, current)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(th)
+	logAction(fmt.Sprintf("Trailhead alias added: %s for %s", alias, current))
+}
+
+// Remove one of a trailhead's aliases. Requires the adminToken.
+func deleteTrailheadAliasHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	current, err := resolveTrailheadName(db, r.PathValue("name"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Trailhead not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	alias := r.PathValue("alias")
+	result, err := db.Exec("DELETE FROM trailhead_aliases WHERE alias = ? AND trailhead_name = ?", alias, current)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Alias not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	logAction(fmt.Sprintf("Trailhead alias removed: %s from %s", alias, current))
+}
+
+// allTrailheads returns the whole catalog, retired trailheads included, by name
+func allTrailheads() ([]Trailhead, error) {
+	rows, err := db.Query(`
+		SELECT name, map_link, latitude, longitude, distance_miles, elevation_gain_feet, duration_minutes, difficulty, hazards, retired_at IS NOT NULL
+		FROM trailheads ORDER BY name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	trailheads := []Trailhead{}
+	for rows.Next() {
+		var th Trailhead
+		if err := rows.Scan(&th.Name, &th.MapLink, &th.Latitude, &th.Longitude, &th.DistanceMiles, &th.ElevationGainFeet, &th.DurationMinutes, &th.Difficulty, &th.Hazards, &th.Retired); err != nil {
+			return nil, err
+		}
+		trailheads = append(trailheads, th)
+	}
+	return trailheads, rows.Err()
+}
+
+// Export the trailhead catalog as csv or geojson, e.g. to edit it and import it again.
+// Requires the adminToken.
+func exportTrailheadsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "geojson" {
+		http.Error(w, "format must be one of csv or geojson", http.StatusBadRequest)
+		return
+	}
+
+	trailheads, err := allTrailheads()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var content []byte
+	var contentType string
+	switch format {
+	case "csv":
+		content, err = trailheadsCSV(trailheads)
+		contentType = "text/csv; charset=utf-8"
+	case "geojson":
+		content, err = json.MarshalIndent(trailheadsGeoJSON(trailheads), "", "  ")
+		contentType = "application/geo+json"
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="trailheads.%s"`, format))
+	w.Write(content)
+}
+
+func trailheadsCSV(trailheads []Trailhead) ([]byte, error) {
+	formatCoordinate := func(c *float64) string {
+		if c == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*c, 'f', -1, 64)
+	}
+	rows := [][]string{trailheadCSVHeader}
+	for _, th := range trailheads {
+		rows = append(rows, []string{
+			th.Name,
+			th.MapLink,
+			formatCoordinate(th.Latitude),
+			formatCoordinate(th.Longitude),
+			strconv.FormatFloat(th.DistanceMiles, 'f', -1, 64),
+			strconv.Itoa(th.ElevationGainFeet),
+			strconv.Itoa(th.DurationMinutes),
+			th.Difficulty,
+			strings.Join(th.Hazards, ","),
+			strconv.FormatBool(th.Retired),
+		})
+	}
+	var out bytes.Buffer
+	cw := csv.NewWriter(&out)
+	if err := cw.WriteAll(rows); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// trailheadFeature is a trailhead as a GeoJSON Point. Its properties are the trailhead's JSON
+// fields; trailheads without coordinates have a null geometry.
+type trailheadFeature struct {
+	Type       string         `json:"type"`
+	Geometry   *pointGeometry `json:"geometry"`
+	Properties Trailhead      `json:"properties"`
+}
+
+type pointGeometry struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"` // Longitude, latitude
+}
+
+func trailheadsGeoJSON(trailheads []Trailhead) interface{} {
+	features := []trailheadFeature{}
+	for _, th := range trailheads {
+		feature := trailheadFeature{Type: "Feature"}
+		if th.Latitude != nil {
+			feature.Geometry = &pointGeometry{"Point", []float64{*th.Longitude, *th.Latitude}}
+		}
+		th.Latitude, th.Longitude = nil, nil // They're in the geometry
+		feature.Properties = th
+		features = append(features, feature)
+	}
+	return map[string]interface{}{"type": "FeatureCollection", "features": features}
+}
+
+// trailheadImport is a trailhead read from an import file, not yet validated
+type trailheadImport struct {
+	Trailhead
+	where   string          // Where it is in the file, e.g. "line 3", for errors
+	columns map[string]bool // The CSV columns given; nil if every field was
+}
+
+// withExisting fills in the fields a CSV left out from the trailhead it updates
+func (imp trailheadImport) withExisting(existing Trailhead) Trailhead {
+	th := imp.Trailhead
+	if imp.columns == nil {
+		return th
+	}
+	missing := func(column string) bool { return !imp.columns[column] }
+	if missing("mapLink") {
+		th.MapLink = existing.MapLink
+	}
+	// A new map link without coordinates gets them from the link
+	if missing("latitude") && missing("longitude") && th.MapLink == existing.MapLink {
+		th.Latitude, th.Longitude = existing.Latitude, existing.Longitude
+	}
+	if missing("distanceMiles") {
+		th.DistanceMiles = existing.DistanceMiles
+	}
+	if missing("elevationGainFeet") {
+		th.ElevationGainFeet = existing.ElevationGainFeet
+	}
+	if missing("durationMinutes") {
+		th.DurationMinutes = existing.DurationMinutes
+	}
+	if missing("difficulty") {
+		th.Difficulty = existing.Difficulty
+	}
+	if missing("hazards") {
+		th.Hazards = existing.Hazards
+	}
+	if missing("retired") {
+		th.Retired = existing.Retired
+	}
+	return th
+}
+
+// parseTrailheadsCSV reads trailheads from CSV with a header row of trailheadCSVHeader's
+// columns. Only name is required; columns can be in any order.
+func parseTrailheadsCSV(data io.Reader) ([]trailheadImport, error) {
+	cr := csv.NewReader(data)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %v", err)
+	}
+	columns := make(map[string]int)
+	given := make(map[string]bool)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+		given[strings.TrimSpace(name)] = true
+	}
+	if !given["name"] {
+		return nil, fmt.Errorf("the header must include a name column")
+	}
+
+	var imports []trailheadImport
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		number := func(name string) (float64, error) {
+			if field(name) == "" {
+				return 0, nil
+			}
+			v, err := strconv.ParseFloat(field(name), 64)
+			if err != nil {
+				return 0, fmt.Errorf("line %d: %s must be a number", line, name)
+			}
+			return v, nil
+		}
+
+		imp := trailheadImport{where: fmt.Sprintf("line %d", line), columns: given}
+		imp.Name, imp.MapLink, imp.Difficulty = field("name"), field("mapLink"), field("difficulty")
+		var values [5]float64
+		for i, name := range []string{"latitude", "longitude", "distanceMiles", "elevationGainFeet", "durationMinutes"} {
+			if values[i], err = number(name); err != nil {
+				return nil, err
+			}
+		}
+		// Each is set only if given, so validation catches a row with only one of them
+		if field("latitude") != "" {
+			imp.Latitude = &values[0]
+		}
+		if field("longitude") != "" {
+			imp.Longitude = &values[1]
+		}
+		imp.DistanceMiles = values[2]
+		imp.ElevationGainFeet = int(values[3])
+		imp.DurationMinutes = int(values[4])
+		if err := imp.Hazards.Scan(field("hazards")); err != nil {
+			return nil, err
+		}
+		if s := field("retired"); s != "" {
+			if imp.Retired, err = strconv.ParseBool(s); err != nil {
+				return nil, fmt.Errorf("line %d: retired must be true or false", line)
+			}
+		}
+		imports = append(imports, imp)
+	}
+	return imports, nil
+}
+
+// parseTrailheadsGeoJSON reads trailheads from a FeatureCollection of Points, as exported
+func parseTrailheadsGeoJSON(data io.Reader) ([]trailheadImport, error) {
+	var collection struct {
+		Type     string             `json:"type"`
+		Features []trailheadFeature `json:"features"`
+	}
+	if err := json.NewDecoder(data).Decode(&collection); err != nil {
+		return nil, err
+	}
+	if collection.Type != "FeatureCollection" {
+		return nil, fmt.Errorf("expected a FeatureCollection")
+	}
+
+	var imports []trailheadImport
+	for i, feature := range collection.Features {
+		imp := trailheadImport{Trailhead: feature.Properties, where: fmt.Sprintf("feature %d", i+1)}
+		imp.Aliases = nil
+		if feature.Geometry != nil {
+			if feature.Geometry.Type != "Point" || len(feature.Geometry.Coordinates) < 2 {
+				return nil, fmt.Errorf("%s: the geometry must be a Point", imp.where)
+			}
+			lng, lat := feature.Geometry.Coordinates[0], feature.Geometry.Coordinates[1]
+			imp.Latitude, imp.Longitude = &lat, &lng
+		}
+		imports = append(imports, imp)
+	}
+	return imports, nil
+}
+
+// Import trailheads from csv or geojson in the format exported. Trailheads are matched by name
+// or alias and updated, keeping any columns a CSV leaves out; new ones are added. Nothing is
+// imported if any row is invalid. Requires the adminToken.
+func importTrailheadsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var imports []trailheadImport
+	var err error
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "csv":
+		imports, err = parseTrailheadsCSV(r.Body)
+	case "geojson":
+		imports, err = parseTrailheadsGeoJSON(r.Body)
+	default:
+		http.Error(w, "format must be one of csv or geojson", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid import: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var result struct {
+		Created int `json:"created"`
+		Updated int `json:"updated"`
+	}
+	for _, imp := range imports {
+		th := imp.Trailhead
+		existing, err := loadTrailhead(tx, strings.TrimSpace(th.Name))
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// A row under an old name updates the trailhead without renaming it back
+		if existing.Name != "" {
+			th = imp.withExisting(existing)
+			th.Name = existing.Name
+		}
+		if err := validateTrailhead(&th); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid import: %s: %v", imp.where, err), http.StatusBadRequest)
+			return
+		}
+		if existing.Name != "" {
+			result.Updated++
+		} else {
+			result.Created++
+		}
+		if err := saveTrailhead(tx, th, existing.Name); err != nil {
+			http.Error(w, fmt.Sprintf("Error importing %s: %v", th.Name, err), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+	logAction(fmt.Sprintf("Trailheads imported: %d created, %d updated", result.Created, result.Updated))
+}
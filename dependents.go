@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Participants under this age are flagged as minors on the roster
+const adultAge = 18
+
+// Dependent is a minor, or another ward, RSVPd by the adult responsible for them. Each
+// dependent is a participant in their own right, so they count toward the hike's capacity
+// and are checked in and out like anyone else; the guardian accepts the waiver for them.
+type Dependent struct {
+	UUID                 string `json:"uuid"` // Generated on the first RSVP if the client doesn't have one yet; must be new or already the guardian's dependent
+	Name                 string `json:"name"`
+	Age                  int    `json:"age"`
+	GuardianAcknowledged bool   `json:"guardianAcknowledged"`        // The guardian accepts the waiver on the dependent's behalf
+	ParticipantId        int64  `json:"participantId,omitempty"`     // Set in the RSVP response
+	ParticipantStatus    string `json:"participantStatus,omitempty"` // Set in the RSVP response
+	ParticipantToken     string `json:"participantToken,omitempty"`  // Set in the RSVP response
+}
+
+func isMinor(age int) bool {
+	return age >= 0 && age < adultAge
+}
+
+// validateDependents checks every dependent before any of them are added, so a mistake in one
+// doesn't leave the others half RSVPd
+func validateDependents(guardian User, dependents []Dependent) error {
+	for i, d := range dependents {
+		if strings.TrimSpace(d.Name) == "" {
+			return fmt.Errorf("Dependent %d needs a name", i+1)
+		}
+		if d.Age < 0 || d.Age > 120 {
+			return fmt.Errorf("Age for %s must be between 0 and 120", d.Name)
+		}
+		if !d.GuardianAcknowledged {
+			return fmt.Errorf("%s must acknowledge the waiver on behalf of %s", guardian.Name, d.Name)
+		}
+		if d.UUID != "" && d.UUID == guardian.UUID {
+			return fmt.Errorf("%s can't be their own dependent", d.Name)
+		}
+	}
+	return nil
+}
+
+// checkDependentUUIDs makes sure a guardian can only RSVP people who are new or already their
+// dependents. Otherwise a guardian could pass the UUID of someone else on the hike and take
+// over their RSVP.
+func checkDependentUUIDs(guardianUUID string, dependents []Dependent) error {
+	for _, d := range dependents {
+		if d.UUID == "" {
+			continue
+		}
+		var known, theirs bool
+		err := db.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM users WHERE uuid = ?) OR EXISTS (SELECT 1 FROM hike_users WHERE user_uuid = ?),
+				EXISTS (SELECT 1 FROM hike_users WHERE user_uuid = ? AND guardian_uuid = ?)
+		`, d.UUID, d.UUID, d.UUID, guardianUUID).Scan(&known, &theirs)
+		if err != nil {
+			return err
+		}
+		if known && !theirs {
+			return &dependentTakenError{d.Name}
+		}
+	}
+	return nil
+}
+
+// dependentTakenError is returned for a dependent whose UUID belongs to someone else
+type dependentTakenError struct {
+	name string
+}
+
+func (e *dependentTakenError) Error() string {
+	return fmt.Sprintf("%s is already registered to someone else", e.name)
+}
+
+// addDependents RSVPs each dependent to the hike under their guardian and records the waiver
+// the guardian accepted for them. The dependents are RSVPd together in one transaction, so
+// either all of them are on the hike or none are. They are returned with their participant
+// details.
+func addDependents(joinCode string, guardian User, dependents []Dependent, userAgent, ipAddress string) ([]Dependent, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // Rollback if not committed
+
+	added := make([]Dependent, 0, len(dependents))
+	notify := make([]bool, 0, len(dependents))
+	for _, d := range dependents {
+		if d.UUID == "" {
+			if d.UUID, err = generateSecureLinkCode(); err != nil {
+				return nil, err
+			}
+		}
+		d.Name = strings.TrimSpace(d.Name)
+
+		// The leader reaches a dependent through their guardian
+		_, err = tx.Exec(`
+			INSERT OR REPLACE INTO users (uuid, name, phone, license_plate, emergency_contact)
+			VALUES (?, ?, ?, '', ?)
+		`, d.UUID, d.Name, guardian.Phone, guardian.EmergencyContact)
+		if err != nil {
+			return nil, err
+		}
+
+		var changed bool
+		d.ParticipantId, d.ParticipantStatus, d.ParticipantToken, changed, err = rsvpParticipant(tx, joinCode, d.UUID)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec("UPDATE hike_users SET guardian_uuid = ?, age = ? WHERE id = ?", guardian.UUID, d.Age, d.ParticipantId)
+		if err != nil {
+			return nil, err
+		}
+		added = append(added, d)
+		notify = append(notify, changed)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	for i, d := range added {
+		if notify[i] {
+			hikeEvents.publish(joinCode, eventRSVP, d.ParticipantId, d.ParticipantStatus)
+		}
+		if err := recordGuardianWaiverSignature(d, guardian, joinCode, userAgent, ipAddress); err != nil {
+			return added, err
+		}
+	}
+	return added, nil
+}
+
+// guardianAcknowledgment is added to the end of the waiver a guardian accepts for a dependent
+func guardianAcknowledgment(guardian User, d Dependent) string {
+	return fmt.Sprintf("\n\nGuardian Acknowledgment:\n\nI, %s, am the parent or legal guardian of %s (age %d). I have read this waiver and agree to it on their behalf.\n",
+		guardian.Name, d.Name, d.Age)
+}
+
+// removeDependents takes a guardian's dependents off a hike along with the guardian. Only
+// dependents who haven't started hiking are removed, the same as for the guardian. The
+// waivers signed for them stay in the waiver log. It returns the removed participant ids.
+func removeDependents(tx *sql.Tx, joinCode, guardianUUID string) ([]int64, error) {
+	rows, err := tx.Query(`
+		DELETE FROM hike_users
+		WHERE hike_join_code = ? AND guardian_uuid = ? AND status IN ('rsvp', 'waitlist')
+		RETURNING id
+	`, joinCode, guardianUUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var removed []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return removed, err
+		}
+		removed = append(removed, id)
+	}
+	return removed, rows.Err()
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hikes are normally found through a shared join link. A leader can also make a hike public,
+// which lists it in its organization's directory: JSON for apps, and an HTML page and RSS
+// feed a club can embed on its own website.
+
+const (
+	difficultyEasy      = "easy"
+	difficultyModerate  = "moderate"
+	difficultyStrenuous = "strenuous"
+)
+
+// validateDifficulty checks a hike's difficulty rating; empty means not rated
+func validateDifficulty(difficulty string) error {
+	switch difficulty {
+	case "", difficultyEasy, difficultyModerate, difficultyStrenuous:
+		return nil
+	}
+	return fmt.Errorf("difficulty must be one of %s, %s or %s", difficultyEasy, difficultyModerate, difficultyStrenuous)
+}
+
+// organizationSlug is how an organization is named in a URL, e.g. "Sierra Club O'ahu" is
+// sierra-club-o-ahu
+func organizationSlug(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(strings.TrimSpace(name)) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// publicHikeFilter narrows an organization's directory
+type publicHikeFilter struct {
+	from, to     time.Time // Hikes starting in [from, to); to is zero for no end
+	trailhead    string    // Lowercase; matches any part of the trailhead name
+	difficulties []string
+	// Limits on the trail; 0 for no limit. Hikes that don't say how long or steep they are
+	// aren't left out.
+	maxDistanceMiles     float64
+	maxElevationGainFeet int
+	maxDurationMinutes   int
+	avoidHazards         []string
+}
+
+// parsePublicHikeFilter reads the from, to, trailhead, difficulty, maxDistance (miles),
+// maxElevationGain (feet), maxDuration (minutes) and avoid (hazards) query parameters. Dates
+// are YYYY-MM-DD and both ends are included; from defaults to now.
+func parsePublicHikeFilter(r *http.Request, now time.Time) (publicHikeFilter, error) {
+	query := r.URL.Query()
+	filter := publicHikeFilter{from: now, trailhead: strings.ToLower(strings.TrimSpace(query.Get("trailhead")))}
+	if from := query.Get("from"); from != "" {
+		date, err := time.ParseInLocation("2006-01-02", from, time.Local)
+		if err != nil {
+			return filter, fmt.Errorf("from must be a date like 2006-01-02")
+		}
+		if date.After(now) {
+			filter.from = date
+		}
+	}
+	if to := query.Get("to"); to != "" {
+		date, err := time.ParseInLocation("2006-01-02", to, time.Local)
+		if err != nil {
+			return filter, fmt.Errorf("to must be a date like 2006-01-02")
+		}
+		filter.to = date.AddDate(0, 0, 1)
+	}
+	if difficulty := query.Get("difficulty"); difficulty != "" {
+		for _, d := range strings.Split(difficulty, ",") {
+			d = strings.TrimSpace(d)
+			if err := validateDifficulty(d); err != nil {
+				return filter, err
+			}
+			filter.difficulties = append(filter.difficulties, d)
+		}
+	}
+	if maxDistance := query.Get("maxDistance"); maxDistance != "" {
+		miles, err := strconv.ParseFloat(maxDistance, 64)
+		if err != nil || miles < 0 {
+			return filter, fmt.Errorf("maxDistance must be a number of miles")
+		}
+		filter.maxDistanceMiles = miles
+	}
+	if maxElevationGain := query.Get("maxElevationGain"); maxElevationGain != "" {
+		feet, err := strconv.Atoi(maxElevationGain)
+		if err != nil || feet < 0 {
+			return filter, fmt.Errorf("maxElevationGain must be a whole number of feet")
+		}
+		filter.maxElevationGainFeet = feet
+	}
+	if maxDuration := query.Get("maxDuration"); maxDuration != "" {
+		minutes, err := strconv.Atoi(maxDuration)
+		if err != nil || minutes < 0 {
+			return filter, fmt.Errorf("maxDuration must be a whole number of minutes")
+		}
+		filter.maxDurationMinutes = minutes
+	}
+	if avoid := query.Get("avoid"); avoid != "" {
+		for _, hazard := range strings.Split(avoid, ",") {
+			hazard = strings.TrimSpace(hazard)
+			if err := validateHazard(hazard); err != nil {
+				return filter, err
+			}
+			filter.avoidHazards = append(filter.avoidHazards, hazard)
+		}
+	}
+	return filter, nil
+}
+
+func (f publicHikeFilter) matches(hike Hike) bool {
+	if hike.StartTime.Before(f.from) || (!f.to.IsZero() && !hike.StartTime.Before(f.to)) {
+		return false
+	}
+	if f.trailhead != "" && !strings.Contains(strings.ToLower(hike.TrailheadName), f.trailhead) {
+		return false
+	}
+	if len(f.difficulties) > 0 {
+		rated := false
+		for _, d := range f.difficulties {
+			rated = rated || hike.Difficulty == d
+		}
+		if !rated {
+			return false
+		}
+	}
+	if f.maxDistanceMiles > 0 && hike.DistanceMiles > f.maxDistanceMiles {
+		return false
+	}
+	if f.maxElevationGainFeet > 0 && hike.ElevationGainFeet > f.maxElevationGainFeet {
+		return false
+	}
+	if f.maxDurationMinutes > 0 && hike.DurationMinutes > f.maxDurationMinutes {
+		return false
+	}
+	for _, hazard := range f.avoidHazards {
+		if hike.Hazards.Has(hazard) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicHikes returns an organization's upcoming public hikes that match the filter, soonest
+// first. Only what someone deciding whether to RSVP needs is filled in. org is either a
+// registered organization or has only its Slug set.
+func publicHikes(org Organization, filter publicHikeFilter) ([]Hike, error) {
+	rows, err := db.Query(`
+		SELECT h.name, h.organization, h.trailhead_name, h.trailhead_map_link, h.start_time, h.join_code, h.description,
+		       h.max_participants, h.duration_minutes, h.difficulty, h.distance_miles, h.elevation_gain_feet, h.hazards,
+		       h.created_at, u.name
+		FROM hikes AS h JOIN users AS u ON h.leader_uuid = u.uuid
+		WHERE h.public AND h.status = 'open' AND h.organization != ''
+		ORDER BY h.start_time
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hikes := []Hike{}
+	for rows.Next() {
+		var h Hike
+		err := rows.Scan(&h.Name, &h.Organization, &h.TrailheadName, &h.TrailheadMapLink, &h.StartTime, &h.JoinCode, &h.DescriptionMarkdown,
+			&h.MaxParticipants, &h.DurationMinutes, &h.Difficulty, &h.DistanceMiles, &h.ElevationGainFeet, &h.Hazards,
+			&h.CreatedAt, &h.Leader.Name)
+		if err != nil {
+			return nil, err
+		}
+		// Hikes of a registered organization use its name; others are free text, matched by slug
+		if org.Id != 0 && !strings.EqualFold(h.Organization, org.Name) {
+			continue
+		}
+		if (org.Id == 0 && organizationSlug(h.Organization) != org.Slug) || !filter.matches(h) {
+			continue
+		}
+		h.Public = true
+		h.Status = "open"
+		populateDescriptionHTML(&h)
+		hikes = append(hikes, h)
+	}
+	return hikes, rows.Err()
+}
+
+// List an organization's upcoming public hikes. format=json (the default), html for a page to
+// embed in an iframe, or rss.
+func publicHikesHandler(w http.ResponseWriter, r *http.Request) {
+	orgSlug := organizationSlug(r.PathValue("org"))
+	filter, err := parsePublicHikeFilter(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "html" && format != "rss" {
+		http.Error(w, "format must be one of json, html or rss", http.StatusBadRequest)
+		return
+	}
+
+	org, err := loadOrganization(db, orgSlug)
+	if err == sql.ErrNoRows {
+		org, err = Organization{Slug: orgSlug, Name: orgSlug}, nil
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hikes, err := publicHikes(org, filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	orgName := org.Name
+	if org.Id == 0 && len(hikes) > 0 {
+		orgName = hikes[0].Organization
+	}
+
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hikes)
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = publicHikesTemplate.Execute(w, publicHikesPage{Organization: orgName, LogoURL: org.LogoURL, Origin: requestOrigin(r), Hikes: hikes})
+	case "rss":
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		err = writePublicHikesRSS(w, orgName, requestOrigin(r), hikes)
+	}
+	if err != nil {
+		log.Printf("Error writing the %s hike directory for %s: %v", format, orgSlug, err)
+	}
+}
+
+// requestOrigin is the scheme and host the request was made to, for links back to the app
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// hikeJoinURL is the link participants use to RSVP
+func hikeJoinURL(origin, joinCode string) string {
+	return origin + "/?code=" + joinCode
+}
+
+type publicHikesPage struct {
+	Organization string
+	LogoURL      string
+	Origin       string
+	Hikes        []Hike
+}
+
+var publicHikesTemplate = template.Must(template.New("public-hikes").Funcs(template.FuncMap{
+	"joinURL":     hikeJoinURL,
+	"hazards":     func(h Hazards) string { return strings.ReplaceAll(strings.Join(h, ", "), "-", " ") },
+	"startTime":   func(t time.Time) string { return t.Format("Mon, Jan 2 3:04 PM") },
+	"description": func(h Hike) template.HTML { return template.HTML(h.DescriptionHTML) }, // Sanitized by populateDescriptionHTML
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Organization}} Hikes</title>
+<style>
+body { font-family: sans-serif; margin: 0; padding: 8px; }
+.hike { border-bottom: 1px solid #ddd; padding: 8px 0; }
+.hike h3 { margin: 0 0 4px; }
+.hike p { margin: 2px 0; }
+.difficulty { text-transform: capitalize; color: #555; }
+.logo { max-height: 48px; }
+</style>
+</head>
+<body>
+{{if .LogoURL}}<img class="logo" src="{{.LogoURL}}" alt="{{.Organization}}">
+{{end}}<h2>Upcoming {{.Organization}} Hikes</h2>
+{{range .Hikes}}<div class="hike">
+<h3><a href="{{joinURL $.Origin .JoinCode}}" target="_blank" rel="noopener">{{.Name}}</a></h3>
+<p>{{startTime .StartTime}} &ndash; {{if .TrailheadMapLink}}<a href="{{.TrailheadMapLink}}" target="_blank" rel="noopener">{{.TrailheadName}}</a>{{else}}{{.TrailheadName}}{{end}}</p>
+<p>Led by {{.Leader.Name}}{{if .Difficulty}} &middot; <span class="difficulty">{{.Difficulty}}</span>{{end}}{{if .DistanceMiles}} &middot; {{.DistanceMiles}} mi{{end}}{{if .ElevationGainFeet}} &middot; {{.ElevationGainFeet}} ft gain{{end}}</p>
+{{if .Hazards}}<p>Hazards: {{hazards .Hazards}}</p>{{end}}
+{{description .}}
+</div>
+{{else}}<p>No upcoming public hikes.</p>
+{{end}}</body>
+</html>
+`))
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Description string  `xml:"description"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+func writePublicHikesRSS(w http.ResponseWriter, orgName, origin string, hikes []Hike) error {
+	feed := rssFeed{Version: "2.0", Channel: rssChannel{
+		Title:       orgName + " Hikes",
+		Link:        origin,
+		Description: "Upcoming public hikes with " + orgName,
+		Items:       []rssItem{},
+	}}
+	for _, h := range hikes {
+		description := fmt.Sprintf("<p>%s at %s, led by %s</p>%s",
+			h.StartTime.Format("Mon, Jan 2 3:04 PM"), template.HTMLEscapeString(h.TrailheadName), template.HTMLEscapeString(h.Leader.Name), h.DescriptionHTML)
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       fmt.Sprintf("%s (%s)", h.Name, h.StartTime.Format("Jan 2")),
+			Link:        hikeJoinURL(origin, h.JoinCode),
+			Description: description,
+			GUID:        rssGUID{Value: h.JoinCode},
+			PubDate:     h.CreatedAt.Format(time.RFC1123Z),
+		})
+	}
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	return encoder.Encode(feed)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Changes to a hike and its roster are published to an in-process hub and streamed to leader
+// consoles as Server-Sent Events. Each event has an id that increases across the whole server;
+// a console that loses its connection reconnects with the last id it saw (EventSource sends it
+// as the Last-Event-ID header) and is sent what it missed.
+
+// Event types, used as the SSE event name
+const (
+	eventSync    = "sync"    // Sent on connect when the client can't be caught up from history; reload everything
+	eventRSVP    = "rsvp"    // A participant RSVPd or joined the waitlist
+	eventUnRSVP  = "unrsvp"  // A participant was removed from the roster
+	eventStatus  = "status"  // A participant's status changed
+	eventHike    = "hike"    // The hike's details or status changed
+	eventCarpool = "carpool" // Someone offered, asked for or was given a ride
+)
+
+// How many recent events are kept per hike for reconnecting clients
+const hikeEventHistory = 100
+
+// A hike nobody is watching is forgotten once its newest event is this old, as is a hike as
+// soon as it closes; a console that reconnects later is told to load everything
+const hikeEventIdle = 24 * time.Hour
+
+// How often a comment is sent on an idle stream so proxies don't close it
+const hikeEventKeepAlive = 25 * time.Second
+
+// HikeEvent is one change to a hike, as sent in an SSE data field
+type HikeEvent struct {
+	Id            int64     `json:"id"`
+	Type          string    `json:"type"`
+	JoinCode      string    `json:"joinCode"`
+	ParticipantId int64     `json:"participantId,omitempty"`
+	Status        string    `json:"status,omitempty"` // The participant's new status, or the hike's for hike events
+	published     time.Time // Not sent; used to forget hikes that have gone quiet
+}
+
+// eventHub fans events out to the clients watching each hike
+type eventHub struct {
+	mu          sync.Mutex
+	lastId      int64
+	history     map[string][]HikeEvent // Most recent events for each hike, oldest first
+	replayFrom  map[string]int64       // Events for the hike after this id are all in history
+	floorId     int64                  // replayFrom for hikes with no history; raised when a hike is forgotten
+	lastPruned  time.Time              // When pruneIdle last ran; it runs from publish at most once per hikeEventIdle
+	subscribers map[string]map[chan HikeEvent]struct{}
+}
+
+// Ids start from the time the server started so ids from before a restart are never reused
+func newEventHub() *eventHub {
+	start := time.Now().UnixMilli()
+	return &eventHub{
+		lastId:      start,
+		floorId:     start,
+		lastPruned:  time.Now(),
+		history:     make(map[string][]HikeEvent),
+		replayFrom:  make(map[string]int64),
+		subscribers: make(map[string]map[chan HikeEvent]struct{}),
+	}
+}
+
+var hikeEvents = newEventHub()
+
+// publish records an event for a hike and sends it to everyone watching. A client that has
+// fallen too far behind is disconnected; it reconnects and catches up from history.
+func (h *eventHub) publish(joinCode, eventType string, participantId int64, status string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(h.lastPruned) >= hikeEventIdle {
+		h.pruneIdle(now)
+	}
+
+	if _, ok := h.history[joinCode]; !ok {
+		h.replayFrom[joinCode] = h.floorId
+	}
+	h.lastId++
+	event := HikeEvent{Id: h.lastId, Type: eventType, JoinCode: joinCode, ParticipantId: participantId, Status: status, published: now}
+
+	history := append(h.history[joinCode], event)
+	if len(history) > hikeEventHistory {
+		h.replayFrom[joinCode] = history[0].Id
+		history = history[1:]
+	}
+	h.history[joinCode] = history
+
+	for ch := range h.subscribers[joinCode] {
+		select {
+		case ch <- event:
+		default:
+			delete(h.subscribers[joinCode], ch)
+			close(ch)
+		}
+	}
+
+	if eventType == eventHike && status == "closed" {
+		h.forget(joinCode)
+	}
+}
+
+// pruneIdle forgets the hikes nobody is watching whose newest event is older than hikeEventIdle.
+// The caller must hold h.mu.
+func (h *eventHub) pruneIdle(now time.Time) {
+	h.lastPruned = now
+	for joinCode, history := range h.history {
+		if len(h.subscribers[joinCode]) == 0 && now.Sub(history[len(history)-1].published) >= hikeEventIdle {
+			h.forget(joinCode)
+		}
+	}
+}
+
+// forget drops a hike's history. Clients that reconnect with an id from before now are sent a
+// sync event. The caller must hold h.mu.
+func (h *eventHub) forget(joinCode string) {
+	delete(h.history, joinCode)
+	delete(h.replayFrom, joinCode)
+	h.floorId = h.lastId
+}
+
+// subscribe starts watching a hike. If lastEventId is set, the events after it are returned to
+// be sent first; complete is false if some of them are no longer in history. The returned
+// channel is closed if the subscriber falls behind.
+func (h *eventHub) subscribe(joinCode string, lastEventId int64) (events chan HikeEvent, missed []HikeEvent, complete bool, latestId int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	replayFrom, ok := h.replayFrom[joinCode]
+	if !ok {
+		replayFrom = h.floorId
+	}
+	complete = lastEventId != 0 && lastEventId >= replayFrom && lastEventId <= h.lastId
+	if complete {
+		for _, event := range h.history[joinCode] {
+			if event.Id > lastEventId {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	events = make(chan HikeEvent, 16)
+	if h.subscribers[joinCode] == nil {
+		h.subscribers[joinCode] = make(map[chan HikeEvent]struct{})
+	}
+	h.subscribers[joinCode][events] = struct{}{}
+	return events, missed, complete, h.lastId
+}
+
+// unsubscribe stops sending events to a channel returned by subscribe
+func (h *eventHub) unsubscribe(joinCode string, events chan HikeEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[joinCode][events]; ok {
+		delete(h.subscribers[joinCode], events)
+		close(events)
+	}
+	if len(h.subscribers[joinCode]) == 0 {
+		delete(h.subscribers, joinCode)
+	}
+}
+
+// publishPromotions publishes the status change of each participant moved off the waitlist
+func publishPromotions(joinCode string, promoted []int64) {
+	for _, id := range promoted {
+		hikeEvents.publish(joinCode, eventStatus, id, "rsvp")
+	}
+}
+
+// Stream changes to a hike's roster as Server-Sent Events. Requires a leaderCode that can view
+// the roster. Resumes after the Last-Event-ID header, or the lastEventId query parameter for
+// clients that can't set headers.
+func hikeEventsHandler(w http.ResponseWriter, r *http.Request) {
+	access, ok := requireHikeAccess(w, r, permViewRoster)
+	if !ok {
+		return
+	}
+
+	lastEventIdStr := r.Header.Get("Last-Event-ID")
+	if lastEventIdStr == "" {
+		lastEventIdStr = r.URL.Query().Get("lastEventId")
+	}
+	var lastEventId int64
+	if lastEventIdStr != "" {
+		var err error
+		if lastEventId, err = strconv.ParseInt(lastEventIdStr, 10, 64); err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	events, missed, complete, latestId := hikeEvents.subscribe(access.joinCode, lastEventId)
+	defer hikeEvents.unsubscribe(access.joinCode, events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Don't let nginx buffer the stream
+	rc := http.NewResponseController(w)
+
+	fmt.Fprintf(w, "retry: %d\n\n", 3000)
+	if !complete {
+		writeHikeEvent(w, HikeEvent{Id: latestId, Type: eventSync, JoinCode: access.joinCode})
+	}
+	for _, event := range missed {
+		writeHikeEvent(w, event)
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(hikeEventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				// Fell behind; the client reconnects and catches up from history
+				return
+			}
+			writeHikeEvent(w, event)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeHikeEvent(w http.ResponseWriter, event HikeEvent) {
+	data, _ := json.Marshal(event)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+var rosterExportHeader = []string{"Name", "Phone", "License Plate", "Emergency Contact", "Status", "Waiver Signed", "Minor", "Guardian"}
+
+// Export a hike's roster as csv, xlsx or a printable pdf sign-in sheet.
+// Requires a leaderCode that can view the roster.
+func exportHikeParticipantsHandler(w http.ResponseWriter, r *http.Request) {
+	access, ok := requireHikeAccess(w, r, permViewRoster)
+	if !ok {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "xlsx" && format != "pdf" {
+		http.Error(w, "format must be one of csv, xlsx or pdf", http.StatusBadRequest)
+		return
+	}
+
+	// Closed hikes can still be exported, e.g. for a report after the hike
+	var hike Hike
+	err := db.QueryRow(`
+		SELECT h.name, h.organization, h.trailhead_name, h.start_time, h.join_code, u.name, u.phone
+		FROM hikes AS h JOIN users AS u ON h.leader_uuid = u.uuid
+		WHERE h.join_code = ?
+	`, access.joinCode).Scan(&hike.Name, &hike.Organization, &hike.TrailheadName, &hike.StartTime, &hike.JoinCode, &hike.Leader.Name, &hike.Leader.Phone)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Hike not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	participants, err := hikeParticipants(access.joinCode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Sort by name, ignoring the ʻokina so ʻAna sorts with the A's
+	sortKey := strings.NewReplacer("ʻ", "", "'", "", "‘", "")
+	sort.SliceStable(participants, func(i, j int) bool {
+		return strings.ToLower(sortKey.Replace(participants[i].User.Name)) < strings.ToLower(sortKey.Replace(participants[j].User.Name))
+	})
+
+	var content []byte
+	var contentType string
+	switch format {
+	case "csv":
+		content, err = rosterCSV(participants)
+		contentType = "text/csv; charset=utf-8"
+	case "xlsx":
+		content, err = writeXLSX("Roster", rosterRows(participants))
+		contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	case "pdf":
+		content = rosterSignInSheet(hike, participants, time.Now())
+		contentType = "application/pdf"
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="hike_participants_%s.%s"`, access.joinCode, format))
+	w.Write(content)
+	logAction(fmt.Sprintf("Roster for hike %s exported as %s by %s", access.joinCode, format, access.role))
+}
+
+// rosterRows is the roster as a table, header first
+func rosterRows(participants []Participant) [][]string {
+	rows := [][]string{rosterExportHeader}
+	for _, p := range participants {
+		rows = append(rows, []string{
+			p.User.Name,
+			formatPhone(p.User.Phone),
+			p.User.LicensePlate,
+			formatPhone(p.User.EmergencyContact),
+			p.Status,
+			formatWaiverTime(p.Waiver),
+			minorLabel(p),
+			p.GuardianName,
+		})
+	}
+	return rows
+}
+
+func rosterCSV(participants []Participant) ([]byte, error) {
+	var out bytes.Buffer
+	cw := csv.NewWriter(&out)
+	if err := cw.WriteAll(rosterRows(participants)); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// minorLabel flags a minor with their age, e.g. "Yes (12)"
+func minorLabel(p Participant) string {
+	if !p.Minor {
+		return ""
+	}
+	return fmt.Sprintf("Yes (%d)", p.Age)
+}
+
+func formatWaiverTime(signedAt time.Time) string {
+	if signedAt.IsZero() {
+		return "Not signed"
+	}
+	return signedAt.Format("2006-01-02 15:04 MST")
+}
+
+// formatPhone shows a 10 digit number as (808) 555-1234, the way the app displays them;
+// anything else is returned as entered
+func formatPhone(phone string) string {
+	var digits strings.Builder
+	for _, r := range phone {
+		if r >= '0' && r <= '9' {
+			digits.WriteRune(r)
+		}
+	}
+	d := digits.String()
+	if len(d) != 10 {
+		return phone
+	}
+	return fmt.Sprintf("(%s) %s-%s", d[:3], d[3:6], d[6:])
+}
+
+var signInStatusLabels = map[string]string{
+	"rsvp": "RSVP", "active": "Hiking", "finished": "Finished", "overdue": "OVERDUE",
+	"no_show": "No-Show", "dropped_out": "Dropped Out",
+}
+
+// rosterSignInSheet lays the roster out as a landscape sign-in sheet with room to record
+// times in and out. Waitlisted participants aren't expected at the trailhead and are left
+// off; the rest of the last page is left blank for walk-ups.
+func rosterSignInSheet(hike Hike, participants []Participant, generatedAt time.Time) []byte {
+	const (
+		pageWidth, pageHeight = pdfLetterHeight, pdfLetterWidth
+		margin                = 36.0
+		tableTop              = 112.0
+		rowHeight             = 22.0
+		headerHeight          = 20.0
+		footerY               = pageHeight - 20
+	)
+	columns := []struct {
+		title string
+		width float64
+	}{
+		{"#", 24}, {"Name", 140}, {"Phone", 86}, {"License Plate", 80}, {"Emergency Contact", 96},
+		{"Waiver Signed", 96}, {"Status", 60}, {"Time In", 46}, {"Time Out", 46}, {"Initials", 46},
+	}
+
+	var onSheet []Participant
+	for _, p := range participants {
+		if p.Status != "waitlist" {
+			onSheet = append(onSheet, p)
+		}
+	}
+	rowsPerPage := int(math.Floor((footerY - 16 - tableTop - headerHeight) / rowHeight))
+	pageCount := (len(onSheet) + rowsPerPage - 1) / rowsPerPage
+	if pageCount == 0 {
+		pageCount = 1
+	}
+
+	doc := newPDFDocument("Sign-In Sheet: "+hike.Name, pageWidth, pageHeight)
+	for page := 0; page < pageCount; page++ {
+		doc.AddPage()
+		doc.Text(margin, 54, 16, true, pdfFit("Sign-In Sheet: "+hike.Name, pageWidth-2*margin, 16, true))
+		details := fmt.Sprintf("Trailhead: %s     Start: %s", hike.TrailheadName, hike.StartTime.Format("Mon Jan 2, 2006 3:04 PM"))
+		doc.Text(margin, 74, 10, false, pdfFit(details, pageWidth-2*margin, 10, false))
+		leader := fmt.Sprintf("Leader: %s %s", hike.Leader.Name, formatPhone(hike.Leader.Phone))
+		if hike.Organization != "" {
+			leader += "     Organization: " + hike.Organization
+		}
+		doc.Text(margin, 90, 10, false, pdfFit(leader, pageWidth-2*margin, 10, false))
+
+		doc.FillRect(margin, tableTop, pageWidth-2*margin, headerHeight, 0.88)
+		x := margin
+		for _, c := range columns {
+			doc.Text(x+3, tableTop+14, 9, true, pdfFit(c.title, c.width-6, 9, true))
+			x += c.width
+		}
+
+		y := tableTop + headerHeight
+		for i := 0; i < rowsPerPage; i++ {
+			index := page*rowsPerPage + i
+			if index < len(onSheet) {
+				p := onSheet[index]
+				status := signInStatusLabels[p.Status]
+				if status == "" {
+					status = p.Status
+				}
+				name := p.User.Name
+				if p.Minor {
+					name = fmt.Sprintf("%s (minor, %d)", name, p.Age)
+				}
+				cells := []string{
+					fmt.Sprint(index + 1), name, formatPhone(p.User.Phone), p.User.LicensePlate,
+					formatPhone(p.User.EmergencyContact), formatWaiverTime(p.Waiver), status, "", "", "",
+				}
+				x = margin
+				for j, c := range columns {
+					doc.Text(x+3, y+15, 9, false, pdfFit(cells[j], c.width-6, 9, false))
+					x += c.width
+				}
+			}
+			y += rowHeight
+			doc.Line(margin, y, pageWidth-margin, y, 0.5)
+		}
+
+		// Grid
+		doc.Line(margin, tableTop, pageWidth-margin, tableTop, 0.5)
+		x = margin
+		for _, c := range columns {
+			doc.Line(x, tableTop, x, y, 0.5)
+			x += c.width
+		}
+		doc.Line(x, tableTop, x, y, 0.5)
+
+		footer := fmt.Sprintf("Hike %s     Generated %s     Page %d of %d", hike.JoinCode, generatedAt.Format("2006-01-02 15:04 MST"), page+1, pageCount)
+		doc.Text(margin, footerY, 8, false, footer)
+	}
+	return doc.Bytes()
+}
@@ -5,21 +5,21 @@ go 1.24.4
 require (
 	github.com/go-rod/rod v0.116.2
 	github.com/mattn/go-sqlite3 v1.14.28
+	github.com/microcosm-cc/bluemonday v1.0.27
 	github.com/stretchr/testify v1.10.0
+	github.com/yuin/goldmark v1.7.12
 )
 
 require (
 	github.com/aymerick/douceur v0.2.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/gorilla/css v1.0.1 // indirect
-	github.com/microcosm-cc/bluemonday v1.0.27 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/ysmood/fetchup v0.2.3 // indirect
 	github.com/ysmood/goob v0.4.0 // indirect
 	github.com/ysmood/got v0.40.0 // indirect
 	github.com/ysmood/gson v0.7.3 // indirect
 	github.com/ysmood/leakless v0.9.0 // indirect
-	github.com/yuin/goldmark v1.7.12 // indirect
 	golang.org/x/net v0.26.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
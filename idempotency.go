@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// A client that isn't sure a request went through, e.g. one the service worker queued while
+// offline, sends it again with the same Idempotency-Key header. The first response for a key
+// is stored and replayed for every retry, so the change is only made once.
+
+// How long a key and its response are kept
+const idempotencyKeyLifetime = 24 * time.Hour
+
+// A request still marked in progress after this long is assumed to have died with the server
+const idempotencyLockTimeout = time.Minute
+
+// Idempotency keys longer than this are refused
+const maxIdempotencyKeyLength = 255
+
+// idempotent wraps a handler that changes something so requests with an Idempotency-Key
+// header are only handled once. Requests without the header are passed straight through.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		// A retry has to be the same request; the body is read here and handed on to the handler
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.RequestURI()+"\n"), body...))
+		requestHash := hex.EncodeToString(sum[:])
+
+		claimed, stored, err := claimIdempotencyKey(key, requestHash, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !claimed {
+			switch {
+			case stored.requestHash != requestHash:
+				http.Error(w, "Idempotency-Key has already been used for a different request", http.StatusUnprocessableEntity)
+			case stored.statusCode == 0:
+				http.Error(w, "A request with this Idempotency-Key is still being processed", http.StatusConflict)
+			default:
+				if stored.contentType != "" {
+					w.Header().Set("Content-Type", stored.contentType)
+				}
+				if stored.etag != "" {
+					w.Header().Set("ETag", stored.etag)
+				}
+				if stored.location != "" {
+					w.Header().Set("Location", stored.location)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.statusCode)
+				w.Write(stored.body)
+			}
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		next(recorder, r)
+
+		// A server error may not happen again, so let the client retry for real
+		if recorder.statusCode() >= http.StatusInternalServerError {
+			_, err = db.Exec("DELETE FROM idempotency_keys WHERE key = ?", key)
+		} else {
+			_, err = db.Exec(`
+				UPDATE idempotency_keys SET status_code = ?, content_type = ?, etag = ?, location = ?, response_body = ?
+				WHERE key = ?
+			`, recorder.statusCode(), recorder.Header().Get("Content-Type"), recorder.Header().Get("ETag"), recorder.Header().Get("Location"),
+				recorder.body.Bytes(), key)
+		}
+		if err != nil {
+			log.Printf("Error storing the response for idempotency key %s: %v", key, err)
+		}
+	}
+}
+
+// storedResponse is the response saved for an idempotency key
+type storedResponse struct {
+	requestHash string
+	statusCode  int // 0 while the request is in progress
+	contentType string
+	etag        string
+	location    string
+	body        []byte
+}
+
+// claimIdempotencyKey marks a key as in progress. If the key has already been used, claimed is
+// false and what was stored for it is returned instead. Expired keys are cleared out first.
+func claimIdempotencyKey(key, requestHash string, now time.Time) (bool, storedResponse, error) {
+	var stored storedResponse
+	tx, err := db.Begin()
+	if err != nil {
+		return false, stored, err
+	}
+	defer tx.Rollback() // Rollback if not committed
+
+	_, err = tx.Exec("DELETE FROM idempotency_keys WHERE created_at < ?", formatIdempotencyTime(now.Add(-idempotencyKeyLifetime)))
+	if err != nil {
+		return false, stored, err
+	}
+	_, err = tx.Exec(`
+		DELETE FROM idempotency_keys
+		WHERE key = ? AND status_code IS NULL AND created_at < ?
+	`, key, formatIdempotencyTime(now.Add(-idempotencyLockTimeout)))
+	if err != nil {
+		return false, stored, err
+	}
+
+	var statusCode sql.NullInt64
+	err = tx.QueryRow("SELECT request_hash, status_code, content_type, etag, location, response_body FROM idempotency_keys WHERE key = ?", key).
+		Scan(&stored.requestHash, &statusCode, &stored.contentType, &stored.etag, &stored.location, &stored.body)
+	if err == nil {
+		stored.statusCode = int(statusCode.Int64)
+		return false, stored, tx.Commit()
+	}
+	if err != sql.ErrNoRows {
+		return false, stored, err
+	}
+
+	_, err = tx.Exec("INSERT INTO idempotency_keys (key, request_hash, created_at) VALUES (?, ?, ?)", key, requestHash, formatIdempotencyTime(now))
+	if err != nil {
+		return false, stored, err
+	}
+	return true, stored, tx.Commit()
+}
+
+// Keys are stored in UTC so created_at compares correctly as text
+func formatIdempotencyTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05-07:00")
+}
+
+// responseRecorder passes a response through to the client and keeps a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+func (rr *responseRecorder) statusCode() int {
+	if rr.status == 0 {
+		return http.StatusOK
+	}
+	return rr.status
+}
@@ -9,7 +9,6 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"sort"
 	"strings"
 	"text/template"
 	"time"
@@ -21,11 +20,22 @@ import (
 
 // Keep in sync with trailheads table schema
 type Trailhead struct {
-	Name    string `json:"name"`
-	MapLink string `json:"mapLink"`
+	Name              string              `json:"name"`
+	MapLink           string              `json:"mapLink"`
+	Latitude          *float64            `json:"latitude,omitempty"` // nil if not known, e.g. the map link is a short link
+	Longitude         *float64            `json:"longitude,omitempty"`
+	DistanceMiles     float64             `json:"distanceMiles,omitempty"`     // Round trip; 0 if not known
+	ElevationGainFeet int                 `json:"elevationGainFeet,omitempty"` // 0 if not known
+	DurationMinutes   int                 `json:"durationMinutes,omitempty"`   // Typical time on the trail; 0 if not known
+	Difficulty        string              `json:"difficulty,omitempty"`
+	Hazards           Hazards             `json:"hazards,omitempty"`
+	Aliases           []string            `json:"aliases,omitempty"`    // Names it had before being renamed or merged
+	Retired           bool                `json:"retired,omitempty"`    // No longer suggested
+	Advisories        []TrailheadAdvisory `json:"advisories,omitempty"` // Closures and warnings in effect, most severe first
 }
 
-// List of predefined trailheads
+// List of predefined trailheads. They only seed an empty database; after that the catalog is
+// maintained through the trailhead admin API (see catalog.go).
 var predefinedTrailheads = []Trailhead{
 	{Name: "Aiea Loop (upper)", MapLink: "https://maps.app.goo.gl/cAFXUQF6Gbk1Yx9k6"},
 	{Name: "Bowman (Radar Hill)", MapLink: "https://www.google.com/maps/search/?api=1&query=21.34992,-157.87685"},
@@ -104,32 +114,56 @@ var predefinedTrailheads = []Trailhead{
 	{Name: "Wiliwilinui Ridge", MapLink: "https://maps.app.goo.gl/MZfAz5heiCYabpBNA"},
 }
 
+// Other names the predefined trailheads are known by, seeded as aliases
+var predefinedTrailheadAliases = map[string]string{
+	"Koko Head Stairs": "Koko Crater (Railway)",
+	"Lanikai Pillbox":  "Ka'iwa Ridge (Lanikai Side)",
+}
+
 type User struct {
-	UUID             string `json:"uuid"`
-	Name             string `json:"name"`
-	Phone            string `json:"phone"`
-	LicensePlate     string `json:"licensePlate"`
-	EmergencyContact string `json:"emergencyContact"`
+	UUID             string         `json:"uuid"`
+	Name             string         `json:"name"`
+	Phone            string         `json:"phone"`
+	LicensePlate     string         `json:"licensePlate"`
+	EmergencyContact string         `json:"emergencyContact"`
+	Dependents       []Dependent    `json:"dependents,omitempty"` // Minors RSVPd along with this user, only used when RSVPing
+	Carpool          *CarpoolSignup `json:"carpool,omitempty"`    // Offer or ask for a ride when RSVPing
 }
 
 // Keep in sync with hikes table schema
 type Hike struct {
-	ParticipantId       int64     `json:"participantId"` // Used when returning hike to User not in table
-	Name                string    `json:"name"`          // Custom name for the hike event
-	Organization        string    `json:"organization"`
-	TrailheadName       string    `json:"trailheadName"`
-	Leader              User      `json:"leader"`
-	TrailheadMapLink    string    `json:"trailheadMapLink"`
-	CreatedAt           time.Time `json:"-"` // don't send this field in JSON response
-	StartTime           time.Time `json:"startTime"`
-	Status              string    `json:"Status"`
-	JoinCode            string    `json:"joinCode"`
-	LeaderCode          string    `json:"leaderCode"`
-	PhotoRelease        bool      `json:"photoRelease"`
-	SourceType          string    `json:"sourceType,omitempty"` // Added for combined hike results
-	DescriptionMarkdown string    `json:"descriptionMarkdown"`
-	DescriptionHTML     string    `json:"descriptionHTML"`
-	WaiverText          string    `json:"waiverText,omitempty"`
+	ParticipantId       int64               `json:"participantId"`               // Used when returning hike to User not in table
+	ParticipantStatus   string              `json:"participantStatus,omitempty"` // Used when returning hike to User not in table
+	Name                string              `json:"name"`                        // Custom name for the hike event
+	Organization        string              `json:"organization"`
+	TrailheadName       string              `json:"trailheadName"`
+	Leader              User                `json:"leader"`
+	TrailheadMapLink    string              `json:"trailheadMapLink"`
+	CreatedAt           time.Time           `json:"-"` // don't send this field in JSON response
+	StartTime           time.Time           `json:"startTime"`
+	Status              string              `json:"Status"`
+	JoinCode            string              `json:"joinCode"`
+	LeaderCode          string              `json:"leaderCode"`
+	PhotoRelease        bool                `json:"photoRelease"`
+	Public              bool                `json:"public"`                      // Listed in the organization's hike directory
+	Difficulty          string              `json:"difficulty,omitempty"`        // easy, moderate or strenuous; empty if not rated
+	DistanceMiles       float64             `json:"distanceMiles,omitempty"`     // Round trip; 0 if not known
+	ElevationGainFeet   int                 `json:"elevationGainFeet,omitempty"` // 0 if not known
+	Hazards             Hazards             `json:"hazards,omitempty"`           // e.g. stream-crossing, exposure, mud
+	HasRoute            bool                `json:"hasRoute,omitempty"`          // A route is attached, see /api/hike/{hikeId}/route.gpx
+	Advisories          []TrailheadAdvisory `json:"advisories,omitempty"`        // Closures and warnings on the trailhead, most severe first
+	SourceType          string              `json:"sourceType,omitempty"`        // Added for combined hike results
+	DescriptionMarkdown string              `json:"descriptionMarkdown"`
+	DescriptionHTML     string              `json:"descriptionHTML"`
+	WaiverText          string              `json:"waiverText,omitempty"`
+	MaxParticipants     int                 `json:"maxParticipants"`            // 0 means no limit
+	DurationMinutes     int                 `json:"durationMinutes"`            // Expected time on the trail, 0 means no expected return time
+	Version             int64               `json:"version,omitempty"`          // Bumped on every edit; sent as the ETag
+	SeriesCode          string              `json:"seriesCode,omitempty"`       // Join code of the hike series this is an occurrence of
+	Role                string              `json:"role,omitempty"`             // Role granted by LeaderCode: leader, co-leader or sweep
+	Permissions         []string            `json:"permissions,omitempty"`      // What LeaderCode is allowed to do
+	ParticipantToken    string              `json:"participantToken,omitempty"` // Secret the participant uses to change their own status
+	Dependents          []Dependent         `json:"dependents,omitempty"`       // Minors RSVPd by the participant, only set in the RSVP response
 }
 
 // populateDescriptionHTML converts markdown to HTML and sanitizes it.
@@ -152,78 +186,20 @@ func populateDescriptionHTML(hike *Hike) {
 
 // Keep in sync with participants table schema
 type Participant struct {
-	Id       int64     `json:"id"`
-	Hike     Hike      `json:"hike"`
-	User     User      `json:"user"`
-	Status   string    `json:"status"`
-	Waiver   time.Time `json:"waiver"`
-	JoinedAt time.Time `json:"joinedAt"`
+	Id               int64     `json:"id"`
+	Hike             Hike      `json:"hike"`
+	User             User      `json:"user"`
+	Status           string    `json:"status"`
+	Waiver           time.Time `json:"waiver"`
+	JoinedAt         time.Time `json:"joinedAt"`
+	WaitlistPosition int       `json:"waitlistPosition,omitempty"` // 1-based, only set when Status is 'waitlist'
+	Age              int       `json:"age,omitempty"`              // Only known for dependents
+	Minor            bool      `json:"minor,omitempty"`
+	GuardianName     string    `json:"guardianName,omitempty"` // The adult who RSVPd this dependent
 }
 
 var db *sql.DB
 
-func createTables() {
-	// Create tables if they don't exist
-	// Note to self: Foreign key declarations must be at the end of the table creation statement
-	// Because go initializes strings to "" we can use TEXT DEFAULT '' for all optional TEXT columns
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS trailheads (
-			name TEXT PRIMARY KEY,
-			map_link TEXT DEFAULT ''
-		);
-
-		CREATE TABLE IF NOT EXISTS users (
-			uuid TEXT PRIMARY KEY,
-			name TEXT NOT NULL,
-			phone TEXT NOT NULL,
-			license_plate TEXT DEFAULT '',
-			emergency_contact TEXT DEFAULT ''
-		);
-
-		CREATE TABLE IF NOT EXISTS hikes (
-			name TEXT NOT NULL,
-            organization TEXT DEFAULT '',
-			trailhead_name TEXT DEFAULT '',
-			trailhead_map_link TEXT DEFAULT '',
-			leader_uuid TEXT NOT NULL,
-			created_at DATETIME NOT NULL,
-			start_time DATETIME NOT NULL,
-			status TEXT DEFAULT 'open',
-			join_code TEXT PRIMARY KEY,
-			leader_code TEXT UNIQUE,
-            photo_release BOOLEAN DEFAULT FALSE,
-            description TEXT DEFAULT '',
-			FOREIGN KEY (leader_uuid) REFERENCES users(uuid)
-		);
-
-		CREATE TABLE IF NOT EXISTS hike_users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			hike_join_code TEXT NOT NULL,
-			user_uuid TEXT NOT NULL,
-			status TEXT DEFAULT 'active',
-			joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-            UNIQUE (hike_join_code, user_uuid),
-			FOREIGN KEY (hike_join_code) REFERENCES hikes(join_code),
-			FOREIGN KEY (user_uuid) REFERENCES users(uuid)
-		);
-
-		CREATE TABLE IF NOT EXISTS waiver_signatures (
-			user_uuid TEXT NOT NULL,
-			hike_join_code TEXT NOT NULL,
-			signed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			user_agent TEXT NOT NULL,
-			ip_address TEXT NOT NULL,
-			waiver_text TEXT NOT NULL,
-            PRIMARY KEY (user_uuid, hike_join_code),
-			FOREIGN KEY (user_uuid) REFERENCES users(uuid),
-			FOREIGN KEY (hike_join_code) REFERENCES hikes(join_code)
-		);
-	`)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
 func populateTrailheads() {
 	// Load trailheads if they haven't been loaded yet
 	var count int
@@ -234,11 +210,22 @@ func populateTrailheads() {
 
 	if count == 0 {
 		for _, trailhead := range predefinedTrailheads {
-			_, err := db.Exec("INSERT INTO trailheads (name, map_link) VALUES (?, ?)", trailhead.Name, trailhead.MapLink)
+			lat, lng := trailheadCoordinates(trailhead.MapLink)
+			_, err := db.Exec("INSERT INTO trailheads (name, map_link, latitude, longitude) VALUES (?, ?, ?, ?)", trailhead.Name, trailhead.MapLink, lat, lng)
 			if err != nil {
 				log.Fatal(err)
 			}
 		}
+		tx, err := db.Begin()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := seedTrailheadAliases(tx); err != nil {
+			log.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			log.Fatal(err)
+		}
 	}
 }
 
@@ -249,30 +236,104 @@ func initDB(databaseName string) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	createTables()
+	if err = migrateDB(db); err != nil {
+		log.Fatal(err)
+	}
 	populateTrailheads()
 }
 
 // Add routes to ServeMux (sparate function so it can be used in testing)
 func addRoutes(mux *http.ServeMux) {
-	// You must define most specific routes first
-	mux.HandleFunc("PUT /api/hike/{hikeId}/participant/{participantId}", updateParticipantStatusHandler)
-	mux.HandleFunc("POST /api/hike/{hikeId}/participant", rsvpToHikeHandler) // pass in User
-	mux.HandleFunc("DELETE /api/hike/{hikeId}/participant/{participantId}", unRSVPHandler)
+	// You must define most specific routes first. Everything that changes data accepts an
+	// Idempotency-Key so a retried request is only handled once.
+	mux.HandleFunc("GET /api/hike/{hikeId}/participant/export", exportHikeParticipantsHandler)
+	mux.HandleFunc("GET /api/hike/{hikeId}/participant/{participantId}/history", getParticipantStatusHistoryHandler)
+	mux.HandleFunc("GET /api/hike/{hikeId}/participant/{participantId}/waiver", getParticipantWaiverHandler)
+	mux.HandleFunc("PUT /api/hike/{hikeId}/participant/{participantId}/carpool/rider/{riderId}", idempotent(acceptCarpoolRiderHandler))
+	mux.HandleFunc("DELETE /api/hike/{hikeId}/participant/{participantId}/carpool/rider/{riderId}", idempotent(removeCarpoolRiderHandler))
+	mux.HandleFunc("PUT /api/hike/{hikeId}/participant/{participantId}/carpool", idempotent(updateCarpoolSignupHandler))
+	mux.HandleFunc("DELETE /api/hike/{hikeId}/participant/{participantId}/carpool", idempotent(deleteCarpoolSignupHandler))
+	mux.HandleFunc("PUT /api/hike/{hikeId}/participant/{participantId}", idempotent(updateParticipantStatusHandler))
+	mux.HandleFunc("POST /api/hike/{hikeId}/participant", idempotent(rsvpToHikeHandler)) // pass in User
+	mux.HandleFunc("DELETE /api/hike/{hikeId}/participant/{participantId}", idempotent(unRSVPHandler))
 	mux.HandleFunc("GET /api/hike/{hikeId}/participant", getHikeParticipantsHandler)
+	mux.HandleFunc("GET /api/hike/{hikeId}/events", hikeEventsHandler)
+	mux.HandleFunc("GET /api/hike/{hikeId}/carpool", getHikeCarpoolHandler)
+	mux.HandleFunc("DELETE /api/hike/{hikeId}/role/{roleId}", idempotent(revokeHikeRoleHandler))
+	mux.HandleFunc("POST /api/hike/{hikeId}/role", idempotent(createHikeRoleHandler))
+	mux.HandleFunc("GET /api/hike/{hikeId}/role", getHikeRolesHandler)
+	mux.HandleFunc("GET /api/hike/{hikeId}/waiver", getHikeWaiversHandler)
+	mux.HandleFunc("PUT /api/hike/{hikeId}/route", idempotent(putHikeRouteHandler))
+	mux.HandleFunc("DELETE /api/hike/{hikeId}/route", idempotent(deleteHikeRouteHandler))
+	mux.HandleFunc("GET /api/hike/{hikeId}/route.geojson", getHikeRouteGeoJSONHandler)
+	mux.HandleFunc("GET /api/hike/{hikeId}/route.gpx", getHikeRouteGPXHandler)
 	mux.HandleFunc("GET /api/hike/{hikeId}", getHikeHandler)
-	mux.HandleFunc("PUT /api/hike/{leaderCode}", updateHikeHandler)
-	mux.HandleFunc("POST /api/hike", createHikeHandler)
+	mux.HandleFunc("PUT /api/hike/{leaderCode}", idempotent(updateHikeHandler))
+	mux.HandleFunc("POST /api/hike", idempotent(createHikeHandler))
 	mux.HandleFunc("GET /api/hike/last", getLastHikeHandler) // Return the last hike details for a given hikeName and leaderUUID
 	mux.HandleFunc("GET /api/hike", getHikesHandler)
+	mux.HandleFunc("GET /api/user/{uuid}/calendar.ics", getUserCalendarHandler)
+	mux.HandleFunc("GET /api/org/{org}/hikes", publicHikesHandler)
+	mux.HandleFunc("POST /api/org/{org}/hike/{hikeId}/close", idempotent(closeOrganizationHikeHandler))
+	mux.HandleFunc("PUT /api/org/{org}/hike/{hikeId}/leader", idempotent(reassignHikeLeaderHandler))
+	mux.HandleFunc("GET /api/org/{org}/hike", getOrganizationHikesHandler)
+	mux.HandleFunc("DELETE /api/org/{org}/admin/{adminId}", idempotent(revokeOrganizationAdminHandler))
+	mux.HandleFunc("POST /api/org/{org}/admin", idempotent(createOrganizationAdminHandler))
+	mux.HandleFunc("GET /api/org/{org}/admin", getOrganizationAdminsHandler)
+	mux.HandleFunc("GET /api/org/{org}", getOrganizationHandler)
+	mux.HandleFunc("PUT /api/org/{org}", idempotent(updateOrganizationHandler))
+	mux.HandleFunc("POST /api/org", idempotent(createOrganizationHandler))
+	mux.HandleFunc("GET /api/trailhead/near", nearbyTrailheadsHandler)
+	mux.HandleFunc("GET /api/trailhead/export", exportTrailheadsHandler)
+	mux.HandleFunc("POST /api/trailhead/import", idempotent(importTrailheadsHandler))
+	mux.HandleFunc("POST /api/trailhead/{name}/merge", idempotent(mergeTrailheadHandler))
+	mux.HandleFunc("DELETE /api/trailhead/{name}/alias/{alias}", idempotent(deleteTrailheadAliasHandler))
+	mux.HandleFunc("POST /api/trailhead/{name}/alias", idempotent(addTrailheadAliasHandler))
+	mux.HandleFunc("DELETE /api/trailhead/{name}/advisory/{advisoryId}", idempotent(deleteTrailheadAdvisoryHandler))
+	mux.HandleFunc("POST /api/trailhead/{name}/advisory", idempotent(createTrailheadAdvisoryHandler))
+	mux.HandleFunc("GET /api/trailhead/{name}/advisory", getTrailheadAdvisoriesHandler)
+	mux.HandleFunc("GET /api/trailhead/{name}", getTrailheadHandler)
+	mux.HandleFunc("PUT /api/trailhead/{name}", idempotent(updateTrailheadHandler))
+	mux.HandleFunc("DELETE /api/trailhead/{name}", idempotent(retireTrailheadHandler))
+	mux.HandleFunc("POST /api/trailhead", idempotent(createTrailheadHandler))
 	mux.HandleFunc("GET /api/trailhead", trailheadSuggestionsHandler)
+	mux.HandleFunc("POST /api/waiver-template", idempotent(publishWaiverTemplateHandler))
+	mux.HandleFunc("GET /api/waiver-template", getWaiverTemplatesHandler)
+	mux.HandleFunc("POST /api/series/{seriesId}/subscriber", idempotent(subscribeToSeriesHandler)) // pass in User
+	mux.HandleFunc("DELETE /api/series/{seriesId}/subscriber/{subscriptionId}", idempotent(unsubscribeFromSeriesHandler))
+	mux.HandleFunc("GET /api/series/{seriesId}", getSeriesHandler)
+	mux.HandleFunc("PUT /api/series/{leaderCode}", idempotent(updateSeriesHandler))
+	mux.HandleFunc("POST /api/series", idempotent(createSeriesHandler))
 }
 
 func main() {
+	// hiketracker verify-waivers checks the waiver log's hash chain and exits
+	if len(os.Args) > 1 && os.Args[1] == "verify-waivers" {
+		initDB("./hiketracker.db")
+		os.Exit(runVerifyWaivers(os.Stdout))
+	}
+
 	initDB("./hiketracker.db")
 
 	addRoutes(http.DefaultServeMux)
 
+	// Watch for participants who haven't come off the trail. Set OVERDUE_WEBHOOK_URL to also
+	// POST each alert to an external service.
+	var notifier OverdueNotifier = logFileNotifier{}
+	if webhookURL := os.Getenv("OVERDUE_WEBHOOK_URL"); webhookURL != "" {
+		notifier = multiNotifier{logFileNotifier{}, newWebhookNotifier(webhookURL)}
+	}
+	startOverdueWatcher(overdueCheckInterval, notifier, nil)
+
+	// Set ADMIN_TOKEN to enable the admin API, e.g. publishing waiver templates and registering organizations
+	adminToken = os.Getenv("ADMIN_TOKEN")
+
+	// Hikes at a closed trailhead are created with a warning; set CLOSED_TRAILHEAD_POLICY=block to refuse them
+	blockClosedTrailheads = os.Getenv("CLOSED_TRAILHEAD_POLICY") == "block"
+
+	// Keep upcoming occurrences of recurring hikes created ahead of time
+	startSeriesMaterializer(seriesMaterializeInterval, nil)
+
 	// Serve static files
 	fs := http.FileServer(http.Dir("./static"))
 	http.Handle("/", fs)
@@ -288,8 +349,15 @@ type WaiverData struct {
 	PhotoRelease bool
 }
 
-// generateWaiverText fetches hike details and generates the waiver text using a template.
+// generateWaiverText renders the waiver currently in effect for a hike
 func generateWaiverText(joinCode string) (string, error) {
+	text, _, err := renderWaiver(joinCode, time.Now())
+	return text, err
+}
+
+// renderWaiver fills in the waiver template in effect at a given time for the hike's
+// organization. It also returns the template's id so a signature can record the version signed.
+func renderWaiver(joinCode string, at time.Time) (string, int64, error) {
 	var leaderName, organization string
 	var photoRelease bool
 
@@ -302,9 +370,9 @@ func generateWaiverText(joinCode string) (string, error) {
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return "", fmt.Errorf("hike not found for join code: %s", joinCode)
+			return "", 0, fmt.Errorf("hike not found for join code: %s", joinCode)
 		}
-		return "", fmt.Errorf("error fetching hike details for waiver: %v", err)
+		return "", 0, fmt.Errorf("error fetching hike details for waiver: %v", err)
 	}
 
 	data := WaiverData{
@@ -313,25 +381,23 @@ func generateWaiverText(joinCode string) (string, error) {
 		PhotoRelease: photoRelease,
 	}
 
-	// Read waiver template
-	templateBytes, err := os.ReadFile("static/waiver.txt")
+	waiverTemplate, err := effectiveWaiverTemplate(organization, at)
 	if err != nil {
-		return "", fmt.Errorf("error reading waiver.txt template: %v", err)
+		return "", 0, fmt.Errorf("error finding waiver template: %v", err)
 	}
-	templateContent := string(templateBytes)
 
 	// Parse and execute template
-	tmpl, err := template.New("waiver").Parse(templateContent)
+	tmpl, err := template.New("waiver").Parse(waiverTemplate.Body)
 	if err != nil {
-		return "", fmt.Errorf("error parsing waiver template: %v", err)
+		return "", 0, fmt.Errorf("error parsing waiver template: %v", err)
 	}
 
 	var renderedWaiver strings.Builder
 	if err := tmpl.Execute(&renderedWaiver, data); err != nil {
-		return "", fmt.Errorf("error executing waiver template: %v", err)
+		return "", 0, fmt.Errorf("error executing waiver template: %v", err)
 	}
 
-	return renderedWaiver.String(), nil
+	return renderedWaiver.String(), waiverTemplate.Id, nil
 }
 
 // getHikeWaiverHandler is removed. Waiver text is now part of Hike object.
@@ -386,12 +452,13 @@ func getLastHikeHandler(w http.ResponseWriter, r *http.Request) {
 	// Original logic for fetching last hike details (exact match)
 	var hike Hike
 	err := db.QueryRow(`
-		SELECT name, organization, trailhead_name, trailhead_map_link, description
+		SELECT name, organization, trailhead_name, trailhead_map_link, description, max_participants, duration_minutes, public, difficulty,
+		       distance_miles, elevation_gain_feet, hazards
 		FROM hikes
 		WHERE name = ? AND leader_uuid = ?
 		ORDER BY created_at DESC, rowid DESC
 		LIMIT 1
-	`, hikeNameQuery, leaderUUID).Scan(&hike.Name, &hike.Organization, &hike.TrailheadName, &hike.TrailheadMapLink, &hike.DescriptionMarkdown)
+	`, hikeNameQuery, leaderUUID).Scan(&hike.Name, &hike.Organization, &hike.TrailheadName, &hike.TrailheadMapLink, &hike.DescriptionMarkdown, &hike.MaxParticipants, &hike.DurationMinutes, &hike.Public, &hike.Difficulty, &hike.DistanceMiles, &hike.ElevationGainFeet, &hike.Hazards)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -421,22 +488,35 @@ func createHikeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate secure code to use for participants to join the hike
-	hike.JoinCode, err = generateSecureLinkCode()
-	if err != nil {
-		http.Error(w, "Failed to generate join code", http.StatusInternalServerError)
+	if hike.MaxParticipants < 0 || hike.DurationMinutes < 0 {
+		http.Error(w, "maxParticipants and durationMinutes cannot be negative", http.StatusBadRequest)
+		return
+	}
+	if err := validateTrailInfo(hike.Difficulty, hike.DistanceMiles, hike.ElevationGainFeet, hike.Hazards); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Anything about the trail the leader left out comes from the trailhead
+	if err = applyTrailheadDefaults(&hike); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Use the registered spelling of the organization so its hikes stay together
+	if hike.Organization, err = canonicalOrganization(hike.Organization); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Check for closures that will still be in effect when the hike starts
+	advisories, err := checkTrailheadOpen(db, hike.TrailheadName, hike.StartTime)
+	if _, isClosed := err.(*trailheadClosedError); isClosed {
+		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
-
-	// Generate secure code to use for the hike leader to manage the hike
-	hike.LeaderCode, err = generateSecureLinkCode()
 	if err != nil {
-		http.Error(w, "Failed to generate leader code", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	hike.CreatedAt = time.Now()
-
 	// Insert or update user (Leader) in the database
 	_, err = db.Exec(`
 		INSERT INTO users (uuid, name, phone)
@@ -450,18 +530,14 @@ func createHikeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Add hike to the Hikes table
-	// Note: hike.DescriptionMarkdown contains the raw markdown from the request
-	_, err = db.Exec(`
-		INSERT INTO hikes (name, organization, trailhead_name, leader_uuid, trailhead_map_link, created_at, start_time, join_code, leader_code, photo_release, description)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, hike.Name, hike.Organization, hike.TrailheadName, hike.Leader.UUID, hike.TrailheadMapLink, hike.CreatedAt.Format("2006-01-02T15:04:05-07:00"), hike.StartTime, hike.JoinCode, hike.LeaderCode, hike.PhotoRelease, hike.DescriptionMarkdown)
-	if err != nil {
+	if err = insertHike(db, &hike); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Populate DescriptionHTML for the response
+	// Populate DescriptionHTML for the response, with any advisories as a warning
 	populateDescriptionHTML(&hike)
+	hike.Advisories = advisories
 
 	// Generate and add waiver text
 	waiverText, err := generateWaiverText(hike.JoinCode)
@@ -473,28 +549,86 @@ func createHikeHandler(w http.ResponseWriter, r *http.Request) {
 		hike.WaiverText = waiverText
 	}
 
+	w.Header().Set("ETag", hikeETag(hike.Version))
 	json.NewEncoder(w).Encode(hike)
 	logAction(fmt.Sprintf("Hike created: %s by %s, starting at %s", hike.Name, hike.Leader.Name, hike.StartTime.Format(time.RFC3339)))
 }
 
+// sqlExecutor is satisfied by both *sql.DB and *sql.Tx
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertHike generates the join and leader codes for a new hike and adds it to the hikes table.
+// The leader must already be in the users table.
+func insertHike(exec sqlExecutor, hike *Hike) error {
+	var err error
+
+	// Generate secure code to use for participants to join the hike
+	hike.JoinCode, err = generateSecureLinkCode()
+	if err != nil {
+		return fmt.Errorf("failed to generate join code: %v", err)
+	}
+
+	// Generate secure code to use for the hike leader to manage the hike
+	hike.LeaderCode, err = generateSecureLinkCode()
+	if err != nil {
+		return fmt.Errorf("failed to generate leader code: %v", err)
+	}
+
+	hike.CreatedAt = time.Now()
+	hike.Version = 1 // The column's default; bumped on every edit
+
+	// Note: hike.DescriptionMarkdown contains the raw markdown from the request
+	_, err = exec.Exec(`
+		INSERT INTO hikes (name, organization, trailhead_name, leader_uuid, trailhead_map_link, created_at, start_time, join_code, leader_code, photo_release, description, max_participants, duration_minutes, public, difficulty,
+		                   distance_miles, elevation_gain_feet, hazards)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, hike.Name, hike.Organization, hike.TrailheadName, hike.Leader.UUID, hike.TrailheadMapLink, hike.CreatedAt.Format("2006-01-02T15:04:05-07:00"), hike.StartTime, hike.JoinCode, hike.LeaderCode, hike.PhotoRelease, hike.DescriptionMarkdown, hike.MaxParticipants, hike.DurationMinutes, hike.Public, hike.Difficulty,
+		hike.DistanceMiles, hike.ElevationGainFeet, hike.Hazards)
+	return err
+}
+
 // Get hike details by join code, Don't return leader code
 func getHikeHandler(w http.ResponseWriter, r *http.Request) {
 	joinCode := r.PathValue("hikeId")
+	// A wildcard has to be a whole path segment, so /api/hike/{hikeId}.ics lands here
+	if calendarJoinCode, ok := strings.CutSuffix(joinCode, ".ics"); ok {
+		getHikeCalendarHandler(w, r, calendarJoinCode)
+		return
+	}
 	leaderCode := r.URL.Query().Get("leaderCode")
 
 	// Retrieve Hike record based on leaderCode if provided otherwise by joinCode
 	var hike Hike
 	var err error
 	if leaderCode != "" {
-		err = db.QueryRow(`SELECT h.name, h.organization, h.trailhead_name, u.name, u.phone, h.trailhead_map_link, h.start_time, h.join_code, h.leader_code, h.description
-		                   FROM hikes As h JOIN users AS u ON leader_uuid = uuid
-		                   WHERE h.leader_code = ? AND h.status = "open"
-		`, leaderCode).Scan(&hike.Name, &hike.Organization, &hike.TrailheadName, &hike.Leader.Name, &hike.Leader.Phone, &hike.TrailheadMapLink, &hike.StartTime, &hike.JoinCode, &hike.LeaderCode, &hike.DescriptionMarkdown)
+		// The leader code may be the hike's own or a role's access code; only hand back the code that was used
+		var access hikeAccess
+		access, err = resolveHikeAccess(leaderCode)
+		if err == nil {
+			err = db.QueryRow(`SELECT h.name, h.organization, h.trailhead_name, u.name, u.phone, h.trailhead_map_link, h.start_time, h.join_code, h.description, h.max_participants, h.duration_minutes, COALESCE(s.join_code, ''), h.version, h.public, h.difficulty, h.distance_miles, h.elevation_gain_feet, h.hazards,
+			                   EXISTS (SELECT 1 FROM hike_routes WHERE hike_join_code = h.join_code)
+			                   FROM hikes As h JOIN users AS u ON h.leader_uuid = u.uuid
+			                   LEFT JOIN hike_series AS s ON h.series_id = s.id
+			                   WHERE h.join_code = ? AND h.status = "open"
+			`, access.joinCode).Scan(&hike.Name, &hike.Organization, &hike.TrailheadName, &hike.Leader.Name, &hike.Leader.Phone, &hike.TrailheadMapLink, &hike.StartTime, &hike.JoinCode, &hike.DescriptionMarkdown, &hike.MaxParticipants, &hike.DurationMinutes, &hike.SeriesCode, &hike.Version, &hike.Public, &hike.Difficulty, &hike.DistanceMiles, &hike.ElevationGainFeet, &hike.Hazards, &hike.HasRoute)
+		}
+		if err == nil {
+			hike.LeaderCode = leaderCode
+			hike.Role = access.role
+			hike.Permissions = rolePermissions[access.role]
+			if claimErr := claimHikeRole(access.roleId, r.URL.Query().Get("userUUID")); claimErr != nil {
+				log.Printf("Error claiming role %d for hike %s: %v", access.roleId, access.joinCode, claimErr)
+			}
+		}
 	} else {
-		err = db.QueryRow(`SELECT h.name, h.organization, h.trailhead_name, u.name, u.phone, h.trailhead_map_link, h.start_time, h.join_code, h.description
-						   FROM hikes As h JOIN users AS u ON leader_uuid = uuid
+		err = db.QueryRow(`SELECT h.name, h.organization, h.trailhead_name, u.name, u.phone, h.trailhead_map_link, h.start_time, h.join_code, h.description, h.max_participants, h.duration_minutes, COALESCE(s.join_code, ''), h.version, h.public, h.difficulty, h.distance_miles, h.elevation_gain_feet, h.hazards,
+						   EXISTS (SELECT 1 FROM hike_routes WHERE hike_join_code = h.join_code)
+						   FROM hikes As h JOIN users AS u ON h.leader_uuid = u.uuid
+						   LEFT JOIN hike_series AS s ON h.series_id = s.id
 						   WHERE h.join_code = ? AND h.status = "open"
-		`, joinCode).Scan(&hike.Name, &hike.Organization, &hike.TrailheadName, &hike.Leader.Name, &hike.Leader.Phone, &hike.TrailheadMapLink, &hike.StartTime, &hike.JoinCode, &hike.DescriptionMarkdown)
+		`, joinCode).Scan(&hike.Name, &hike.Organization, &hike.TrailheadName, &hike.Leader.Name, &hike.Leader.Phone, &hike.TrailheadMapLink, &hike.StartTime, &hike.JoinCode, &hike.DescriptionMarkdown, &hike.MaxParticipants, &hike.DurationMinutes, &hike.SeriesCode, &hike.Version, &hike.Public, &hike.Difficulty, &hike.DistanceMiles, &hike.ElevationGainFeet, &hike.Hazards, &hike.HasRoute)
 	}
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -507,6 +641,11 @@ func getHikeHandler(w http.ResponseWriter, r *http.Request) {
 
 	populateDescriptionHTML(&hike)
 
+	// Closures and warnings posted on the trailhead since the hike was scheduled
+	if hike.Advisories, err = trailheadAdvisories(db, hike.TrailheadName, time.Now()); err != nil {
+		log.Printf("Error loading advisories for hike %s: %v", hike.JoinCode, err)
+	}
+
 	// Generate and add waiver text
 	waiverText, err := generateWaiverText(hike.JoinCode)
 	if err != nil {
@@ -516,12 +655,32 @@ func getHikeHandler(w http.ResponseWriter, r *http.Request) {
 		hike.WaiverText = waiverText
 	}
 
-	// Return retrieved Hike
+	// Return retrieved Hike. The ETag goes back in If-Match when the hike is edited.
+	w.Header().Set("ETag", hikeETag(hike.Version))
 	json.NewEncoder(w).Encode(hike)
 }
 
+// hikeETag is the entity tag for a version of a hike
+func hikeETag(version int64) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// ifMatchHike reports whether an If-Match header matches the hike's current version
+func ifMatchHike(ifMatch string, version int64) bool {
+	etag := hikeETag(version)
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
 // updateHikeHandler updates hike details based on leaderCode.
-// It can update hike information and change the leader.
+// It can update hike information and change the leader. The If-Match header must carry the
+// ETag of the version being edited; if someone else has changed the hike since, nothing is
+// changed and the current hike is returned with 412 Precondition Failed.
 func updateHikeHandler(w http.ResponseWriter, r *http.Request) {
 	leaderCodeFromPath := r.PathValue("leaderCode")
 
@@ -537,6 +696,42 @@ func updateHikeHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Leader UUID is required in the request body", http.StatusBadRequest)
 		return
 	}
+	if updatedHike.MaxParticipants < 0 || updatedHike.DurationMinutes < 0 {
+		http.Error(w, "maxParticipants and durationMinutes cannot be negative", http.StatusBadRequest)
+		return
+	}
+	if err := validateTrailInfo(updatedHike.Difficulty, updatedHike.DistanceMiles, updatedHike.ElevationGainFeet, updatedHike.Hazards); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if updatedHike.Organization, err = canonicalOrganization(updatedHike.Organization); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The leader code may be the hike's own or a role's access code
+	access, err := resolveHikeAccess(leaderCodeFromPath)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Hike not found for the given leader code", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching current hike details: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if !access.can(permEditHike) {
+		http.Error(w, fmt.Sprintf("The %s role cannot edit this hike", access.role), http.StatusForbidden)
+		return
+	}
+	if updatedHike.Status == "closed" && !access.can(permCloseHike) {
+		http.Error(w, fmt.Sprintf("The %s role cannot close this hike", access.role), http.StatusForbidden)
+		return
+	}
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		http.Error(w, "If-Match is required; send the ETag of the hike being edited", http.StatusPreconditionRequired)
+		return
+	}
 
 	// Begin transaction
 	tx, err := db.Begin()
@@ -549,7 +744,10 @@ func updateHikeHandler(w http.ResponseWriter, r *http.Request) {
 	// Fetch current leader_uuid to check if it's a leader change
 	var currentDBLeaderUUID string
 	var currentJoinCode string
-	err = tx.QueryRow("SELECT leader_uuid, join_code FROM hikes WHERE leader_code = ?", leaderCodeFromPath).Scan(&currentDBLeaderUUID, &currentJoinCode)
+	var currentVersion int64
+	var currentTrailheadName string
+	var currentStartTime time.Time
+	err = tx.QueryRow("SELECT leader_uuid, join_code, version, trailhead_name, start_time FROM hikes WHERE join_code = ?", access.joinCode).Scan(&currentDBLeaderUUID, &currentJoinCode, &currentVersion, &currentTrailheadName, &currentStartTime)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, "Hike not found for the given leader code", http.StatusNotFound)
@@ -559,20 +757,57 @@ func updateHikeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Update user (potential new Leader) in the users table
-	// This ensures the new leader exists if they are different from the current one.
-	// If it's the same leader, their details (name, phone) might be updated.
-	_, err = tx.Exec(`
-		INSERT INTO users (uuid, name, phone)
-		VALUES (?, ?, ?)
-		ON CONFLICT(uuid) DO UPDATE SET name = excluded.name, phone = excluded.phone
-	`, updatedHike.Leader.UUID, updatedHike.Leader.Name, updatedHike.Leader.Phone)
-	if err != nil {
-		http.Error(w, "Error updating leader details in users table: "+err.Error(), http.StatusInternalServerError)
+	// Someone else saved first; send back what they saved so the edits can be merged
+	if !ifMatchHike(ifMatch, currentVersion) {
+		tx.Rollback()
+		currentHike, err := loadEditedHike(currentJoinCode, leaderCodeFromPath, access)
+		if err != nil {
+			http.Error(w, "Error fetching current hike details: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", hikeETag(currentHike.Version))
+		w.WriteHeader(http.StatusPreconditionFailed)
+		json.NewEncoder(w).Encode(currentHike)
+		logAction(fmt.Sprintf("Hike update rejected, version %d has changed: %s (LeaderCode: %s)", currentVersion, currentJoinCode, leaderCodeFromPath))
 		return
 	}
 
-	// Update the hike details in the hikes table
+	// Moving the hike to another trailhead, or another time, checks for closures there and then
+	var advisories []TrailheadAdvisory
+	if updatedHike.Status != "closed" && (updatedHike.TrailheadName != currentTrailheadName || !updatedHike.StartTime.Equal(currentStartTime)) {
+		advisories, err = checkTrailheadOpen(tx, updatedHike.TrailheadName, updatedHike.StartTime)
+		if _, isClosed := err.(*trailheadClosedError); isClosed {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Only a code that can manage roles can hand the hike to a new leader; a co-leader editing
+	// the hike leaves the leader as is
+	newLeaderUUID := currentDBLeaderUUID
+	if access.can(permManageRoles) {
+		// Update user (potential new Leader) in the users table
+		// This ensures the new leader exists if they are different from the current one.
+		// If it's the same leader, their details (name, phone) might be updated.
+		_, err = tx.Exec(`
+			INSERT INTO users (uuid, name, phone)
+			VALUES (?, ?, ?)
+			ON CONFLICT(uuid) DO UPDATE SET name = excluded.name, phone = excluded.phone
+		`, updatedHike.Leader.UUID, updatedHike.Leader.Name, updatedHike.Leader.Phone)
+		if err != nil {
+			http.Error(w, "Error updating leader details in users table: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		newLeaderUUID = updatedHike.Leader.UUID
+	}
+
+	// Update the hike details in the hikes table.
+	// An occurrence of a series that is edited on its own no longer follows edits to the whole series.
 	updateQuery := `
 		UPDATE hikes
 		SET name = ?,
@@ -582,10 +817,23 @@ func updateHikeHandler(w http.ResponseWriter, r *http.Request) {
 		    start_time = ?,
 		    photo_release = ?,
 		    description = ?,
-		    leader_uuid = ?`
+		    leader_uuid = ?,
+		    max_participants = ?,
+		    duration_minutes = ?,
+		    public = ?,
+		    difficulty = ?,
+		    distance_miles = ?,
+		    elevation_gain_feet = ?,
+		    hazards = ?,
+		    series_override = (series_id IS NOT NULL),
+		    version = version + 1,
+		    updated_at = ?`
 	args := []interface{}{
 		updatedHike.Name, updatedHike.Organization, updatedHike.TrailheadName, updatedHike.TrailheadMapLink,
-		updatedHike.StartTime, updatedHike.PhotoRelease, updatedHike.DescriptionMarkdown, updatedHike.Leader.UUID,
+		updatedHike.StartTime, updatedHike.PhotoRelease, updatedHike.DescriptionMarkdown, newLeaderUUID,
+		updatedHike.MaxParticipants, updatedHike.DurationMinutes, updatedHike.Public, updatedHike.Difficulty,
+		updatedHike.DistanceMiles, updatedHike.ElevationGainFeet, updatedHike.Hazards,
+		time.Now().Format("2006-01-02T15:04:05-07:00"),
 	}
 
 	// Handle status update
@@ -593,7 +841,7 @@ func updateHikeHandler(w http.ResponseWriter, r *http.Request) {
 		// Fetch current status to ensure we are not trying to close an already closed hike unnecessarily,
 		// or to apply "closing" logic only if it's currently open.
 		var currentDBStatus string
-		err = tx.QueryRow("SELECT status FROM hikes WHERE leader_code = ?", leaderCodeFromPath).Scan(&currentDBStatus)
+		err = tx.QueryRow("SELECT status FROM hikes WHERE join_code = ?", currentJoinCode).Scan(&currentDBStatus)
 		if err != nil {
 			// This error should ideally not happen if the previous check for hike existence passed
 			http.Error(w, "Error fetching current hike status: "+err.Error(), http.StatusInternalServerError)
@@ -605,12 +853,7 @@ func updateHikeHandler(w http.ResponseWriter, r *http.Request) {
 			args = append(args, "closed")
 
 			// Also update participants' status to 'finished'
-			_, err = tx.Exec(`
-				UPDATE hike_users
-				SET status = 'finished'
-				WHERE hike_join_code = ? AND (status = 'active' OR status = 'rsvp')
-			`, currentJoinCode) // currentJoinCode fetched earlier
-			if err != nil {
+			if err = finishHikeParticipants(tx, currentJoinCode); err != nil {
 				http.Error(w, "Error updating participants to finished: "+err.Error(), http.StatusInternalServerError)
 				return
 			}
@@ -618,8 +861,8 @@ func updateHikeHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	} // Add more status handling here if needed, e.g., reopening a hike
 
-	updateQuery += " WHERE leader_code = ?"
-	args = append(args, leaderCodeFromPath)
+	updateQuery += " WHERE join_code = ?"
+	args = append(args, currentJoinCode)
 
 	_, err = tx.Exec(updateQuery, args...)
 	if err != nil {
@@ -627,49 +870,105 @@ func updateHikeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Raising or removing the cap may free up spots for people on the waitlist
+	var promoted []int64
+	if updatedHike.Status != "closed" {
+		promoted, err = promoteFromWaitlist(tx, currentJoinCode)
+		if err != nil {
+			http.Error(w, "Error promoting waitlisted participants: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if len(promoted) > 0 {
+		logAction(fmt.Sprintf("Hike %s promoted %d participant(s) from the waitlist: %v", currentJoinCode, len(promoted), promoted))
+	}
+	hikeStatus := "open"
+	if updatedHike.Status == "closed" {
+		hikeStatus = "closed"
+	}
+	hikeEvents.publish(currentJoinCode, eventHike, 0, hikeStatus)
+	publishPromotions(currentJoinCode, promoted)
 
 	// After successful update, fetch the updated hike details to return
-	var finalHike Hike
-	// Fetch using the original leaderCodeFromPath, as that's the identifier used for update
-	// The leader_uuid in the table might have changed, so fetch based on leader_code.
-	err = db.QueryRow(`
+	finalHike, err := loadEditedHike(currentJoinCode, leaderCodeFromPath, access)
+	if err != nil {
+		// This would be unusual if the update succeeded, but handle it.
+		http.Error(w, "Error fetching updated hike details: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	finalHike.Advisories = advisories
+
+	w.Header().Set("ETag", hikeETag(finalHike.Version))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(finalHike)
+	logAction(fmt.Sprintf("Hike updated: %s (LeaderCode: %s)", finalHike.Name, leaderCodeFromPath))
+}
+
+// finishHikeParticipants marks everyone still on a hike that is being closed as finished
+func finishHikeParticipants(tx *sql.Tx, joinCode string) error {
+	_, err := tx.Exec(`
+		INSERT INTO participant_status_history (hike_user_id, hike_join_code, from_status, to_status, actor, changed_at)
+		SELECT id, hike_join_code, status, 'finished', ?, ?
+		FROM hike_users
+		WHERE hike_join_code = ? AND (status = 'active' OR status = 'rsvp' OR status = 'overdue')
+	`, actorSystem, time.Now().Format("2006-01-02T15:04:05-07:00"), joinCode)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE hike_users
+		SET status = 'finished'
+		WHERE hike_join_code = ? AND (status = 'active' OR status = 'rsvp' OR status = 'overdue')
+	`, joinCode)
+	return err
+}
+
+// loadEditedHike fetches a hike as returned to a leader who edits it
+func loadEditedHike(joinCode, leaderCode string, access hikeAccess) (Hike, error) {
+	var hike Hike
+	// The leader_uuid in the table might have changed, so fetch based on join_code.
+	err := db.QueryRow(`
 		SELECT h.name, h.organization, h.trailhead_name, u.uuid, u.name, u.phone,
-		       h.trailhead_map_link, h.start_time, h.join_code, h.leader_code, h.photo_release, h.description, h.status
+		       h.trailhead_map_link, h.start_time, h.join_code, h.photo_release, h.description, h.status,
+		       h.max_participants, h.duration_minutes, h.version, h.public, h.difficulty, h.distance_miles, h.elevation_gain_feet, h.hazards,
+		       EXISTS (SELECT 1 FROM hike_routes WHERE hike_join_code = h.join_code)
 		FROM hikes h
 		JOIN users u ON h.leader_uuid = u.uuid
-		WHERE h.leader_code = ?
-	`, leaderCodeFromPath).Scan(
-		&finalHike.Name, &finalHike.Organization, &finalHike.TrailheadName,
-		&finalHike.Leader.UUID, &finalHike.Leader.Name, &finalHike.Leader.Phone,
-		&finalHike.TrailheadMapLink, &finalHike.StartTime, &finalHike.JoinCode, &finalHike.LeaderCode,
-		&finalHike.PhotoRelease, &finalHike.DescriptionMarkdown, &finalHike.Status,
+		WHERE h.join_code = ?
+	`, joinCode).Scan(
+		&hike.Name, &hike.Organization, &hike.TrailheadName,
+		&hike.Leader.UUID, &hike.Leader.Name, &hike.Leader.Phone,
+		&hike.TrailheadMapLink, &hike.StartTime, &hike.JoinCode,
+		&hike.PhotoRelease, &hike.DescriptionMarkdown, &hike.Status,
+		&hike.MaxParticipants, &hike.DurationMinutes, &hike.Version, &hike.Public, &hike.Difficulty,
+		&hike.DistanceMiles, &hike.ElevationGainFeet, &hike.Hazards, &hike.HasRoute,
 	)
-
 	if err != nil {
-		// This would be unusual if the update succeeded, but handle it.
-		http.Error(w, "Error fetching updated hike details: "+err.Error(), http.StatusInternalServerError)
-		return
+		return hike, err
 	}
+	// Hand back the code that was used, which may be a role's access code
+	hike.LeaderCode = leaderCode
+	hike.Role = access.role
+	hike.Permissions = rolePermissions[access.role]
 
-	populateDescriptionHTML(&finalHike)
+	populateDescriptionHTML(&hike)
 
 	// Regenerate waiver text as leader or organization might have changed
-	waiverText, waiverErr := generateWaiverText(finalHike.JoinCode)
+	waiverText, waiverErr := generateWaiverText(hike.JoinCode)
 	if waiverErr != nil {
-		log.Printf("Error generating waiver text for updated hike %s: %v", finalHike.JoinCode, waiverErr)
-		finalHike.WaiverText = "" // Or some default/error message
+		log.Printf("Error generating waiver text for updated hike %s: %v", hike.JoinCode, waiverErr)
+		hike.WaiverText = "" // Or some default/error message
 	} else {
-		finalHike.WaiverText = waiverText
+		hike.WaiverText = waiverText
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(finalHike)
-	logAction(fmt.Sprintf("Hike updated: %s (LeaderCode: %s)", finalHike.Name, leaderCodeFromPath))
+	return hike, nil
 }
 
 func rsvpToHikeHandler(w http.ResponseWriter, r *http.Request) { // Renamed function
@@ -705,6 +1004,55 @@ func rsvpToHikeHandler(w http.ResponseWriter, r *http.Request) { // Renamed func
 		return
 	}
 
+	if err := validateDependents(user, user.Dependents); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkDependentUUIDs(user.UUID, user.Dependents); err != nil {
+		if _, isTaken := err.(*dependentTakenError); isTaken {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if user.Carpool != nil {
+		if err := validateCarpoolSignup(user.Carpool); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	// Only the participant can RSVP again and change their details
+	rsvping := []string{user.UUID}
+	for _, d := range user.Dependents {
+		if d.UUID != "" {
+			rsvping = append(rsvping, d.UUID)
+		}
+	}
+	if !authorizeRepeatRSVP(w, r, joinCode, rsvping...) {
+		return
+	}
+	if err := checkRepeatRSVPs(joinCode, rsvping...); err != nil {
+		if _, isTransitionError := err.(*statusTransitionError); isTransitionError {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	// Refuse a driver's new seat count before anything is written, so the RSVP isn't half made
+	if user.Carpool != nil {
+		err = checkCarpoolSeats(db, joinCode, user.UUID, *user.Carpool)
+		if err == errCarpoolOverfull {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
 	// Insert or update user in the database
 	_, err = db.Exec(`
 		INSERT OR REPLACE INTO users (uuid, name, phone, license_plate, emergency_contact)
@@ -716,25 +1064,192 @@ func rsvpToHikeHandler(w http.ResponseWriter, r *http.Request) { // Renamed func
 		return
 	}
 
-	// Add the participant to the hike with status rsvp
-	result, err := db.Exec(`
-		INSERT OR REPLACE INTO hike_users (hike_join_code, user_uuid, status, joined_at)
-		VALUES (?, ?, 'rsvp', CURRENT_TIMESTAMP)
-	`, joinCode, user.UUID)
-
+	// Add the participant to the hike with status rsvp, or to the waitlist if the hike is full.
+	hike.ParticipantId, hike.ParticipantStatus, hike.ParticipantToken, err = addParticipant(joinCode, user.UUID)
+	if _, isTransitionError := err.(*statusTransitionError); isTransitionError {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	hike.ParticipantId, err = result.LastInsertId()
+	err = recordWaiverSignature(user.UUID, joinCode, r.UserAgent(), clientIPAddress(r))
+	if err != nil {
+		// Log the error but don't fail the entire join operation,
+		// as the user is already in hike_users.
+		// Potentially, you might want to roll back the hike_users insertion
+		// if waiver signing is absolutely critical, but that adds complexity.
+		log.Printf("Error inserting waiver signature: %v. User: %s, Hike: %s", err, user.UUID, joinCode)
+	}
+
+	hike.Dependents, err = addDependents(joinCode, user, user.Dependents, r.UserAgent(), clientIPAddress(r))
+	if _, isTransitionError := err.(*statusTransitionError); isTransitionError {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Generate waiver text using the new helper function
-	waiverText, err := generateWaiverText(joinCode)
+	if user.Carpool != nil {
+		err := joinCarpool(joinCode, user.UUID, *user.Carpool)
+		if err == errCarpoolOverfull {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		hikeEvents.publish(joinCode, eventCarpool, hike.ParticipantId, user.Carpool.Role)
+		logAction(fmt.Sprintf("Participant %s signed up for the carpool as a %s (%d seats) (Hike Join Code: %s)", user.Name, user.Carpool.Role, user.Carpool.Seats, hike.JoinCode))
+	}
+	for _, d := range hike.Dependents {
+		logAction(fmt.Sprintf("Dependent %s (age %d) RSVPd by %s with status %s (Hike Join Code: %s), Waiver Acknowledged by Guardian", d.Name, d.Age, user.Name, d.ParticipantStatus, hike.JoinCode))
+	}
+
+	if hike.ParticipantStatus == "waitlist" {
+		logAction(fmt.Sprintf("Participant waitlisted for full hike: %s (Hike Join Code: %s), Waiver Signed", user.Name, hike.JoinCode))
+	} else {
+		logAction(fmt.Sprintf("Participant RSVPd to hike: %s (Hike Join Code: %s), Waiver Signed", user.Name, hike.JoinCode)) // Updated log message
+	}
+	json.NewEncoder(w).Encode(hike)
+}
+
+// addParticipant RSVPs a user to a hike, or puts them on the waitlist if the hike is full,
+// and returns their participant id, status and the token they need to change their status.
+// The capacity check and insert share a transaction so two late RSVPs can't both take the
+// last spot. Someone already on the hike can RSVP again only while they're on the waitlist or
+// RSVPd; otherwise a *statusTransitionError is returned.
+func addParticipant(joinCode, userUUID string) (int64, string, string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, "", "", fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback() // Rollback if not committed
+
+	participantId, status, token, notify, err := rsvpParticipant(tx, joinCode, userUUID)
+	if err != nil {
+		return 0, "", "", err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, "", "", fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	if notify {
+		hikeEvents.publish(joinCode, eventRSVP, participantId, status)
+	}
+	return participantId, status, token, nil
+}
+
+// checkRepeatRSVPs returns a *statusTransitionError if any of the users is already on the hike
+// with a status an RSVP can't change, so an RSVP that will be refused writes nothing
+func checkRepeatRSVPs(joinCode string, userUUIDs ...string) error {
+	for _, userUUID := range userUUIDs {
+		var status string
+		err := db.QueryRow("SELECT status FROM hike_users WHERE hike_join_code = ? AND user_uuid = ?", joinCode, userUUID).Scan(&status)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if status != "rsvp" && status != "waitlist" {
+			return &statusTransitionError{from: status, to: "rsvp", actor: actorParticipant}
+		}
+	}
+	return nil
+}
+
+// rsvpParticipant does the work of addParticipant in the caller's transaction. notify is
+// false when nothing the leader would see has changed, so no event needs to be published.
+func rsvpParticipant(tx *sql.Tx, joinCode, userUUID string) (participantId int64, status, token string, notify bool, err error) {
+	// Someone already on the waitlist keeps their place in line when they RSVP again
+	var existingId int64
+	var existingStatus string
+	var existingToken sql.NullString
+	err = tx.QueryRow("SELECT id, status, participant_token FROM hike_users WHERE hike_join_code = ? AND user_uuid = ?", joinCode, userUUID).Scan(&existingId, &existingStatus, &existingToken)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, "", "", false, err
+	}
+	if existingId != 0 && existingStatus != "rsvp" && existingStatus != "waitlist" {
+		// Someone out on the trail, back already, or marked a no-show can't RSVP over that
+		return 0, "", "", false, &statusTransitionError{from: existingStatus, to: "rsvp", actor: actorParticipant}
+	}
+
+	// Someone who already holds a spot keeps it, even if the cap has been lowered since
+	status = existingStatus
+	if existingId == 0 || existingStatus == "waitlist" {
+		spotAvailable, err := hasOpenSpot(tx, joinCode, userUUID)
+		if err != nil {
+			return 0, "", "", false, fmt.Errorf("error checking hike capacity: %v", err)
+		}
+		status = "rsvp"
+		if !spotAvailable {
+			status = "waitlist"
+		}
+	}
+
+	// Someone RSVPing again keeps their token; it's their proof they RSVPd
+	participantId, token = existingId, existingToken.String
+	changed := existingId == 0 || status != existingStatus
+	if token == "" {
+		token, err = generateSecureLinkCode()
+		if err != nil {
+			return 0, "", "", false, fmt.Errorf("failed to generate participant token: %v", err)
+		}
+	}
+	switch {
+	case existingId == 0:
+		result, err := tx.Exec(`
+			INSERT INTO hike_users (hike_join_code, user_uuid, status, joined_at, participant_token)
+			VALUES (?, ?, ?, CURRENT_TIMESTAMP, ?)
+		`, joinCode, userUUID, status, token)
+		if err != nil {
+			return 0, "", "", false, err
+		}
+		participantId, err = result.LastInsertId()
+		if err != nil {
+			return 0, "", "", false, err
+		}
+		if err = recordStatusChange(tx, participantId, joinCode, "", status, actorParticipant); err != nil {
+			return 0, "", "", false, err
+		}
+	case changed:
+		// A spot has opened up since they were waitlisted
+		if err = checkStatusTransition(existingStatus, status, actorSystem); err != nil {
+			return 0, "", "", false, err
+		}
+		if _, err = tx.Exec("UPDATE hike_users SET status = ?, participant_token = ? WHERE id = ?", status, token, participantId); err != nil {
+			return 0, "", "", false, err
+		}
+		if err = recordStatusChange(tx, participantId, joinCode, existingStatus, status, actorSystem); err != nil {
+			return 0, "", "", false, err
+		}
+	}
+
+	// Someone RSVPing again may have changed their details; a place on the waitlist is unchanged
+	notify = status != "waitlist" || existingStatus != "waitlist"
+	return participantId, status, token, notify, nil
+}
+
+// recordWaiverSignature stores the waiver a participant agreed to when they RSVPd to a hike
+func recordWaiverSignature(userUUID, joinCode, userAgent, ipAddress string) error {
+	return storeWaiverSignature(userUUID, joinCode, userAgent, ipAddress, "", "")
+}
+
+// recordGuardianWaiverSignature stores the waiver a guardian agreed to on a dependent's behalf
+func recordGuardianWaiverSignature(d Dependent, guardian User, joinCode, userAgent, ipAddress string) error {
+	return storeWaiverSignature(d.UUID, joinCode, userAgent, ipAddress, guardian.UUID, guardianAcknowledgment(guardian, d))
+}
+
+// storeWaiverSignature renders the hike's waiver, adds the guardian's acknowledgment if a
+// guardian is signing for someone else, and stores it as signed now
+func storeWaiverSignature(userUUID, joinCode, userAgent, ipAddress, guardianUUID, acknowledgment string) error {
+	signedAt := time.Now()
+	waiverText, templateId, err := renderWaiver(joinCode, signedAt)
 	if err != nil {
 		// Log the error but proceed with joining the hike, as waiver signing is secondary
 		// However, if the waiver can't be generated, it's a significant issue.
@@ -747,43 +1262,36 @@ func rsvpToHikeHandler(w http.ResponseWriter, r *http.Request) { // Renamed func
 		waiverText = "" // Or handle error more gracefully, e.g., http.Error
 	}
 
-	// Get User-Agent
-	userAgent := r.UserAgent()
-	if userAgent == "" { // Fallback, though UserAgent() usually provides a value
-		userAgent = r.Header.Get("User-Agent")
+	rec := waiverRecord{
+		UserUUID:   userUUID,
+		JoinCode:   joinCode,
+		SignedAt:   signedAt,
+		UserAgent:  userAgent,
+		IPAddress:  ipAddress,
+		WaiverText: waiverText + acknowledgment,
+		TemplateId: templateId,
+	}
+	if guardianUUID != "" {
+		rec.GuardianUUID, rec.GuardianAcknowledgedAt = guardianUUID, signedAt
 	}
+	// Signing again, e.g. on a second RSVP, adds to the log rather than replacing the earlier signature
+	return appendWaiverSignature(rec)
+}
 
-	// Get IP Address
+// clientIPAddress returns the IP address of the client that made the request
+func clientIPAddress(r *http.Request) string {
 	ipAddress := r.Header.Get("X-Forwarded-For")
 	if ipAddress == "" {
-		ipAddress = r.RemoteAddr
-	} else {
-		// X-Forwarded-For can be a comma-separated list of IPs.
-		// The first IP is generally the client's IP.
-		ips := strings.Split(ipAddress, ",")
-		ipAddress = strings.TrimSpace(ips[0])
+		return r.RemoteAddr
 	}
-
-	// Insert waiver signature
-	_, err = db.Exec(`
-		INSERT OR REPLACE INTO waiver_signatures
-               (user_uuid, hike_join_code, signed_at, user_agent, ip_address, waiver_text)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, user.UUID, joinCode, time.Now().Format("2006-01-02T15:04:05-07:00"), userAgent, ipAddress, waiverText)
-
-	if err != nil {
-		// Log the error but don't fail the entire join operation,
-		// as the user is already in hike_users.
-		// Potentially, you might want to roll back the hike_users insertion
-		// if waiver signing is absolutely critical, but that adds complexity.
-		log.Printf("Error inserting waiver signature: %v. User: %s, Hike: %s", err, user.UUID, joinCode)
-	}
-
-	logAction(fmt.Sprintf("Participant RSVPd to hike: %s (Hike Join Code: %s), Waiver Signed", user.Name, hike.JoinCode)) // Updated log message
-	json.NewEncoder(w).Encode(hike)
+	// X-Forwarded-For can be a comma-separated list of IPs.
+	// The first IP is generally the client's IP.
+	ips := strings.Split(ipAddress, ",")
+	return strings.TrimSpace(ips[0])
 }
 
-// unRSVPHandler allows a user to remove their RSVP if their status is 'rsvp'
+// unRSVPHandler allows a user to remove their RSVP if their status is 'rsvp'.
+// Requires the participant's token or a leaderCode that can update participants.
 func unRSVPHandler(w http.ResponseWriter, r *http.Request) {
 	joinCode := r.PathValue("hikeId")
 	participantIdStr := r.PathValue("participantId")
@@ -794,6 +1302,10 @@ func unRSVPHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid participant ID format", http.StatusBadRequest)
 		return
 	}
+	actor, ok := authorizeParticipantChange(w, r, joinCode, participantId)
+	if !ok {
+		return
+	}
 
 	// Begin transaction
 	tx, err := db.Begin()
@@ -816,14 +1328,14 @@ func unRSVPHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if currentStatus != "rsvp" {
+	if currentStatus != "rsvp" && currentStatus != "waitlist" {
 		http.Error(w, fmt.Sprintf("Cannot unRSVP. Participant status is '%s', not 'rsvp'. Only users who RSVPd can unRSVP.", currentStatus), http.StatusBadRequest)
 		return
 	}
 
 	// Delete from hike_users using participantId
 	result, err := tx.Exec(`DELETE FROM hike_users
-							 WHERE id = ? AND hike_join_code = ? AND status = 'rsvp'`,
+							 WHERE id = ? AND hike_join_code = ? AND status IN ('rsvp', 'waitlist')`,
 		participantId, joinCode)
 	if err != nil {
 		http.Error(w, "Failed to delete participant from hike: "+err.Error(), http.StatusInternalServerError)
@@ -841,18 +1353,24 @@ func unRSVPHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Delete from waiver_signatures using the fetched userUUID
-	_, err = tx.Exec(`DELETE FROM waiver_signatures
-					   WHERE hike_join_code = ? AND user_uuid = ?`,
-		joinCode, userUUID)
+	// Dependents can't hike without the adult who RSVPd them
+	removedDependents, err := removeDependents(tx, joinCode, userUUID)
+	if err != nil {
+		http.Error(w, "Failed to remove dependents from hike: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Riders with this participant, or their dependents, need to find another car
+	if err := pruneCarpool(tx, joinCode); err != nil {
+		http.Error(w, "Failed to update the carpool: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The freed spot goes to the next person on the waitlist
+	promoted, err := promoteFromWaitlist(tx, joinCode)
 	if err != nil {
-		// Log this error, but the primary action (removing from hike_users) succeeded.
-		// Depending on policy, this might be considered a critical failure requiring rollback,
-		// but waiver cleanup is secondary to unRSVPing from the hike itself.
-		log.Printf("Error deleting waiver signature for user %s, hike %s (participantId %d): %v. Continuing with unRSVP.", userUUID, joinCode, participantId, err)
-		// If this should be a hard failure, uncomment the following:
-		// http.Error(w, "Failed to delete waiver signature: "+err.Error(), http.StatusInternalServerError)
-		// return
+		http.Error(w, "Error promoting waitlisted participants: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	err = tx.Commit()
@@ -861,8 +1379,20 @@ func unRSVPHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	hikeEvents.publish(joinCode, eventUnRSVP, participantId, "")
+	for _, id := range removedDependents {
+		hikeEvents.publish(joinCode, eventUnRSVP, id, "")
+	}
+	publishPromotions(joinCode, promoted)
+
 	w.WriteHeader(http.StatusOK)
-	logAction(fmt.Sprintf("Participant with ID %d (UserUUID: %s) unRSVPd from hike %s", participantId, userUUID, joinCode))
+	logAction(fmt.Sprintf("Participant with ID %d (UserUUID: %s) unRSVPd from hike %s by %s", participantId, userUUID, joinCode, actor))
+	if len(removedDependents) > 0 {
+		logAction(fmt.Sprintf("%d dependents of participant %d unRSVPd from hike %s: %v", len(removedDependents), participantId, joinCode, removedDependents))
+	}
+	for _, id := range promoted {
+		logAction(fmt.Sprintf("Participant with ID %d promoted from waitlist for hike %s", id, joinCode))
+	}
 }
 
 // Helper function to parse string to int64 (could be in a utils package)
@@ -872,10 +1402,24 @@ func parseInt64(s string) (int64, error) {
 	return i, err
 }
 
-// Given a leader code, return all participants of the hike
+// Given a leader code (or a role access code), return all participants of the hike
 func getHikeParticipantsHandler(w http.ResponseWriter, r *http.Request) {
-	leaderCode := r.URL.Query().Get("leaderCode")
+	access, ok := requireHikeAccess(w, r, permViewRoster)
+	if !ok {
+		return
+	}
 
+	participants, err := hikeParticipants(access.joinCode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(participants)
+}
+
+// hikeParticipants returns everyone on a hike's roster along with when they signed the waiver
+func hikeParticipants(joinCode string) ([]Participant, error) {
 	var participants []Participant
 
 	rows, err := db.Query(`
@@ -886,78 +1430,120 @@ func getHikeParticipantsHandler(w http.ResponseWriter, r *http.Request) {
 		  u.emergency_contact,
 		  hu.status,
           hu.id,
-		  ws.signed_at
+		  COALESCE(ws.signed_at, ''),
+		  COALESCE(hu.age, -1),
+		  COALESCE(g.name, ''),
+		  CASE WHEN hu.status = 'waitlist' THEN
+		    (SELECT COUNT(*) FROM hike_users w
+		     WHERE w.hike_join_code = hu.hike_join_code AND w.status = 'waitlist'
+		       AND (w.joined_at < hu.joined_at OR (w.joined_at = hu.joined_at AND w.id <= hu.id)))
+		  ELSE 0 END
 		FROM
 		  hike_users hu
 		  JOIN users u ON hu.user_uuid = u.uuid
           LEFT JOIN waiver_signatures ws
-            ON hu.user_uuid = ws.user_uuid AND hu.hike_join_code = ws.hike_join_code
+            ON ws.id = (SELECT MAX(id) FROM waiver_signatures
+                        WHERE user_uuid = hu.user_uuid AND hike_join_code = hu.hike_join_code)
+		  LEFT JOIN users g ON hu.guardian_uuid = g.uuid
 		WHERE
-		  hu.hike_join_code = (SELECT join_code FROM hikes WHERE leader_code = ?)`,
-		leaderCode)
+		  hu.hike_join_code = ?`,
+		joinCode)
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var p Participant
 		var dateTimeString string
-		err := rows.Scan(&p.User.Name, &p.User.Phone, &p.User.LicensePlate, &p.User.EmergencyContact, &p.Status, &p.Id, &dateTimeString)
+		var age int
+		err := rows.Scan(&p.User.Name, &p.User.Phone, &p.User.LicensePlate, &p.User.EmergencyContact, &p.Status, &p.Id, &dateTimeString, &age, &p.GuardianName, &p.WaitlistPosition)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, err
 		}
-		p.Waiver, err = time.Parse("2006-01-02T15:04:05-07:00", dateTimeString)
-		if err != nil {
-			logAction(fmt.Sprintf("Error parsing date: %s", err.Error()))
+		if age >= 0 {
+			p.Age, p.Minor = age, isMinor(age)
+		}
+		if dateTimeString != "" {
+			p.Waiver, err = time.Parse("2006-01-02T15:04:05-07:00", dateTimeString)
+			if err != nil {
+				logAction(fmt.Sprintf("Error parsing date: %s", err.Error()))
+			}
 		}
 		participants = append(participants, p)
 	}
-
-	json.NewEncoder(w).Encode(participants)
+	return participants, rows.Err()
 }
 
-// TODO: For security require either LeaderCode or User's UUID
+// Change a participant's status, e.g. when they start hiking or finish.
+// Requires the participant's token or a leaderCode that can update participants.
 func updateParticipantStatusHandler(w http.ResponseWriter, r *http.Request) {
 	joinCode := r.PathValue("hikeId")
-	participantId := r.PathValue("participantId")
+	participantId, err := parseInt64(r.PathValue("participantId"))
+	if err != nil {
+		http.Error(w, "Invalid participant ID format", http.StatusBadRequest)
+		return
+	}
+	actor, ok := authorizeParticipantChange(w, r, joinCode, participantId)
+	if !ok {
+		return
+	}
 
 	var request struct {
 		Status string `json:"status"`
 	}
 
-	err := json.NewDecoder(r.Body).Decode(&request)
+	err = json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	result, err := db.Exec(`UPDATE hike_users
-					  SET status = ?
-					  WHERE
-                        hike_join_code = (SELECT join_code FROM hikes
-                                          WHERE join_code = ? and status = "open") AND
-                        id = ?
-					 `, request.Status, joinCode, participantId)
+	tx, err := db.Begin()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Failed to start transaction: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback() // Rollback if not committed
 
-	rowsAffected, err := result.RowsAffected()
+	// Only moves the state machine allows for this actor are made, see status.go
+	previousStatus, err := transitionParticipantStatus(tx, joinCode, participantId, request.Status, actor)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Participant not found for this hike with the given ID.", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if _, isTransitionError := err.(*statusTransitionError); isTransitionError || err == errHikeNotOpen {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else if err == errHikeFull {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
-	if rowsAffected == 0 {
-		http.Error(w, "Hike not found or not open", http.StatusBadRequest)
+
+	// A no-show or someone dropping out frees their spot for the waitlist
+	promoted, err := promoteFromWaitlist(tx, joinCode)
+	if err != nil {
+		http.Error(w, "Error promoting waitlisted participants: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
 
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hikeEvents.publish(joinCode, eventStatus, participantId, request.Status)
+	publishPromotions(joinCode, promoted)
+
 	//w.WriteHeader(http.StatusOK)
-	logAction(fmt.Sprintf("Participant status updated: Id: %s, Leader Code: %s, New Status: %s", participantId, joinCode, request.Status))
+	logAction(fmt.Sprintf("Participant status updated by %s: Id: %d, Join Code: %s, Status: %s -> %s", actor, participantId, joinCode, previousStatus, request.Status))
+	for _, id := range promoted {
+		logAction(fmt.Sprintf("Participant with ID %d promoted from waitlist for hike %s", id, joinCode))
+	}
 }
 
 // getHikesHandler returns hikes based on query parameters:
@@ -976,11 +1562,12 @@ func getHikesHandler(w http.ResponseWriter, r *http.Request) {
 	// Fetch by userUUID (RSVP'd hikes)
 	rows, err := db.Query(`
 			SELECT h.name, h.organization, h.trailhead_name, h.trailhead_map_link, h.start_time, h.join_code, h.status, h.description,
-			       hu.id AS participant_id, l.uuid AS leader_uuid, l.name AS leader_name, l.phone AS leader_phone
+			       hu.id AS participant_id, hu.status AS participant_status, COALESCE(hu.participant_token, ''), h.max_participants, h.duration_minutes,
+			       l.uuid AS leader_uuid, l.name AS leader_name, l.phone AS leader_phone
 			FROM hikes AS h
 			JOIN hike_users AS hu ON h.join_code = hu.hike_join_code
 			JOIN users AS l ON h.leader_uuid = l.uuid
-			WHERE hu.user_uuid = ? AND hu.status = 'rsvp' AND h.status = 'open'
+			WHERE hu.user_uuid = ? AND hu.status IN ('rsvp', 'waitlist') AND h.status = 'open'
 			ORDER BY h.start_time DESC
 		`, userUUID)
 
@@ -994,7 +1581,7 @@ func getHikesHandler(w http.ResponseWriter, r *http.Request) {
 		var h Hike
 		err := rows.Scan(
 			&h.Name, &h.Organization, &h.TrailheadName, &h.TrailheadMapLink, &h.StartTime, &h.JoinCode, &h.Status, &h.DescriptionMarkdown,
-			&h.ParticipantId, &h.Leader.UUID, &h.Leader.Name, &h.Leader.Phone,
+			&h.ParticipantId, &h.ParticipantStatus, &h.ParticipantToken, &h.MaxParticipants, &h.DurationMinutes, &h.Leader.UUID, &h.Leader.Name, &h.Leader.Phone,
 		)
 		if err != nil {
 			http.Error(w, "Error scanning RSVP hike: "+err.Error(), http.StatusInternalServerError)
@@ -1012,7 +1599,7 @@ func getHikesHandler(w http.ResponseWriter, r *http.Request) {
 	// If userUUID is provided, also fetch hikes led by this user
 	rows, err = db.Query(`
 			SELECT h.join_code, h.name, h.organization, h.trailhead_name, u.uuid as leader_uuid, u.name AS leader_name, u.phone AS leader_phone,
-			       h.trailhead_map_link, h.start_time, h.status, h.leader_code, h.description
+			       h.trailhead_map_link, h.start_time, h.status, h.leader_code, h.description, h.max_participants, h.duration_minutes
 			FROM hikes AS h
 			JOIN users AS u ON h.leader_uuid = u.uuid
 			WHERE h.leader_uuid = ? AND h.status = 'open'
@@ -1029,13 +1616,15 @@ func getHikesHandler(w http.ResponseWriter, r *http.Request) {
 		var h Hike
 		err := rows.Scan(
 			&h.JoinCode, &h.Name, &h.Organization, &h.TrailheadName, &h.Leader.UUID, &h.Leader.Name, &h.Leader.Phone,
-			&h.TrailheadMapLink, &h.StartTime, &h.Status, &h.LeaderCode, &h.DescriptionMarkdown, // Added h.LeaderCode
+			&h.TrailheadMapLink, &h.StartTime, &h.Status, &h.LeaderCode, &h.DescriptionMarkdown, &h.MaxParticipants, &h.DurationMinutes, // Added h.LeaderCode
 		)
 		if err != nil {
 			http.Error(w, "Error scanning hike led by user: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 		populateDescriptionHTML(&h)
+		h.Role = "leader"
+		h.Permissions = rolePermissions[h.Role]
 		h.SourceType = "led_by_user" // New SourceType
 		allHikes = append(allHikes, h)
 	}
@@ -1044,6 +1633,43 @@ func getHikesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Also fetch hikes where this user holds a role, returned with that role's access code
+	rows, err = db.Query(`
+			SELECT h.join_code, h.name, h.organization, h.trailhead_name, u.uuid as leader_uuid, u.name AS leader_name, u.phone AS leader_phone,
+			       h.trailhead_map_link, h.start_time, h.status, r.access_code, r.role, h.description, h.max_participants, h.duration_minutes
+			FROM hike_roles AS r
+			JOIN hikes AS h ON r.hike_join_code = h.join_code
+			JOIN users AS u ON h.leader_uuid = u.uuid
+			WHERE r.user_uuid = ? AND r.revoked_at IS NULL AND h.status = 'open'
+			ORDER BY h.start_time DESC
+		`, userUUID)
+
+	if err != nil {
+		http.Error(w, "Error querying hikes with roles for user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var h Hike
+		err := rows.Scan(
+			&h.JoinCode, &h.Name, &h.Organization, &h.TrailheadName, &h.Leader.UUID, &h.Leader.Name, &h.Leader.Phone,
+			&h.TrailheadMapLink, &h.StartTime, &h.Status, &h.LeaderCode, &h.Role, &h.DescriptionMarkdown, &h.MaxParticipants, &h.DurationMinutes,
+		)
+		if err != nil {
+			http.Error(w, "Error scanning hike with role for user: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		populateDescriptionHTML(&h)
+		h.Permissions = rolePermissions[h.Role]
+		h.SourceType = "led_by_user"
+		allHikes = append(allHikes, h)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, "Error iterating hikes with roles for user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Note: As per plan, if a hike matches multiple criteria, it will appear multiple times
 	// in allHikes, each with its respective SourceType. No deduplication is done.
 
@@ -1051,7 +1677,8 @@ func getHikesHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(allHikes)
 }
 
-// Given a query string, return a list of trailhead suggestions
+// Given a query string, return a list of trailhead suggestions. The leader's own trailheads
+// are preferred over the catalog's when they match as well; see rankTrailheads.
 func trailheadSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query().Get("q")
 	userUUID := r.URL.Query().Get("userUUID")
@@ -1061,100 +1688,21 @@ func trailheadSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Clean the query input in the same way the database fields are cleaned for comparison
-	cleanedQuery := strings.ReplaceAll(query, "'", "")
-	likePattern := "%" + cleanedQuery + "%"
-
-	suggestionsMap := make(map[string]Trailhead) // Stores unique suggestions by name
-	var orderedSuggestions []Trailhead           // Maintains order of addition, prioritizing user history
-
-	// 1. Fetch from user's hike history if userUUID is provided
-	if userUUID != "" {
-		userHikeRows, err := db.Query(`
-			SELECT trailhead_name, trailhead_map_link
-			FROM (
-				SELECT
-					trailhead_name,
-					trailhead_map_link,
-					ROW_NUMBER() OVER(PARTITION BY trailhead_name ORDER BY created_at DESC) as rn
-				FROM hikes
-				WHERE leader_uuid = ? AND REPLACE(trailhead_name, '''', '') LIKE ?
-			) sub
-			WHERE sub.rn = 1
-			ORDER BY trailhead_name ASC
-		`, userUUID, likePattern) // Use the cleaned likePattern
-		if err != nil {
-			http.Error(w, "Error querying user-led hike trailheads: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer userHikeRows.Close()
-
-		for userHikeRows.Next() {
-			var th Trailhead
-			// startTime is no longer fetched or used from this query for ordering user suggestions here,
-			// as recency is handled by the ROW_NUMBER() and created_at in the SQL.
-			if err := userHikeRows.Scan(&th.Name, &th.MapLink); err != nil {
-				http.Error(w, "Error scanning user hike trailhead: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-			if _, exists := suggestionsMap[th.Name]; !exists {
-				suggestionsMap[th.Name] = th
-				orderedSuggestions = append(orderedSuggestions, th)
-			}
-		}
-		if err = userHikeRows.Err(); err != nil {
-			http.Error(w, "Error iterating user hike trailheads: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-	}
-
-	// 2. Fetch from predefined trailheads table
-	if len(orderedSuggestions) < 5 {
-		stdTrailheadRows, err := db.Query(`
-			SELECT name, map_link
-			FROM trailheads
-			WHERE REPLACE(name, '''', '') LIKE ?
-			ORDER BY name
-			LIMIT ?
-		`, likePattern, 5) // Use the cleaned likePattern, fetch up to 5, will filter later
-		if err != nil {
-			http.Error(w, "Error querying predefined trailheads: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer stdTrailheadRows.Close()
-
-		for stdTrailheadRows.Next() {
-			if len(orderedSuggestions) >= 5 {
-				break
-			}
-			var th Trailhead
-			if err := stdTrailheadRows.Scan(&th.Name, &th.MapLink); err != nil {
-				http.Error(w, "Error scanning predefined trailhead: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-			if _, exists := suggestionsMap[th.Name]; !exists {
-				suggestionsMap[th.Name] = th
-				orderedSuggestions = append(orderedSuggestions, th)
-			}
-		}
-		if err = stdTrailheadRows.Err(); err != nil {
-			http.Error(w, "Error iterating predefined trailheads: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
+	candidates, err := trailheadCandidates(userUUID)
+	if err != nil {
+		http.Error(w, "Error loading trailheads: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
+	suggestions := rankTrailheads(query, candidates)
 
-	finalSuggestions := orderedSuggestions
-	if len(finalSuggestions) > 5 {
-		finalSuggestions = finalSuggestions[:5]
+	// Warn leaders about closures as they pick the trailhead
+	if err := attachTrailheadAdvisories(suggestions); err != nil {
+		http.Error(w, "Error loading trailhead advisories: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	// Sort the final list alphabetically by trailhead name
-	sort.Slice(finalSuggestions, func(i, j int) bool {
-		return strings.ToLower(finalSuggestions[i].Name) < strings.ToLower(finalSuggestions[j].Name)
-	})
-
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(finalSuggestions)
+	json.NewEncoder(w).Encode(suggestions)
 }
 
 func generateSecureLinkCode() (string, error) {
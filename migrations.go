@@ -0,0 +1,724 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration is a single forward step of the database schema.
+// Append new migrations to the end of the migrations slice; never edit or reorder one that has shipped.
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{1, "Initial schema", migrateInitialSchema},
+	{2, "Add hike description and photo release", migrateHikeDescriptionAndPhotoRelease},
+	{3, "Add hike participant capacity", migrateHikeCapacity},
+	{4, "Add hike expected duration", migrateHikeDuration},
+	{5, "Add recurring hike series", migrateHikeSeries},
+	{6, "Add hike roles", migrateHikeRoles},
+	{7, "Add participant tokens", migrateParticipantTokens},
+	{8, "Add participant status history", migrateParticipantStatusHistory},
+	{9, "Add waiver templates", migrateWaiverTemplates},
+	{10, "Add dependents", migrateDependents},
+	{11, "Make waiver signatures an append-only hash chain", migrateWaiverLog},
+	{12, "Add idempotency keys", migrateIdempotencyKeys},
+	{13, "Add hike version", migrateHikeVersion},
+	{14, "Add carpools", migrateCarpools},
+	{15, "Add hike updated time", migrateHikeUpdatedAt},
+	{16, "Add public hikes and difficulty", migratePublicHikes},
+	{17, "Add organizations and their admins", migrateOrganizations},
+	{18, "Add trail information to hikes and trailheads", migrateTrailInfo},
+	{19, "Add hike routes", migrateHikeRoutes},
+	{20, "Add trailhead coordinates", migrateTrailheadCoordinates},
+	{21, "Add trailhead aliases and retirement", migrateTrailheadCatalog},
+	{22, "Add trailhead advisories", migrateTrailheadAdvisories},
+	{23, "Add well-known trailhead aliases", seedTrailheadAliases},
+	{24, "Add series subscription tokens", migrateSubscriptionTokens},
+	{25, "Store ETag and Location with idempotent responses", migrateIdempotencyHeaders},
+}
+
+// latestSchemaVersion returns the schema version this build knows how to produce.
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// migrateDB brings the database schema up to date. All pending migrations are applied
+// in a single transaction so a failure leaves the database at its previous version.
+// Databases created before schema_version existed are treated as version 0; the early
+// migrations are written so they are safe to run against those.
+func migrateDB(conn *sql.DB) error {
+	_, err := conn.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			description TEXT NOT NULL,
+			applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_version table: %v", err)
+	}
+
+	var current int
+	err = conn.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&current)
+	if err != nil {
+		return fmt.Errorf("error reading schema version: %v", err)
+	}
+
+	latest := latestSchemaVersion()
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d); refusing to start", current, latest)
+	}
+	if current == latest {
+		return nil
+	}
+
+	tx, err := conn.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting migration transaction: %v", err)
+	}
+	defer tx.Rollback() // Rollback if not committed
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := m.up(tx); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.version, m.description, err)
+		}
+		_, err = tx.Exec("INSERT INTO schema_version (version, description) VALUES (?, ?)", m.version, m.description)
+		if err != nil {
+			return fmt.Errorf("error recording migration %d: %v", m.version, err)
+		}
+		log.Printf("Applied schema migration %d: %s", m.version, m.description)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing migrations: %v", err)
+	}
+	return nil
+}
+
+// columnExists reports whether table already has the named column.
+func columnExists(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, dataType string
+		var dfltValue interface{}
+		if err := rows.Scan(&cid, &name, &dataType, &notnull, &dfltValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// addColumnIfMissing adds a column unless it is already present. Older databases had
+// columns added by hand, so migrations that add columns must tolerate finding them there.
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) error {
+	exists, err := columnExists(tx, table, column)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+func migrateInitialSchema(tx *sql.Tx) error {
+	// Note to self: Foreign key declarations must be at the end of the table creation statement
+	// Because go initializes strings to "" we can use TEXT DEFAULT '' for all optional TEXT columns
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS trailheads (
+			name TEXT PRIMARY KEY,
+			map_link TEXT DEFAULT ''
+		);
+
+		CREATE TABLE IF NOT EXISTS users (
+			uuid TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			phone TEXT NOT NULL,
+			license_plate TEXT DEFAULT '',
+			emergency_contact TEXT DEFAULT ''
+		);
+
+		CREATE TABLE IF NOT EXISTS hikes (
+			name TEXT NOT NULL,
+			organization TEXT DEFAULT '',
+			trailhead_name TEXT DEFAULT '',
+			trailhead_map_link TEXT DEFAULT '',
+			leader_uuid TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			start_time DATETIME NOT NULL,
+			status TEXT DEFAULT 'open',
+			join_code TEXT PRIMARY KEY,
+			leader_code TEXT UNIQUE,
+			FOREIGN KEY (leader_uuid) REFERENCES users(uuid)
+		);
+
+		CREATE TABLE IF NOT EXISTS hike_users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			hike_join_code TEXT NOT NULL,
+			user_uuid TEXT NOT NULL,
+			status TEXT DEFAULT 'active',
+			joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (hike_join_code, user_uuid),
+			FOREIGN KEY (hike_join_code) REFERENCES hikes(join_code),
+			FOREIGN KEY (user_uuid) REFERENCES users(uuid)
+		);
+
+		CREATE TABLE IF NOT EXISTS waiver_signatures (
+			user_uuid TEXT NOT NULL,
+			hike_join_code TEXT NOT NULL,
+			signed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			user_agent TEXT NOT NULL,
+			ip_address TEXT NOT NULL,
+			waiver_text TEXT NOT NULL,
+			PRIMARY KEY (user_uuid, hike_join_code),
+			FOREIGN KEY (user_uuid) REFERENCES users(uuid),
+			FOREIGN KEY (hike_join_code) REFERENCES hikes(join_code)
+		);
+	`)
+	return err
+}
+
+func migrateHikeDescriptionAndPhotoRelease(tx *sql.Tx) error {
+	if err := addColumnIfMissing(tx, "hikes", "photo_release", "BOOLEAN DEFAULT FALSE"); err != nil {
+		return err
+	}
+	return addColumnIfMissing(tx, "hikes", "description", "TEXT DEFAULT ''")
+}
+
+func migrateHikeCapacity(tx *sql.Tx) error {
+	return addColumnIfMissing(tx, "hikes", "max_participants", "INTEGER DEFAULT 0")
+}
+
+func migrateHikeDuration(tx *sql.Tx) error {
+	return addColumnIfMissing(tx, "hikes", "duration_minutes", "INTEGER DEFAULT 0")
+}
+
+func migrateHikeSeries(tx *sql.Tx) error {
+	// start_time is the first occurrence; recurrence is an RRULE (see recurrence.go)
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS hike_series (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			join_code TEXT UNIQUE NOT NULL,
+			leader_code TEXT UNIQUE NOT NULL,
+			recurrence TEXT NOT NULL,
+			name TEXT NOT NULL,
+			organization TEXT DEFAULT '',
+			trailhead_name TEXT DEFAULT '',
+			trailhead_map_link TEXT DEFAULT '',
+			leader_uuid TEXT NOT NULL,
+			start_time DATETIME NOT NULL,
+			photo_release BOOLEAN DEFAULT FALSE,
+			description TEXT DEFAULT '',
+			max_participants INTEGER DEFAULT 0,
+			duration_minutes INTEGER DEFAULT 0,
+			status TEXT DEFAULT 'open',
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (leader_uuid) REFERENCES users(uuid)
+		);
+
+		CREATE TABLE IF NOT EXISTS series_subscriptions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			series_id INTEGER NOT NULL,
+			user_uuid TEXT NOT NULL,
+			user_agent TEXT NOT NULL,
+			ip_address TEXT NOT NULL,
+			subscribed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (series_id, user_uuid),
+			FOREIGN KEY (series_id) REFERENCES hike_series(id),
+			FOREIGN KEY (user_uuid) REFERENCES users(uuid)
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// series_index is the occurrence's position in the recurrence; series_override is set once
+	// an occurrence has been edited on its own so edits to the whole series leave it alone
+	if err := addColumnIfMissing(tx, "hikes", "series_id", "INTEGER DEFAULT NULL REFERENCES hike_series(id)"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(tx, "hikes", "series_index", "INTEGER DEFAULT NULL"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(tx, "hikes", "series_override", "BOOLEAN DEFAULT FALSE"); err != nil {
+		return err
+	}
+	_, err = tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS hikes_series_occurrence ON hikes (series_id, series_index)")
+	return err
+}
+
+func migrateHikeRoles(tx *sql.Tx) error {
+	// user_uuid is filled in when someone opens the access code, and may not be in users yet
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS hike_roles (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			hike_join_code TEXT NOT NULL,
+			role TEXT NOT NULL,
+			name TEXT DEFAULT '',
+			user_uuid TEXT DEFAULT NULL,
+			access_code TEXT UNIQUE NOT NULL,
+			created_at DATETIME NOT NULL,
+			revoked_at DATETIME DEFAULT NULL,
+			FOREIGN KEY (hike_join_code) REFERENCES hikes(join_code)
+		)
+	`)
+	return err
+}
+
+func migrateParticipantTokens(tx *sql.Tx) error {
+	if err := addColumnIfMissing(tx, "hike_users", "participant_token", "TEXT DEFAULT NULL"); err != nil {
+		return err
+	}
+
+	// Participants who RSVPd before tokens existed get one so they can still change their own
+	// status; their app picks it up the next time it loads their hikes
+	rows, err := tx.Query("SELECT id FROM hike_users WHERE participant_token IS NULL")
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		token, err := generateSecureLinkCode()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE hike_users SET participant_token = ? WHERE id = ?", token, id); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS hike_users_participant_token ON hike_users (participant_token)")
+	return err
+}
+
+func migrateParticipantStatusHistory(tx *sql.Tx) error {
+	// hike_user_id has no foreign key; the history outlives the hike_users row when someone unRSVPs
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS participant_status_history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			hike_user_id INTEGER NOT NULL,
+			hike_join_code TEXT NOT NULL,
+			from_status TEXT DEFAULT '',
+			to_status TEXT NOT NULL,
+			actor TEXT NOT NULL,
+			changed_at DATETIME NOT NULL,
+			FOREIGN KEY (hike_join_code) REFERENCES hikes(join_code)
+		);
+
+		CREATE INDEX IF NOT EXISTS participant_status_history_participant ON participant_status_history (hike_user_id);
+	`)
+	return err
+}
+
+func migrateWaiverTemplates(tx *sql.Tx) error {
+	// An empty organization is the default template, used by hikes whose organization has none
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS waiver_templates (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			organization TEXT NOT NULL DEFAULT '' COLLATE NOCASE,
+			version INTEGER NOT NULL,
+			body TEXT NOT NULL,
+			effective_at DATETIME NOT NULL,
+			published_at DATETIME NOT NULL,
+			UNIQUE (organization, version)
+		);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// The waiver everyone signed until now becomes version 1 of the default template. Signatures
+	// made before this migration keep a NULL template_id; their rendered text is stored with them.
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM waiver_templates").Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		_, err = tx.Exec(`
+			INSERT INTO waiver_templates (organization, version, body, effective_at, published_at)
+			VALUES ('', 1, ?, ?, ?)
+		`, defaultWaiverTemplate, time.Unix(0, 0).Format("2006-01-02T15:04:05-07:00"), time.Now().Format("2006-01-02T15:04:05-07:00"))
+		if err != nil {
+			return err
+		}
+	}
+
+	return addColumnIfMissing(tx, "waiver_signatures", "template_id", "INTEGER DEFAULT NULL REFERENCES waiver_templates(id)")
+}
+
+func migrateDependents(tx *sql.Tx) error {
+	// A dependent's hike_users row points to the guardian who RSVPd them; age is their age for
+	// this hike. The guardian accepts the waiver for them.
+	if err := addColumnIfMissing(tx, "hike_users", "guardian_uuid", "TEXT DEFAULT NULL REFERENCES users(uuid)"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(tx, "hike_users", "age", "INTEGER DEFAULT NULL"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(tx, "waiver_signatures", "guardian_uuid", "TEXT DEFAULT NULL REFERENCES users(uuid)"); err != nil {
+		return err
+	}
+	return addColumnIfMissing(tx, "waiver_signatures", "guardian_acknowledged_at", "DATETIME DEFAULT NULL")
+}
+
+func migrateWaiverLog(tx *sql.Tx) error {
+	// waiver_signatures allowed one row per participant and hike, replaced on every RSVP. It is
+	// rebuilt as a log with an id and a hash chain; see waiverlog.go. Existing signatures are
+	// chained in the order they were written.
+	_, err := tx.Exec(`
+		ALTER TABLE waiver_signatures RENAME TO waiver_signatures_unchained;
+
+		CREATE TABLE waiver_signatures (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_uuid TEXT NOT NULL,
+			hike_join_code TEXT NOT NULL,
+			signed_at DATETIME NOT NULL,
+			user_agent TEXT NOT NULL,
+			ip_address TEXT NOT NULL,
+			waiver_text TEXT NOT NULL,
+			template_id INTEGER DEFAULT NULL,
+			guardian_uuid TEXT DEFAULT NULL,
+			guardian_acknowledged_at DATETIME DEFAULT NULL,
+			prev_hash TEXT NOT NULL,
+			hash TEXT NOT NULL UNIQUE,
+			FOREIGN KEY (user_uuid) REFERENCES users(uuid),
+			FOREIGN KEY (hike_join_code) REFERENCES hikes(join_code),
+			FOREIGN KEY (template_id) REFERENCES waiver_templates(id),
+			FOREIGN KEY (guardian_uuid) REFERENCES users(uuid)
+		);
+
+		CREATE INDEX IF NOT EXISTS waiver_signatures_participant ON waiver_signatures (hike_join_code, user_uuid);
+	`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`
+		SELECT rowid, user_uuid, hike_join_code, signed_at, user_agent, ip_address, waiver_text,
+		       template_id, guardian_uuid, guardian_acknowledged_at, '', ''
+		FROM waiver_signatures_unchained
+		ORDER BY rowid
+	`)
+	if err != nil {
+		return err
+	}
+	var records []waiverRecord
+	for rows.Next() {
+		var rec waiverRecord
+		if err := scanWaiverRecord(rows.Scan, &rec); err != nil {
+			rows.Close()
+			return err
+		}
+		records = append(records, rec)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	prevHash := waiverChainGenesis
+	for _, rec := range records {
+		rec.PrevHash = prevHash
+		rec.Hash = rec.chainHash()
+		if err := insertWaiverRecord(tx, rec); err != nil {
+			return err
+		}
+		prevHash = rec.Hash
+	}
+
+	// Nothing, including the app, may change the log once written
+	_, err = tx.Exec(`
+		DROP TABLE waiver_signatures_unchained;
+
+		CREATE TRIGGER IF NOT EXISTS waiver_signatures_no_update BEFORE UPDATE ON waiver_signatures
+		BEGIN SELECT RAISE(ABORT, 'waiver_signatures is append-only'); END;
+
+		CREATE TRIGGER IF NOT EXISTS waiver_signatures_no_delete BEFORE DELETE ON waiver_signatures
+		BEGIN SELECT RAISE(ABORT, 'waiver_signatures is append-only'); END;
+	`)
+	return err
+}
+
+func migrateIdempotencyKeys(tx *sql.Tx) error {
+	// status_code is NULL while the first request with the key is still being handled
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS idempotency_keys (
+			key TEXT PRIMARY KEY,
+			request_hash TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			status_code INTEGER DEFAULT NULL,
+			content_type TEXT DEFAULT '',
+			response_body BLOB DEFAULT NULL
+		);
+
+		CREATE INDEX IF NOT EXISTS idempotency_keys_created_at ON idempotency_keys (created_at);
+	`)
+	return err
+}
+
+func migrateHikeVersion(tx *sql.Tx) error {
+	// Bumped on every edit so a leader can't overwrite a change they haven't seen
+	return addColumnIfMissing(tx, "hikes", "version", "INTEGER NOT NULL DEFAULT 1")
+}
+
+func migrateCarpools(tx *sql.Tx) error {
+	// One row per person in a hike's carpool, keyed by user so it survives an RSVP being
+	// replaced. driver_uuid is who a rider is going with, NULL until a driver accepts them.
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS carpool_signups (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			hike_join_code TEXT NOT NULL,
+			user_uuid TEXT NOT NULL,
+			role TEXT NOT NULL,
+			seats INTEGER NOT NULL DEFAULT 1,
+			meeting_point TEXT DEFAULT '',
+			departure_time DATETIME DEFAULT NULL,
+			driver_uuid TEXT DEFAULT NULL,
+			created_at DATETIME NOT NULL,
+			UNIQUE (hike_join_code, user_uuid),
+			FOREIGN KEY (hike_join_code) REFERENCES hikes(join_code),
+			FOREIGN KEY (user_uuid) REFERENCES users(uuid)
+		);
+	`)
+	return err
+}
+
+func migrateHikeUpdatedAt(tx *sql.Tx) error {
+	// When the hike was last edited or closed, for calendar feeds; NULL if it never has been
+	return addColumnIfMissing(tx, "hikes", "updated_at", "DATETIME DEFAULT NULL")
+}
+
+func migratePublicHikes(tx *sql.Tx) error {
+	// Public hikes are listed in their organization's directory; series pass both on to occurrences
+	for _, table := range []string{"hikes", "hike_series"} {
+		if err := addColumnIfMissing(tx, table, "public", "BOOLEAN DEFAULT FALSE"); err != nil {
+			return err
+		}
+		if err := addColumnIfMissing(tx, table, "difficulty", "TEXT DEFAULT ''"); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec("CREATE INDEX IF NOT EXISTS hikes_public ON hikes (public, status)")
+	return err
+}
+
+func migrateOrganizations(tx *sql.Tx) error {
+	// Hikes, series and waiver templates still refer to an organization by name; a registered
+	// organization's name is the one they are all kept in step with
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS organizations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			slug TEXT NOT NULL UNIQUE,
+			name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+			logo_url TEXT DEFAULT '',
+			default_photo_release BOOLEAN DEFAULT FALSE,
+			created_at DATETIME NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS organization_admins (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			organization_id INTEGER NOT NULL,
+			user_uuid TEXT NOT NULL,
+			admin_code TEXT NOT NULL UNIQUE,
+			created_at DATETIME NOT NULL,
+			revoked_at DATETIME DEFAULT NULL,
+			FOREIGN KEY (organization_id) REFERENCES organizations(id),
+			FOREIGN KEY (user_uuid) REFERENCES users(uuid)
+		);
+	`)
+	return err
+}
+
+func migrateTrailInfo(tx *sql.Tx) error {
+	// A trailhead's values are the defaults for new hikes there; hazards are comma-separated
+	columns := []struct{ name, definition string }{
+		{"distance_miles", "REAL DEFAULT 0"},
+		{"elevation_gain_feet", "INTEGER DEFAULT 0"},
+		{"hazards", "TEXT DEFAULT ''"},
+	}
+	for _, table := range []string{"hikes", "hike_series", "trailheads"} {
+		for _, c := range columns {
+			if err := addColumnIfMissing(tx, table, c.name, c.definition); err != nil {
+				return err
+			}
+		}
+	}
+	if err := addColumnIfMissing(tx, "trailheads", "duration_minutes", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	return addColumnIfMissing(tx, "trailheads", "difficulty", "TEXT DEFAULT ''")
+}
+
+func migrateHikeRoutes(tx *sql.Tx) error {
+	// coordinates is a JSON array of lines of [lon, lat] or [lon, lat, elevation in meters] points
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS hike_routes (
+			hike_join_code TEXT PRIMARY KEY,
+			name TEXT DEFAULT '',
+			coordinates TEXT NOT NULL,
+			distance_miles REAL NOT NULL,
+			elevation_gain_feet INTEGER NOT NULL,
+			uploaded_at DATETIME NOT NULL,
+			FOREIGN KEY (hike_join_code) REFERENCES hikes(join_code)
+		);
+	`)
+	return err
+}
+
+func migrateTrailheadCoordinates(tx *sql.Tx) error {
+	for _, column := range []string{"latitude", "longitude"} {
+		if err := addColumnIfMissing(tx, "trailheads", column, "REAL DEFAULT NULL"); err != nil {
+			return err
+		}
+	}
+	// Fill them in from map links that carry them, e.g. ...?api=1&query=21.34992,-157.87685
+	rows, err := tx.Query("SELECT name, map_link FROM trailheads WHERE latitude IS NULL")
+	if err != nil {
+		return err
+	}
+	links := make(map[string]string)
+	for rows.Next() {
+		var name, mapLink string
+		if err := rows.Scan(&name, &mapLink); err != nil {
+			rows.Close()
+			return err
+		}
+		links[name] = mapLink
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for name, mapLink := range links {
+		if lat, lng, ok := mapLinkCoordinates(mapLink); ok {
+			if _, err := tx.Exec("UPDATE trailheads SET latitude = ?, longitude = ? WHERE name = ?", lat, lng, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func migrateTrailheadCatalog(tx *sql.Tx) error {
+	if err := addColumnIfMissing(tx, "trailheads", "retired_at", "DATETIME DEFAULT NULL"); err != nil {
+		return err
+	}
+	// Names a trailhead had before it was renamed or merged into another
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS trailhead_aliases (
+			alias TEXT PRIMARY KEY,
+			trailhead_name TEXT NOT NULL,
+			created_at DATETIME NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_trailhead_aliases_trailhead ON trailhead_aliases (trailhead_name);
+	`)
+	return err
+}
+
+func migrateTrailheadAdvisories(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS trailhead_advisories (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			trailhead_name TEXT NOT NULL,
+			status TEXT NOT NULL,
+			message TEXT NOT NULL,
+			source TEXT DEFAULT '',
+			expires_at DATETIME DEFAULT NULL,
+			created_at DATETIME NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_trailhead_advisories_trailhead ON trailhead_advisories (trailhead_name);
+	`)
+	return err
+}
+
+// seedTrailheadAliases adds predefinedTrailheadAliases for the trailheads in the catalog. An
+// empty database has none yet, so populateTrailheads seeds them again after the trailheads.
+func seedTrailheadAliases(tx *sql.Tx) error {
+	now := time.Now().Format("2006-01-02T15:04:05-07:00")
+	for alias, name := range predefinedTrailheadAliases {
+		_, err := tx.Exec(`
+			INSERT OR IGNORE INTO trailhead_aliases (alias, trailhead_name, created_at)
+			SELECT ?, name, ? FROM trailheads WHERE name = ?
+		`, alias, now, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateSubscriptionTokens(tx *sql.Tx) error {
+	if err := addColumnIfMissing(tx, "series_subscriptions", "subscription_token", "TEXT DEFAULT NULL"); err != nil {
+		return err
+	}
+
+	// Existing subscriptions get a token too. Their subscribers never received it, so the
+	// leader unsubscribes them.
+	rows, err := tx.Query("SELECT id FROM series_subscriptions WHERE subscription_token IS NULL")
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		token, err := generateSecureLinkCode()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE series_subscriptions SET subscription_token = ? WHERE id = ?", token, id); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS series_subscriptions_token ON series_subscriptions (subscription_token)")
+	return err
+}
+
+func migrateIdempotencyHeaders(tx *sql.Tx) error {
+	// Replayed responses need these as well as the body, e.g. the ETag to edit a hike with
+	if err := addColumnIfMissing(tx, "idempotency_keys", "etag", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	return addColumnIfMissing(tx, "idempotency_keys", "location", "TEXT DEFAULT ''")
+}
@@ -0,0 +1,703 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// An organization can be registered so its hikes stop being spread across every spelling of
+// its name. Hikes, series and waiver templates keep referring to it by name, but a name that
+// matches a registered organization is replaced with the organization's own. Each organization
+// has admins with their own admin codes, separate from any hike's leader code, who can see all
+// of its hikes, hand a hike to a new leader and close hikes that were left open.
+
+// Organization is a registered club or group that leads hikes
+type Organization struct {
+	Id                  int64               `json:"id"`
+	Slug                string              `json:"slug"` // How the organization is named in URLs; can't be changed once created
+	Name                string              `json:"name"`
+	LogoURL             string              `json:"logoUrl"`
+	DefaultPhotoRelease bool                `json:"defaultPhotoRelease"`     // Whether new hikes include the photo release unless the leader changes it
+	DefaultWaiver       string              `json:"defaultWaiver,omitempty"` // Body of the organization's current waiver template; setting it publishes a new version
+	Admins              []OrganizationAdmin `json:"admins,omitempty"`        // Only sent when creating the organization
+	CreatedAt           time.Time           `json:"createdAt"`
+}
+
+// OrganizationAdmin is a user who can manage an organization and all of its hikes
+type OrganizationAdmin struct {
+	Id        int64     `json:"id"`
+	User      User      `json:"user"`
+	AdminCode string    `json:"adminCode"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// sqlQueryer is satisfied by both *sql.DB and *sql.Tx
+type sqlQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// loadOrganization looks up a registered organization by slug, or by a name as typed by a
+// leader. It returns sql.ErrNoRows if there is no such organization.
+func loadOrganization(q sqlQueryer, slugOrName string) (Organization, error) {
+	var org Organization
+	name := strings.TrimSpace(slugOrName)
+	if name == "" {
+		return org, sql.ErrNoRows
+	}
+	err := q.QueryRow(`
+		SELECT id, slug, name, logo_url, default_photo_release, created_at
+		FROM organizations
+		WHERE slug = ? OR name = ?
+		ORDER BY slug = ? DESC
+		LIMIT 1
+	`, organizationSlug(name), name, organizationSlug(name)).Scan(&org.Id, &org.Slug, &org.Name, &org.LogoURL, &org.DefaultPhotoRelease, &org.CreatedAt)
+	return org, err
+}
+
+// canonicalOrganization returns the registered name for an organization as typed by a leader,
+// or the name as typed, trimmed, if it isn't registered
+func canonicalOrganization(name string) (string, error) {
+	org, err := loadOrganization(db, name)
+	if err == sql.ErrNoRows {
+		return strings.TrimSpace(name), nil
+	}
+	return org.Name, err
+}
+
+// organizationWaiver returns the body of the organization's own latest waiver template, or ""
+// if it uses the default
+func organizationWaiver(q sqlQueryer, name string) (string, error) {
+	var body string
+	err := q.QueryRow("SELECT body FROM waiver_templates WHERE organization = ? ORDER BY version DESC LIMIT 1", name).Scan(&body)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return body, err
+}
+
+// adoptOrganizationHikes renames every hike and series whose organization has the same slug as
+// the registered organization, or is its old name, to the registered name
+func adoptOrganizationHikes(tx *sql.Tx, org Organization, oldName string) error {
+	rows, err := tx.Query("SELECT DISTINCT organization FROM hikes UNION SELECT DISTINCT organization FROM hike_series")
+	if err != nil {
+		return err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		if name == org.Name {
+			continue
+		}
+		slug := organizationSlug(name)
+		if slug == "" {
+			continue
+		}
+		if name == oldName || slug == org.Slug || slug == organizationSlug(org.Name) {
+			names = append(names, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if _, err := tx.Exec("UPDATE hikes SET organization = ? WHERE organization = ?", org.Name, name); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE hike_series SET organization = ? WHERE organization = ?", org.Name, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateOrganization checks the fields an admin can set on an organization
+func validateOrganization(org Organization) error {
+	if org.Name == "" {
+		return fmt.Errorf("An organization name is required")
+	}
+	if org.LogoURL != "" {
+		u, err := url.Parse(org.LogoURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("logoUrl must be an http or https URL")
+		}
+	}
+	if org.DefaultWaiver != "" {
+		return validateWaiverTemplate(org.DefaultWaiver, org.Name)
+	}
+	return nil
+}
+
+// publishOrganizationWaiver publishes the organization's default waiver as a new template
+// version if it differs from the current one
+func publishOrganizationWaiver(tx *sql.Tx, org Organization) error {
+	if org.DefaultWaiver == "" {
+		return nil
+	}
+	current, err := organizationWaiver(tx, org.Name)
+	if err != nil || current == org.DefaultWaiver {
+		return err
+	}
+	wt := WaiverTemplate{Organization: org.Name, Body: org.DefaultWaiver, PublishedAt: time.Now()}
+	wt.EffectiveAt = wt.PublishedAt
+	if err := insertWaiverTemplate(tx, &wt); err != nil {
+		return err
+	}
+	logAction(fmt.Sprintf("Waiver template version %d published for organization '%s'", wt.Version, wt.Organization))
+	return nil
+}
+
+// insertOrganizationAdmin gives a user an admin code for the organization, adding the user if
+// they are new
+func insertOrganizationAdmin(tx *sql.Tx, organizationId int64, admin *OrganizationAdmin) error {
+	if admin.User.UUID == "" {
+		return fmt.Errorf("An admin's user UUID is required")
+	}
+	_, err := tx.Exec(`
+		INSERT INTO users (uuid, name, phone)
+		VALUES (?, ?, ?)
+		ON CONFLICT(uuid) DO UPDATE SET name = excluded.name, phone = excluded.phone
+	`, admin.User.UUID, admin.User.Name, admin.User.Phone)
+	if err != nil {
+		return err
+	}
+	if admin.AdminCode, err = generateSecureLinkCode(); err != nil {
+		return err
+	}
+	admin.CreatedAt = time.Now()
+	result, err := tx.Exec(`
+		INSERT INTO organization_admins (organization_id, user_uuid, admin_code, created_at)
+		VALUES (?, ?, ?, ?)
+	`, organizationId, admin.User.UUID, admin.AdminCode, admin.CreatedAt.Format("2006-01-02T15:04:05-07:00"))
+	if err != nil {
+		return err
+	}
+	admin.Id, err = result.LastInsertId()
+	return err
+}
+
+// requireOrganizationAdmin loads the organization in the path and checks the request's
+// adminCode query parameter is an unrevoked admin code for it. The site-wide adminToken is
+// also accepted. It writes the error response and returns false if not, otherwise it returns
+// who is acting for the logs.
+func requireOrganizationAdmin(w http.ResponseWriter, r *http.Request) (Organization, string, bool) {
+	org, err := loadOrganization(db, r.PathValue("org"))
+	if err == sql.ErrNoRows || (err == nil && org.Slug != r.PathValue("org")) {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return org, "", false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return org, "", false
+	}
+
+	token := r.URL.Query().Get("adminToken")
+	if token != "" && adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+		return org, "site admin", true
+	}
+	code := r.URL.Query().Get("adminCode")
+	if code == "" {
+		http.Error(w, "An adminCode is required", http.StatusUnauthorized)
+		return org, "", false
+	}
+	var organizationId int64
+	var userUUID string
+	err = db.QueryRow(`
+		SELECT organization_id, user_uuid FROM organization_admins
+		WHERE admin_code = ? AND revoked_at IS NULL
+	`, code).Scan(&organizationId, &userUUID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid admin code", http.StatusUnauthorized)
+		return org, "", false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return org, "", false
+	}
+	if organizationId != org.Id {
+		http.Error(w, "The admin code is for a different organization", http.StatusForbidden)
+		return org, "", false
+	}
+	return org, "admin " + userUUID, true
+}
+
+// Register an organization along with its first admins, whose admin codes are returned.
+// Hikes already using a spelling of its name are moved to it. Requires the adminToken.
+func createOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var org Organization
+	if err := json.NewDecoder(r.Body).Decode(&org); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	org.Name = strings.TrimSpace(org.Name)
+	if org.Slug == "" {
+		org.Slug = organizationSlug(org.Name)
+	}
+	if org.Slug == "" || organizationSlug(org.Slug) != org.Slug {
+		http.Error(w, "slug must be lowercase letters and digits separated by dashes", http.StatusBadRequest)
+		return
+	}
+	if err := validateOrganization(org); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM organizations WHERE slug = ? OR name = ?)", org.Slug, org.Name).Scan(&exists)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if exists {
+		http.Error(w, "An organization with that slug or name already exists", http.StatusConflict)
+		return
+	}
+
+	org.CreatedAt = time.Now()
+	result, err := tx.Exec(`
+		INSERT INTO organizations (slug, name, logo_url, default_photo_release, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, org.Slug, org.Name, org.LogoURL, org.DefaultPhotoRelease, org.CreatedAt.Format("2006-01-02T15:04:05-07:00"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if org.Id, err = result.LastInsertId(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range org.Admins {
+		if err := insertOrganizationAdmin(tx, org.Id, &org.Admins[i]); err != nil {
+			http.Error(w, "Error adding organization admin: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := publishOrganizationWaiver(tx, org); err != nil {
+		http.Error(w, "Error publishing the organization's waiver: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := adoptOrganizationHikes(tx, org, ""); err != nil {
+		http.Error(w, "Error moving hikes to the organization: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(org)
+	logAction(fmt.Sprintf("Organization created: %s (%s) with %d admin(s)", org.Name, org.Slug, len(org.Admins)))
+}
+
+// Return an organization's public details, for leaders creating a hike and for the hike directory
+func getOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	org, err := loadOrganization(db, r.PathValue("org"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		org.DefaultWaiver, err = organizationWaiver(db, org.Name)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(org)
+}
+
+// Change an organization's name, logo or defaults. Renaming it renames its hikes, series and
+// waiver templates too. Requires an adminCode for the organization.
+func updateOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	current, actor, ok := requireOrganizationAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var org Organization
+	if err := json.NewDecoder(r.Body).Decode(&org); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	org.Id, org.Slug, org.CreatedAt = current.Id, current.Slug, current.CreatedAt
+	org.Name = strings.TrimSpace(org.Name)
+	if err := validateOrganization(org); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if org.Name != current.Name {
+		var taken bool
+		err = tx.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM organizations WHERE name = ? AND id != ?)
+			    OR EXISTS (SELECT 1 FROM waiver_templates WHERE organization = ? AND organization != ?)
+		`, org.Name, org.Id, org.Name, current.Name).Scan(&taken)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if taken {
+			http.Error(w, "Another organization already uses that name", http.StatusConflict)
+			return
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE organizations SET name = ?, logo_url = ?, default_photo_release = ?
+		WHERE id = ?
+	`, org.Name, org.LogoURL, org.DefaultPhotoRelease, org.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if org.Name != current.Name {
+		if _, err = tx.Exec("UPDATE waiver_templates SET organization = ? WHERE organization = ?", org.Name, current.Name); err != nil {
+			http.Error(w, "Error renaming the organization's waiver templates: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err = adoptOrganizationHikes(tx, org, current.Name); err != nil {
+			http.Error(w, "Error renaming the organization's hikes: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err = publishOrganizationWaiver(tx, org); err != nil {
+		http.Error(w, "Error publishing the organization's waiver: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if org.DefaultWaiver, err = organizationWaiver(tx, org.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(org)
+	logAction(fmt.Sprintf("Organization %s updated by %s", org.Slug, actor))
+}
+
+// Add an admin to an organization and return their admin code. Requires an adminCode for the
+// organization.
+func createOrganizationAdminHandler(w http.ResponseWriter, r *http.Request) {
+	org, actor, ok := requireOrganizationAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var admin OrganizationAdmin
+	if err := json.NewDecoder(r.Body).Decode(&admin.User); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if admin.User.UUID == "" {
+		http.Error(w, "The admin's user UUID is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if err = insertOrganizationAdmin(tx, org.Id, &admin); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(admin)
+	logAction(fmt.Sprintf("Admin ID %d (%s) added to organization %s by %s", admin.Id, admin.User.Name, org.Slug, actor))
+}
+
+// List an organization's unrevoked admins. Requires an adminCode for the organization.
+func getOrganizationAdminsHandler(w http.ResponseWriter, r *http.Request) {
+	org, _, ok := requireOrganizationAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT a.id, u.uuid, u.name, u.phone, a.admin_code, a.created_at
+		FROM organization_admins a
+		JOIN users u ON a.user_uuid = u.uuid
+		WHERE a.organization_id = ? AND a.revoked_at IS NULL
+		ORDER BY a.id
+	`, org.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	admins := []OrganizationAdmin{}
+	for rows.Next() {
+		var admin OrganizationAdmin
+		if err := rows.Scan(&admin.Id, &admin.User.UUID, &admin.User.Name, &admin.User.Phone, &admin.AdminCode, &admin.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		admins = append(admins, admin)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(admins)
+}
+
+// Revoke an admin so their admin code stops working. Requires an adminCode for the organization.
+func revokeOrganizationAdminHandler(w http.ResponseWriter, r *http.Request) {
+	org, actor, ok := requireOrganizationAdmin(w, r)
+	if !ok {
+		return
+	}
+	adminId, err := parseInt64(r.PathValue("adminId"))
+	if err != nil {
+		http.Error(w, "Invalid admin ID format", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`
+		UPDATE organization_admins SET revoked_at = ?
+		WHERE id = ? AND organization_id = ? AND revoked_at IS NULL
+	`, time.Now().Format("2006-01-02T15:04:05-07:00"), adminId, org.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Admin not found for this organization or already revoked", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	logAction(fmt.Sprintf("Admin ID %d revoked from organization %s by %s", adminId, org.Slug, actor))
+}
+
+// List all of an organization's hikes, public or not and in any status, newest first. status
+// narrows it to open or closed hikes. Requires an adminCode for the organization.
+func getOrganizationHikesHandler(w http.ResponseWriter, r *http.Request) {
+	org, _, ok := requireOrganizationAdmin(w, r)
+	if !ok {
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status != "" && status != "open" && status != "closed" {
+		http.Error(w, "status must be open or closed", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT h.name, h.organization, h.trailhead_name, h.trailhead_map_link, h.start_time, h.status, h.join_code,
+		       h.public, h.difficulty, h.distance_miles, h.elevation_gain_feet, h.hazards, h.max_participants, h.duration_minutes, h.version,
+		       u.uuid, u.name, u.phone,
+		       (SELECT COUNT(*) FROM hike_users hu WHERE hu.hike_join_code = h.join_code AND hu.status IN ('rsvp', 'active', 'finished', 'overdue'))
+		FROM hikes h
+		JOIN users u ON h.leader_uuid = u.uuid
+		WHERE h.organization = ? COLLATE NOCASE AND (? = '' OR h.status = ?)
+		ORDER BY h.start_time DESC
+	`, org.Name, status, status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type organizationHike struct {
+		Hike
+		ParticipantCount int `json:"participantCount"`
+	}
+	hikes := []organizationHike{}
+	for rows.Next() {
+		var h organizationHike
+		err := rows.Scan(&h.Name, &h.Organization, &h.TrailheadName, &h.TrailheadMapLink, &h.StartTime, &h.Status, &h.JoinCode,
+			&h.Public, &h.Difficulty, &h.DistanceMiles, &h.ElevationGainFeet, &h.Hazards, &h.MaxParticipants, &h.DurationMinutes, &h.Version,
+			&h.Leader.UUID, &h.Leader.Name, &h.Leader.Phone, &h.ParticipantCount)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		hikes = append(hikes, h)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hikes)
+}
+
+// loadOrganizationHike checks the hike in the path belongs to the organization. It writes the
+// error response and returns false if not.
+func loadOrganizationHike(w http.ResponseWriter, tx *sql.Tx, org Organization, joinCode string) (string, bool) {
+	var status string
+	err := tx.QueryRow("SELECT status FROM hikes WHERE join_code = ? AND organization = ? COLLATE NOCASE", joinCode, org.Name).Scan(&status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Hike not found for this organization", http.StatusNotFound)
+		return "", false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return "", false
+	}
+	return status, true
+}
+
+// Hand one of the organization's hikes to a new leader. The hike gets a new leader code, which
+// is returned for the admin to pass on; the previous leader's code stops working. Requires an
+// adminCode for the organization.
+func reassignHikeLeaderHandler(w http.ResponseWriter, r *http.Request) {
+	org, actor, ok := requireOrganizationAdmin(w, r)
+	if !ok {
+		return
+	}
+	joinCode := r.PathValue("hikeId")
+
+	var leader User
+	if err := json.NewDecoder(r.Body).Decode(&leader); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if leader.UUID == "" {
+		http.Error(w, "The new leader's UUID is required", http.StatusBadRequest)
+		return
+	}
+	leaderCode, err := generateSecureLinkCode()
+	if err != nil {
+		http.Error(w, "Failed to generate leader code", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	status, ok := loadOrganizationHike(w, tx, org, joinCode)
+	if !ok {
+		return
+	}
+	_, err = tx.Exec(`
+		INSERT INTO users (uuid, name, phone)
+		VALUES (?, ?, ?)
+		ON CONFLICT(uuid) DO UPDATE SET name = excluded.name, phone = excluded.phone
+	`, leader.UUID, leader.Name, leader.Phone)
+	if err != nil {
+		http.Error(w, "Error updating leader details in users table: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(`
+		UPDATE hikes SET leader_uuid = ?, leader_code = ?, version = version + 1, updated_at = ?
+		WHERE join_code = ?
+	`, leader.UUID, leaderCode, time.Now().Format("2006-01-02T15:04:05-07:00"), joinCode)
+	if err != nil {
+		http.Error(w, "Error reassigning the hike: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hikeEvents.publish(joinCode, eventHike, 0, status)
+
+	hike, err := loadEditedHike(joinCode, leaderCode, hikeAccess{joinCode: joinCode, role: "leader"})
+	if err != nil {
+		http.Error(w, "Error fetching updated hike details: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", hikeETag(hike.Version))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hike)
+	logAction(fmt.Sprintf("Hike %s of organization %s reassigned to leader %s (%s) by %s", joinCode, org.Slug, leader.Name, leader.UUID, actor))
+}
+
+// Close one of the organization's hikes that its leader left open, marking anyone still on it
+// finished. Requires an adminCode for the organization.
+func closeOrganizationHikeHandler(w http.ResponseWriter, r *http.Request) {
+	org, actor, ok := requireOrganizationAdmin(w, r)
+	if !ok {
+		return
+	}
+	joinCode := r.PathValue("hikeId")
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	status, ok := loadOrganizationHike(w, tx, org, joinCode)
+	if !ok {
+		return
+	}
+	if status != "open" {
+		http.Error(w, "The hike is already closed", http.StatusConflict)
+		return
+	}
+	if err = finishHikeParticipants(tx, joinCode); err != nil {
+		http.Error(w, "Error updating participants to finished: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(`
+		UPDATE hikes SET status = 'closed', version = version + 1, updated_at = ?
+		WHERE join_code = ?
+	`, time.Now().Format("2006-01-02T15:04:05-07:00"), joinCode)
+	if err != nil {
+		http.Error(w, "Error closing the hike: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hikeEvents.publish(joinCode, eventHike, 0, "closed")
+
+	w.WriteHeader(http.StatusOK)
+	logAction(fmt.Sprintf("Hike %s of organization %s closed by %s", joinCode, org.Slug, actor))
+}
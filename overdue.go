@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// How long past a hike's expected end a participant can still be 'active' before they are flagged
+const overdueGracePeriod = 30 * time.Minute
+
+// How often the overdue watcher checks for participants who haven't come off the trail
+const overdueCheckInterval = time.Minute
+
+// OverdueAlert describes a participant who is still on the trail past the hike's expected end time
+type OverdueAlert struct {
+	HikeName         string    `json:"hikeName"`
+	JoinCode         string    `json:"joinCode"`
+	LeaderName       string    `json:"leaderName"`
+	LeaderPhone      string    `json:"leaderPhone"`
+	ParticipantId    int64     `json:"participantId"`
+	ParticipantName  string    `json:"participantName"`
+	ParticipantPhone string    `json:"participantPhone"`
+	EmergencyContact string    `json:"emergencyContact"`
+	ExpectedEndTime  time.Time `json:"expectedEndTime"`
+}
+
+// OverdueNotifier is told about each participant when they are first flagged as overdue
+type OverdueNotifier interface {
+	NotifyOverdue(alert OverdueAlert) error
+}
+
+// logFileNotifier records overdue participants in hiketracker.log
+type logFileNotifier struct{}
+
+func (logFileNotifier) NotifyOverdue(alert OverdueAlert) error {
+	logAction(fmt.Sprintf("OVERDUE: %s (Participant ID: %d, Phone: %s, Emergency Contact: %s) has not finished hike %s (Join Code: %s), expected back by %s. Leader: %s %s",
+		alert.ParticipantName, alert.ParticipantId, alert.ParticipantPhone, alert.EmergencyContact,
+		alert.HikeName, alert.JoinCode, alert.ExpectedEndTime.Format(time.RFC3339), alert.LeaderName, alert.LeaderPhone))
+	return nil
+}
+
+// webhookNotifier POSTs each OverdueAlert as JSON to a URL (e.g. a chat or SMS gateway integration)
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookNotifier(url string) *webhookNotifier {
+	return &webhookNotifier{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (n *webhookNotifier) NotifyOverdue(alert OverdueAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error posting overdue alert to webhook: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("overdue webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// multiNotifier fans an alert out to several notifiers, continuing past failures
+type multiNotifier []OverdueNotifier
+
+func (m multiNotifier) NotifyOverdue(alert OverdueAlert) error {
+	var firstErr error
+	for _, n := range m {
+		if err := n.NotifyOverdue(alert); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// startOverdueWatcher checks for overdue participants every interval until stop is closed
+func startOverdueWatcher(interval time.Duration, notifier OverdueNotifier, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := checkOverdueParticipants(time.Now(), notifier); err != nil {
+					log.Printf("Error checking for overdue participants: %v", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// checkOverdueParticipants flags every participant still 'active' on an open hike more than
+// overdueGracePeriod past its expected end time as 'overdue', and notifies about each one.
+// Hikes without a duration have no expected end time and are never checked.
+func checkOverdueParticipants(now time.Time, notifier OverdueNotifier) ([]OverdueAlert, error) {
+	rows, err := db.Query(`
+		SELECT h.name, h.join_code, h.start_time, h.duration_minutes, l.name, l.phone,
+		       hu.id, u.name, u.phone, u.emergency_contact
+		FROM hike_users hu
+		JOIN hikes h ON hu.hike_join_code = h.join_code
+		JOIN users u ON hu.user_uuid = u.uuid
+		JOIN users l ON h.leader_uuid = l.uuid
+		WHERE hu.status = 'active' AND h.status = 'open' AND h.duration_minutes > 0
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []OverdueAlert
+	for rows.Next() {
+		var alert OverdueAlert
+		var startTime time.Time
+		var durationMinutes int
+		err := rows.Scan(&alert.HikeName, &alert.JoinCode, &startTime, &durationMinutes, &alert.LeaderName, &alert.LeaderPhone,
+			&alert.ParticipantId, &alert.ParticipantName, &alert.ParticipantPhone, &alert.EmergencyContact)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		alert.ExpectedEndTime = startTime.Add(time.Duration(durationMinutes) * time.Minute)
+		if now.After(alert.ExpectedEndTime.Add(overdueGracePeriod)) {
+			candidates = append(candidates, alert)
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// A participant who can't be flagged doesn't stop the others being flagged; the first error
+	// is returned once they have all been tried
+	var flagged []OverdueAlert
+	var firstErr error
+	for _, alert := range candidates {
+		changed, err := flagOverdue(alert)
+		if err != nil {
+			log.Printf("Error flagging participant %d as overdue: %v", alert.ParticipantId, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if !changed {
+			continue
+		}
+		hikeEvents.publish(alert.JoinCode, eventStatus, alert.ParticipantId, "overdue")
+		flagged = append(flagged, alert)
+		if err := notifier.NotifyOverdue(alert); err != nil {
+			log.Printf("Error sending overdue notification for participant %d: %v", alert.ParticipantId, err)
+		}
+	}
+	return flagged, firstErr
+}
+
+// flagOverdue moves a participant from 'active' to 'overdue' and records the change in one
+// transaction. It reports false if their status has changed since they were found.
+func flagOverdue(alert OverdueAlert) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback() // Rollback if not committed
+
+	result, err := tx.Exec("UPDATE hike_users SET status = 'overdue' WHERE id = ? AND status = 'active'", alert.ParticipantId)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if err := recordStatusChange(tx, alert.ParticipantId, alert.JoinCode, "active", "overdue", actorSystem); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
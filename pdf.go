@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// pdfDocument is a minimal PDF writer for the printable documents the app produces. It only
+// knows the standard Helvetica fonts, text and lines, which is all a sign-in sheet or a
+// waiver needs, and keeps us from pulling in a PDF library. Coordinates are in points from
+// the top left corner of the page.
+type pdfDocument struct {
+	title  string
+	width  float64
+	height float64
+	pages  []*bytes.Buffer
+}
+
+// Page sizes in points
+const (
+	pdfLetterWidth  = 612.0
+	pdfLetterHeight = 792.0
+)
+
+func newPDFDocument(title string, width, height float64) *pdfDocument {
+	return &pdfDocument{title: title, width: width, height: height}
+}
+
+// AddPage starts a new page; drawing always happens on the last page added
+func (d *pdfDocument) AddPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+}
+
+func (d *pdfDocument) page() *bytes.Buffer {
+	if len(d.pages) == 0 {
+		d.AddPage()
+	}
+	return d.pages[len(d.pages)-1]
+}
+
+// Text draws a line of text with its baseline at y
+func (d *pdfDocument) Text(x, y, size float64, bold bool, text string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.page(), "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, d.height-y, pdfEscape(text))
+}
+
+// Line draws a straight line
+func (d *pdfDocument) Line(x1, y1, x2, y2, lineWidth float64) {
+	fmt.Fprintf(d.page(), "%.2f w %.2f %.2f m %.2f %.2f l S\n", lineWidth, x1, d.height-y1, x2, d.height-y2)
+}
+
+// FillRect fills a rectangle with a shade of gray, 0 is black and 1 is white
+func (d *pdfDocument) FillRect(x, y, w, h, gray float64) {
+	fmt.Fprintf(d.page(), "q %.2f g %.2f %.2f %.2f %.2f re f Q\n", gray, x, d.height-y-h, w, h)
+}
+
+// Bytes renders the document
+func (d *pdfDocument) Bytes() []byte {
+	if len(d.pages) == 0 {
+		d.AddPage()
+	}
+
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	// Objects 1-4 are the catalog, page tree, fonts and info; each page is then a page
+	// object followed by its content stream
+	out.WriteString("%PDF-1.4\n")
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 6+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	object(fmt.Sprintf("<< /Title (%s) /Producer (HikerRoll) >>", pdfEscape(d.title)))
+	for i, content := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			d.width, d.height, 7+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 5 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+// pdfTextWidth estimates how wide text is in Helvetica. It is only used to keep text inside
+// table cells and page margins, so an average character width is close enough.
+func pdfTextWidth(text string, size float64, bold bool) float64 {
+	average := 0.52
+	if bold {
+		average = 0.56
+	}
+	return float64(len([]rune(text))) * size * average
+}
+
+// pdfFit shortens text with an ellipsis so it fits in width
+func pdfFit(text string, width, size float64, bold bool) string {
+	if pdfTextWidth(text, size, bold) <= width {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 && pdfTextWidth(string(runes)+"...", size, bold) > width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "..."
+}
+
+// pdfWrap breaks text into lines that fit in width. Line breaks in the text are kept, so a
+// blank line between paragraphs stays blank; a word too long for a line is split.
+func pdfWrap(text string, width, size float64, bold bool) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			for pdfTextWidth(word, size, bold) > width {
+				if line != "" {
+					lines = append(lines, line)
+					line = ""
+				}
+				runes := []rune(word)
+				n := len(runes) - 1
+				for n > 1 && pdfTextWidth(string(runes[:n]), size, bold) > width {
+					n--
+				}
+				lines = append(lines, string(runes[:n]))
+				word = string(runes[n:])
+			}
+			if line == "" {
+				line = word
+			} else if pdfTextWidth(line+" "+word, size, bold) <= width {
+				line += " " + word
+			} else {
+				lines = append(lines, line)
+				line = word
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// pdfEscape encodes text for a PDF string in WinAnsiEncoding. Characters the standard fonts
+// can't show are replaced; the ʻokina and curly quotes become plain quotes.
+func pdfEscape(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch r {
+		case '\\', '(', ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '\n', '\r', '\t':
+			b.WriteByte(' ')
+		case 'ʻ', 'ʼ', '‘', '’':
+			b.WriteByte('\'')
+		case '“', '”':
+			b.WriteByte('"')
+		case '–', '—':
+			b.WriteByte('-')
+		default:
+			if r >= 0x20 && r < 0x7f {
+				b.WriteRune(r)
+			} else if r >= 0xa0 && r <= 0xff {
+				// Latin-1 characters have the same code in WinAnsiEncoding
+				fmt.Fprintf(&b, "\\%03o", r)
+			} else {
+				b.WriteByte('?')
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recurrenceRule is the subset of an iCalendar RRULE (RFC 5545) that hike series use:
+//
+//	FREQ=WEEKLY;INTERVAL=1;BYDAY=SA        every Saturday
+//	FREQ=WEEKLY;INTERVAL=2;BYDAY=SA,SU     every other weekend
+//	FREQ=MONTHLY;BYDAY=1SA                 first Saturday of the month
+//	FREQ=MONTHLY;BYMONTHDAY=15;COUNT=6     the 15th, six times
+//	FREQ=MONTHLY;BYDAY=FR;BYMONTHDAY=13    every Friday the 13th
+//
+// As in RFC 5545, a MONTHLY rule with both BYDAY and BYMONTHDAY only matches days that
+// satisfy both.
+// UNTIL (YYYYMMDD or RFC3339) and COUNT bound the series. Weeks start on Monday.
+type recurrenceRule struct {
+	freq       string // WEEKLY or MONTHLY
+	interval   int
+	byDay      []recurrenceDay
+	byMonthDay []int
+	count      int       // 0 means unbounded
+	until      time.Time // zero means unbounded
+}
+
+// recurrenceDay is a BYDAY entry; ordinal is only used with FREQ=MONTHLY (e.g. 1SA, -1SU)
+type recurrenceDay struct {
+	ordinal int
+	weekday time.Weekday
+}
+
+var rruleWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// parseRecurrence parses an RRULE string. dtstart is the first occurrence; it supplies the
+// time of day and the default day when BYDAY/BYMONTHDAY are omitted.
+func parseRecurrence(rule string, dtstart time.Time) (*recurrenceRule, error) {
+	r := &recurrenceRule{interval: 1}
+	rule = strings.TrimPrefix(strings.TrimSpace(rule), "RRULE:")
+	if rule == "" {
+		return nil, fmt.Errorf("recurrence rule is required")
+	}
+
+	for _, part := range strings.Split(rule, ";") {
+		key, value, found := strings.Cut(part, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid recurrence rule part %q", part)
+		}
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			r.freq = strings.ToUpper(value)
+			if r.freq != "WEEKLY" && r.freq != "MONTHLY" {
+				return nil, fmt.Errorf("unsupported FREQ %q, only WEEKLY and MONTHLY are supported", value)
+			}
+		case "INTERVAL":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid INTERVAL %q", value)
+			}
+			r.interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid COUNT %q", value)
+			}
+			r.count = n
+		case "UNTIL":
+			until, err := parseRRuleUntil(value, dtstart.Location())
+			if err != nil {
+				return nil, err
+			}
+			r.until = until
+		case "BYDAY":
+			for _, day := range strings.Split(strings.ToUpper(value), ",") {
+				if len(day) < 2 {
+					return nil, fmt.Errorf("invalid BYDAY %q", day)
+				}
+				weekday, ok := rruleWeekdays[day[len(day)-2:]]
+				if !ok {
+					return nil, fmt.Errorf("invalid BYDAY %q", day)
+				}
+				ordinal := 0
+				if prefix := day[:len(day)-2]; prefix != "" {
+					n, err := strconv.Atoi(prefix)
+					if err != nil || n == 0 || n < -5 || n > 5 {
+						return nil, fmt.Errorf("invalid BYDAY %q", day)
+					}
+					ordinal = n
+				}
+				r.byDay = append(r.byDay, recurrenceDay{ordinal: ordinal, weekday: weekday})
+			}
+		case "BYMONTHDAY":
+			for _, d := range strings.Split(value, ",") {
+				n, err := strconv.Atoi(d)
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return nil, fmt.Errorf("invalid BYMONTHDAY %q", d)
+				}
+				r.byMonthDay = append(r.byMonthDay, n)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported recurrence rule part %q", key)
+		}
+	}
+
+	if r.freq == "" {
+		return nil, fmt.Errorf("recurrence rule must include FREQ")
+	}
+	if r.freq == "WEEKLY" {
+		if len(r.byMonthDay) > 0 {
+			return nil, fmt.Errorf("BYMONTHDAY cannot be used with FREQ=WEEKLY")
+		}
+		for _, d := range r.byDay {
+			if d.ordinal != 0 {
+				return nil, fmt.Errorf("BYDAY ordinals can only be used with FREQ=MONTHLY")
+			}
+		}
+		if len(r.byDay) == 0 {
+			r.byDay = []recurrenceDay{{weekday: dtstart.Weekday()}}
+		}
+	}
+	if r.freq == "MONTHLY" && len(r.byDay) == 0 && len(r.byMonthDay) == 0 {
+		r.byMonthDay = []int{dtstart.Day()}
+	}
+	return r, nil
+}
+
+func parseRRuleUntil(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("20060102T150405Z", value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("20060102", value, loc); err == nil {
+		// A date-only UNTIL includes the whole day
+		return t.Add(24*time.Hour - time.Second), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid UNTIL %q", value)
+}
+
+// occurrences returns every occurrence from dtstart through the given time, in order.
+// The index of an occurrence in the result is stable, which is what ties a materialized
+// hike to its place in the series.
+func (r *recurrenceRule) occurrences(dtstart, through time.Time) []time.Time {
+	var result []time.Time
+	done := func(t time.Time) bool {
+		return t.After(through) || (!r.until.IsZero() && t.After(r.until)) || (r.count > 0 && len(result) >= r.count)
+	}
+
+	hour, min, sec := dtstart.Clock()
+	loc := dtstart.Location()
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, hour, min, sec, 0, loc)
+	}
+
+	switch r.freq {
+	case "WEEKLY":
+		// Monday of the week containing dtstart
+		offset := (int(dtstart.Weekday()) + 6) % 7
+		weekStart := at(dtstart.Year(), dtstart.Month(), dtstart.Day()-offset)
+		for week := 0; ; week += r.interval {
+			var dates []time.Time
+			for _, d := range r.byDay {
+				dayOffset := (int(d.weekday) + 6) % 7
+				dates = append(dates, at(weekStart.Year(), weekStart.Month(), weekStart.Day()+week*7+dayOffset))
+			}
+			sortTimes(dates)
+			for _, t := range dates {
+				if t.Before(dtstart) {
+					continue
+				}
+				if done(t) {
+					return result
+				}
+				result = append(result, t)
+			}
+		}
+	case "MONTHLY":
+		for month := 0; ; month += r.interval {
+			first := at(dtstart.Year(), dtstart.Month()+time.Month(month), 1)
+			if first.After(through) || (!r.until.IsZero() && first.After(r.until)) {
+				return result
+			}
+			for _, t := range r.datesInMonth(first) {
+				if t.Before(dtstart) {
+					continue
+				}
+				if done(t) {
+					return result
+				}
+				result = append(result, t)
+			}
+		}
+	}
+	return result
+}
+
+// datesInMonth expands BYMONTHDAY and BYDAY for the month starting at first. When the rule
+// has both, a date must match each of them.
+func (r *recurrenceRule) datesInMonth(first time.Time) []time.Time {
+	daysInMonth := first.AddDate(0, 1, -1).Day()
+	byMonthDay := make(map[int]bool)
+	for _, d := range r.byMonthDay {
+		if d > 0 {
+			byMonthDay[d] = true
+		} else {
+			byMonthDay[daysInMonth+d+1] = true
+		}
+	}
+	byDay := make(map[int]bool)
+	for _, d := range r.byDay {
+		firstMatch := 1 + (int(d.weekday)-int(first.Weekday())+7)%7
+		switch {
+		case d.ordinal > 0:
+			byDay[firstMatch+(d.ordinal-1)*7] = true
+		case d.ordinal < 0:
+			last := firstMatch
+			for last+7 <= daysInMonth {
+				last += 7
+			}
+			byDay[last+(d.ordinal+1)*7] = true
+		default:
+			for day := firstMatch; day <= daysInMonth; day += 7 {
+				byDay[day] = true
+			}
+		}
+	}
+
+	var dates []time.Time
+	for day := 1; day <= daysInMonth; day++ {
+		if len(r.byMonthDay) > 0 && !byMonthDay[day] {
+			continue
+		}
+		if len(r.byDay) > 0 && !byDay[day] {
+			continue
+		}
+		dates = append(dates, first.AddDate(0, 0, day-1))
+	}
+	return dates
+}
+
+func sortTimes(times []time.Time) {
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Besides the hike's own leader_code, a hike can hand out access codes for additional roles
+// (another leader, a co-leader or a sweep). Each code is tied to one row in hike_roles and
+// stops working once it is revoked. What a code can do is decided by its role.
+
+const (
+	permViewRoster         = "view_roster"         // see the hike and its participant list
+	permUpdateParticipants = "update_participants" // change a participant's status, e.g. mark them finished
+	permEditHike           = "edit_hike"           // change the hike details
+	permCloseHike          = "close_hike"          // end the hike
+	permManageRoles        = "manage_roles"        // add and revoke roles, and hand the hike to a new leader
+)
+
+var rolePermissions = map[string][]string{
+	"leader":    {permViewRoster, permUpdateParticipants, permEditHike, permCloseHike, permManageRoles},
+	"co-leader": {permViewRoster, permUpdateParticipants, permEditHike, permCloseHike},
+	"sweep":     {permViewRoster, permUpdateParticipants},
+}
+
+// HikeRole is an additional leader, co-leader or sweep on a hike
+type HikeRole struct {
+	Id          int64     `json:"id"`
+	Role        string    `json:"role"`
+	Name        string    `json:"name"`               // Who the role is for, as entered by the leader
+	UserUUID    string    `json:"userUUID,omitempty"` // Set once the code has been opened by a user
+	AccessCode  string    `json:"accessCode"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// hikeAccess is what a leader or role access code grants
+type hikeAccess struct {
+	joinCode string
+	role     string
+	roleId   int64 // 0 for the hike's own leader_code
+}
+
+func (a hikeAccess) can(permission string) bool {
+	for _, p := range rolePermissions[a.role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveHikeAccess looks up the hike and role for a leader_code or an unrevoked role access
+// code. It returns sql.ErrNoRows when the code doesn't grant access to any hike.
+func resolveHikeAccess(code string) (hikeAccess, error) {
+	var a hikeAccess
+	if code == "" {
+		return a, sql.ErrNoRows
+	}
+
+	err := db.QueryRow("SELECT join_code FROM hikes WHERE leader_code = ?", code).Scan(&a.joinCode)
+	if err == nil {
+		a.role = "leader"
+		return a, nil
+	}
+	if err != sql.ErrNoRows {
+		return a, err
+	}
+
+	err = db.QueryRow(`
+		SELECT id, hike_join_code, role FROM hike_roles
+		WHERE access_code = ? AND revoked_at IS NULL
+	`, code).Scan(&a.roleId, &a.joinCode, &a.role)
+	return a, err
+}
+
+// requireHikeAccess resolves the leaderCode query parameter for the hike in the path and
+// checks it grants permission. It writes the error response and returns false if not.
+func requireHikeAccess(w http.ResponseWriter, r *http.Request, permission string) (hikeAccess, bool) {
+	access, err := resolveHikeAccess(r.URL.Query().Get("leaderCode"))
+	if err == sql.ErrNoRows || (err == nil && access.joinCode != r.PathValue("hikeId")) {
+		http.Error(w, "Hike not found for the given leader code", http.StatusNotFound)
+		return access, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return access, false
+	}
+	if !access.can(permission) {
+		http.Error(w, fmt.Sprintf("The %s role does not have the %s permission", access.role, permission), http.StatusForbidden)
+		return access, false
+	}
+	return access, true
+}
+
+// authorizeParticipantChange checks the request may change the given participant. It needs
+// either the participantToken issued to that participant when they RSVPd, or a leaderCode for
+// the hike with the update_participants permission. Missing or unrecognized credentials are
+// 401; credentials that are valid but don't cover this participant are 403. It writes the
+// error response and returns false if not, otherwise it returns who is acting for the logs.
+func authorizeParticipantChange(w http.ResponseWriter, r *http.Request, joinCode string, participantId int64) (string, bool) {
+	token := r.URL.Query().Get("participantToken")
+	leaderCode := r.URL.Query().Get("leaderCode")
+	if token == "" && leaderCode == "" {
+		http.Error(w, "A participantToken or leaderCode is required", http.StatusUnauthorized)
+		return "", false
+	}
+
+	if leaderCode != "" {
+		access, err := resolveHikeAccess(leaderCode)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid leader code", http.StatusUnauthorized)
+			return "", false
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return "", false
+		}
+		if access.joinCode != joinCode {
+			http.Error(w, "The leader code is not for this hike", http.StatusForbidden)
+			return "", false
+		}
+		if !access.can(permUpdateParticipants) {
+			http.Error(w, fmt.Sprintf("The %s role does not have the %s permission", access.role, permUpdateParticipants), http.StatusForbidden)
+			return "", false
+		}
+		return access.role, true
+	}
+
+	var tokenParticipantId int64
+	err := db.QueryRow("SELECT id FROM hike_users WHERE participant_token = ?", token).Scan(&tokenParticipantId)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid participant token", http.StatusUnauthorized)
+		return "", false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return "", false
+	}
+	if tokenParticipantId != participantId {
+		// A guardian's token also covers the dependents they RSVPd
+		var isGuardian bool
+		err = db.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM hike_users d JOIN hike_users g
+			               ON d.guardian_uuid = g.user_uuid AND d.hike_join_code = g.hike_join_code
+			               WHERE d.id = ? AND g.id = ?)
+		`, participantId, tokenParticipantId).Scan(&isGuardian)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return "", false
+		}
+		if !isGuardian {
+			http.Error(w, "The participant token is for a different participant", http.StatusForbidden)
+			return "", false
+		}
+	}
+	return "participant", true
+}
+
+// authorizeRepeatRSVP checks the request may RSVP each of the given users to the hike. Anyone
+// not yet on the hike may be RSVPd; someone already on it needs the participantToken they were
+// issued, or for a dependent their guardian's, so nobody else can take over their RSVP or get
+// their token. It writes the error response and returns false if not.
+func authorizeRepeatRSVP(w http.ResponseWriter, r *http.Request, joinCode string, userUUIDs ...string) bool {
+	token := r.URL.Query().Get("participantToken")
+	for _, userUUID := range userUUIDs {
+		var onHike, authorized bool
+		err := db.QueryRow(`
+			SELECT COUNT(*) > 0, COALESCE(MAX(hu.participant_token = ? OR g.participant_token = ?), 0)
+			FROM hike_users hu LEFT JOIN hike_users g ON g.hike_join_code = hu.hike_join_code AND g.user_uuid = hu.guardian_uuid
+			WHERE hu.hike_join_code = ? AND hu.user_uuid = ?
+		`, token, token, joinCode, userUUID).Scan(&onHike, &authorized)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return false
+		}
+		if onHike && (token == "" || !authorized) {
+			http.Error(w, "Already RSVPd to this hike; RSVPing again requires the participantToken", http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// claimHikeRole remembers which user opened a role's access code so the hike shows up in
+// their list of hikes they are leading. The first user to open it keeps it.
+func claimHikeRole(roleId int64, userUUID string) error {
+	if roleId == 0 || userUUID == "" {
+		return nil
+	}
+	_, err := db.Exec("UPDATE hike_roles SET user_uuid = ? WHERE id = ? AND user_uuid IS NULL", userUUID, roleId)
+	return err
+}
+
+// Add a role to a hike. Requires a leaderCode with the manage_roles permission.
+func createHikeRoleHandler(w http.ResponseWriter, r *http.Request) {
+	access, ok := requireHikeAccess(w, r, permManageRoles)
+	if !ok {
+		return
+	}
+
+	var role HikeRole
+	if err := json.NewDecoder(r.Body).Decode(&role); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, known := rolePermissions[role.Role]; !known {
+		http.Error(w, "Role must be one of leader, co-leader or sweep", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	role.AccessCode, err = generateSecureLinkCode()
+	if err != nil {
+		http.Error(w, "Failed to generate access code", http.StatusInternalServerError)
+		return
+	}
+	role.CreatedAt = time.Now()
+	role.Permissions = rolePermissions[role.Role]
+	role.UserUUID = ""
+
+	result, err := db.Exec(`
+		INSERT INTO hike_roles (hike_join_code, role, name, access_code, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, access.joinCode, role.Role, role.Name, role.AccessCode, role.CreatedAt.Format("2006-01-02T15:04:05-07:00"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	role.Id, err = result.LastInsertId()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(role)
+	logAction(fmt.Sprintf("Role added to hike %s: %s (%s), role ID %d", access.joinCode, role.Role, role.Name, role.Id))
+}
+
+// List the unrevoked roles on a hike. Requires a leaderCode with the manage_roles permission.
+func getHikeRolesHandler(w http.ResponseWriter, r *http.Request) {
+	access, ok := requireHikeAccess(w, r, permManageRoles)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT id, role, name, COALESCE(user_uuid, ''), access_code, created_at
+		FROM hike_roles
+		WHERE hike_join_code = ? AND revoked_at IS NULL
+		ORDER BY id
+	`, access.joinCode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	roles := []HikeRole{}
+	for rows.Next() {
+		var role HikeRole
+		if err := rows.Scan(&role.Id, &role.Role, &role.Name, &role.UserUUID, &role.AccessCode, &role.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		role.Permissions = rolePermissions[role.Role]
+		roles = append(roles, role)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(roles)
+}
+
+// Revoke a role so its access code stops working. Requires a leaderCode with the manage_roles permission.
+func revokeHikeRoleHandler(w http.ResponseWriter, r *http.Request) {
+	access, ok := requireHikeAccess(w, r, permManageRoles)
+	if !ok {
+		return
+	}
+	roleId, err := parseInt64(r.PathValue("roleId"))
+	if err != nil {
+		http.Error(w, "Invalid role ID format", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`
+		UPDATE hike_roles SET revoked_at = ?
+		WHERE id = ? AND hike_join_code = ? AND revoked_at IS NULL
+	`, time.Now().Format("2006-01-02T15:04:05-07:00"), roleId, access.joinCode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Role not found for this hike or already revoked", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	logAction(fmt.Sprintf("Role ID %d revoked from hike %s", roleId, access.joinCode))
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A leader can attach the hike's route as a GPX, KML or GeoJSON file. The route is stored as
+// GeoJSON-style coordinates, its distance and elevation gain become the hike's, and
+// participants can download it as GeoJSON or GPX to load into a GPS app before losing signal.
+
+const (
+	maxRouteUploadBytes = 5 << 20
+	// Climbs smaller than this between a low point and a high point are treated as GPS noise
+	elevationNoiseMeters = 3.0
+	earthRadiusMiles     = 3958.8
+	feetPerMeter         = 3.28084
+)
+
+// routeCoordinate is [longitude, latitude] or [longitude, latitude, elevation in meters], as in GeoJSON
+type routeCoordinate []float64
+
+// hikeRoute is a hike's route: one or more lines, e.g. the tracks or segments of a GPX file
+type hikeRoute struct {
+	Name              string
+	Lines             [][]routeCoordinate
+	DistanceMiles     float64
+	ElevationGainFeet int
+}
+
+// measure sets the route's distance and elevation gain from its lines
+func (route *hikeRoute) measure() {
+	var miles, gainMeters float64
+	for _, line := range route.Lines {
+		low := math.NaN()
+		for i, c := range line {
+			if i > 0 {
+				miles += haversineMiles(line[i-1], c)
+			}
+			if len(c) < 3 {
+				continue
+			}
+			// Count a climb once it rises clear of the noise above the last low point
+			if math.IsNaN(low) || c[2] < low {
+				low = c[2]
+			} else if c[2]-low >= elevationNoiseMeters {
+				gainMeters += c[2] - low
+				low = c[2]
+			}
+		}
+	}
+	route.DistanceMiles = math.Round(miles*100) / 100
+	route.ElevationGainFeet = int(math.Round(gainMeters * feetPerMeter))
+}
+
+func haversineMiles(a, b routeCoordinate) float64 {
+	lat1, lat2 := a[1]*math.Pi/180, b[1]*math.Pi/180
+	dLat, dLon := lat2-lat1, (b[0]-a[0])*math.Pi/180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMiles * math.Asin(math.Sqrt(h))
+}
+
+// parseRoute reads a GPX, KML or GeoJSON file. format is gpx, kml or geojson; if it is empty
+// the format is worked out from the content.
+func parseRoute(data []byte, format string) (hikeRoute, error) {
+	if format == "" {
+		trimmed := bytes.TrimSpace(data)
+		switch {
+		case bytes.HasPrefix(trimmed, []byte("{")):
+			format = "geojson"
+		case bytes.Contains(trimmed, []byte("<gpx")):
+			format = "gpx"
+		case bytes.Contains(trimmed, []byte("<kml")):
+			format = "kml"
+		default:
+			return hikeRoute{}, fmt.Errorf("the route must be a GPX, KML or GeoJSON file")
+		}
+	}
+
+	var route hikeRoute
+	var err error
+	switch format {
+	case "gpx":
+		route, err = parseGPX(data)
+	case "kml":
+		route, err = parseKML(data)
+	case "geojson":
+		route, err = parseGeoJSON(data)
+	default:
+		return route, fmt.Errorf("format must be one of gpx, kml or geojson")
+	}
+	if err != nil {
+		return route, fmt.Errorf("invalid %s route: %v", format, err)
+	}
+
+	// A line needs two points; drop stray single points
+	lines := route.Lines[:0]
+	for _, line := range route.Lines {
+		for _, c := range line {
+			if len(c) < 2 || c[1] < -90 || c[1] > 90 || c[0] < -180 || c[0] > 180 {
+				return route, fmt.Errorf("invalid %s route: coordinates out of range", format)
+			}
+		}
+		if len(line) >= 2 {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return route, fmt.Errorf("the %s file has no track or route with at least two points", format)
+	}
+	route.Lines = lines
+	route.measure()
+	return route, nil
+}
+
+type gpxPoint struct {
+	Lat float64  `xml:"lat,attr"`
+	Lon float64  `xml:"lon,attr"`
+	Ele *float64 `xml:"ele,omitempty"`
+}
+
+func (p gpxPoint) coordinate() routeCoordinate {
+	if p.Ele != nil {
+		return routeCoordinate{p.Lon, p.Lat, *p.Ele}
+	}
+	return routeCoordinate{p.Lon, p.Lat}
+}
+
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+type gpxTrack struct {
+	Name     string       `xml:"name,omitempty"`
+	Segments []gpxSegment `xml:"trkseg"`
+}
+
+type gpxFile struct {
+	XMLName  xml.Name   `xml:"gpx"`
+	Version  string     `xml:"version,attr"`
+	Creator  string     `xml:"creator,attr"`
+	Xmlns    string     `xml:"xmlns,attr,omitempty"`
+	Name     string     `xml:"metadata>name,omitempty"`
+	Tracks   []gpxTrack `xml:"trk"`
+	GPXRoute []struct {
+		Name   string     `xml:"name"`
+		Points []gpxPoint `xml:"rtept"`
+	} `xml:"rte"`
+}
+
+func parseGPX(data []byte) (hikeRoute, error) {
+	var gpx gpxFile
+	if err := xml.Unmarshal(data, &gpx); err != nil {
+		return hikeRoute{}, err
+	}
+	route := hikeRoute{Name: gpx.Name}
+	for _, trk := range gpx.Tracks {
+		if route.Name == "" {
+			route.Name = trk.Name
+		}
+		for _, seg := range trk.Segments {
+			var line []routeCoordinate
+			for _, p := range seg.Points {
+				line = append(line, p.coordinate())
+			}
+			route.Lines = append(route.Lines, line)
+		}
+	}
+	// Planned routes are only used when there's no recorded track
+	if len(route.Lines) == 0 {
+		for _, rte := range gpx.GPXRoute {
+			if route.Name == "" {
+				route.Name = rte.Name
+			}
+			var line []routeCoordinate
+			for _, p := range rte.Points {
+				line = append(line, p.coordinate())
+			}
+			route.Lines = append(route.Lines, line)
+		}
+	}
+	return route, nil
+}
+
+// parseKML reads the LineStrings in a KML file, wherever they are nested
+func parseKML(data []byte) (hikeRoute, error) {
+	var route hikeRoute
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var path []string
+	var text strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return route, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name.Local)
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			parent := ""
+			if len(path) > 1 {
+				parent = path[len(path)-2]
+			}
+			switch {
+			case t.Name.Local == "name" && route.Name == "" && (parent == "Document" || parent == "Placemark"):
+				route.Name = strings.TrimSpace(text.String())
+			case t.Name.Local == "coordinates" && parent == "LineString":
+				line, err := parseKMLCoordinates(text.String())
+				if err != nil {
+					return route, err
+				}
+				route.Lines = append(route.Lines, line)
+			}
+			path = path[:len(path)-1]
+			text.Reset()
+		}
+	}
+	return route, nil
+}
+
+// parseKMLCoordinates reads KML's whitespace-separated lon,lat[,alt] tuples
+func parseKMLCoordinates(s string) ([]routeCoordinate, error) {
+	var line []routeCoordinate
+	for _, tuple := range strings.Fields(s) {
+		var c routeCoordinate
+		for _, field := range strings.Split(tuple, ",") {
+			v, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad coordinate %q", tuple)
+			}
+			c = append(c, v)
+		}
+		if len(c) < 2 || len(c) > 3 {
+			return nil, fmt.Errorf("bad coordinate %q", tuple)
+		}
+		line = append(line, c)
+	}
+	return line, nil
+}
+
+type geoJSONGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates,omitempty"`
+}
+
+// geoJSONObject is a FeatureCollection, a Feature or a bare geometry
+type geoJSONObject struct {
+	Type        string                 `json:"type"`
+	Geometry    *geoJSONGeometry       `json:"geometry,omitempty"`
+	Properties  map[string]interface{} `json:"properties,omitempty"`
+	Features    []geoJSONObject        `json:"features,omitempty"`
+	Coordinates json.RawMessage        `json:"coordinates,omitempty"`
+}
+
+// parseGeoJSON reads the LineStrings and MultiLineStrings in a GeoJSON file
+func parseGeoJSON(data []byte) (hikeRoute, error) {
+	var route hikeRoute
+	var obj geoJSONObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return route, err
+	}
+	var add func(o geoJSONObject) error
+	addGeometry := func(g geoJSONGeometry) error {
+		switch g.Type {
+		case "LineString":
+			var line []routeCoordinate
+			if err := json.Unmarshal(g.Coordinates, &line); err != nil {
+				return err
+			}
+			route.Lines = append(route.Lines, line)
+		case "MultiLineString":
+			var lines [][]routeCoordinate
+			if err := json.Unmarshal(g.Coordinates, &lines); err != nil {
+				return err
+			}
+			route.Lines = append(route.Lines, lines...)
+		}
+		return nil
+	}
+	add = func(o geoJSONObject) error {
+		switch o.Type {
+		case "FeatureCollection":
+			for _, f := range o.Features {
+				if err := add(f); err != nil {
+					return err
+				}
+			}
+		case "Feature":
+			if name, ok := o.Properties["name"].(string); ok && route.Name == "" {
+				route.Name = name
+			}
+			if o.Geometry != nil {
+				return addGeometry(*o.Geometry)
+			}
+		default:
+			return addGeometry(geoJSONGeometry{Type: o.Type, Coordinates: o.Coordinates})
+		}
+		return nil
+	}
+	return route, add(obj)
+}
+
+// geoJSON returns the route as a GeoJSON Feature
+func (route hikeRoute) geoJSON() interface{} {
+	geometry := map[string]interface{}{"type": "MultiLineString", "coordinates": route.Lines}
+	if len(route.Lines) == 1 {
+		geometry = map[string]interface{}{"type": "LineString", "coordinates": route.Lines[0]}
+	}
+	return map[string]interface{}{
+		"type":     "Feature",
+		"geometry": geometry,
+		"properties": map[string]interface{}{
+			"name":              route.Name,
+			"distanceMiles":     route.DistanceMiles,
+			"elevationGainFeet": route.ElevationGainFeet,
+		},
+	}
+}
+
+// gpx returns the route as a GPX 1.1 track with a segment per line
+func (route hikeRoute) gpx() ([]byte, error) {
+	gpx := gpxFile{Version: "1.1", Creator: "hiketracker", Xmlns: "http://www.topografix.com/GPX/1/1", Name: route.Name}
+	trk := gpxTrack{Name: route.Name}
+	for _, line := range route.Lines {
+		var seg gpxSegment
+		for _, c := range line {
+			p := gpxPoint{Lon: c[0], Lat: c[1]}
+			if len(c) > 2 {
+				ele := c[2]
+				p.Ele = &ele
+			}
+			seg.Points = append(seg.Points, p)
+		}
+		trk.Segments = append(trk.Segments, seg)
+	}
+	gpx.Tracks = []gpxTrack{trk}
+	out, err := xml.MarshalIndent(gpx, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+// loadHikeRoute returns the route attached to a hike, or sql.ErrNoRows if there isn't one
+func loadHikeRoute(joinCode string) (hikeRoute, error) {
+	var route hikeRoute
+	var lines string
+	err := db.QueryRow(`
+		SELECT name, coordinates, distance_miles, elevation_gain_feet
+		FROM hike_routes WHERE hike_join_code = ?
+	`, joinCode).Scan(&route.Name, &lines, &route.DistanceMiles, &route.ElevationGainFeet)
+	if err != nil {
+		return route, err
+	}
+	return route, json.Unmarshal([]byte(lines), &route.Lines)
+}
+
+// Attach a GPX, KML or GeoJSON route to a hike, replacing any it had, and set the hike's
+// distance and elevation gain from it. The file is the request body; format can be given if
+// the content doesn't make it clear. Requires a leaderCode with the edit_hike permission.
+func putHikeRouteHandler(w http.ResponseWriter, r *http.Request) {
+	access, ok := requireHikeAccess(w, r, permEditHike)
+	if !ok {
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRouteUploadBytes))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("The route file must be under %d MB", maxRouteUploadBytes>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+	route, err := parseRoute(data, strings.ToLower(r.URL.Query().Get("format")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lines, err := json.Marshal(route.Lines)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Format("2006-01-02T15:04:05-07:00")
+	_, err = tx.Exec(`
+		INSERT INTO hike_routes (hike_join_code, name, coordinates, distance_miles, elevation_gain_feet, uploaded_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(hike_join_code) DO UPDATE SET name = excluded.name, coordinates = excluded.coordinates,
+		    distance_miles = excluded.distance_miles, elevation_gain_feet = excluded.elevation_gain_feet, uploaded_at = excluded.uploaded_at
+	`, access.joinCode, route.Name, string(lines), route.DistanceMiles, route.ElevationGainFeet, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(`
+		UPDATE hikes SET distance_miles = ?, elevation_gain_feet = ?, version = version + 1, updated_at = ?
+		WHERE join_code = ?
+	`, route.DistanceMiles, route.ElevationGainFeet, now, access.joinCode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hikeEvents.publish(access.joinCode, eventHike, 0, "open")
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	json.NewEncoder(w).Encode(route.geoJSON())
+	logAction(fmt.Sprintf("Route attached to hike %s by %s: %.2f mi, %d ft gain", access.joinCode, access.role, route.DistanceMiles, route.ElevationGainFeet))
+}
+
+// Remove a hike's route. The hike keeps the distance and elevation gain it had. Requires a
+// leaderCode with the edit_hike permission.
+func deleteHikeRouteHandler(w http.ResponseWriter, r *http.Request) {
+	access, ok := requireHikeAccess(w, r, permEditHike)
+	if !ok {
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM hike_routes WHERE hike_join_code = ?", access.joinCode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "The hike has no route", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	logAction(fmt.Sprintf("Route removed from hike %s by %s", access.joinCode, access.role))
+}
+
+// Download a hike's route as GeoJSON, e.g. to preview it on a map. Anyone with the join code can.
+func getHikeRouteGeoJSONHandler(w http.ResponseWriter, r *http.Request) {
+	route, ok := requireHikeRoute(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	json.NewEncoder(w).Encode(route.geoJSON())
+}
+
+// Download a hike's route as GPX for a GPS app. Anyone with the join code can.
+func getHikeRouteGPXHandler(w http.ResponseWriter, r *http.Request) {
+	route, ok := requireHikeRoute(w, r)
+	if !ok {
+		return
+	}
+	out, err := route.gpx()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gpx+xml")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.gpx"`, r.PathValue("hikeId")))
+	w.Write(out)
+}
+
+// requireHikeRoute loads the route of the hike in the path. It writes the error response and
+// returns false if there isn't one.
+func requireHikeRoute(w http.ResponseWriter, r *http.Request) (hikeRoute, bool) {
+	route, err := loadHikeRoute(r.PathValue("hikeId"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "The hike has no route", http.StatusNotFound)
+		return route, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return route, false
+	}
+	return route, true
+}
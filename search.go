@@ -0,0 +1,265 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Trailhead search matches names the way people type them: without the ʻokina or kahakō
+// ("Kuliouou" for Kuliʻouʻou), with a typo or two ("Kuliuou"), or by another name the
+// trailhead goes by ("Stairway to Heaven" for Haʻikū Stairs). The catalog is small, so it is
+// scored in memory on each search rather than kept in a separate index.
+
+const maxTrailheadSuggestions = 5
+
+// searchFolder drops the ʻokina and apostrophes, which sit inside words, and takes the
+// diacritics off letters
+var searchFolder = strings.NewReplacer(
+	"ʻ", "", "ʼ", "", "‘", "", "’", "", "'", "", "`", "", "´", "",
+	"ā", "a", "ē", "e", "ī", "i", "ō", "o", "ū", "u",
+	"à", "a", "á", "a", "â", "a", "ã", "a", "ä", "a", "å", "a",
+	"è", "e", "é", "e", "ê", "e", "ë", "e",
+	"ì", "i", "í", "i", "î", "i", "ï", "i",
+	"ò", "o", "ó", "o", "ô", "o", "õ", "o", "ö", "o",
+	"ù", "u", "ú", "u", "û", "u", "ü", "u",
+	"ñ", "n", "ç", "c", "ý", "y", "ÿ", "y",
+)
+
+// normalizeSearchText folds text for matching: lowercase, without diacritics, ʻokina or
+// punctuation, and with single spaces between words
+func normalizeSearchText(s string) string {
+	s = searchFolder.Replace(strings.ToLower(s))
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, " ")
+}
+
+// How a query matched a name, best first
+const (
+	matchExact = iota
+	matchPrefix
+	matchWordStart
+	matchSubstring
+	matchFuzzy
+	noMatch
+)
+
+// maxSearchTypos is how many typos a query of a given length may have. Short queries must
+// match exactly, or every trailhead would match.
+func maxSearchTypos(queryLength int) int {
+	if queryLength < 4 {
+		return 0
+	}
+	if queryLength < 8 {
+		return 1
+	}
+	return queryLength / 4
+}
+
+// matchSearchText compares a normalized query with a normalized name. Spaces are ignored, so
+// "puupia" matches "pu'u pia". Returns how it matched and, for fuzzy matches, the typos.
+func matchSearchText(query, name string) (kind, typos int) {
+	compactQuery := strings.ReplaceAll(query, " ", "")
+	compactName := strings.ReplaceAll(name, " ", "")
+	switch {
+	case compactQuery == "":
+		return noMatch, 0
+	case compactQuery == compactName:
+		return matchExact, 0
+	case strings.HasPrefix(compactName, compactQuery):
+		return matchPrefix, 0
+	case strings.Contains(" "+name, " "+query):
+		return matchWordStart, 0
+	case strings.Contains(compactName, compactQuery):
+		return matchSubstring, 0
+	}
+	typos = substringEditDistance([]rune(compactQuery), []rune(compactName))
+	if typos <= maxSearchTypos(len([]rune(compactQuery))) {
+		return matchFuzzy, typos
+	}
+	return noMatch, 0
+}
+
+// substringEditDistance is the fewest insertions, deletions and substitutions that turn the
+// query into some part of the text
+func substringEditDistance(query, text []rune) int {
+	// previous[j] is the distance between the query so far and the best part of text ending at j
+	previous := make([]int, len(text)+1)
+	current := make([]int, len(text)+1)
+	for i := 1; i <= len(query); i++ {
+		current[0] = i
+		for j := 1; j <= len(text); j++ {
+			cost := 1
+			if query[i-1] == text[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j-1]+cost, previous[j]+1, current[j-1]+1)
+		}
+		previous, current = current, previous
+	}
+	best := len(query)
+	for _, d := range previous {
+		best = min(best, d)
+	}
+	return best
+}
+
+// trailheadCandidate is a trailhead that might be suggested
+type trailheadCandidate struct {
+	Trailhead
+	names      []string // Normalized name and aliases
+	fromLeader bool     // From the leader's own hikes
+	popularity int      // Hikes there
+	kind       int
+	typos      int
+}
+
+// rankTrailheads keeps the candidates matching the query, best match first: how closely it
+// matched, then the leader's own trailheads, then the most hiked
+func rankTrailheads(query string, candidates []trailheadCandidate) []Trailhead {
+	query = normalizeSearchText(query)
+	var matched []trailheadCandidate
+	for _, c := range candidates {
+		c.kind = noMatch
+		for _, name := range c.names {
+			kind, typos := matchSearchText(query, name)
+			if kind < c.kind || (kind == c.kind && typos < c.typos) {
+				c.kind, c.typos = kind, typos
+			}
+		}
+		if c.kind != noMatch {
+			matched = append(matched, c)
+		}
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if a.kind != b.kind {
+			return a.kind < b.kind
+		}
+		if a.typos != b.typos {
+			return a.typos < b.typos
+		}
+		if a.fromLeader != b.fromLeader {
+			return a.fromLeader
+		}
+		if a.popularity != b.popularity {
+			return a.popularity > b.popularity
+		}
+		return a.names[0] < b.names[0]
+	})
+
+	// The leader's trailhead replaces the catalog's of the same name, e.g. with their own map link
+	suggestions := []Trailhead{}
+	seen := make(map[string]bool)
+	for _, c := range matched {
+		if seen[c.Name] {
+			continue
+		}
+		seen[c.Name] = true
+		suggestions = append(suggestions, c.Trailhead)
+		if len(suggestions) == maxTrailheadSuggestions {
+			break
+		}
+	}
+	return suggestions
+}
+
+// trailheadCandidates loads what a search can suggest: the leader's own trailheads, each as on
+// their last hike there, and the catalog's trailheads that aren't retired, with their aliases
+func trailheadCandidates(userUUID string) ([]trailheadCandidate, error) {
+	popularity := make(map[string]int)
+	rows, err := db.Query("SELECT trailhead_name, COUNT(*) FROM hikes GROUP BY trailhead_name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var count int
+		if err := rows.Scan(&name, &count); err != nil {
+			return nil, err
+		}
+		popularity[name] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var candidates []trailheadCandidate
+	if userUUID != "" {
+		rows, err := db.Query(`
+			SELECT trailhead_name, trailhead_map_link, distance_miles, elevation_gain_feet, duration_minutes, difficulty, hazards
+			FROM (
+				SELECT trailhead_name, trailhead_map_link, distance_miles, elevation_gain_feet, duration_minutes, difficulty, hazards,
+					ROW_NUMBER() OVER(PARTITION BY trailhead_name ORDER BY created_at DESC) as rn
+				FROM hikes
+				WHERE leader_uuid = ? AND trailhead_name != ''
+			) sub
+			WHERE sub.rn = 1
+		`, userUUID)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			c := trailheadCandidate{fromLeader: true}
+			if err := rows.Scan(&c.Name, &c.MapLink, &c.DistanceMiles, &c.ElevationGainFeet, &c.DurationMinutes, &c.Difficulty, &c.Hazards); err != nil {
+				return nil, err
+			}
+			if lat, lng, ok := mapLinkCoordinates(c.MapLink); ok {
+				c.Latitude, c.Longitude = &lat, &lng
+			}
+			c.names = []string{normalizeSearchText(c.Name)}
+			c.popularity = popularity[c.Name]
+			candidates = append(candidates, c)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	aliases := make(map[string][]string)
+	aliasRows, err := db.Query("SELECT alias, trailhead_name FROM trailhead_aliases")
+	if err != nil {
+		return nil, err
+	}
+	defer aliasRows.Close()
+	for aliasRows.Next() {
+		var alias, name string
+		if err := aliasRows.Scan(&alias, &name); err != nil {
+			return nil, err
+		}
+		aliases[name] = append(aliases[name], alias)
+	}
+	if err := aliasRows.Err(); err != nil {
+		return nil, err
+	}
+
+	catalogRows, err := db.Query(`
+		SELECT name, map_link, latitude, longitude, distance_miles, elevation_gain_feet, duration_minutes, difficulty, hazards
+		FROM trailheads
+		WHERE retired_at IS NULL
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer catalogRows.Close()
+	for catalogRows.Next() {
+		var c trailheadCandidate
+		if err := catalogRows.Scan(&c.Name, &c.MapLink, &c.Latitude, &c.Longitude, &c.DistanceMiles, &c.ElevationGainFeet, &c.DurationMinutes, &c.Difficulty, &c.Hazards); err != nil {
+			return nil, err
+		}
+		c.names = []string{normalizeSearchText(c.Name)}
+		c.popularity = popularity[c.Name]
+		// Hikes under an old name count towards the trailhead
+		for _, alias := range aliases[c.Name] {
+			c.names = append(c.names, normalizeSearchText(alias))
+			c.popularity += popularity[alias]
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, catalogRows.Err()
+}
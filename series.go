@@ -0,0 +1,797 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// A hike series is a template hike plus a recurrence rule. Occurrences are materialized
+// ahead of time as ordinary rows in hikes, each with its own join and leader codes, so
+// RSVPs, waitlists and the leader console work on an occurrence exactly as on any other hike.
+
+// How far ahead of time occurrences of a series are created
+const seriesMaterializeAhead = 60 * 24 * time.Hour
+
+// How often the series materializer checks for occurrences that have come into range
+const seriesMaterializeInterval = time.Hour
+
+type HikeSeries struct {
+	JoinCode          string `json:"joinCode"`
+	LeaderCode        string `json:"leaderCode,omitempty"`
+	Recurrence        string `json:"recurrence"` // RRULE, e.g. FREQ=WEEKLY;BYDAY=SA
+	Status            string `json:"status"`
+	Template          Hike   `json:"template"` // Details copied to each occurrence; StartTime is the first occurrence
+	Occurrences       []Hike `json:"occurrences"`
+	SubscriptionId    int64  `json:"subscriptionId,omitempty"`    // Used when returning series to a subscriber
+	SubscriptionToken string `json:"subscriptionToken,omitempty"` // Needed to unsubscribe or subscribe again
+}
+
+// loadSeries fetches a series by one of its unique columns (id, join_code or leader_code)
+func loadSeries(column string, value interface{}) (int64, HikeSeries, error) {
+	var id int64
+	var s HikeSeries
+	t := &s.Template
+	err := db.QueryRow(fmt.Sprintf(`
+		SELECT s.id, s.join_code, s.leader_code, s.recurrence, s.status,
+		       s.name, s.organization, s.trailhead_name, s.trailhead_map_link, s.start_time,
+		       s.photo_release, s.description, s.max_participants, s.duration_minutes, s.public, s.difficulty,
+		       s.distance_miles, s.elevation_gain_feet, s.hazards,
+		       u.uuid, u.name, u.phone
+		FROM hike_series s
+		JOIN users u ON s.leader_uuid = u.uuid
+		WHERE s.%s = ?
+	`, column), value).Scan(&id, &s.JoinCode, &s.LeaderCode, &s.Recurrence, &s.Status,
+		&t.Name, &t.Organization, &t.TrailheadName, &t.TrailheadMapLink, &t.StartTime,
+		&t.PhotoRelease, &t.DescriptionMarkdown, &t.MaxParticipants, &t.DurationMinutes, &t.Public, &t.Difficulty,
+		&t.DistanceMiles, &t.ElevationGainFeet, &t.Hazards,
+		&t.Leader.UUID, &t.Leader.Name, &t.Leader.Phone)
+	if err != nil {
+		return 0, s, err
+	}
+	populateDescriptionHTML(t)
+	return id, s, nil
+}
+
+// seriesOccurrences returns the open occurrences of a series in order. Leader codes are
+// only filled in for the series leader.
+func seriesOccurrences(seriesId int64, includeLeaderCodes bool) ([]Hike, error) {
+	rows, err := db.Query(`
+		SELECT h.name, h.organization, h.trailhead_name, h.trailhead_map_link, h.start_time, h.status,
+		       h.join_code, h.leader_code, h.photo_release, h.description, h.max_participants, h.duration_minutes,
+		       h.public, h.difficulty, h.distance_miles, h.elevation_gain_feet, h.hazards, h.version,
+		       u.uuid, u.name, u.phone, s.join_code
+		FROM hikes h
+		JOIN users u ON h.leader_uuid = u.uuid
+		JOIN hike_series s ON h.series_id = s.id
+		WHERE h.series_id = ? AND h.status = 'open'
+		ORDER BY h.series_index
+	`, seriesId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	occurrences := []Hike{}
+	for rows.Next() {
+		var h Hike
+		err := rows.Scan(&h.Name, &h.Organization, &h.TrailheadName, &h.TrailheadMapLink, &h.StartTime, &h.Status,
+			&h.JoinCode, &h.LeaderCode, &h.PhotoRelease, &h.DescriptionMarkdown, &h.MaxParticipants, &h.DurationMinutes,
+			&h.Public, &h.Difficulty, &h.DistanceMiles, &h.ElevationGainFeet, &h.Hazards, &h.Version,
+			&h.Leader.UUID, &h.Leader.Name, &h.Leader.Phone, &h.SeriesCode)
+		if err != nil {
+			return nil, err
+		}
+		if !includeLeaderCodes {
+			h.LeaderCode = ""
+		}
+		populateDescriptionHTML(&h)
+		occurrences = append(occurrences, h)
+	}
+	return occurrences, rows.Err()
+}
+
+// startSeriesMaterializer creates upcoming occurrences for every open series now and then
+// every interval until stop is closed
+func startSeriesMaterializer(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		if err := materializeAllSeries(time.Now()); err != nil {
+			log.Printf("Error materializing hike series: %v", err)
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := materializeAllSeries(time.Now()); err != nil {
+					log.Printf("Error materializing hike series: %v", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func materializeAllSeries(now time.Time) error {
+	rows, err := db.Query("SELECT id FROM hike_series WHERE status = 'open'")
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if _, err := materializeSeries(id, now); err != nil {
+			return fmt.Errorf("series %d: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// materializeSeries creates a hike for every occurrence of the series between now and
+// seriesMaterializeAhead that doesn't have one yet, and RSVPs the series' subscribers to
+// each new hike. It returns the join codes of the hikes it created.
+func materializeSeries(seriesId int64, now time.Time) ([]string, error) {
+	_, series, err := loadSeries("id", seriesId)
+	if err != nil {
+		return nil, err
+	}
+	if series.Status != "open" {
+		return nil, nil
+	}
+	rule, err := parseRecurrence(series.Recurrence, series.Template.StartTime)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := make(map[int]bool)
+	rows, err := db.Query("SELECT series_index FROM hikes WHERE series_id = ?", seriesId)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var index int
+		if err := rows.Scan(&index); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		existing[index] = true
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// An occurrence at a closed trailhead is left out; it's created once the closure ends if
+	// that's before it starts
+	var due []int
+	starts := rule.occurrences(series.Template.StartTime, now.Add(seriesMaterializeAhead))
+	for index, start := range starts {
+		if existing[index] || start.Before(now) {
+			continue
+		}
+		if _, err := checkTrailheadOpen(db, series.Template.TrailheadName, start); err != nil {
+			if _, isClosed := err.(*trailheadClosedError); !isClosed {
+				return nil, err
+			}
+			logAction(fmt.Sprintf("Hike series %s: occurrence %d not created, %v", series.JoinCode, index, err))
+			continue
+		}
+		due = append(due, index)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // Rollback if not committed
+
+	var created []string
+	for _, index := range due {
+		hike := series.Template
+		hike.StartTime = starts[index]
+		if err := insertHike(tx, &hike); err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec("UPDATE hikes SET series_id = ?, series_index = ? WHERE join_code = ?", seriesId, index, hike.JoinCode)
+		if err != nil {
+			return nil, err
+		}
+		created = append(created, hike.JoinCode)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if len(created) == 0 {
+		return nil, nil
+	}
+	logAction(fmt.Sprintf("Hike series %s: created %d occurrence(s) of %s", series.JoinCode, len(created), series.Template.Name))
+
+	subscribers, err := seriesSubscribers(seriesId)
+	if err != nil {
+		return created, err
+	}
+	for _, sub := range subscribers {
+		for _, joinCode := range created {
+			if _, _, _, err := rsvpSubscriber(sub, joinCode); err != nil {
+				log.Printf("Error RSVPing subscriber %s to hike %s: %v", sub.userUUID, joinCode, err)
+			}
+		}
+	}
+	return created, nil
+}
+
+type seriesSubscriber struct {
+	userUUID  string
+	userAgent string
+	ipAddress string
+}
+
+func seriesSubscribers(seriesId int64) ([]seriesSubscriber, error) {
+	rows, err := db.Query("SELECT user_uuid, user_agent, ip_address FROM series_subscriptions WHERE series_id = ?", seriesId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscribers []seriesSubscriber
+	for rows.Next() {
+		var sub seriesSubscriber
+		if err := rows.Scan(&sub.userUUID, &sub.userAgent, &sub.ipAddress); err != nil {
+			return nil, err
+		}
+		subscribers = append(subscribers, sub)
+	}
+	return subscribers, rows.Err()
+}
+
+// rsvpSubscriber RSVPs a series subscriber to one occurrence. Subscribing accepts the waiver for
+// every occurrence, so it is recorded with the details captured when they subscribed.
+func rsvpSubscriber(sub seriesSubscriber, joinCode string) (int64, string, string, error) {
+	participantId, status, token, err := addParticipant(joinCode, sub.userUUID)
+	if err != nil {
+		return 0, "", "", err
+	}
+	if err := recordWaiverSignature(sub.userUUID, joinCode, sub.userAgent, sub.ipAddress); err != nil {
+		log.Printf("Error inserting waiver signature: %v. User: %s, Hike: %s", err, sub.userUUID, joinCode)
+	}
+	logAction(fmt.Sprintf("Series subscriber %s RSVPd to hike %s with status %s", sub.userUUID, joinCode, status))
+	return participantId, status, token, nil
+}
+
+// Create a new hike series, create its first occurrences and return codes for the series
+// and for each occurrence
+func createSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	var series HikeSeries
+	if err := json.NewDecoder(r.Body).Decode(&series); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t := series.Template
+
+	if t.Name == "" || t.Leader.UUID == "" || t.StartTime.IsZero() {
+		http.Error(w, "Series template requires a name, leader and start time", http.StatusBadRequest)
+		return
+	}
+	if t.MaxParticipants < 0 || t.DurationMinutes < 0 {
+		http.Error(w, "maxParticipants and durationMinutes cannot be negative", http.StatusBadRequest)
+		return
+	}
+	if err := validateTrailInfo(t.Difficulty, t.DistanceMiles, t.ElevationGainFeet, t.Hazards); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	organization, err := canonicalOrganization(t.Organization)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	t.Organization = organization
+	if err = applyTrailheadDefaults(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := parseRecurrence(series.Recurrence, t.StartTime); err != nil {
+		http.Error(w, "Invalid recurrence: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Later occurrences are checked as they're created
+	advisories, err := checkTrailheadOpen(db, t.TrailheadName, t.StartTime)
+	if _, isClosed := err.(*trailheadClosedError); isClosed {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	series.JoinCode, err = generateSecureLinkCode()
+	if err != nil {
+		http.Error(w, "Failed to generate join code", http.StatusInternalServerError)
+		return
+	}
+	series.LeaderCode, err = generateSecureLinkCode()
+	if err != nil {
+		http.Error(w, "Failed to generate leader code", http.StatusInternalServerError)
+		return
+	}
+
+	// Insert or update user (Leader) in the database
+	_, err = db.Exec(`
+		INSERT INTO users (uuid, name, phone)
+		VALUES (?, ?, ?)
+		ON CONFLICT(uuid) DO UPDATE SET name = excluded.name, phone = excluded.phone
+		`, t.Leader.UUID, t.Leader.Name, t.Leader.Phone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO hike_series (join_code, leader_code, recurrence, name, organization, trailhead_name, trailhead_map_link,
+		                         leader_uuid, start_time, photo_release, description, max_participants, duration_minutes,
+		                         public, difficulty, distance_miles, elevation_gain_feet, hazards, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, series.JoinCode, series.LeaderCode, series.Recurrence, t.Name, t.Organization, t.TrailheadName, t.TrailheadMapLink,
+		t.Leader.UUID, t.StartTime, t.PhotoRelease, t.DescriptionMarkdown, t.MaxParticipants, t.DurationMinutes,
+		t.Public, t.Difficulty, t.DistanceMiles, t.ElevationGainFeet, t.Hazards, time.Now().Format("2006-01-02T15:04:05-07:00"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	seriesId, err := result.LastInsertId()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := materializeSeries(seriesId, time.Now()); err != nil {
+		http.Error(w, "Error creating series occurrences: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, series, err = loadSeries("id", seriesId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	series.Occurrences, err = seriesOccurrences(seriesId, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	series.Template.Advisories = advisories
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(series)
+	logAction(fmt.Sprintf("Hike series created: %s (%s) by %s, first occurrence %s", t.Name, series.Recurrence, t.Leader.Name, t.StartTime.Format(time.RFC3339)))
+}
+
+// Get series details and its upcoming occurrences by join code, or by leaderCode to include leader codes
+func getSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	joinCode := r.PathValue("seriesId")
+	leaderCode := r.URL.Query().Get("leaderCode")
+
+	var seriesId int64
+	var series HikeSeries
+	var err error
+	if leaderCode != "" {
+		seriesId, series, err = loadSeries("leader_code", leaderCode)
+	} else {
+		seriesId, series, err = loadSeries("join_code", joinCode)
+		series.LeaderCode = ""
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Hike series not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	series.Occurrences, err = seriesOccurrences(seriesId, leaderCode != "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(series)
+}
+
+// updateSeriesHandler edits the whole series. The changes apply to the template and to every
+// upcoming occurrence that hasn't been edited on its own; a new start time only changes the
+// time of day. Setting status to 'closed' ends the series so no more occurrences are created.
+func updateSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	leaderCode := r.PathValue("leaderCode")
+
+	var update HikeSeries
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	t := update.Template
+	if t.Leader.UUID == "" {
+		http.Error(w, "Leader UUID is required in the request body", http.StatusBadRequest)
+		return
+	}
+	if t.MaxParticipants < 0 || t.DurationMinutes < 0 {
+		http.Error(w, "maxParticipants and durationMinutes cannot be negative", http.StatusBadRequest)
+		return
+	}
+	if err := validateTrailInfo(t.Difficulty, t.DistanceMiles, t.ElevationGainFeet, t.Hazards); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	organization, err := canonicalOrganization(t.Organization)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	t.Organization = organization
+	if err = applyTrailheadDefaults(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	seriesId, current, err := loadSeries("leader_code", leaderCode)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Hike series not found for the given leader code", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if update.Recurrence != "" && update.Recurrence != current.Recurrence {
+		http.Error(w, "The recurrence of a series can't be changed; end this series and start a new one", http.StatusBadRequest)
+		return
+	}
+	if update.Status == "" {
+		update.Status = current.Status
+	}
+
+	// Keep the date of the first occurrence and take the time of day from the update
+	dtstart := current.Template.StartTime
+	if !t.StartTime.IsZero() {
+		hour, min, sec := t.StartTime.In(dtstart.Location()).Clock()
+		dtstart = time.Date(dtstart.Year(), dtstart.Month(), dtstart.Day(), hour, min, sec, 0, dtstart.Location())
+	}
+	rule, err := parseRecurrence(current.Recurrence, dtstart)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to start transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback() // Rollback if not committed
+
+	_, err = tx.Exec(`
+		INSERT INTO users (uuid, name, phone)
+		VALUES (?, ?, ?)
+		ON CONFLICT(uuid) DO UPDATE SET name = excluded.name, phone = excluded.phone
+	`, t.Leader.UUID, t.Leader.Name, t.Leader.Phone)
+	if err != nil {
+		http.Error(w, "Error updating leader details in users table: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE hike_series
+		SET name = ?, organization = ?, trailhead_name = ?, trailhead_map_link = ?, start_time = ?, photo_release = ?,
+		    description = ?, leader_uuid = ?, max_participants = ?, duration_minutes = ?, public = ?, difficulty = ?,
+		    distance_miles = ?, elevation_gain_feet = ?, hazards = ?, status = ?
+		WHERE id = ?
+	`, t.Name, t.Organization, t.TrailheadName, t.TrailheadMapLink, dtstart, t.PhotoRelease,
+		t.DescriptionMarkdown, t.Leader.UUID, t.MaxParticipants, t.DurationMinutes, t.Public, t.Difficulty,
+		t.DistanceMiles, t.ElevationGainFeet, t.Hazards, update.Status, seriesId)
+	if err != nil {
+		http.Error(w, "Error updating hike series: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Find the upcoming occurrences that still follow the series
+	rows, err := tx.Query(`
+		SELECT join_code, series_index, start_time FROM hikes
+		WHERE series_id = ? AND status = 'open' AND NOT series_override
+		ORDER BY series_index
+	`, seriesId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	type occurrence struct {
+		joinCode  string
+		index     int
+		startTime time.Time
+		promoted  []int64
+	}
+	var upcoming []occurrence
+	var latest time.Time
+	now := time.Now()
+	for rows.Next() {
+		var o occurrence
+		if err := rows.Scan(&o.joinCode, &o.index, &o.startTime); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if o.startTime.After(now) {
+			upcoming = append(upcoming, o)
+			if o.startTime.After(latest) {
+				latest = o.startTime
+			}
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A change to the time of day can move an occurrence by at most a day
+	startTimes := rule.occurrences(dtstart, latest.Add(48*time.Hour))
+	var promoted []int64
+	var advisories []TrailheadAdvisory
+	for i := range upcoming {
+		o := &upcoming[i]
+		startTime := o.startTime
+		if o.index < len(startTimes) {
+			startTime = startTimes[o.index]
+		}
+
+		// An occurrence moved to another trailhead, or another time, is checked for closures
+		// there and then, the same as a hike edited on its own
+		if update.Status != "closed" && (t.TrailheadName != current.Template.TrailheadName || !startTime.Equal(o.startTime)) {
+			occurrenceAdvisories, err := checkTrailheadOpen(tx, t.TrailheadName, startTime)
+			if _, isClosed := err.(*trailheadClosedError); isClosed {
+				http.Error(w, fmt.Sprintf("The occurrence on %s can't be moved: %v", startTime.Format("2006-01-02"), err), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if i == 0 {
+				advisories = occurrenceAdvisories
+			}
+		}
+		_, err = tx.Exec(`
+			UPDATE hikes
+			SET name = ?, organization = ?, trailhead_name = ?, trailhead_map_link = ?, start_time = ?, photo_release = ?,
+			    description = ?, leader_uuid = ?, max_participants = ?, duration_minutes = ?, public = ?, difficulty = ?,
+			    distance_miles = ?, elevation_gain_feet = ?, hazards = ?, version = version + 1, updated_at = ?
+			WHERE join_code = ?
+		`, t.Name, t.Organization, t.TrailheadName, t.TrailheadMapLink, startTime, t.PhotoRelease,
+			t.DescriptionMarkdown, t.Leader.UUID, t.MaxParticipants, t.DurationMinutes, t.Public, t.Difficulty,
+			t.DistanceMiles, t.ElevationGainFeet, t.Hazards, time.Now().Format("2006-01-02T15:04:05-07:00"), o.joinCode)
+		if err != nil {
+			http.Error(w, "Error updating series occurrence: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Raising or removing the cap may free up spots for people on the waitlist
+		o.promoted, err = promoteFromWaitlist(tx, o.joinCode)
+		if err != nil {
+			http.Error(w, "Error promoting waitlisted participants: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		promoted = append(promoted, o.promoted...)
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, "Failed to commit transaction: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, o := range upcoming {
+		hikeEvents.publish(o.joinCode, eventHike, 0, "open")
+		publishPromotions(o.joinCode, o.promoted)
+	}
+	if len(promoted) > 0 {
+		logAction(fmt.Sprintf("Hike series %s promoted %d participant(s) from the waitlist: %v", current.JoinCode, len(promoted), promoted))
+	}
+
+	_, series, err := loadSeries("id", seriesId)
+	if err != nil {
+		http.Error(w, "Error fetching updated hike series: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	series.Occurrences, err = seriesOccurrences(seriesId, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	series.Template.Advisories = advisories
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(series)
+	logAction(fmt.Sprintf("Hike series updated: %s (LeaderCode: %s), %d upcoming occurrence(s) changed", series.Template.Name, leaderCode, len(upcoming)))
+}
+
+// subscribeToSeriesHandler subscribes a user to a series: they are RSVPd to every upcoming
+// occurrence they haven't already joined and to each new occurrence as it is created.
+// The returned occurrences carry the subscriber's participant id and status for each hike.
+func subscribeToSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	joinCode := r.PathValue("seriesId")
+
+	var user User
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(user.Dependents) > 0 {
+		http.Error(w, "Dependents can't be subscribed to a series; RSVP them to each hike instead", http.StatusBadRequest)
+		return
+	}
+
+	seriesId, series, err := loadSeries("join_code", joinCode)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Hike series not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	series.LeaderCode = ""
+	if series.Status != "open" {
+		http.Error(w, "Hike series has ended", http.StatusBadRequest)
+		return
+	}
+
+	// Only the subscriber can subscribe again and get their token back
+	err = db.QueryRow("SELECT id, COALESCE(subscription_token, '') FROM series_subscriptions WHERE series_id = ? AND user_uuid = ?", seriesId, user.UUID).Scan(&series.SubscriptionId, &series.SubscriptionToken)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if series.SubscriptionId != 0 && r.URL.Query().Get("subscriptionToken") != series.SubscriptionToken {
+		http.Error(w, "Already subscribed to this hike series; subscribing again requires the subscriptionToken", http.StatusForbidden)
+		return
+	}
+	if series.SubscriptionId == 0 {
+		if series.SubscriptionToken, err = generateSecureLinkCode(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Insert or update user in the database. Someone already RSVPd to an occurrence changes their
+	// details by RSVPing to it again with their participantToken.
+	var onOccurrence bool
+	err = db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM hike_users hu JOIN hikes h ON hu.hike_join_code = h.join_code WHERE h.series_id = ? AND hu.user_uuid = ?)
+	`, seriesId, user.UUID).Scan(&onOccurrence)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	upsertUser := "INSERT OR REPLACE"
+	if onOccurrence {
+		upsertUser = "INSERT OR IGNORE"
+	}
+	_, err = db.Exec(upsertUser+` INTO users (uuid, name, phone, license_plate, emergency_contact)
+		VALUES (?, ?, ?, ?, ?)
+		`, user.UUID, user.Name, user.Phone, user.LicensePlate, user.EmergencyContact)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sub := seriesSubscriber{userUUID: user.UUID, userAgent: r.UserAgent(), ipAddress: clientIPAddress(r)}
+	_, err = db.Exec(`
+		INSERT INTO series_subscriptions (series_id, user_uuid, user_agent, ip_address, subscription_token)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(series_id, user_uuid) DO UPDATE SET user_agent = excluded.user_agent, ip_address = excluded.ip_address
+	`, seriesId, sub.userUUID, sub.userAgent, sub.ipAddress, series.SubscriptionToken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = db.QueryRow("SELECT id FROM series_subscriptions WHERE series_id = ? AND user_uuid = ?", seriesId, user.UUID).Scan(&series.SubscriptionId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	occurrences, err := seriesOccurrences(seriesId, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range occurrences {
+		o := &occurrences[i]
+		if !o.StartTime.After(time.Now()) {
+			continue
+		}
+		// Leave existing RSVPs to individual occurrences as they are. Their tokens were handed out
+		// when they RSVPd and aren't given out again.
+		err := db.QueryRow("SELECT id, status FROM hike_users WHERE hike_join_code = ? AND user_uuid = ?", o.JoinCode, user.UUID).Scan(&o.ParticipantId, &o.ParticipantStatus)
+		if err == nil {
+			continue
+		}
+		if err != sql.ErrNoRows {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		o.ParticipantId, o.ParticipantStatus, o.ParticipantToken, err = rsvpSubscriber(sub, o.JoinCode)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	series.Occurrences = occurrences
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(series)
+	logAction(fmt.Sprintf("Participant subscribed to hike series: %s (Series Join Code: %s)", user.Name, joinCode))
+}
+
+// unsubscribeFromSeriesHandler stops RSVPing the subscriber to new occurrences. RSVPs to
+// occurrences that already exist are kept; they can be removed one at a time. Requires the
+// subscriptionToken issued when they subscribed, or the series leaderCode.
+func unsubscribeFromSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	joinCode := r.PathValue("seriesId")
+	subscriptionId, err := parseInt64(r.PathValue("subscriptionId"))
+	if err != nil {
+		http.Error(w, "Invalid subscription ID format", http.StatusBadRequest)
+		return
+	}
+	token := r.URL.Query().Get("subscriptionToken")
+	leaderCode := r.URL.Query().Get("leaderCode")
+	if token == "" && leaderCode == "" {
+		http.Error(w, "A subscriptionToken or leaderCode is required", http.StatusUnauthorized)
+		return
+	}
+
+	var subscriptionToken, seriesLeaderCode string
+	err = db.QueryRow(`
+		SELECT COALESCE(ss.subscription_token, ''), s.leader_code
+		FROM series_subscriptions ss JOIN hike_series s ON ss.series_id = s.id
+		WHERE ss.id = ? AND s.join_code = ?
+	`, subscriptionId, joinCode).Scan(&subscriptionToken, &seriesLeaderCode)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Subscription not found for this hike series", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if (token == "" || token != subscriptionToken) && (leaderCode == "" || leaderCode != seriesLeaderCode) {
+		http.Error(w, "The subscriptionToken or leaderCode is not for this subscription", http.StatusForbidden)
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM series_subscriptions WHERE id = ?", subscriptionId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	logAction(fmt.Sprintf("Subscription %d removed from hike series %s", subscriptionId, joinCode))
+}
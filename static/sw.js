@@ -1,4 +1,4 @@
-const CACHE_NAME = 'hike-tracker-cache-v1';
+const CACHE_NAME = 'hike-tracker-cache-v2';
 const CORE_ASSETS = [
   '/index.html',
   '/favicon.ico',
@@ -52,6 +52,11 @@ self.addEventListener('activate', event => {
 self.addEventListener('fetch', event => {
   const url = new URL(event.request.url);
 
+  // Leave live event streams to the browser; they never finish, so they can't be cached
+  if (event.request.headers.get('Accept') === 'text/event-stream') {
+    return;
+  }
+
   // Serve core assets from cache first
   if (CORE_ASSETS.includes(url.pathname)) {
     console.log('Service Worker: Serving core asset (cache-first):', event.request.url);
@@ -73,6 +78,11 @@ self.addEventListener('fetch', event => {
       })
     );
   }
+  // Changes sent with an Idempotency-Key are queued if the network is down and replayed later;
+  // the key makes it safe to send them again if the first attempt did reach the server
+  else if (url.pathname.startsWith('/api/') && event.request.method !== 'GET' && event.request.headers.has('Idempotency-Key')) {
+    event.respondWith(sendOrQueue(event.request));
+  }
   // Network-first strategy for API calls
   else if (url.pathname.startsWith('/api/')) {
     console.log('Service Worker: API call (network-first):', event.request.url);
@@ -122,5 +132,97 @@ self.addEventListener('fetch', event => {
   }
 });
 
-// Sync event listener for 'hike-data-sync' was removed as the client-side queuing mechanism
-// that triggered it has been removed.
+// Offline mutation queue. Requests are kept in IndexedDB in the order they were made and
+// replayed in that order by Background Sync, or when a page tells us it is back online in
+// browsers without Background Sync.
+const QUEUE_DB_NAME = 'hike-tracker-queue';
+const QUEUE_STORE = 'requests';
+const SYNC_TAG = 'hike-data-sync';
+
+function openQueue() {
+  return new Promise((resolve, reject) => {
+    const open = indexedDB.open(QUEUE_DB_NAME, 1);
+    open.onupgradeneeded = () => open.result.createObjectStore(QUEUE_STORE, { keyPath: 'id', autoIncrement: true });
+    open.onsuccess = () => resolve(open.result);
+    open.onerror = () => reject(open.error);
+  });
+}
+
+// Runs fn against the request store and resolves with the result once the transaction is done
+function withQueue(mode, fn) {
+  return openQueue().then(db => new Promise((resolve, reject) => {
+    const tx = db.transaction(QUEUE_STORE, mode);
+    const request = fn(tx.objectStore(QUEUE_STORE));
+    tx.oncomplete = () => resolve(request.result);
+    tx.onerror = () => reject(tx.error);
+  }));
+}
+
+async function sendOrQueue(request) {
+  const copy = request.clone();
+  try {
+    return await fetch(request);
+  } catch (error) {
+    console.warn('Service Worker: Offline, queuing request:', request.method, request.url);
+    const body = await copy.text();
+    await withQueue('readwrite', store => store.add({
+      url: copy.url,
+      method: copy.method,
+      headers: {
+        'Content-Type': copy.headers.get('Content-Type') || 'application/json',
+        'Idempotency-Key': copy.headers.get('Idempotency-Key'),
+      },
+      body,
+      queuedAt: new Date().toISOString(),
+    }));
+    if (self.registration.sync) {
+      self.registration.sync.register(SYNC_TAG).catch(err => console.error('Service Worker: Background sync registration failed:', err));
+    }
+    await notifyQueueLength(0);
+    return new Response(JSON.stringify({ queued: true }), {
+      status: 202,
+      headers: { 'Content-Type': 'application/json', 'X-Queued-Offline': 'true' },
+    });
+  }
+}
+
+// Sends queued requests oldest first. Stops at the first one that can't be sent so they stay
+// in order; it throws so Background Sync tries again later.
+async function replayQueue() {
+  const queued = await withQueue('readonly', store => store.getAll());
+  let replayed = 0;
+  try {
+    for (const item of queued) {
+      const response = await fetch(item.url, { method: item.method, headers: item.headers, body: item.body || undefined });
+      // Server errors aren't stored against the key, so the request can be tried again
+      if (response.status >= 500) {
+        throw new Error(`Server error ${response.status} replaying ${item.method} ${item.url}`);
+      }
+      if (!response.ok) {
+        console.warn('Service Worker: Queued request was rejected:', item.method, item.url, response.status);
+      }
+      await withQueue('readwrite', store => store.delete(item.id));
+      replayed++;
+    }
+  } finally {
+    await notifyQueueLength(replayed);
+  }
+}
+
+async function notifyQueueLength(replayed) {
+  const pending = await withQueue('readonly', store => store.count());
+  const clients = await self.clients.matchAll();
+  clients.forEach(client => client.postMessage({ type: 'queue', pending, replayed }));
+}
+
+self.addEventListener('sync', event => {
+  if (event.tag === SYNC_TAG) {
+    event.waitUntil(replayQueue());
+  }
+});
+
+self.addEventListener('message', event => {
+  if (event.data && event.data.type === 'replay-queue') {
+    event.waitUntil(replayQueue().catch(error => console.warn('Service Worker: Queue replay stopped:', error)));
+  }
+});
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A participant's hike_users.status moves through a fixed set of states. The usual path is
+// rsvp → active → finished. Before that a participant may sit on the waitlist, someone who
+// never turns up is a no_show, someone who turns back early has dropped_out, and someone
+// still out past the expected return time is overdue.
+//
+// Who may make each move depends on the actor. Participants check themselves in and out,
+// leaders (and co-leaders and sweeps) can do that for them and correct mistakes, and the
+// system handles the waitlist, overdue hikers and closing the hike.
+
+const (
+	actorParticipant = "participant"
+	actorLeader      = "leader"
+	actorSystem      = "system"
+)
+
+var participantStatuses = []string{"waitlist", "rsvp", "active", "finished", "overdue", "no_show", "dropped_out"}
+
+// statusTransitions lists, per actor, the statuses each status may move to
+var statusTransitions = map[string]map[string][]string{
+	actorParticipant: {
+		"rsvp":    {"active"},
+		"active":  {"finished", "dropped_out"},
+		"overdue": {"finished", "dropped_out"},
+	},
+	actorLeader: {
+		"rsvp":        {"active", "no_show"},
+		"active":      {"finished", "dropped_out"},
+		"overdue":     {"active", "finished", "dropped_out"},
+		"finished":    {"active"},
+		"no_show":     {"rsvp", "active"},
+		"dropped_out": {"active", "finished"},
+	},
+	actorSystem: {
+		"waitlist": {"rsvp"},
+		"rsvp":     {"finished"},
+		"active":   {"finished", "overdue"},
+		"overdue":  {"finished"},
+	},
+}
+
+// StatusChange is one entry in a participant's status history
+type StatusChange struct {
+	FromStatus string    `json:"fromStatus"` // Empty for the participant's first status
+	ToStatus   string    `json:"toStatus"`
+	Actor      string    `json:"actor"` // participant, system, or the role of the leader who made the change
+	ChangedAt  time.Time `json:"changedAt"`
+}
+
+// statusTransitionError is returned for a status change the actor isn't allowed to make
+type statusTransitionError struct {
+	from, to, actor string
+}
+
+func (e *statusTransitionError) Error() string {
+	if !isParticipantStatus(e.to) {
+		return fmt.Sprintf("Unknown status '%s'; must be one of '%s'", e.to, strings.Join(participantStatuses, "', '"))
+	}
+	allowed := statusTransitions[statusActorClass(e.actor)][e.from]
+	if len(allowed) == 0 {
+		return fmt.Sprintf("A %s can't change a participant's status from '%s'", e.actor, e.from)
+	}
+	return fmt.Sprintf("A %s can't change a participant's status from '%s' to '%s'; it can only be changed to '%s'",
+		e.actor, e.from, e.to, strings.Join(allowed, "', '"))
+}
+
+// statusActorClass maps an actor to the set of transition rules it follows. Every hike role
+// that can update participants follows the leader's rules.
+func statusActorClass(actor string) string {
+	if actor == actorParticipant || actor == actorSystem {
+		return actor
+	}
+	return actorLeader
+}
+
+func isParticipantStatus(status string) bool {
+	for _, s := range participantStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// checkStatusTransition returns a *statusTransitionError describing why the actor can't move
+// a participant from one status to another, or nil if it can
+func checkStatusTransition(from, to, actor string) error {
+	for _, allowed := range statusTransitions[statusActorClass(actor)][from] {
+		if allowed == to {
+			return nil
+		}
+	}
+	return &statusTransitionError{from: from, to: to, actor: actor}
+}
+
+// recordStatusChange adds a transition to a participant's status history
+func recordStatusChange(exec sqlExecutor, participantId int64, joinCode, from, to, actor string) error {
+	_, err := exec.Exec(`
+		INSERT INTO participant_status_history (hike_user_id, hike_join_code, from_status, to_status, actor, changed_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, participantId, joinCode, from, to, actor, time.Now().Format("2006-01-02T15:04:05-07:00"))
+	return err
+}
+
+var errHikeNotOpen = fmt.Errorf("Hike not found or not open")
+var errHikeFull = fmt.Errorf("The hike is full; raise its cap to bring this participant back")
+
+// transitionParticipantStatus moves a participant on an open hike to a new status if the actor
+// is allowed to, and records the change. It returns sql.ErrNoRows if the participant isn't on
+// the hike, errHikeNotOpen if the hike has ended, a *statusTransitionError if the change
+// isn't allowed, and errHikeFull if it would put them back in a spot the hike doesn't have.
+func transitionParticipantStatus(tx *sql.Tx, joinCode string, participantId int64, to, actor string) (string, error) {
+	var from, hikeStatus, userUUID string
+	err := tx.QueryRow(`
+		SELECT hu.status, h.status, hu.user_uuid FROM hike_users hu JOIN hikes h ON hu.hike_join_code = h.join_code
+		WHERE hu.id = ? AND hu.hike_join_code = ?
+	`, participantId, joinCode).Scan(&from, &hikeStatus, &userUUID)
+	if err != nil {
+		return "", err
+	}
+	if hikeStatus != "open" {
+		return from, errHikeNotOpen
+	}
+	if err := checkStatusTransition(from, to, actor); err != nil {
+		return from, err
+	}
+	// A no-show or someone who dropped out gave up their spot, which may have gone to the waitlist
+	if !holdsSpot(from) && holdsSpot(to) {
+		open, err := hasOpenSpot(tx, joinCode, userUUID)
+		if err != nil {
+			return from, err
+		}
+		if !open {
+			return from, errHikeFull
+		}
+	}
+
+	_, err = tx.Exec("UPDATE hike_users SET status = ? WHERE id = ?", to, participantId)
+	if err != nil {
+		return from, err
+	}
+	return from, recordStatusChange(tx, participantId, joinCode, from, to, actor)
+}
+
+// Return a participant's status history, oldest first. Requires a leaderCode that can view the roster.
+func getParticipantStatusHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	access, ok := requireHikeAccess(w, r, permViewRoster)
+	if !ok {
+		return
+	}
+	participantId, err := parseInt64(r.PathValue("participantId"))
+	if err != nil {
+		http.Error(w, "Invalid participant ID format", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT from_status, to_status, actor, changed_at
+		FROM participant_status_history
+		WHERE hike_user_id = ? AND hike_join_code = ?
+		ORDER BY id
+	`, participantId, access.joinCode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	history := []StatusChange{}
+	for rows.Next() {
+		var change StatusChange
+		if err := rows.Scan(&change.FromStatus, &change.ToStatus, &change.Actor, &change.ChangedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		history = append(history, change)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
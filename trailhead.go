@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Trailheads have a latitude and longitude when they're known, so participants can find the
+// trailheads, and so the hikes, near them. Map links that are short links don't say where they
+// point, so those trailheads have no coordinates until someone sets them.
+
+const (
+	kmPerMile           = 1.609344
+	defaultNearRadiusKm = 25.0
+	maxNearRadiusKm     = 500.0
+	defaultNearLimit    = 20
+	kmPerDegreeLatitude = 111.0
+	maxNearbyTrailheads = 100
+)
+
+// mapLinkCoordinates reads the latitude and longitude from a map link such as
+// https://www.google.com/maps/search/?api=1&query=21.34992,-157.87685
+func mapLinkCoordinates(link string) (lat, lng float64, ok bool) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return 0, 0, false
+	}
+	for _, param := range []string{"query", "q", "ll"} {
+		parts := strings.Split(u.Query().Get(param), ",")
+		if len(parts) != 2 {
+			continue
+		}
+		lat, errLat := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		lng, errLng := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if errLat == nil && errLng == nil && validCoordinates(lat, lng) {
+			return lat, lng, true
+		}
+	}
+	return 0, 0, false
+}
+
+func validCoordinates(lat, lng float64) bool {
+	return lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180
+}
+
+// trailheadCoordinates returns the coordinates to store for a trailhead's map link, NULL if unknown
+func trailheadCoordinates(mapLink string) (lat, lng interface{}) {
+	if la, ln, ok := mapLinkCoordinates(mapLink); ok {
+		return la, ln
+	}
+	return nil, nil
+}
+
+// NearbyTrailhead is a trailhead and how far it is from where the participant is
+type NearbyTrailhead struct {
+	Trailhead
+	DistanceKm float64 `json:"distanceKm"`
+}
+
+// Find the trailheads within radiusKm (default 25) of lat and lng, nearest first.
+// limit caps how many are returned (default 20).
+func nearbyTrailheadsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	lat, errLat := strconv.ParseFloat(query.Get("lat"), 64)
+	lng, errLng := strconv.ParseFloat(query.Get("lng"), 64)
+	if errLat != nil || errLng != nil || !validCoordinates(lat, lng) {
+		http.Error(w, "lat and lng must be a valid latitude and longitude", http.StatusBadRequest)
+		return
+	}
+	radiusKm := defaultNearRadiusKm
+	if s := query.Get("radiusKm"); s != "" {
+		var err error
+		radiusKm, err = strconv.ParseFloat(s, 64)
+		if err != nil || radiusKm <= 0 || radiusKm > maxNearRadiusKm {
+			http.Error(w, "radiusKm must be a number of kilometers up to 500", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultNearLimit
+	if s := query.Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > maxNearbyTrailheads {
+			http.Error(w, "limit must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Narrow down to a band of latitude in SQL; the exact distance is worked out below
+	latDelta := radiusKm / kmPerDegreeLatitude
+	rows, err := db.Query(`
+		SELECT name, map_link, latitude, longitude, distance_miles, elevation_gain_feet, duration_minutes, difficulty, hazards
+		FROM trailheads
+		WHERE latitude BETWEEN ? AND ? AND longitude IS NOT NULL AND retired_at IS NULL
+	`, lat-latDelta, lat+latDelta)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	nearby := []NearbyTrailhead{}
+	for rows.Next() {
+		var th NearbyTrailhead
+		if err := rows.Scan(&th.Name, &th.MapLink, &th.Latitude, &th.Longitude, &th.DistanceMiles, &th.ElevationGainFeet, &th.DurationMinutes, &th.Difficulty, &th.Hazards); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		miles := haversineMiles(routeCoordinate{lng, lat}, routeCoordinate{*th.Longitude, *th.Latitude})
+		th.DistanceKm = math.Round(miles*kmPerMile*100) / 100
+		if th.DistanceKm <= radiusKm {
+			nearby = append(nearby, th)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sort.SliceStable(nearby, func(i, j int) bool {
+		return nearby[i].DistanceKm < nearby[j].DistanceKm
+	})
+	if len(nearby) > limit {
+		nearby = nearby[:limit]
+	}
+	for i := range nearby {
+		if nearby[i].Advisories, err = trailheadAdvisories(db, nearby[i].Name, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(nearby)
+}
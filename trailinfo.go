@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+)
+
+// Besides the free-form description, hikes and trailheads carry structured trail information:
+// distance, elevation gain, expected duration, difficulty and hazards. A trailhead's values are
+// defaults; a new hike at that trailhead takes any it doesn't set itself.
+
+const (
+	hazardStreamCrossing = "stream-crossing"
+	hazardExposure       = "exposure" // Narrow ridges and drop-offs
+	hazardMud            = "mud"
+	hazardRockfall       = "rockfall"
+	hazardFlashFlood     = "flash-flood"
+)
+
+var knownHazards = []string{hazardStreamCrossing, hazardExposure, hazardMud, hazardRockfall, hazardFlashFlood}
+
+// Hazards is a list of hazards on a trail, stored as a comma-separated string
+type Hazards []string
+
+func (h Hazards) Value() (driver.Value, error) {
+	return strings.Join(h, ","), nil
+}
+
+func (h *Hazards) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into Hazards", src)
+	}
+	*h = nil
+	if s != "" {
+		*h = strings.Split(s, ",")
+	}
+	return nil
+}
+
+// Has reports whether the trail has the hazard
+func (h Hazards) Has(hazard string) bool {
+	for _, x := range h {
+		if x == hazard {
+			return true
+		}
+	}
+	return false
+}
+
+// validateHazard checks a hazard is one the app knows about
+func validateHazard(hazard string) error {
+	for _, known := range knownHazards {
+		if hazard == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("hazards must be among %s", strings.Join(knownHazards, ", "))
+}
+
+// validateTrailInfo checks the trail information on a hike, series template or trailhead
+func validateTrailInfo(difficulty string, distanceMiles float64, elevationGainFeet int, hazards Hazards) error {
+	if err := validateDifficulty(difficulty); err != nil {
+		return err
+	}
+	if distanceMiles < 0 || elevationGainFeet < 0 {
+		return fmt.Errorf("distanceMiles and elevationGainFeet cannot be negative")
+	}
+	for _, hazard := range hazards {
+		if err := validateHazard(hazard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyTrailheadDefaults fills in the trail information a new hike leaves unset from its
+// trailhead in the trailheads table, if there is one. The trailhead may be under a name it
+// had before being renamed.
+func applyTrailheadDefaults(hike *Hike) error {
+	var th Trailhead
+	err := db.QueryRow(`
+		SELECT distance_miles, elevation_gain_feet, duration_minutes, difficulty, hazards
+		FROM trailheads
+		WHERE name = ? OR name = (SELECT trailhead_name FROM trailhead_aliases WHERE alias = ?)
+		LIMIT 1
+	`, hike.TrailheadName, hike.TrailheadName).Scan(&th.DistanceMiles, &th.ElevationGainFeet, &th.DurationMinutes, &th.Difficulty, &th.Hazards)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if hike.DistanceMiles == 0 {
+		hike.DistanceMiles = th.DistanceMiles
+	}
+	if hike.ElevationGainFeet == 0 {
+		hike.ElevationGainFeet = th.ElevationGainFeet
+	}
+	if hike.DurationMinutes == 0 {
+		hike.DurationMinutes = th.DurationMinutes
+	}
+	if hike.Difficulty == "" {
+		hike.Difficulty = th.Difficulty
+	}
+	if len(hike.Hazards) == 0 {
+		hike.Hazards = th.Hazards
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"database/sql"
+)
+
+// A hike with max_participants > 0 is capped. Everyone in hike_users who is coming, or has
+// come, holds one of the spots: rsvp, active, finished and overdue. No-shows and those who
+// dropped out give theirs up, and the waitlist is served in join order.
+
+// holdsSpot reports whether a participant with the status takes up one of a hike's spots
+func holdsSpot(status string) bool {
+	switch status {
+	case "rsvp", "active", "finished", "overdue":
+		return true
+	}
+	return false
+}
+
+// hasOpenSpot reports whether a capped hike has room for one more participant.
+// excludeUserUUID lets a participant who is re-RSVPing not count against themselves.
+func hasOpenSpot(tx *sql.Tx, joinCode string, excludeUserUUID string) (bool, error) {
+	var maxParticipants, taken int
+	err := tx.QueryRow("SELECT max_participants FROM hikes WHERE join_code = ?", joinCode).Scan(&maxParticipants)
+	if err != nil {
+		return false, err
+	}
+	if maxParticipants <= 0 {
+		return true, nil
+	}
+
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM hike_users
+		WHERE hike_join_code = ? AND status IN ('rsvp', 'active', 'finished', 'overdue') AND user_uuid != ?
+	`, joinCode, excludeUserUUID).Scan(&taken)
+	if err != nil {
+		return false, err
+	}
+	return taken < maxParticipants, nil
+}
+
+// promoteFromWaitlist moves waitlisted participants to 'rsvp', earliest first, for as long
+// as the hike has open spots. It returns the participant ids that were promoted.
+func promoteFromWaitlist(tx *sql.Tx, joinCode string) ([]int64, error) {
+	var promoted []int64
+	for {
+		open, err := hasOpenSpot(tx, joinCode, "")
+		if err != nil {
+			return promoted, err
+		}
+		if !open {
+			return promoted, nil
+		}
+
+		var participantId int64
+		err = tx.QueryRow(`
+			SELECT id FROM hike_users
+			WHERE hike_join_code = ? AND status = 'waitlist'
+			ORDER BY joined_at, id
+			LIMIT 1
+		`, joinCode).Scan(&participantId)
+		if err == sql.ErrNoRows {
+			return promoted, nil
+		}
+		if err != nil {
+			return promoted, err
+		}
+
+		_, err = tx.Exec("UPDATE hike_users SET status = 'rsvp' WHERE id = ?", participantId)
+		if err != nil {
+			return promoted, err
+		}
+		if err = recordStatusChange(tx, participantId, joinCode, "waitlist", "rsvp", actorSystem); err != nil {
+			return promoted, err
+		}
+		promoted = append(promoted, participantId)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// defaultWaiverTemplate is the waiver every hike used before organizations had their own.
+// It is published as version 1 of the default template when the database is created.
+//
+//go:embed static/waiver.txt
+var defaultWaiverTemplate string
+
+// WaiverTemplate is one published version of an organization's waiver. Body is a text/template
+// filled in with WaiverData. Templates are never edited; a change is published as a new version.
+type WaiverTemplate struct {
+	Id           int64     `json:"id"`
+	Organization string    `json:"organization"` // Empty for the default, used when an organization has no template of its own
+	Version      int       `json:"version"`
+	Body         string    `json:"body"`
+	EffectiveAt  time.Time `json:"effectiveAt"`
+	PublishedAt  time.Time `json:"publishedAt"`
+}
+
+// effectiveWaiverTemplate returns the latest version of the organization's waiver that is in
+// effect at the given time, falling back to the default template
+func effectiveWaiverTemplate(organization string, at time.Time) (WaiverTemplate, error) {
+	rows, err := db.Query(`
+		SELECT id, organization, version, body, effective_at, published_at
+		FROM waiver_templates
+		WHERE organization = ? OR organization = ''
+		ORDER BY organization = '', version DESC
+	`, strings.TrimSpace(organization))
+	if err != nil {
+		return WaiverTemplate{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var wt WaiverTemplate
+		if err := rows.Scan(&wt.Id, &wt.Organization, &wt.Version, &wt.Body, &wt.EffectiveAt, &wt.PublishedAt); err != nil {
+			return WaiverTemplate{}, err
+		}
+		if !wt.EffectiveAt.After(at) {
+			return wt, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return WaiverTemplate{}, err
+	}
+	return WaiverTemplate{}, sql.ErrNoRows
+}
+
+// Publish a new version of an organization's waiver. Requires the adminToken.
+func publishWaiverTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var request struct {
+		Organization string     `json:"organization"`
+		Body         string     `json:"body"`
+		EffectiveAt  *time.Time `json:"effectiveAt"` // Defaults to now
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(request.Body) == "" {
+		http.Error(w, "A waiver template body is required", http.StatusBadRequest)
+		return
+	}
+	if err := validateWaiverTemplate(request.Body, request.Organization); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	wt := WaiverTemplate{
+		Organization: strings.TrimSpace(request.Organization),
+		Body:         request.Body,
+		PublishedAt:  time.Now(),
+	}
+	wt.EffectiveAt = wt.PublishedAt
+	if request.EffectiveAt != nil {
+		wt.EffectiveAt = *request.EffectiveAt
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err = insertWaiverTemplate(tx, &wt); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(wt)
+	logAction(fmt.Sprintf("Waiver template version %d published for organization '%s', effective %s", wt.Version, wt.Organization, wt.EffectiveAt.Format(time.RFC3339)))
+}
+
+// validateWaiverTemplate parses a waiver template body and fills it in with sample data, to
+// catch mistakes now rather than when someone tries to RSVP
+func validateWaiverTemplate(body, organization string) error {
+	tmpl, err := template.New("waiver").Parse(body)
+	if err == nil {
+		err = tmpl.Execute(io.Discard, WaiverData{LeaderName: "Leader", Organization: organization, PhotoRelease: true})
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid waiver template: %v", err)
+	}
+	return nil
+}
+
+// insertWaiverTemplate publishes wt as the next version of its organization's waiver, setting
+// its Version and Id
+func insertWaiverTemplate(tx *sql.Tx, wt *WaiverTemplate) error {
+	err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) + 1 FROM waiver_templates WHERE organization = ?", wt.Organization).Scan(&wt.Version)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(`
+		INSERT INTO waiver_templates (organization, version, body, effective_at, published_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, wt.Organization, wt.Version, wt.Body, wt.EffectiveAt.Format("2006-01-02T15:04:05-07:00"), wt.PublishedAt.Format("2006-01-02T15:04:05-07:00"))
+	if err != nil {
+		return err
+	}
+	wt.Id, err = result.LastInsertId()
+	return err
+}
+
+// List every version of an organization's waiver, newest first. Requires the adminToken.
+func getWaiverTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT id, organization, version, body, effective_at, published_at
+		FROM waiver_templates
+		WHERE organization = ?
+		ORDER BY version DESC
+	`, strings.TrimSpace(r.URL.Query().Get("organization")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	templates := []WaiverTemplate{}
+	for rows.Next() {
+		var wt WaiverTemplate
+		if err := rows.Scan(&wt.Id, &wt.Organization, &wt.Version, &wt.Body, &wt.EffectiveAt, &wt.PublishedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		templates = append(templates, wt)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templates)
+}
+
+// signedWaiver is a participant's current waiver signature, the latest in the waiver log for
+// them and the hike, along with the hike and participant details printed on it
+type signedWaiver struct {
+	waiverRecord
+	ParticipantId   int64
+	ParticipantName string
+	HikeName        string
+	HikeStart       time.Time
+	// The template version signed; 0 for signatures made before templates were versioned
+	TemplateVersion      int
+	TemplateOrganization string
+	GuardianName         string // Set when a guardian signed on the participant's behalf
+}
+
+// signedWaivers returns the signed waivers of the participants on a hike, or of just one
+// participant if participantId isn't 0
+func signedWaivers(joinCode string, participantId int64) ([]signedWaiver, error) {
+	rows, err := db.Query(`
+		SELECT `+waiverRecordColumns+`, hu.id, u.name, h.name, h.start_time,
+		       COALESCE(wt.version, 0), COALESCE(wt.organization, ''), COALESCE(g.name, '')
+		FROM hike_users hu
+		JOIN users u ON hu.user_uuid = u.uuid
+		JOIN hikes h ON hu.hike_join_code = h.join_code
+		JOIN waiver_signatures ws
+		  ON ws.id = (SELECT MAX(id) FROM waiver_signatures
+		              WHERE user_uuid = hu.user_uuid AND hike_join_code = hu.hike_join_code)
+		LEFT JOIN waiver_templates wt ON ws.template_id = wt.id
+		LEFT JOIN users g ON ws.guardian_uuid = g.uuid
+		WHERE hu.hike_join_code = ? AND (? = 0 OR hu.id = ?)
+		ORDER BY hu.id
+	`, joinCode, participantId, participantId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var waivers []signedWaiver
+	for rows.Next() {
+		var sw signedWaiver
+		err := scanWaiverRecord(func(dest ...interface{}) error {
+			return rows.Scan(append(dest, &sw.ParticipantId, &sw.ParticipantName, &sw.HikeName, &sw.HikeStart,
+				&sw.TemplateVersion, &sw.TemplateOrganization, &sw.GuardianName)...)
+		}, &sw.waiverRecord)
+		if err != nil {
+			return nil, err
+		}
+		waivers = append(waivers, sw)
+	}
+	return waivers, rows.Err()
+}
+
+// Download a participant's signed waiver as a PDF. Requires a leaderCode that can view the roster.
+func getParticipantWaiverHandler(w http.ResponseWriter, r *http.Request) {
+	access, ok := requireHikeAccess(w, r, permViewRoster)
+	if !ok {
+		return
+	}
+	participantId, err := parseInt64(r.PathValue("participantId"))
+	if err != nil {
+		http.Error(w, "Invalid participant ID format", http.StatusBadRequest)
+		return
+	}
+
+	waivers, err := signedWaivers(access.joinCode, participantId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(waivers) == 0 {
+		http.Error(w, "No signed waiver found for this participant", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, waiverFileName(waivers[0])))
+	w.Write(waiverPDF(waivers[0]))
+	logAction(fmt.Sprintf("Waiver for participant %d on hike %s downloaded by %s", participantId, access.joinCode, access.role))
+}
+
+// Download every signed waiver for a hike as a zip of PDFs. Requires a leaderCode that can view the roster.
+func getHikeWaiversHandler(w http.ResponseWriter, r *http.Request) {
+	access, ok := requireHikeAccess(w, r, permViewRoster)
+	if !ok {
+		return
+	}
+
+	waivers, err := signedWaivers(access.joinCode, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var out bytes.Buffer
+	zw := zip.NewWriter(&out)
+	for _, sw := range waivers {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: waiverFileName(sw), Method: zip.Deflate, Modified: sw.SignedAt})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, err := fw.Write(waiverPDF(sw)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="waivers_%s.zip"`, access.joinCode))
+	w.Write(out.Bytes())
+	logAction(fmt.Sprintf("%d waivers for hike %s downloaded by %s", len(waivers), access.joinCode, access.role))
+}
+
+func (sw signedWaiver) templateLabel() string {
+	switch {
+	case sw.TemplateVersion == 0:
+		return "Not recorded"
+	case sw.TemplateOrganization == "":
+		return fmt.Sprintf("Default waiver, version %d", sw.TemplateVersion)
+	default:
+		return fmt.Sprintf("%s waiver, version %d", sw.TemplateOrganization, sw.TemplateVersion)
+	}
+}
+
+// waiverFileName names a waiver after the participant, keeping only characters that are
+// safe in a file name on any system
+func waiverFileName(sw signedWaiver) string {
+	var name strings.Builder
+	for _, r := range sw.ParticipantName {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+			name.WriteRune(r)
+		case r == ' ':
+			name.WriteByte('_')
+		}
+	}
+	return fmt.Sprintf("waiver_%s_%d_%s.pdf", sw.JoinCode, sw.ParticipantId, name.String())
+}
+
+// waiverPDF renders a signed waiver: the signature details first, then the waiver text the
+// participant agreed to. Every page carries the content hash in its footer.
+func waiverPDF(sw signedWaiver) []byte {
+	const (
+		margin     = 54.0
+		labelWidth = 110.0
+		lineHeight = 13.0
+		textSize   = 10.0
+		footerY    = pdfLetterHeight - 30
+		bodyBottom = footerY - 24
+	)
+	hash := sw.ContentHash()
+	valueWidth := pdfLetterWidth - 2*margin - labelWidth
+
+	type detail struct{ label, value string }
+	details := []detail{
+		{"Hike", sw.HikeName},
+		{"Hike Date", sw.HikeStart.Format("Mon Jan 2, 2006 3:04 PM")},
+		{"Participant", sw.ParticipantName},
+	}
+	if sw.GuardianName != "" {
+		details = append(details, detail{"Signed By", sw.GuardianName + " (parent or guardian)"})
+	}
+	details = append(details,
+		detail{"Signed At", sw.SignedAt.Format("2006-01-02 15:04:05 MST")},
+		detail{"IP Address", sw.IPAddress},
+		detail{"User Agent", sw.UserAgent},
+		detail{"Waiver Version", sw.templateLabel()},
+		detail{"Content SHA-256", hash},
+		detail{"Log Entry", fmt.Sprintf("#%d, SHA-256 %s", sw.Id, sw.Hash)},
+	)
+
+	// Lay out the waiver text first so the footer can say how many pages there are
+	y := 96.0
+	for _, d := range details {
+		y += lineHeight * float64(len(pdfWrap(d.value, valueWidth, textSize, false)))
+	}
+	bodyTop := y + 34
+	body := pdfWrap(sw.WaiverText, pdfLetterWidth-2*margin, textSize, false)
+	pageCount := 1
+	for y, i := bodyTop, 0; i < len(body); i++ {
+		if y > bodyBottom {
+			pageCount++
+			y = margin + 12
+		}
+		y += lineHeight
+	}
+
+	doc := newPDFDocument("Signed Waiver: "+sw.ParticipantName, pdfLetterWidth, pdfLetterHeight)
+	page := 1
+	footer := func() {
+		doc.Text(margin, footerY, 8, false, fmt.Sprintf("%s - %s     SHA-256 %s     Page %d of %d",
+			pdfFit(sw.ParticipantName, 120, 8, false), sw.JoinCode, hash, page, pageCount))
+	}
+
+	doc.AddPage()
+	doc.Text(margin, 66, 18, true, pdfFit("Signed Waiver: "+sw.HikeName, pdfLetterWidth-2*margin, 18, true))
+	y = 96
+	for _, d := range details {
+		doc.Text(margin, y, textSize, true, d.label)
+		for _, line := range pdfWrap(d.value, valueWidth, textSize, false) {
+			doc.Text(margin+labelWidth, y, textSize, false, line)
+			y += lineHeight
+		}
+	}
+	doc.Line(margin, y+4, pdfLetterWidth-margin, y+4, 0.5)
+
+	y = bodyTop
+	for _, line := range body {
+		if y > bodyBottom {
+			footer()
+			doc.AddPage()
+			page++
+			y = margin + 12
+		}
+		doc.Text(margin, y, textSize, false, line)
+		y += lineHeight
+	}
+	footer()
+	return doc.Bytes()
+}
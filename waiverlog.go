@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// waiver_signatures is an append-only log. Every RSVP adds a record, even when the participant
+// signed for the hike before, and records are never updated or deleted (triggers refuse to).
+// Each record carries the hash of the record before it, so editing, removing or inserting a
+// record breaks the chain; verify-waivers walks the chain and reports where.
+
+// waiverChainGenesis is the prev_hash of the first record in the log
+var waiverChainGenesis = strings.Repeat("0", 64)
+
+// waiverRecord is one entry in the waiver log, as stored
+type waiverRecord struct {
+	Id                     int64
+	UserUUID               string
+	JoinCode               string
+	SignedAt               time.Time
+	UserAgent              string
+	IPAddress              string
+	WaiverText             string
+	TemplateId             int64     // 0 if the template wasn't recorded
+	GuardianUUID           string    // Set when a guardian signed for a dependent
+	GuardianAcknowledgedAt time.Time // Zero unless a guardian signed
+	PrevHash               string
+	Hash                   string
+}
+
+// ContentHash is the SHA-256 of what the participant agreed to and the record of them
+// agreeing to it. It is printed on the waiver PDF so a copy can be checked against the log.
+func (rec waiverRecord) ContentHash() string {
+	acknowledgedAt := ""
+	if !rec.GuardianAcknowledgedAt.IsZero() {
+		acknowledgedAt = rec.GuardianAcknowledgedAt.UTC().Format(time.RFC3339)
+	}
+	// The waiver text is last since it is the only field that may contain line breaks
+	content := strings.Join([]string{
+		rec.JoinCode, rec.UserUUID, rec.SignedAt.UTC().Format(time.RFC3339), rec.IPAddress, rec.UserAgent,
+		strconv.FormatInt(rec.TemplateId, 10), rec.GuardianUUID, acknowledgedAt, rec.WaiverText,
+	}, "\n")
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// chainHash is the hash stored with the record: its content hash chained to the record before it
+func (rec waiverRecord) chainHash() string {
+	sum := sha256.Sum256([]byte(rec.PrevHash + "\n" + rec.ContentHash()))
+	return hex.EncodeToString(sum[:])
+}
+
+// waiverLogMu makes sure two signatures can't both be chained to the same previous record
+var waiverLogMu sync.Mutex
+
+// appendWaiverSignature adds a record to the end of the waiver log
+func appendWaiverSignature(rec waiverRecord) error {
+	waiverLogMu.Lock()
+	defer waiverLogMu.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Rollback if not committed
+
+	rec.PrevHash = waiverChainGenesis
+	err = tx.QueryRow("SELECT hash FROM waiver_signatures ORDER BY id DESC LIMIT 1").Scan(&rec.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	rec.Hash = rec.chainHash()
+	if err := insertWaiverRecord(tx, rec); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertWaiverRecord(exec sqlExecutor, rec waiverRecord) error {
+	var templateId sql.NullInt64
+	var guardianUUID, acknowledgedAt sql.NullString
+	if rec.TemplateId != 0 {
+		templateId = sql.NullInt64{Int64: rec.TemplateId, Valid: true}
+	}
+	if rec.GuardianUUID != "" {
+		guardianUUID = sql.NullString{String: rec.GuardianUUID, Valid: true}
+	}
+	if !rec.GuardianAcknowledgedAt.IsZero() {
+		acknowledgedAt = sql.NullString{String: rec.GuardianAcknowledgedAt.Format("2006-01-02T15:04:05-07:00"), Valid: true}
+	}
+	_, err := exec.Exec(`
+		INSERT INTO waiver_signatures
+		       (user_uuid, hike_join_code, signed_at, user_agent, ip_address, waiver_text,
+		        template_id, guardian_uuid, guardian_acknowledged_at, prev_hash, hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, rec.UserUUID, rec.JoinCode, rec.SignedAt.Format("2006-01-02T15:04:05-07:00"), rec.UserAgent, rec.IPAddress, rec.WaiverText,
+		templateId, guardianUUID, acknowledgedAt, rec.PrevHash, rec.Hash)
+	return err
+}
+
+// scanWaiverRecord reads the columns selected by waiverRecordColumns
+func scanWaiverRecord(scan func(dest ...interface{}) error, rec *waiverRecord) error {
+	var templateId sql.NullInt64
+	var guardianUUID sql.NullString
+	var acknowledgedAt sql.NullTime
+	err := scan(&rec.Id, &rec.UserUUID, &rec.JoinCode, &rec.SignedAt, &rec.UserAgent, &rec.IPAddress, &rec.WaiverText,
+		&templateId, &guardianUUID, &acknowledgedAt, &rec.PrevHash, &rec.Hash)
+	rec.TemplateId = templateId.Int64
+	rec.GuardianUUID = guardianUUID.String
+	rec.GuardianAcknowledgedAt = acknowledgedAt.Time
+	return err
+}
+
+const waiverRecordColumns = `ws.id, ws.user_uuid, ws.hike_join_code, ws.signed_at, ws.user_agent, ws.ip_address, ws.waiver_text,
+	ws.template_id, ws.guardian_uuid, ws.guardian_acknowledged_at, ws.prev_hash, ws.hash`
+
+// verifyWaiverChain walks the waiver log in order and describes each place the chain is
+// broken. It returns the number of records checked.
+func verifyWaiverChain() (int, []string, error) {
+	rows, err := db.Query("SELECT " + waiverRecordColumns + " FROM waiver_signatures ws ORDER BY ws.id")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	var problems []string
+	count := 0
+	prevHash := waiverChainGenesis
+	var lastId int64
+	for rows.Next() {
+		var rec waiverRecord
+		if err := scanWaiverRecord(rows.Scan, &rec); err != nil {
+			return count, problems, err
+		}
+		count++
+		if rec.PrevHash != prevHash {
+			problems = append(problems, fmt.Sprintf("Record %d: prev_hash doesn't match the record before it; records may have been removed or inserted", rec.Id))
+		}
+		if rec.chainHash() != rec.Hash {
+			problems = append(problems, fmt.Sprintf("Record %d: contents don't match its hash; it may have been edited", rec.Id))
+		}
+		// Keep walking from the stored hash so one bad record is reported once
+		prevHash, lastId = rec.Hash, rec.Id
+	}
+	if err := rows.Err(); err != nil {
+		return count, problems, err
+	}
+
+	// Removing records from the end of the log leaves the chain intact, but AUTOINCREMENT
+	// remembers the highest id handed out
+	var highestId int64
+	err = db.QueryRow("SELECT seq FROM sqlite_sequence WHERE name = 'waiver_signatures'").Scan(&highestId)
+	if err != nil && err != sql.ErrNoRows {
+		return count, problems, err
+	}
+	if highestId == lastId+1 {
+		problems = append(problems, fmt.Sprintf("Record %d has been removed from the end of the log", highestId))
+	} else if highestId > lastId {
+		problems = append(problems, fmt.Sprintf("Records %d to %d have been removed from the end of the log", lastId+1, highestId))
+	}
+	return count, problems, nil
+}
+
+// runVerifyWaivers is the verify-waivers command. It prints what it found and returns the
+// exit status: 0 if the chain is intact, 1 if it is broken and 2 if it couldn't be read.
+func runVerifyWaivers(out io.Writer) int {
+	count, problems, err := verifyWaiverChain()
+	if err != nil {
+		fmt.Fprintf(out, "Error reading the waiver log: %v\n", err)
+		return 2
+	}
+	for _, problem := range problems {
+		fmt.Fprintln(out, problem)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(out, "Waiver log is BROKEN: %d problem(s) found in %d records\n", len(problems), count)
+		return 1
+	}
+	fmt.Fprintf(out, "Waiver log OK: %d records verified\n", count)
+	return 0
+}